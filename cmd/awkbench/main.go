@@ -0,0 +1,175 @@
+/*
+ * Copyright (C) 2021 Andrea Fiori <andrea.fiori.1998@gmail.com>
+ *
+ * Licensed under GPLv2, see file LICENSE in this source tree.
+ */
+
+// awkbench measures the interpreter on workloads over generated inputs of a
+// few megabytes, so that optimizations can be compared.
+//
+//	go run ./cmd/awkbench [-size mb] [-save file] [-baseline file] [-tolerance pct] [name...]
+//
+// With -save, the results are written to a file which can later be given to
+// -baseline: the workloads slower than the baseline by more than the
+// tolerance are reported and make the command fail.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/fioriandrea/aawk/interpreter"
+)
+
+type workload struct {
+	name    string
+	program string
+	input   string // Name of the input generator
+}
+
+var words = []string{"alpha", "beta", "gamma", "delta", "epsilon", "zeta", "eta", "theta", "iota", "kappa", "lambda", "mu"}
+
+// Lines of space separated words and numbers
+func tableInput(size int) []byte {
+	rng := rand.New(rand.NewSource(1))
+	var b bytes.Buffer
+	for b.Len() < size {
+		fmt.Fprintf(&b, "%s %d %s %.3f %s %d\n",
+			words[rng.Intn(len(words))], rng.Intn(1000),
+			words[rng.Intn(len(words))], rng.Float64()*100,
+			words[rng.Intn(len(words))], rng.Intn(100000))
+	}
+	return b.Bytes()
+}
+
+// Lines of colon separated fields, like /etc/passwd
+func passwdInput(size int) []byte {
+	rng := rand.New(rand.NewSource(2))
+	var b bytes.Buffer
+	for i := 0; b.Len() < size; i++ {
+		fmt.Fprintf(&b, "user%d:x:%d:%d:%s user:/home/user%d:/bin/%s\n",
+			i, 1000+i, rng.Intn(100), words[rng.Intn(len(words))], i, words[rng.Intn(len(words))])
+	}
+	return b.Bytes()
+}
+
+var generators = map[string]func(size int) []byte{
+	"table":  tableInput,
+	"passwd": passwdInput,
+}
+
+var workloads = []workload{
+	{"fields", `{ n += NF; s += $2 + $6 } END { print n, s }`, "table"},
+	{"fieldassign", `{ $3 = "x"; out = out substr($0, 1, 1) } END { print length(out) }`, "table"},
+	{"fs", `BEGIN { FS = ":" } { shells[$7]++ } END { for (s in shells) n++; print n }`, "passwd"},
+	{"fsregex", `BEGIN { FS = "[:/]+" } { n += NF } END { print n }`, "passwd"},
+	{"grep", `/lambda [0-9]+ kappa/ { n++ } /theta/ { m++ } END { print n, m }`, "table"},
+	{"regex", `/^(alpha|gamma) [0-9]+ .*a$/ { n++ } $3 ~ /et/ { m++ } END { print n, m }`, "table"},
+	{"gsub", `{ n += gsub(/a/, "A") } END { print n }`, "table"},
+	{"arrays", `{ count[$1 SUBSEP $3]++; sum[$1] += $2 } END { for (k in count) n++; print n, length(sum) }`, "table"},
+	{"printf", `{ s = sprintf("%-10s %5d %8.2f %x", $1, $2, $4, $6) } END { print s }`, "table"},
+	{"print", `{ print $1, $2 > "/dev/null" }`, "table"},
+	{"getline", `BEGIN { while ((getline line) > 0) { split(line, parts); n += parts[2] } print n }`, "table"},
+	{"concat", `{ s = $1 $3 $5; n += length(s) } END { print n }`, "table"},
+	{"concatmany", `{ s = $1 "-" $2 "-" $3 "-" $4 "-" $5 "-" NR; k[$1 "/" $3]++; n += length(s) } END { print n, length(k) }`, "table"},
+}
+
+func run(w workload, input []byte) error {
+	var out bytes.Buffer
+	errs := interpreter.ExecuteCL(interpreter.CommandLine{
+		Fs:          " ",
+		Program:     strings.NewReader(w.program),
+		Programname: "awkbench",
+		Stdin:       bytes.NewReader(input),
+		Stdout:      &out,
+		Stderr:      &out,
+	})
+	for _, err := range errs {
+		if _, ok := err.(interpreter.ErrorExit); !ok {
+			return fmt.Errorf("%s: %s", w.name, err)
+		}
+	}
+	return nil
+}
+
+func main() {
+	size := flag.Int("size", 4, "size of the generated inputs in megabytes")
+	save := flag.String("save", "", "file to save the results to")
+	baseline := flag.String("baseline", "", "file of results to compare with")
+	tolerance := flag.Float64("tolerance", 10, "percentage by which a workload may be slower than the baseline")
+	flag.Parse()
+
+	selected := map[string]bool{}
+	for _, name := range flag.Args() {
+		selected[name] = true
+	}
+	var base map[string]int64
+	if *baseline != "" {
+		b, err := ioutil.ReadFile(*baseline)
+		if err == nil {
+			err = json.Unmarshal(b, &base)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "awkbench: %s\n", err)
+			os.Exit(2)
+		}
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	results := map[string]int64{}
+	inputs := map[string][]byte{}
+	var regressions int
+	for _, wl := range workloads {
+		if len(selected) > 0 && !selected[wl.name] {
+			continue
+		}
+		if inputs[wl.input] == nil {
+			inputs[wl.input] = generators[wl.input](*size << 20)
+		}
+		input := inputs[wl.input]
+		var err error
+		res := testing.Benchmark(func(b *testing.B) {
+			b.SetBytes(int64(len(input)))
+			for i := 0; i < b.N && err == nil; i++ {
+				err = run(wl, input)
+			}
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "awkbench: %s\n", err)
+			os.Exit(2)
+		}
+		results[wl.name] = res.NsPerOp()
+		fmt.Fprintf(w, "%-12s %s", wl.name, res)
+		if old, ok := base[wl.name]; ok && old > 0 {
+			delta := float64(res.NsPerOp()-old) / float64(old) * 100
+			fmt.Fprintf(w, "\t%+.1f%%", delta)
+			if delta > *tolerance {
+				regressions++
+				fmt.Fprintf(w, " REGRESSION")
+			}
+		}
+		fmt.Fprintln(w)
+		w.Flush()
+	}
+
+	if *save != "" {
+		b, _ := json.MarshalIndent(results, "", "\t")
+		if err := ioutil.WriteFile(*save, append(b, '\n'), 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "awkbench: %s\n", err)
+			os.Exit(2)
+		}
+	}
+	if regressions > 0 {
+		w.Flush()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,52 @@
+/*
+ * Copyright (C) 2021 Andrea Fiori <andrea.fiori.1998@gmail.com>
+ *
+ * Licensed under GPLv2, see file LICENSE in this source tree.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Runs the corpus as part of go test, comparing aawk with the first
+// reference awk found
+func TestCorpus(t *testing.T) {
+	ref := findReference()
+	if ref == nil {
+		t.Skip("no reference awk found")
+	}
+	programs, err := filepath.Glob(filepath.Join("testdata", "*.awk"))
+	if err != nil || len(programs) == 0 {
+		t.Fatalf("no programs found in testdata")
+	}
+	for _, program := range programs {
+		program := program
+		name := strings.TrimSuffix(filepath.Base(program), ".awk")
+		t.Run(name, func(t *testing.T) {
+			input, err := ioutil.ReadFile(strings.TrimSuffix(program, ".awk") + ".in")
+			if err != nil && !os.IsNotExist(err) {
+				t.Fatal(err)
+			}
+			expected, err := runReference(ref, program, input)
+			if err != nil {
+				t.Fatalf("%s: %s", strings.Join(ref, " "), err)
+			}
+			got, err := runAawk(program, input, posixReference(ref))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected.output != got.output {
+				t.Errorf("output differs at %s", firstDifference(expected.output, got.output))
+			}
+			if expected.status != got.status {
+				t.Errorf("exit status %d, reference %d", got.status, expected.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+/*
+ * Copyright (C) 2021 Andrea Fiori <andrea.fiori.1998@gmail.com>
+ *
+ * Licensed under GPLv2, see file LICENSE in this source tree.
+ */
+
+// awktest runs a corpus of awk programs with aawk and with a reference awk
+// and reports the programs whose output or exit status differ.
+//
+// Every program of the corpus is a file NAME.awk, run with NAME.in (if it
+// exists) as standard input.
+//
+//	go run ./cmd/awktest [-ref awk] [-dir corpus] [-v] [name...]
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/fioriandrea/aawk/interpreter"
+)
+
+// Reference implementations, in order of preference
+var referenceAwks = [][]string{
+	{"gawk", "--posix"},
+	{"onetrueawk"},
+	{"original-awk"},
+	{"nawk"},
+	{"busybox", "awk"},
+	{"mawk"},
+	{"awk"},
+}
+
+type result struct {
+	output string
+	status int
+}
+
+func findReference() []string {
+	for _, cmd := range referenceAwks {
+		if _, err := exec.LookPath(cmd[0]); err == nil {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// aawk runs in POSIX mode if the reference does, so that both implement
+// the same dialect
+func posixReference(ref []string) bool {
+	for _, arg := range ref[1:] {
+		if arg == "--posix" || arg == "-P" {
+			return true
+		}
+	}
+	return false
+}
+
+// Only standard output and the exit status are compared: the diagnostics
+// on standard error differ from one implementation to another
+func runReference(ref []string, program string, input []byte) (result, error) {
+	cmd := exec.Command(ref[0], append(ref[1:], "-f", program)...)
+	cmd.Stdin = bytes.NewReader(input)
+	out, err := cmd.Output()
+	if ee, ok := err.(*exec.ExitError); ok {
+		return result{string(out), ee.ExitCode()}, nil
+	}
+	return result{string(out), 0}, err
+}
+
+func runAawk(program string, input []byte, posix bool) (result, error) {
+	src, err := os.Open(program)
+	if err != nil {
+		return result{}, err
+	}
+	defer src.Close()
+	var out bytes.Buffer
+	errs := interpreter.ExecuteCL(interpreter.CommandLine{
+		Fs:          " ",
+		Program:     src,
+		Programname: "aawk",
+		Posix:       posix,
+		Stdin:       bytes.NewReader(input),
+		Stdout:      &out,
+		Stderr:      ioutil.Discard,
+	})
+	res := result{status: 0}
+	for _, err := range errs {
+		if ee, ok := err.(interpreter.ErrorExit); ok {
+			res.status = ee.Status
+		} else if err != nil {
+			res.status = 2
+		}
+	}
+	res.output = out.String()
+	return res, nil
+}
+
+// Returns the first differing line of the two outputs
+func firstDifference(expected, got string) string {
+	el := strings.Split(expected, "\n")
+	gl := strings.Split(got, "\n")
+	for i := 0; i < len(el) || i < len(gl); i++ {
+		var e, g string
+		if i < len(el) {
+			e = el[i]
+		}
+		if i < len(gl) {
+			g = gl[i]
+		}
+		if e != g || i >= len(el) || i >= len(gl) {
+			return fmt.Sprintf("line %d:\n\treference: %q\n\taawk:      %q", i+1, e, g)
+		}
+	}
+	return ""
+}
+
+func main() {
+	refflag := flag.String("ref", "", "reference awk command (default: the first found among gawk, onetrueawk, nawk, busybox awk, mawk, awk)")
+	dir := flag.String("dir", filepath.Join("cmd", "awktest", "testdata"), "directory of the corpus")
+	verbose := flag.Bool("v", false, "report passing programs too")
+	flag.Parse()
+
+	ref := strings.Fields(*refflag)
+	if len(ref) == 0 {
+		ref = findReference()
+	}
+	if len(ref) == 0 {
+		fmt.Fprintln(os.Stderr, "awktest: no reference awk found")
+		os.Exit(2)
+	}
+
+	programs, err := filepath.Glob(filepath.Join(*dir, "*.awk"))
+	if err != nil || len(programs) == 0 {
+		fmt.Fprintf(os.Stderr, "awktest: no programs found in %s\n", *dir)
+		os.Exit(2)
+	}
+	sort.Strings(programs)
+	selected := map[string]bool{}
+	for _, name := range flag.Args() {
+		selected[name] = true
+	}
+
+	var failed, total int
+	for _, program := range programs {
+		name := strings.TrimSuffix(filepath.Base(program), ".awk")
+		if len(selected) > 0 && !selected[name] {
+			continue
+		}
+		total++
+		input, err := ioutil.ReadFile(strings.TrimSuffix(program, ".awk") + ".in")
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "awktest: %s\n", err)
+			os.Exit(2)
+		}
+		expected, err := runReference(ref, program, input)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "awktest: %s: %s\n", strings.Join(ref, " "), err)
+			os.Exit(2)
+		}
+		got, err := runAawk(program, input, posixReference(ref))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "awktest: %s\n", err)
+			os.Exit(2)
+		}
+
+		switch {
+		case expected.output != got.output:
+			failed++
+			fmt.Printf("FAIL %s: output differs at %s\n", name, firstDifference(expected.output, got.output))
+		case expected.status != got.status:
+			failed++
+			fmt.Printf("FAIL %s: exit status %d, reference %d\n", name, got.status, expected.status)
+		case *verbose:
+			fmt.Printf("ok   %s\n", name)
+		}
+	}
+	fmt.Printf("%d/%d programs agree with %s\n", total-failed, total, strings.Join(ref, " "))
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
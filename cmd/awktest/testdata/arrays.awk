@@ -0,0 +1,12 @@
+BEGIN {
+	a["x"] = 1; a["y"] = 2; a[1, 2] = 3
+	print length(a), ("x" in a), ("z" in a), ((1, 2) in a)
+	delete a["x"]
+	print length(a)
+	for (k in a) n++
+	print n
+	split("c b a", b)
+	print b[1] b[2] b[3]
+	delete b
+	print length(b)
+}
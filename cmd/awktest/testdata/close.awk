@@ -0,0 +1,53 @@
+# Closing a file or a command and then using it again starts over
+BEGIN {
+	"mktemp" | getline tmp
+	close("mktemp")
+
+	# A command runs again after being closed
+	c = "echo $$"
+	c | getline first
+	close(c)
+	c | getline second
+	close(c)
+	print "restarted:", first != second
+
+	# Reading the whole output, then reopening, reads it again
+	c = "printf 'a\\nb\\n'"
+	while ((c | getline line) > 0)
+		print "first", line
+	print "at end:", (c | getline line)
+	close(c)
+	while ((c | getline line) > 0)
+		print "again", line
+	close(c)
+
+	# > truncates when the file is opened, not on every print
+	print "one" > tmp
+	print "two" > tmp
+	close(tmp)
+	while ((getline line < tmp) > 0)
+		print "file", line
+	close(tmp)
+	print "three" > tmp
+	close(tmp)
+	# >> appends
+	print "four" >> tmp
+	close(tmp)
+	while ((getline line < tmp) > 0)
+		print "reopened", line
+	close(tmp)
+
+	# An output command gets its input again after being closed
+	c = "sort -r >> " tmp
+	print "x" | c
+	print "y" | c
+	close(c)
+	print "z" | c
+	close(c)
+	while ((getline line < tmp) > 0)
+		print "sorted", line
+	close(tmp)
+
+	print "status of unopened:", close("never opened")
+	system("rm -f " tmp)
+}
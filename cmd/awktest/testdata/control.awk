@@ -0,0 +1,16 @@
+BEGIN {
+	for (i = 0; i < 10; i++) {
+		if (i == 2) continue
+		if (i == 6) break
+		printf "%d ", i
+	}
+	print ""
+	i = 0
+	do { i++ } while (i < 5)
+	print i
+	while (i > 0) i -= 2
+	print i
+}
+NR % 2 { next }
+{ print "even", $0 }
+END { exit NR }
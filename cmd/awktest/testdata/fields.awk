@@ -0,0 +1,4 @@
+{ print NF, $1, $NF }
+NR == 2 { $3 = "x"; print; print NF }
+NR == 3 { $7 = "y"; print; NF = 2; print }
+END { print NR }
@@ -0,0 +1,4 @@
+BEGIN { FS = ":" }
+{ print $1, $3 }
+NR == 2 { FS = "," }
+END { n = split("a.b.c", p, "."); print n, p[2] }
@@ -0,0 +1,10 @@
+NR == 1 {
+	while ((getline line) > 0)
+		n++
+	print "read", n, "more lines, NR =", NR
+}
+END {
+	"echo from a command" | getline x
+	print x
+	close("echo from a command")
+}
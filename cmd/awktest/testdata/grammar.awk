@@ -0,0 +1,31 @@
+# Every form of program item, in an order which checks that BEGIN and END
+# actions run in the order they appear
+BEGIN { printf "begin1 " }
+function twice(x) { return 2 * x }
+BEGIN { print "begin2" }; END { print "end1", n, twice(NR) }
+
+# Pattern only: prints the record
+/^p/
+
+# Action only
+{ n++ }
+
+# Pattern and action, separated by semicolons
+NR == 2 { print "second" }; NR == 3 { print "third" }
+
+# Range, with and without action
+/^start/, /^stop/ { print "in range:", $0 }
+/^stop/, /^start/
+
+# Newline between the pattern and the action: two items
+$1 == "x"
+{ }
+
+function late(s)
+{
+	return "<" s ">"
+}
+
+END {
+	print "end2", late(n)
+}
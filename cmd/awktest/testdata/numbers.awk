@@ -0,0 +1,8 @@
+BEGIN {
+	print 1 / 3, 2 ^ 10, 7 % 3, -7 % 3, 1e6, 0.1 + 0.2
+	print int(3.9), int(-3.9), 1 == 1.0, "10" < "9", 10 < 9
+	x = "3.0"; print x + 0, (x == 3)
+	CONVFMT = "%.2g"; y = 3.14159; z = y ""; print z
+	OFMT = "%.3f"; print 3.14159, 3.14159 ""
+}
+{ print ($1 < $2), ($1 == $2) }
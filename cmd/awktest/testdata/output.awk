@@ -0,0 +1,3 @@
+BEGIN { OFS = "-"; ORS = "|\n" }
+{ $1 = $1; print; print $1, $2 }
+END { print "done" > "/dev/stderr"; printf "%s\n", "end" }
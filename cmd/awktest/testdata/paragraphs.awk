@@ -0,0 +1,2 @@
+BEGIN { RS = "" }
+{ print NR ": " NF " fields, first " $1 ", last " $NF }
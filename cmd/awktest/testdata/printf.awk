@@ -0,0 +1,7 @@
+BEGIN {
+	printf "%d|%5d|%-5d|%05d\n", 42.7, 42, 42, 42
+	printf "%s|%10s|%-10s|%.2s\n", "abc", "abc", "abc", "abc"
+	printf "%f|%.2f|%e|%g|%g\n", 3.14159, 3.14159, 31415.9, 0.0001, 123456789
+	printf "%x|%X|%o|%c|%%\n", 255, 255, 8, "hello"
+	printf "%*d|%-*d|\n", 6, 1, 6, 2
+}
@@ -0,0 +1,2 @@
+/start/, /end/ { print NR ": " $0 }
+$0 == "x", $0 == "x" { print "single", NR }
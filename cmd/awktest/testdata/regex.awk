@@ -0,0 +1,4 @@
+/^[0-9]+$/ { print "number", $0; next }
+/^[[:alpha:]]+$/ { print "word", $0; next }
+$0 ~ "a|b" { print "has a or b", $0; next }
+!/x/ { print "other", $0 }
@@ -0,0 +1,10 @@
+BEGIN {
+	s = "Hello, World"
+	print length(s), index(s, "World"), substr(s, 1, 5), substr(s, 8)
+	print toupper(s), tolower(s)
+	print match(s, /o, W/), RSTART, RLENGTH
+	t = s; n = gsub(/o/, "0", t); print n, t
+	t = s; sub(/World/, "[&]", t); print t
+	t = s; gsub(/l/, "\\&", t); print t
+	print sprintf("%s-%d", "a", 5)
+}
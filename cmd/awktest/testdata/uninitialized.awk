@@ -0,0 +1,7 @@
+BEGIN {
+	print length(x), x + 0, x == 0, x == ""
+	if (!(1 in arr)) print "not in"
+	print length(arr)
+	y++; print y
+	print substr("hello", -1), substr("hello", 4, 100)
+}
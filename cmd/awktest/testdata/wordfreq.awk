@@ -0,0 +1,19 @@
+# Counts word frequencies, printed in a deterministic order
+{
+	for (i = 1; i <= NF; i++)
+		count[tolower($i)]++
+}
+END {
+	n = 0
+	for (w in count)
+		words[++n] = w
+	# Insertion sort
+	for (i = 2; i <= n; i++) {
+		v = words[i]
+		for (j = i - 1; j > 0 && words[j] > v; j--)
+			words[j + 1] = words[j]
+		words[j + 1] = v
+	}
+	for (i = 1; i <= n; i++)
+		print words[i], count[words[i]]
+}
@@ -0,0 +1,90 @@
+/*
+ * Copyright (C) 2021 Andrea Fiori <andrea.fiori.1998@gmail.com>
+ *
+ * Licensed under GPLv2, see file LICENSE in this source tree.
+ */
+
+package interpreter
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+var benchWords = []string{"alpha", "beta", "gamma", "delta", "epsilon", "zeta", "eta", "theta", "iota", "kappa", "lambda", "mu"}
+
+var benchTable []byte
+
+// About a megabyte of lines of space separated words and numbers, generated
+// once for all benchmarks
+func benchInput() []byte {
+	if benchTable == nil {
+		rng := rand.New(rand.NewSource(1))
+		var b bytes.Buffer
+		for b.Len() < 1<<20 {
+			fmt.Fprintf(&b, "%s %d %s %.3f %s:%d\n",
+				benchWords[rng.Intn(len(benchWords))], rng.Intn(1000),
+				benchWords[rng.Intn(len(benchWords))], rng.Float64()*100,
+				benchWords[rng.Intn(len(benchWords))], rng.Intn(100000))
+		}
+		benchTable = b.Bytes()
+	}
+	return benchTable
+}
+
+func benchProgram(b *testing.B, program string) {
+	p, errs := NewProgram(CommandLine{
+		Fs:          " ",
+		Program:     strings.NewReader(program),
+		Programname: "bench",
+	})
+	if len(errs) > 0 {
+		b.Fatal(errs[0])
+	}
+	input := benchInput()
+	b.SetBytes(int64(len(input)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, err := range p.Run(bytes.NewReader(input), ioutil.Discard, ioutil.Discard) {
+			if _, ok := err.(ErrorExit); !ok {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkFields(b *testing.B) {
+	benchProgram(b, `{ n += NF; s += $2 + $4 } END { print n, s }`)
+}
+
+func BenchmarkFieldAssign(b *testing.B) {
+	benchProgram(b, `{ $3 = "x"; n += length($0) } END { print n }`)
+}
+
+func BenchmarkFieldSeparator(b *testing.B) {
+	benchProgram(b, `BEGIN { FS = "[ :]" } { n += NF } END { print n }`)
+}
+
+func BenchmarkRegex(b *testing.B) {
+	benchProgram(b, `/^(alpha|gamma) [0-9]+ .*a:/ { n++ } $3 ~ /et/ { m++ } END { print n, m }`)
+}
+
+func BenchmarkGsub(b *testing.B) {
+	benchProgram(b, `{ n += gsub(/a/, "A") } END { print n }`)
+}
+
+func BenchmarkArrays(b *testing.B) {
+	benchProgram(b, `{ count[$1, $3]++; sum[$1] += $2 } END { for (k in count) n++; print n, length(sum) }`)
+}
+
+func BenchmarkPrintf(b *testing.B) {
+	benchProgram(b, `{ s = sprintf("%-10s %5d %8.2f %s", $1, $2, $4, $5); printf "%s\n", s }`)
+}
+
+func BenchmarkGetline(b *testing.B) {
+	benchProgram(b, `BEGIN { while ((getline line) > 0) { split(line, parts); n += parts[2] } print n }`)
+}
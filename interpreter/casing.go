@@ -0,0 +1,67 @@
+/*
+ * Copyright (C) 2021 Andrea Fiori <andrea.fiori.1998@gmail.com>
+ *
+ * Licensed under GPLv2, see file LICENSE in this source tree.
+ */
+
+package interpreter
+
+import (
+	"strings"
+
+	"golang.org/x/text/cases"
+)
+
+// Case conversion of toupper and tolower. Without a locale, every character
+// is mapped on its own, as towupper does. With one, the full Unicode rules
+// of its language apply: "ß" becomes "SS", the Greek final sigma is
+// lowered as such and, in Turkish and Azerbaijani, "i" becomes "İ" and "I"
+// becomes "ı". In byte mode only the ASCII letters are changed, which is
+// also what POSIX requires when there is no locale.
+type casing struct {
+	bytes bool
+	upper *cases.Caser
+	lower *cases.Caser
+}
+
+func newCasing(locale string, bytes, posix bool) (casing, error) {
+	tag, ok, err := parseLocale(locale)
+	if bytes || (posix && !ok) {
+		return casing{bytes: true}, err
+	} else if !ok {
+		return casing{}, err
+	}
+	upper, lower := cases.Upper(tag), cases.Lower(tag)
+	return casing{upper: &upper, lower: &lower}, nil
+}
+
+func (c casing) toUpper(s string) string {
+	switch {
+	case c.bytes:
+		return mapASCII(s, 'a', 'z', 'A'-'a')
+	case c.upper != nil:
+		return c.upper.String(s)
+	}
+	return strings.ToUpper(s)
+}
+
+func (c casing) toLower(s string) string {
+	switch {
+	case c.bytes:
+		return mapASCII(s, 'A', 'Z', 'a'-'A')
+	case c.lower != nil:
+		return c.lower.String(s)
+	}
+	return strings.ToLower(s)
+}
+
+// Adds delta to the bytes between from and to, leaving the others alone
+func mapASCII(s string, from, to byte, delta int) string {
+	b := []byte(s)
+	for i, c := range b {
+		if c >= from && c <= to {
+			b[i] = byte(int(c) + delta)
+		}
+	}
+	return string(b)
+}
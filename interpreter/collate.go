@@ -0,0 +1,54 @@
+/*
+ * Copyright (C) 2021 Andrea Fiori <andrea.fiori.1998@gmail.com>
+ *
+ * Licensed under GPLv2, see file LICENSE in this source tree.
+ */
+
+package interpreter
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/text/collate"
+	"golang.org/x/text/language"
+)
+
+// Returns the language of a locale, which is either a language tag (de,
+// sv-SE) or a POSIX locale name (de_DE.UTF-8). The C and POSIX locales, as
+// well as the empty one, have no language.
+func parseLocale(locale string) (tag language.Tag, ok bool, err error) {
+	if i := strings.IndexAny(locale, ".@"); i >= 0 {
+		locale = locale[:i]
+	}
+	switch locale {
+	case "", "C", "POSIX":
+		return language.Und, false, nil
+	}
+	tag, err = language.Parse(strings.ReplaceAll(locale, "_", "-"))
+	if err != nil {
+		return language.Und, false, fmt.Errorf("unknown locale %s", locale)
+	}
+	return tag, true, nil
+}
+
+// Returns the collator of a locale, nil for byte order
+func newCollator(locale string) (*collate.Collator, error) {
+	tag, ok, err := parseLocale(locale)
+	if !ok {
+		return nil, err
+	}
+	return collate.New(tag), nil
+}
+
+// Compares strings in the order of the collation locale, if there is one.
+// Strings which collate equally are ordered by their bytes, so that only
+// identical strings are equal.
+func (inter *interpreter) compareStrings(s1, s2 string) int {
+	if inter.collator != nil {
+		if c := inter.collator.CompareString(s1, s2); c != 0 {
+			return c
+		}
+	}
+	return strings.Compare(s1, s2)
+}
@@ -0,0 +1,115 @@
+/*
+ * Copyright (C) 2021 Andrea Fiori <andrea.fiori.1998@gmail.com>
+ *
+ * Licensed under GPLv2, see file LICENSE in this source tree.
+ */
+
+package interpreter
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Returns the process running a command of system, a pipe or getline.
+// Env is set by the interpreter afterwards.
+type CommandRunner func(command string) (*exec.Cmd, error)
+
+// Returns the shell running the commands of system, pipes and getline: the
+// one of the command line, AWKSHELL in the environment of the program, or
+// sh (cmd.exe on Windows)
+func shellOf(params RunParams) string {
+	if params.Shell != "" {
+		return params.Shell
+	}
+	environ := params.Environ
+	if environ == nil {
+		environ = os.Environ()
+	}
+	for _, pair := range environ {
+		if strings.HasPrefix(pair, "AWKSHELL=") && len(pair) > len("AWKSHELL=") {
+			return pair[len("AWKSHELL="):]
+		}
+	}
+	return defaultShell
+}
+
+// Returns the command running name in the environment of the program,
+// either with the runner of the embedder, through the shell or, without
+// one, directly as a program followed by its arguments
+func (inter *interpreter) command(name string) (*exec.Cmd, error) {
+	var cmd *exec.Cmd
+	if inter.runner != nil {
+		var err error
+		if cmd, err = inter.runner(name); err != nil {
+			return nil, err
+		}
+	} else if inter.directexec {
+		words, err := splitCommand(name)
+		if err != nil {
+			return nil, err
+		}
+		cmd = exec.Command(words[0], words[1:]...)
+	} else {
+		cmd = shellCommand(inter.shell, name)
+	}
+	cmd.Env = inter.environ
+	return cmd, nil
+}
+
+// Splits a command into words separated by blanks. Quotes and backslashes
+// work as in the shell, but nothing is expanded: a single quoted string is
+// taken literally, while in a double quoted one a backslash only escapes ",
+// \ and newline.
+func splitCommand(s string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inword := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			if inword {
+				words = append(words, word.String())
+				word.Reset()
+				inword = false
+			}
+			continue
+		case c == '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end < 0 {
+				return nil, errors.New("unterminated single quote")
+			}
+			word.WriteString(s[i+1 : i+1+end])
+			i += end + 1
+		case c == '"':
+			i++
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) && strings.IndexByte("\"\\\n", s[i+1]) >= 0 {
+					i++
+				}
+				word.WriteByte(s[i])
+			}
+			if i >= len(s) {
+				return nil, errors.New("unterminated double quote")
+			}
+		case c == '\\':
+			if i+1 < len(s) {
+				i++
+				word.WriteByte(s[i])
+			}
+		default:
+			word.WriteByte(c)
+		}
+		inword = true
+	}
+	if inword {
+		words = append(words, word.String())
+	}
+	if len(words) == 0 {
+		return nil, errors.New("empty command")
+	}
+	return words, nil
+}
@@ -0,0 +1,22 @@
+//go:build !windows
+
+/*
+ * Copyright (C) 2021 Andrea Fiori <andrea.fiori.1998@gmail.com>
+ *
+ * Licensed under GPLv2, see file LICENSE in this source tree.
+ */
+
+package interpreter
+
+import "os/exec"
+
+const defaultShell = "sh"
+
+func shellCommand(shell, name string) *exec.Cmd {
+	return exec.Command(shell, "-c", name)
+}
+
+// Names of files are used as they are
+func hostPath(name string) string {
+	return name
+}
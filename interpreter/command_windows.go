@@ -0,0 +1,44 @@
+//go:build windows
+
+/*
+ * Copyright (C) 2021 Andrea Fiori <andrea.fiori.1998@gmail.com>
+ *
+ * Licensed under GPLv2, see file LICENSE in this source tree.
+ */
+
+package interpreter
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const defaultShell = "cmd.exe"
+
+// cmd.exe does not parse its arguments as other programs do, so the command
+// line is built by hand: with /S, everything between the first and the last
+// quote is run unchanged. Other shells, such as the sh of MSYS or Cygwin,
+// take -c.
+func shellCommand(shell, name string) *exec.Cmd {
+	base := strings.ToLower(filepath.Base(shell))
+	if base != "cmd" && base != "cmd.exe" {
+		return exec.Command(shell, "-c", name)
+	}
+	cmd := exec.Command(shell)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		CmdLine: syscall.EscapeArg(shell) + ` /S /C "` + name + `"`,
+	}
+	return cmd
+}
+
+// /dev/null is the only special file which is opened, the others refer to
+// the streams of the interpreter (see specialFd)
+func hostPath(name string) string {
+	if name == "/dev/null" {
+		return os.DevNull
+	}
+	return name
+}
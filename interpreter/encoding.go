@@ -0,0 +1,152 @@
+/*
+ * Copyright (C) 2021 Andrea Fiori <andrea.fiori.1998@gmail.com>
+ *
+ * Licensed under GPLv2, see file LICENSE in this source tree.
+ */
+
+package interpreter
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// Strings are UTF-8 inside the interpreter. Files in a single byte encoding
+// are decoded when read and the output is encoded back, so that length,
+// substr, toupper and the like work on characters.
+
+type charset struct {
+	decode [256]rune
+	encode map[rune]byte
+}
+
+// Characters which differ from ISO-8859-1, by byte
+var cp1252 = map[byte]rune{
+	0x80: 0x20ac, 0x82: 0x201a, 0x83: 0x0192, 0x84: 0x201e, 0x85: 0x2026,
+	0x86: 0x2020, 0x87: 0x2021, 0x88: 0x02c6, 0x89: 0x2030, 0x8a: 0x0160,
+	0x8b: 0x2039, 0x8c: 0x0152, 0x8e: 0x017d, 0x91: 0x2018, 0x92: 0x2019,
+	0x93: 0x201c, 0x94: 0x201d, 0x95: 0x2022, 0x96: 0x2013, 0x97: 0x2014,
+	0x98: 0x02dc, 0x99: 0x2122, 0x9a: 0x0161, 0x9b: 0x203a, 0x9c: 0x0153,
+	0x9e: 0x017e, 0x9f: 0x0178,
+}
+
+var iso885915 = map[byte]rune{
+	0xa4: 0x20ac, 0xa6: 0x0160, 0xa8: 0x0161, 0xb4: 0x017d, 0xb8: 0x017e,
+	0xbc: 0x0152, 0xbd: 0x0153, 0xbe: 0x0178,
+}
+
+// Returns the charset of an encoding, nil for UTF-8
+func lookupCharset(name string) (*charset, error) {
+	var diffs map[byte]rune
+	switch strings.ToLower(name) {
+	case "", "utf-8", "utf8":
+		return nil, nil
+	case "latin1", "latin-1", "iso-8859-1", "iso8859-1":
+	case "latin9", "latin-9", "iso-8859-15", "iso8859-15":
+		diffs = iso885915
+	case "cp1252", "windows-1252":
+		diffs = cp1252
+	default:
+		return nil, fmt.Errorf("unknown encoding %s", name)
+	}
+	cs := &charset{encode: map[rune]byte{}}
+	for i := range cs.decode {
+		r := rune(i)
+		if d, ok := diffs[byte(i)]; ok {
+			r = d
+		}
+		cs.decode[i] = r
+		cs.encode[r] = byte(i)
+	}
+	return cs, nil
+}
+
+func (cs *charset) reader(r io.Reader) io.Reader {
+	if cs == nil {
+		return r
+	}
+	return &decodingReader{r: r, cs: cs}
+}
+
+func (cs *charset) writer(w io.Writer) io.Writer {
+	if cs == nil {
+		return w
+	}
+	return &encodingWriter{w: w, cs: cs}
+}
+
+type decodingReader struct {
+	r       io.Reader
+	cs      *charset
+	raw     [4096]byte
+	pending []byte // Decoded, not yet read
+	err     error  // Returned once pending is empty
+}
+
+func (dr *decodingReader) Read(p []byte) (int, error) {
+	if len(dr.pending) == 0 {
+		if dr.err != nil {
+			return 0, dr.err
+		}
+		n, err := dr.r.Read(dr.raw[:])
+		dr.err = err
+		if n == 0 {
+			return 0, err
+		}
+		dr.pending = dr.pending[:0]
+		var enc [utf8.UTFMax]byte
+		for _, b := range dr.raw[:n] {
+			if b < utf8.RuneSelf {
+				dr.pending = append(dr.pending, b)
+				continue
+			}
+			size := utf8.EncodeRune(enc[:], dr.cs.decode[b])
+			dr.pending = append(dr.pending, enc[:size]...)
+		}
+	}
+	n := copy(p, dr.pending)
+	dr.pending = dr.pending[n:]
+	return n, nil
+}
+
+// Characters which the encoding lacks, and bytes which are not UTF-8, are
+// written as '?'
+type encodingWriter struct {
+	w       io.Writer
+	cs      *charset
+	partial []byte // Beginning of a character split between writes
+	buf     []byte
+}
+
+func (ew *encodingWriter) Write(p []byte) (int, error) {
+	s := p
+	if len(ew.partial) > 0 {
+		s = append(ew.partial, p...)
+		ew.partial = nil
+	}
+	ew.buf = ew.buf[:0]
+	for len(s) > 0 {
+		if s[0] < utf8.RuneSelf {
+			ew.buf = append(ew.buf, s[0])
+			s = s[1:]
+			continue
+		}
+		if !utf8.FullRune(s) {
+			ew.partial = append([]byte(nil), s...)
+			break
+		}
+		r, size := utf8.DecodeRune(s)
+		b, ok := ew.cs.encode[r]
+		if !ok {
+			b = '?'
+		}
+		ew.buf = append(ew.buf, b)
+		s = s[size:]
+	}
+	if _, err := ew.w.Write(ew.buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,136 @@
+/*
+ * Copyright (C) 2021 Andrea Fiori <andrea.fiori.1998@gmail.com>
+ *
+ * Licensed under GPLv2, see file LICENSE in this source tree.
+ */
+
+package interpreter
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/fioriandrea/aawk/parser"
+)
+
+// The fields of the current record. fields[0] is $0 and NF is always
+// len(fields) - 1. Setting $0 splits it again with the current FS; setting
+// any other field or NF rebuilds $0 from the fields, joined by the current
+// OFS. Changing FS or OFS alone touches neither.
+type fieldbuf struct {
+	fields   []Awkvalue
+	splitbuf []string // Reused from one record to the next
+
+	// Kept up to date by the interpreter when the variables they come from
+	// are assigned
+	sep       separator
+	paragraph bool // RS is "", so newline always separates fields
+	ofs       string
+	convfmt   string
+	hex       bool // Hexadecimal integers are numeric strings
+}
+
+func (fb *fieldbuf) nf() int {
+	if len(fb.fields) == 0 {
+		return 0
+	}
+	return len(fb.fields) - 1
+}
+
+func (fb *fieldbuf) get(i int) Awkvalue {
+	if i < 0 || i >= len(fb.fields) {
+		return Awknormalstring("")
+	}
+	return fb.fields[i]
+}
+
+func (fb *fieldbuf) set(i int, v Awkvalue) {
+	if i == 0 {
+		fb.setRecord(v)
+		return
+	}
+	// https://stackoverflow.com/questions/51632945/in-awk-why-does-a-nonexistent-field-like-nf1-not-equal-zero/51638902
+	if i >= len(fb.fields) {
+		fb.resize(i)
+	}
+	// Numbers are kept as they are, so that printing the field uses OFMT,
+	// while $0 is rebuilt using CONVFMT
+	if v.Typ == Number || v.Typ == Normalstring {
+		fb.fields[i] = v
+	} else {
+		fb.fields[i] = awknumericstring(v.String(fb.convfmt), fb.hex)
+	}
+	fb.rebuild()
+}
+
+func (fb *fieldbuf) setRecord(v Awkvalue) {
+	fb.splitbuf = fb.split(fb.splitbuf[:0], v.String(fb.convfmt))
+	fb.fields = append(fb.fields[:0], v)
+	// Fields are always numeric string candidates
+	for _, sp := range fb.splitbuf {
+		fb.fields = append(fb.fields, awknumericstring(sp, fb.hex))
+	}
+}
+
+// Truncates the fields or adds empty ones, keeping the values of the others.
+// nf cannot be negative.
+func (fb *fieldbuf) setNF(nf int) {
+	fb.resize(nf)
+	fb.rebuild()
+}
+
+// Splits s as a record, appending the fields to dst
+func (fb *fieldbuf) split(dst []string, s string) []string {
+	if fb.paragraph && fb.sep.kind != parser.FsBlanks {
+		for _, line := range strings.Split(s, "\n") {
+			dst = appendSplitFs(dst, line, fb.sep)
+		}
+		return dst
+	}
+	return appendSplitFs(dst, s, fb.sep)
+}
+
+func (fb *fieldbuf) resize(nf int) {
+	if len(fb.fields) == 0 {
+		fb.fields = append(fb.fields, Awknormalstring(""))
+	}
+	if nf+1 <= len(fb.fields) {
+		fb.fields = fb.fields[:nf+1]
+	}
+	for len(fb.fields) < nf+1 {
+		fb.fields = append(fb.fields, Awknormalstring(""))
+	}
+}
+
+func (fb *fieldbuf) rebuild() {
+	var b strings.Builder
+	for j, field := range fb.fields[1:] {
+		if j > 0 {
+			b.WriteString(fb.ofs)
+		}
+		b.WriteString(field.String(fb.convfmt))
+	}
+	fb.fields[0] = Awknormalstring(b.String())
+}
+
+// The interpreter keeps NF in sync with the fields
+
+func (inter *interpreter) getField(i int) Awkvalue {
+	return inter.fields.get(i)
+}
+
+func (inter *interpreter) setField(i int, v Awkvalue) {
+	inter.fields.set(i, v)
+	inter.builtins[parser.Nf] = Awknumber(float64(inter.fields.nf()))
+}
+
+var errNegativeNF = errors.New("cannot set NF to a negative value")
+
+func (inter *interpreter) setNF(nf int) error {
+	if nf < 0 {
+		return errNegativeNF
+	}
+	inter.fields.setNF(nf)
+	inter.builtins[parser.Nf] = Awknumber(float64(inter.fields.nf()))
+	return nil
+}
@@ -0,0 +1,147 @@
+/*
+ * Copyright (C) 2021 Andrea Fiori <andrea.fiori.1998@gmail.com>
+ *
+ * Licensed under GPLv2, see file LICENSE in this source tree.
+ */
+
+package interpreter
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/fioriandrea/aawk/parser"
+)
+
+func testFieldbuf(t *testing.T, fs string, record string) *fieldbuf {
+	re, err := parser.CompileFs(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fb := &fieldbuf{
+		sep:     newSeparator(fs, re),
+		ofs:     " ",
+		convfmt: "%.6g",
+	}
+	fb.setRecord(Awknormalstring(record))
+	return fb
+}
+
+// Returns $1 to $NF as strings
+func fieldStrings(fb *fieldbuf) []string {
+	res := []string{}
+	for i := 1; i <= fb.nf(); i++ {
+		res = append(res, fb.get(i).String(fb.convfmt))
+	}
+	return res
+}
+
+func TestSetRecord(t *testing.T) {
+	tests := []struct {
+		fs, record string
+		fields     []string
+	}{
+		{" ", "  a   b\tc \n", []string{"a", "b", "c"}},
+		{" ", "", []string{}},
+		{":", "a::b", []string{"a", "", "b"}},
+		{":", "", []string{}},
+		{"[0-9]+", "a12b3c", []string{"a", "b", "c"}},
+	}
+	for _, test := range tests {
+		fb := testFieldbuf(t, test.fs, test.record)
+		if got := fieldStrings(fb); !reflect.DeepEqual(got, test.fields) {
+			t.Errorf("FS %q, record %q: fields %q, expected %q", test.fs, test.record, got, test.fields)
+		}
+		if got := fb.get(0).String(fb.convfmt); got != test.record {
+			t.Errorf("FS %q, record %q: $0 is %q", test.fs, test.record, got)
+		}
+	}
+}
+
+func TestSetRecordNumericStrings(t *testing.T) {
+	fb := testFieldbuf(t, " ", "10 abc 1e1")
+	for i, expected := range []Awkvaluetype{Numericstring, Normalstring, Numericstring} {
+		if got := fb.get(i + 1).Typ; got != expected {
+			t.Errorf("$%d has type %v, expected %v", i+1, got, expected)
+		}
+	}
+}
+
+func TestSetField(t *testing.T) {
+	fb := testFieldbuf(t, " ", "a  b c")
+	fb.set(2, Awknormalstring("x"))
+	if got := fb.get(0).String(fb.convfmt); got != "a x c" {
+		t.Errorf("$0 after $2 = \"x\" is %q", got)
+	}
+	fb.set(5, Awknumber(3.5))
+	if got := fb.get(0).String(fb.convfmt); got != "a x c  3.5" {
+		t.Errorf("$0 after $5 = 3.5 is %q", got)
+	}
+	if fb.nf() != 5 {
+		t.Errorf("NF after $5 = 3.5 is %d", fb.nf())
+	}
+	fb.set(0, Awknormalstring("d e"))
+	if got := fieldStrings(fb); !reflect.DeepEqual(got, []string{"d", "e"}) {
+		t.Errorf("fields after $0 = \"d e\" are %q", got)
+	}
+}
+
+func TestSetNF(t *testing.T) {
+	tests := []struct {
+		nf     int
+		record string
+	}{
+		{5, "a b c  "},
+		{2, "a b"},
+		{0, ""},
+	}
+	for _, test := range tests {
+		fb := testFieldbuf(t, " ", "a b c")
+		fb.setNF(test.nf)
+		if fb.nf() != test.nf {
+			t.Errorf("NF = %d: NF is %d", test.nf, fb.nf())
+		}
+		if got := fb.get(0).String(fb.convfmt); got != test.record {
+			t.Errorf("NF = %d: $0 is %q, expected %q", test.nf, got, test.record)
+		}
+	}
+}
+
+func TestRebuildOfs(t *testing.T) {
+	fb := testFieldbuf(t, " ", "a b c")
+	fb.ofs = "-"
+	if got := fb.get(0).String(fb.convfmt); got != "a b c" {
+		t.Errorf("changing OFS alone changed $0 to %q", got)
+	}
+	fb.set(1, fb.get(1))
+	if got := fb.get(0).String(fb.convfmt); got != "a-b-c" {
+		t.Errorf("$0 rebuilt with OFS \"-\" is %q", got)
+	}
+	fb.convfmt = "%.2f"
+	fb.set(2, Awknumber(3.14159))
+	if got := fb.get(0).String(fb.convfmt); got != "a-3.14-c" {
+		t.Errorf("$0 rebuilt with CONVFMT \"%%.2f\" is %q", got)
+	}
+}
+
+func TestSplitParagraph(t *testing.T) {
+	tests := []struct {
+		fs, record string
+		fields     []string
+	}{
+		{" ", "a b\nc", []string{"a", "b", "c"}},
+		{":", "a:b\nc:d", []string{"a", "b", "c", "d"}},
+		{"[0-9]", "a1b\nc", []string{"a", "b", "c"}},
+	}
+	for _, test := range tests {
+		fb := testFieldbuf(t, test.fs, "")
+		fb.paragraph = true
+		if got := fb.split(nil, test.record); !reflect.DeepEqual(got, test.fields) {
+			t.Errorf("FS %q, record %q: fields %q, expected %q", test.fs, test.record, got, test.fields)
+		}
+		fb.paragraph = false
+		if got := fb.split(nil, test.record); test.fs != " " && reflect.DeepEqual(got, test.fields) {
+			t.Errorf("FS %q, record %q: newline separates fields outside paragraph mode", test.fs, test.record)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+/*
+ * Copyright (C) 2021 Andrea Fiori <andrea.fiori.1998@gmail.com>
+ *
+ * Licensed under GPLv2, see file LICENSE in this source tree.
+ */
+
+package interpreter
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Opens the files named by the program: the file operands, getline < file
+// and the redirections > and >>. It can rewrite the names, confine them or
+// serve the files from elsewhere. "-" and the special files of the standard
+// streams (/dev/stdin, /dev/fd/0, /dev/stdout...) are handled by the
+// interpreter and never passed to it.
+type FileOpener interface {
+	Open(name string) (io.ReadCloser, error)
+	// Creates or truncates the file, or appends to it if appending is true
+	Create(name string, appending bool) (io.WriteCloser, error)
+}
+
+// FileOpener of the files of the operating system. Relative names are
+// resolved against Dir, or the working directory if Dir is empty.
+type OSFiles struct {
+	Dir string
+}
+
+func (f OSFiles) Open(name string) (io.ReadCloser, error) {
+	return os.Open(f.path(name))
+}
+
+func (f OSFiles) Create(name string, appending bool) (io.WriteCloser, error) {
+	mode := os.O_TRUNC
+	if appending {
+		mode = os.O_APPEND
+	}
+	return os.OpenFile(f.path(name), os.O_CREATE|os.O_WRONLY|mode, 0600)
+}
+
+func (f OSFiles) path(name string) string {
+	if f.Dir == "" || filepath.IsAbs(name) || strings.HasPrefix(name, "/") {
+		return hostPath(name)
+	}
+	return filepath.Join(f.Dir, name)
+}
+
+// File system which files can be written to as well as read from
+type WritableFS interface {
+	fs.FS
+	// Creates or truncates the file, or appends to it if appending is true
+	Create(name string, appending bool) (io.WriteCloser, error)
+}
+
+// FileOpener of the files of a file system, such as an embed.FS, a zip
+// archive or an fstest.MapFS. Names are taken relative to its root, which
+// they cannot leave: "/a/b", "a/b" and "./a//b" all name a/b, while "../a"
+// is invalid, as are the names of the root itself ("", "/", "."). Files can
+// be written only if FS is a WritableFS.
+type FSFiles struct {
+	FS fs.FS
+}
+
+func (f FSFiles) Open(name string) (io.ReadCloser, error) {
+	p, err := fsPath("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return f.FS.Open(p)
+}
+
+func (f FSFiles) Create(name string, appending bool) (io.WriteCloser, error) {
+	p, err := fsPath("create", name)
+	if err != nil {
+		return nil, err
+	}
+	wfs, ok := f.FS.(WritableFS)
+	if !ok {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: fs.ErrPermission}
+	}
+	return wfs.Create(p, appending)
+}
+
+func fsPath(op, name string) (string, error) {
+	p := path.Clean(strings.TrimLeft(name, "/"))
+	if p == "." || !fs.ValidPath(p) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return p, nil
+}
@@ -0,0 +1,185 @@
+/*
+ * Copyright (C) 2021 Andrea Fiori <andrea.fiori.1998@gmail.com>
+ *
+ * Licensed under GPLv2, see file LICENSE in this source tree.
+ */
+
+package interpreter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// Runs the program of cl over input, returning what it printed on stdout
+// and stderr and the errors other than ErrorExit
+func runCL(t *testing.T, cl CommandLine, input string, arguments ...string) (string, string, []error) {
+	if cl.Fs == "" {
+		cl.Fs = " "
+	}
+	p, errs := NewProgram(cl)
+	if len(errs) > 0 {
+		t.Fatal(errs[0])
+	}
+	var stdout, stderr bytes.Buffer
+	var runerrs []error
+	for _, err := range p.Run(strings.NewReader(input), &stdout, &stderr, arguments...) {
+		if _, ok := err.(ErrorExit); !ok {
+			runerrs = append(runerrs, err)
+		}
+	}
+	return stdout.String(), stderr.String(), runerrs
+}
+
+var testFS = fstest.MapFS{
+	"one":     {Data: []byte("a\nb\n")},
+	"dir/two": {Data: []byte("c\n")},
+}
+
+func TestFSFilesRead(t *testing.T) {
+	cl := CommandLine{
+		Program: strings.NewReader(`{ print FILENAME, $0 } END { while ((getline line < "/dir/two") > 0) print "getline", line }`),
+		Files:   FSFiles{FS: testFS},
+	}
+	out, _, errs := runCL(t, cl, "", "one", "./dir//two")
+	if len(errs) > 0 {
+		t.Fatal(errs[0])
+	}
+	if expected := "one a\none b\n./dir//two c\ngetline c\n"; out != expected {
+		t.Errorf("printed %q, expected %q", out, expected)
+	}
+}
+
+func TestFSFilesInvalidNames(t *testing.T) {
+	files := FSFiles{FS: testFS}
+	for _, name := range []string{"../one", "dir/../../one", "", "/", "."} {
+		if _, err := files.Open(name); !errors.Is(err, fs.ErrInvalid) {
+			t.Errorf("opening %q: error %v, expected %v", name, err, fs.ErrInvalid)
+		}
+		if _, err := files.Create(name, false); !errors.Is(err, fs.ErrInvalid) {
+			t.Errorf("creating %q: error %v, expected %v", name, err, fs.ErrInvalid)
+		}
+	}
+	cl := CommandLine{
+		Program: strings.NewReader(`BEGIN { print (getline line < "../one") }`),
+		Files:   files,
+	}
+	if out, _, _ := runCL(t, cl, ""); out != "-1\n" {
+		t.Errorf("getline from ../one printed %q", out)
+	}
+}
+
+func TestFSFilesReadOnly(t *testing.T) {
+	files := FSFiles{FS: testFS}
+	for _, appending := range []bool{false, true} {
+		if _, err := files.Create("new", appending); !errors.Is(err, fs.ErrPermission) {
+			t.Errorf("creating a file with appending %v: error %v, expected %v", appending, err, fs.ErrPermission)
+		}
+	}
+	cl := CommandLine{
+		Program: strings.NewReader(`BEGIN { print "x" > "new" }`),
+		Files:   files,
+	}
+	if _, _, errs := runCL(t, cl, ""); len(errs) == 0 {
+		t.Errorf("writing to a read only file system did not fail")
+	}
+}
+
+// Records the files opened through it, which it opens with Files
+type recordingFiles struct {
+	Files  FileOpener
+	opened *[]string
+}
+
+func (f recordingFiles) Open(name string) (io.ReadCloser, error) {
+	*f.opened = append(*f.opened, "open "+name)
+	return f.Files.Open(name)
+}
+
+func (f recordingFiles) Create(name string, appending bool) (io.WriteCloser, error) {
+	*f.opened = append(*f.opened, fmt.Sprintf("create %s %v", name, appending))
+	return f.Files.Create(name, appending)
+}
+
+func TestFileOpener(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "in"), []byte("a\nb\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var opened []string
+	cl := CommandLine{
+		Program: strings.NewReader(`{ print > "out" }
+END {
+	getline line < "in"
+	print line >> "log"
+	print "read", (getline line < "/nonexistent/file")
+}`),
+		Files: recordingFiles{Files: OSFiles{Dir: dir}, opened: &opened},
+	}
+	out, _, errs := runCL(t, cl, "x\n", "in", "-")
+	if len(errs) > 0 {
+		t.Fatal(errs[0])
+	}
+	if expected := "read -1\n"; out != expected {
+		t.Errorf("printed %q, expected %q", out, expected)
+	}
+	expected := []string{"open in", "create out false", "open in", "create log true", "open /nonexistent/file"}
+	if !reflect.DeepEqual(opened, expected) {
+		t.Errorf("opened %q, expected %q", opened, expected)
+	}
+	for name, content := range map[string]string{"out": "a\nb\nx\n", "log": "a\n"} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != content {
+			t.Errorf("%s contains %q, expected %q", name, data, content)
+		}
+	}
+}
+
+func TestMaxOpenFiles(t *testing.T) {
+	dir := t.TempDir()
+	var opened []string
+	cl := CommandLine{
+		Program: strings.NewReader(`{ print > ("f" NR % 2) }
+END {
+	close("f0")
+	print "new" > "f0"
+	print "end" > "f1"
+}`),
+		Files:        recordingFiles{Files: OSFiles{Dir: dir}, opened: &opened},
+		MaxOpenFiles: 1,
+	}
+	_, _, errs := runCL(t, cl, "1\n2\n3\n4\n5\n6\n")
+	if len(errs) > 0 {
+		t.Fatal(errs[0])
+	}
+	expected := []string{
+		"create f1 false", "create f0 false",
+		"create f1 true", "create f0 true",
+		"create f1 true", "create f0 true",
+		"create f0 false", "create f1 true",
+	}
+	if !reflect.DeepEqual(opened, expected) {
+		t.Errorf("opened %q, expected %q", opened, expected)
+	}
+	for name, content := range map[string]string{"f0": "new\n", "f1": "1\n3\n5\nend\n"} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != content {
+			t.Errorf("%s contains %q, expected %q", name, data, content)
+		}
+	}
+}
@@ -0,0 +1,488 @@
+/*
+ * Copyright (C) 2021 Andrea Fiori <andrea.fiori.1998@gmail.com>
+ *
+ * Licensed under GPLv2, see file LICENSE in this source tree.
+ */
+
+package interpreter
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/fioriandrea/aawk/lexer"
+	"github.com/fioriandrea/aawk/parser"
+)
+
+// The formats of printf and sprintf follow the conversions of C: the values
+// are formatted here, not by package fmt, whose verbs behave differently.
+
+// Widths and precisions larger than this are rejected, since they would
+// only exhaust memory
+const maxFormatWidth = 1 << 20
+
+// A conversion specification of a format, with the literal text preceding
+// it. The text at the end of the format has a spec of its own, with verb 0.
+type fmtspec struct {
+	text                            string
+	minus, plus, space, sharp, zero bool
+	width                           int
+	prec                            int  // -1 if not given
+	widtharg, precarg               bool // Given by arguments, with *
+	verb                            byte
+}
+
+// Number of arguments taken by the specification
+func (sp fmtspec) nargs() int {
+	if sp.verb == 0 {
+		return 0
+	}
+	n := 1
+	if sp.widtharg {
+		n++
+	}
+	if sp.precarg {
+		n++
+	}
+	return n
+}
+
+func parseFormat(s string) ([]fmtspec, error) {
+	var specs []fmtspec
+	var text strings.Builder
+	i := 0
+	for i < len(s) {
+		if s[i] != '%' {
+			text.WriteByte(s[i])
+			i++
+			continue
+		}
+		i++
+		if i < len(s) && s[i] == '%' {
+			text.WriteByte('%')
+			i++
+			continue
+		}
+		sp := fmtspec{text: text.String(), prec: -1}
+		text.Reset()
+	flags:
+		for ; i < len(s); i++ {
+			switch s[i] {
+			case '-':
+				sp.minus = true
+			case '+':
+				sp.plus = true
+			case ' ':
+				sp.space = true
+			case '#':
+				sp.sharp = true
+			case '0':
+				sp.zero = true
+			default:
+				break flags
+			}
+		}
+		var err error
+		if i < len(s) && s[i] == '*' {
+			sp.widtharg = true
+			i++
+		} else if sp.width, i, err = scanFormatInt(s, i); err != nil {
+			return nil, err
+		}
+		if i < len(s) && s[i] == '.' {
+			i++
+			if i < len(s) && s[i] == '*' {
+				sp.precarg = true
+				i++
+			} else if sp.prec, i, err = scanFormatInt(s, i); err != nil {
+				return nil, err
+			}
+		}
+		// The length modifiers of C mean nothing in awk
+		for i < len(s) && strings.IndexByte("hlLjzt", s[i]) >= 0 {
+			i++
+		}
+		if i >= len(s) {
+			return nil, errors.New("expected format type at end of string")
+		}
+		switch s[i] {
+		case 'a', 'A', 'c', 'd', 'e', 'E', 'f', 'F', 'g', 'G', 'i', 'o', 's', 'u', 'x', 'X':
+			sp.verb = s[i]
+		default:
+			r, _ := utf8.DecodeRuneInString(s[i:])
+			return nil, fmt.Errorf("unknown format %c in string %q", r, s)
+		}
+		i++
+		specs = append(specs, sp)
+	}
+	if text.Len() > 0 {
+		specs = append(specs, fmtspec{text: text.String(), prec: -1})
+	}
+	return specs, nil
+}
+
+func scanFormatInt(s string, i int) (int, int, error) {
+	n := 0
+	for ; i < len(s) && isDigit(s[i]); i++ {
+		n = n*10 + int(s[i]-'0')
+		if n > maxFormatWidth {
+			return 0, i, errors.New("width or precision too large in format")
+		}
+	}
+	return n, i, nil
+}
+
+func (inter *interpreter) parsedFormat(printtok lexer.Token, s string) ([]fmtspec, error) {
+	if specs, ok := inter.fprintfcache[s]; ok {
+		return specs, nil
+	}
+	specs, err := parseFormat(s)
+	if err != nil {
+		return nil, inter.runtimeError(printtok, err.Error())
+	}
+	if len(inter.fprintfcache) < 100 {
+		inter.fprintfcache[s] = specs
+	}
+	return specs, nil
+}
+
+// Formats the values of exprs[1:] with the format exprs[0]. As in the
+// printf utility, the format is used again from the beginning while
+// arguments remain, missing ones on the last use being empty strings or
+// zeroes. The arguments of a format without conversions are ignored.
+func (inter *interpreter) fprintf(w io.Writer, print lexer.Token, exprs []parser.Expr) error {
+	format, err := inter.eval(exprs[0])
+	if err != nil {
+		return err
+	}
+	specs, err := inter.parsedFormat(print, inter.toString(format))
+	if err != nil {
+		return err
+	}
+	nargs := 0
+	for _, sp := range specs {
+		nargs += sp.nargs()
+	}
+	rest := exprs[1:]
+	if nargs > len(rest) {
+		return inter.runtimeError(print, "run out of arguments for formatted output")
+	}
+	next := func() (Awkvalue, error) {
+		if len(rest) == 0 {
+			return Awknull, nil
+		}
+		v, err := inter.eval(rest[0])
+		rest = rest[1:]
+		if err == nil && v.Typ == Array {
+			err = inter.runtimeError(print, "cannot print array")
+		}
+		return v, err
+	}
+
+	var buf []byte
+	for {
+		for _, sp := range specs {
+			buf = append(buf, sp.text...)
+			if sp.verb == 0 {
+				continue
+			}
+			minus, width, prec := sp.minus, sp.width, sp.prec
+			if sp.widtharg {
+				v, err := next()
+				if err != nil {
+					return err
+				}
+				width = clampFormatInt(inter.toNumber(v))
+				if width < 0 {
+					minus, width = true, -width
+				}
+			}
+			if sp.precarg {
+				v, err := next()
+				if err != nil {
+					return err
+				}
+				prec = clampFormatInt(inter.toNumber(v))
+				if prec < 0 {
+					prec = -1
+				}
+			}
+			v, err := next()
+			if err != nil {
+				return err
+			}
+			buf = inter.appendFormatted(buf, sp, minus, width, prec, v)
+		}
+		if nargs == 0 || len(rest) == 0 {
+			break
+		}
+	}
+	if _, err := w.Write(buf); err != nil {
+		return writeError{err}
+	}
+	return nil
+}
+
+func clampFormatInt(f float64) int {
+	if math.IsNaN(f) {
+		return 0
+	}
+	return int(math.Max(-maxFormatWidth, math.Min(f, maxFormatWidth)))
+}
+
+// Appends v formatted by sp, with the given width and precision
+func (inter *interpreter) appendFormatted(dst []byte, sp fmtspec, minus bool, width, prec int, v Awkvalue) []byte {
+	var prefix, body string
+	zero := sp.zero && !minus
+	switch sp.verb {
+	case 'c':
+		body = inter.formatChar(v)
+		zero = false
+	case 's':
+		body = inter.toString(v)
+		if prec >= 0 && prec < len(body) {
+			body = truncateRunes(body, prec)
+		}
+		zero = false
+	case 'd', 'i', 'o', 'u', 'x', 'X':
+		f := inter.toNumber(v)
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			prefix, body = formatNonFinite(sp, f)
+			zero = false
+			break
+		}
+		prefix, body = formatInteger(sp, prec, f)
+		zero = zero && prec < 0
+	default:
+		f := inter.toNumber(v)
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			prefix, body = formatNonFinite(sp, f)
+			zero = false
+			break
+		}
+		prefix = signPrefix(sp, math.Signbit(f))
+		body = formatFloat(sp, prec, math.Abs(f))
+	}
+
+	pad := width - utf8.RuneCountInString(prefix) - utf8.RuneCountInString(body)
+	switch {
+	case pad <= 0:
+		dst = append(dst, prefix...)
+		dst = append(dst, body...)
+	case minus:
+		dst = append(dst, prefix...)
+		dst = append(dst, body...)
+		dst = appendRepeated(dst, ' ', pad)
+	case zero:
+		dst = append(dst, prefix...)
+		dst = appendRepeated(dst, '0', pad)
+		dst = append(dst, body...)
+	default:
+		dst = appendRepeated(dst, ' ', pad)
+		dst = append(dst, prefix...)
+		dst = append(dst, body...)
+	}
+	return dst
+}
+
+// A number is printed as the character whose code point it is, U+FFFD if
+// there is none, or in byte mode as the byte of its lowest 8 bits, as C
+// does. A string is printed as its first character, the empty string as NUL.
+func (inter *interpreter) formatChar(v Awkvalue) string {
+	if v.Typ == Number || v.Typ == Numericstring {
+		f := math.Trunc(inter.toNumber(v))
+		switch {
+		case inter.bytes && math.Abs(f) < 1<<63:
+			return string([]byte{byte(int64(f))})
+		case f >= 0 && f <= unicode.MaxRune:
+			return string(rune(f))
+		}
+		return string(utf8.RuneError)
+	}
+	s := inter.toString(v)
+	switch {
+	case s == "":
+		return "\000"
+	case inter.bytes:
+		return s[:1]
+	}
+	_, size := utf8.DecodeRuneInString(s)
+	return s[:size]
+}
+
+func appendRepeated(dst []byte, c byte, n int) []byte {
+	for ; n > 0; n-- {
+		dst = append(dst, c)
+	}
+	return dst
+}
+
+func truncateRunes(s string, n int) string {
+	for i := range s {
+		if n == 0 {
+			return s[:i]
+		}
+		n--
+	}
+	return s
+}
+
+func signPrefix(sp fmtspec, negative bool) string {
+	switch {
+	case negative:
+		return "-"
+	case sp.plus:
+		return "+"
+	case sp.space:
+		return " "
+	}
+	return ""
+}
+
+func isUpperVerb(verb byte) bool {
+	return verb >= 'A' && verb <= 'Z'
+}
+
+func formatNonFinite(sp fmtspec, f float64) (string, string) {
+	body := "inf"
+	if math.IsNaN(f) {
+		body = "nan"
+	}
+	if isUpperVerb(sp.verb) {
+		body = strings.ToUpper(body)
+	}
+	return signPrefix(sp, f < 0), body
+}
+
+// Formats the integer part of f. The values of o, u, x and X are unsigned,
+// negative ones being taken modulo 2^64 as long as they fit in 64 bits.
+func formatInteger(sp fmtspec, prec int, f float64) (string, string) {
+	base := 10
+	switch sp.verb {
+	case 'o':
+		base = 8
+	case 'x', 'X':
+		base = 16
+	}
+	unsigned := sp.verb != 'd' && sp.verb != 'i'
+	t := math.Trunc(f)
+	negative := t < 0
+	var digits string
+	switch a := math.Abs(t); {
+	case unsigned && negative && t >= -0x1p63:
+		negative = false
+		digits = strconv.FormatUint(uint64(int64(t)), base)
+	case a < 0x1p63:
+		digits = strconv.FormatInt(int64(a), base)
+	default:
+		n, _ := new(big.Float).SetFloat64(a).Int(nil)
+		digits = n.Text(base)
+	}
+	iszero := digits == "0"
+	if prec == 0 && iszero {
+		digits = ""
+	}
+	if len(digits) < prec {
+		digits = strings.Repeat("0", prec-len(digits)) + digits
+	}
+	if sp.verb == 'X' {
+		digits = strings.ToUpper(digits)
+	}
+
+	var prefix string
+	if unsigned {
+		if negative {
+			prefix = "-"
+		}
+	} else {
+		prefix = signPrefix(sp, negative)
+	}
+	if sp.sharp {
+		switch {
+		case sp.verb == 'o' && !strings.HasPrefix(digits, "0"):
+			digits = "0" + digits
+		case sp.verb == 'x' && !iszero:
+			prefix += "0x"
+		case sp.verb == 'X' && !iszero:
+			prefix += "0X"
+		}
+	}
+	return prefix, digits
+}
+
+// Formats f, which is finite and not negative
+func formatFloat(sp fmtspec, prec int, f float64) string {
+	var s string
+	switch sp.verb {
+	case 'a', 'A':
+		s = formatHexFloat(f, prec)
+	case 'e', 'E':
+		if prec < 0 {
+			prec = 6
+		}
+		s = strconv.FormatFloat(f, 'e', prec, 64)
+		if sp.sharp && prec == 0 {
+			s = strings.Replace(s, "e", ".e", 1)
+		}
+	case 'f', 'F':
+		if prec < 0 {
+			prec = 6
+		}
+		s = strconv.FormatFloat(f, 'f', prec, 64)
+		if sp.sharp && prec == 0 {
+			s += "."
+		}
+	case 'g', 'G':
+		s = formatG(f, prec, sp.sharp)
+	}
+	if isUpperVerb(sp.verb) {
+		s = strings.ToUpper(s)
+	}
+	return s
+}
+
+// %g uses the style of %e if the exponent is less than -4 or not less than
+// the precision, the one of %f otherwise. Trailing zeros are removed, unless
+// sharp is true.
+func formatG(f float64, prec int, sharp bool) string {
+	if prec < 0 {
+		prec = 6
+	} else if prec == 0 {
+		prec = 1
+	}
+	s := strconv.FormatFloat(f, 'e', prec-1, 64)
+	exp, _ := strconv.Atoi(s[strings.LastIndexByte(s, 'e')+1:])
+	if exp >= -4 && exp < prec {
+		s = strconv.FormatFloat(f, 'f', prec-1-exp, 64)
+	}
+	mantissa, exponent := s, ""
+	if i := strings.IndexByte(s, 'e'); i >= 0 {
+		mantissa, exponent = s[:i], s[i:]
+	}
+	if sharp {
+		if !strings.Contains(mantissa, ".") {
+			mantissa += "."
+		}
+	} else if strings.Contains(mantissa, ".") {
+		mantissa = strings.TrimSuffix(strings.TrimRight(mantissa, "0"), ".")
+	}
+	return mantissa + exponent
+}
+
+// Unlike the one of package strconv, the exponent of C has no leading zeros
+func formatHexFloat(f float64, prec int) string {
+	s := strconv.FormatFloat(f, 'x', prec, 64)
+	i := strings.IndexByte(s, 'p') + 2
+	exp := strings.TrimLeft(s[i:], "0")
+	if exp == "" {
+		exp = "0"
+	}
+	return s[:i] + exp
+}
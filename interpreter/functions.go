@@ -14,83 +14,167 @@ import (
 	"regexp"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/fioriandrea/aawk/lexer"
 	"github.com/fioriandrea/aawk/parser"
 )
 
-func (inter *interpreter) giveStackFrame(size int) ([]Awkvalue, int) {
-	if inter.stackcount+size > cap(inter.stack) {
-		return make([]Awkvalue, size), 0
+// The frames of the calls of user defined functions are taken from a slice
+// which is reused by the following calls, and grows when calls nest deeper.
+// Growing it does not copy the frames in use, which keep the ones they were
+// given.
+type callStack struct {
+	values []Awkvalue
+	top    int
+	high   int // Highest top reached
+}
+
+func (cs *callStack) push(size int) []Awkvalue {
+	if cs.top+size > len(cs.values) {
+		n := 2 * len(cs.values)
+		if n < cs.top+size {
+			n = cs.top + size
+		}
+		cs.values = make([]Awkvalue, n)
 	}
-	inter.stackcount += size
-	return inter.stack[inter.stackcount-size : inter.stackcount], size
+	frame := cs.values[cs.top : cs.top+size : cs.top+size]
+	cs.top += size
+	if cs.top > cs.high {
+		cs.high = cs.top
+	}
+	return frame
 }
 
-func (inter *interpreter) releaseStackFrame(size int) {
-	inter.stackcount -= size
+// Releases the frame on top, so that its values can be collected
+func (cs *callStack) pop(frame []Awkvalue) {
+	for i := range frame {
+		frame[i] = Awknull
+	}
+	cs.top -= len(frame)
 }
 
-func (inter *interpreter) evalUserCall(fdef *parser.FunctionDef, args []parser.Expr) (Awkvalue, error) {
-	arity := len(fdef.Args)
-	sublocals, size := inter.giveStackFrame(arity)
+func (inter *interpreter) evalUserCall(called lexer.Token, fdef *parser.FunctionDef, args []parser.Expr) (Awkvalue, error) {
+	sublocals := inter.stack.push(len(fdef.Args))
+	if err := inter.bindArgs(args, sublocals); err != nil {
+		inter.stack.pop(sublocals)
+		return Awknull, err
+	}
+	v, err := inter.runUserFunction(called, fdef, sublocals)
+	inter.stack.pop(sublocals)
+	return v, err
+}
 
-	for i := 0; i < arity; i++ {
+// Evaluates the arguments of a call into frame, evaluating and discarding
+// the extra ones. An uninitialized variable shares an arrayref with the
+// parameter it is passed to, since the function could use it as an array.
+func (inter *interpreter) bindArgs(args []parser.Expr, frame []Awkvalue) error {
+	for i := range frame {
 		var arg parser.Expr
-		if len(args) > 0 {
-			arg, args = args[0], args[1:]
+		if i < len(args) {
+			arg = args[i]
 		}
 		v, err := inter.evalArrayAllowed(arg)
 		if err != nil {
-			return Awknull, err
+			return err
 		}
-
-		// undefined values could be used as arrays
-		if idexpr, ok := arg.(*parser.IdExpr); ok && v.Typ == Null && v.Array == nil {
-			v.Array = map[string]Awkvalue{}
-			inter.setVariable(idexpr, v)
-
-			i := i
-			defer func() {
-				afterv := inter.getVariable(idexpr)
-				// if assigned array in the meantime
-				if afterv.Typ != Array {
-					var res Awkvalue
-					if sublocals[i].Typ == Array {
-						res = nullToArray(v)
-					}
-					inter.setVariableArrayAllowed(idexpr, res)
-				}
-			}()
+		if idexpr, ok := arg.(*parser.IdExpr); ok && v.Typ == Null && v.ref == nil && idexpr.BuiltinIndex < 0 {
+			v.ref = &arrayref{}
+			inter.setVariableArrayAllowed(idexpr, v)
 		}
+		frame[i] = v
+	}
 
-		sublocals[i] = v
+	for i := len(frame); i < len(args); i++ {
+		if _, err := inter.eval(args[i]); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	for _, arg := range args {
-		_, err := inter.eval(arg)
-		if err != nil {
-			return Awknull, err
+// Calls a user defined function with already evaluated arguments
+func (inter *interpreter) callUserFunction(fdef *parser.FunctionDef, args []Awkvalue) (Awkvalue, error) {
+	sublocals := inter.stack.push(len(fdef.Args))
+	for i := range sublocals {
+		if i < len(args) {
+			sublocals[i] = args[i]
+		} else {
+			sublocals[i] = Awknull
 		}
 	}
+	v, err := inter.runUserFunction(fdef.Name, fdef, sublocals)
+	inter.stack.pop(sublocals)
+	return v, err
+}
+
+// Returned by the body of a function to run it again with the arguments in
+// frame, see tailCall
+type errorTailCall struct {
+	frame []Awkvalue
+	call  lexer.Token
+}
 
+func (tc errorTailCall) Error() string {
+	return "tail call"
+}
+
+// Runs the body of fdef with the frame sublocals, which the caller pops
+// afterwards. The calls of fdef whose value the body returns reuse the
+// frame of the call, so that they do not count towards the depth of calls.
+func (inter *interpreter) runUserFunction(called lexer.Token, fdef *parser.FunctionDef, sublocals []Awkvalue) (Awkvalue, error) {
 	prevlocals := inter.locals
+	prevtailfunc := inter.tailfunc
+	prevcallsite := inter.callsite
 	inter.locals = sublocals
+	inter.tailfunc = fdef
+	inter.callsite = called
+	inter.calldepth++
+	if inter.calldepth > inter.highdepth {
+		inter.highdepth = inter.calldepth
+	}
 
 	defer func() {
 		inter.locals = prevlocals
-		inter.releaseStackFrame(size)
+		inter.tailfunc = prevtailfunc
+		inter.callsite = prevcallsite
+		inter.calldepth--
 	}()
 
-	err := inter.execute(fdef.Body)
-	var retval Awkvalue
-	if errRet, ok := err.(errorReturn); ok {
-		retval = Awkvalue(errRet)
-	} else if err != nil {
-		return Awknull, err
+	if inter.maxdepth > 0 && inter.calldepth > inter.maxdepth {
+		return Awknull, inter.runtimeError(called, fmt.Sprintf("calls of %s nested more than %d deep", fdef.Name.Lexeme, inter.maxdepth))
 	}
 
-	return retval, nil
+	for {
+		err := inter.execute(fdef.Body)
+		if tc, ok := err.(errorTailCall); ok {
+			copy(sublocals, tc.frame)
+			inter.stack.pop(tc.frame)
+			inter.callsite = tc.call
+			if err := inter.checkSignals(); err != nil {
+				return Awknull, err
+			}
+			continue
+		}
+		var retval Awkvalue
+		if errRet, ok := err.(errorReturn); ok {
+			retval = Awkvalue(errRet)
+		} else if err != nil {
+			return Awknull, err
+		}
+		return retval, nil
+	}
+}
+
+// Returns a call of the function being run, made by its return statement,
+// so that the body of the function is run again in the same frame
+func (inter *interpreter) tailCall(call *parser.CallExpr) error {
+	frame := inter.stack.push(len(inter.tailfunc.Args))
+	if err := inter.bindArgs(call.Args, frame); err != nil {
+		inter.stack.pop(frame)
+		return err
+	}
+	return errorTailCall{frame: frame, call: call.Called.Id}
 }
 
 func (inter *interpreter) evalBuiltinCall(called lexer.Token, args []parser.Expr) (Awkvalue, error) {
@@ -108,8 +192,8 @@ func (inter *interpreter) evalBuiltinCall(called lexer.Token, args []parser.Expr
 		if err != nil {
 			return Awknull, err
 		}
-		num1 := n1.Float()
-		num2 := n2.Float()
+		num1 := inter.toNumber(n1)
+		num2 := inter.toNumber(n2)
 		return Awknumber(math.Atan2(num1, num2)), nil
 	case lexer.Cos:
 		if len(args) != 1 {
@@ -119,7 +203,7 @@ func (inter *interpreter) evalBuiltinCall(called lexer.Token, args []parser.Expr
 		if err != nil {
 			return Awknull, err
 		}
-		num := n.Float()
+		num := inter.toNumber(n)
 		return Awknumber(math.Cos(num)), nil
 	case lexer.Sin:
 		if len(args) != 1 {
@@ -129,7 +213,7 @@ func (inter *interpreter) evalBuiltinCall(called lexer.Token, args []parser.Expr
 		if err != nil {
 			return Awknull, err
 		}
-		num := n.Float()
+		num := inter.toNumber(n)
 		return Awknumber(math.Sin(num)), nil
 	case lexer.Exp:
 		if len(args) != 1 {
@@ -139,7 +223,7 @@ func (inter *interpreter) evalBuiltinCall(called lexer.Token, args []parser.Expr
 		if err != nil {
 			return Awknull, err
 		}
-		num := n.Float()
+		num := inter.toNumber(n)
 		return Awknumber(math.Exp(num)), nil
 	case lexer.Log:
 		if len(args) != 1 {
@@ -149,7 +233,7 @@ func (inter *interpreter) evalBuiltinCall(called lexer.Token, args []parser.Expr
 		if err != nil {
 			return Awknull, err
 		}
-		num := n.Float()
+		num := inter.toNumber(n)
 		if num <= 0 {
 			return Awknull, inter.runtimeError(called, "cannot compute log of a number <= 0")
 		}
@@ -162,7 +246,7 @@ func (inter *interpreter) evalBuiltinCall(called lexer.Token, args []parser.Expr
 		if err != nil {
 			return Awknull, err
 		}
-		num := n.Float()
+		num := inter.toNumber(n)
 		if num < 0 {
 			return Awknull, inter.runtimeError(called, "cannot compute sqrt of a negative number")
 		}
@@ -175,8 +259,8 @@ func (inter *interpreter) evalBuiltinCall(called lexer.Token, args []parser.Expr
 		if err != nil {
 			return Awknull, err
 		}
-		num := n.Float()
-		return Awknumber(float64(int(num))), nil
+		num := inter.toNumber(n)
+		return Awknumber(math.Trunc(num)), nil
 	case lexer.Rand:
 		if len(args) > 0 {
 			return Awknull, inter.runtimeError(called, "too may arguments")
@@ -189,15 +273,15 @@ func (inter *interpreter) evalBuiltinCall(called lexer.Token, args []parser.Expr
 		}
 		ret := inter.rng.rngseed
 		if len(args) == 0 {
-			inter.rng.setSeed(time.Now().UTC().UnixNano())
+			inter.rng.setSeed(float64(time.Now().Unix()))
 		} else {
 			seed, err := inter.eval(args[0])
 			if err != nil {
 				return Awknull, err
 			}
-			inter.rng.setSeed(int64(seed.Float()))
+			inter.rng.setSeed(inter.toNumber(seed))
 		}
-		return Awknumber(float64(ret)), nil
+		return Awknumber(ret), nil
 	// String functions
 	case lexer.Gsub:
 		return generalsub(inter, called, args, true)
@@ -215,6 +299,10 @@ func (inter *interpreter) evalBuiltinCall(called lexer.Token, args []parser.Expr
 		}
 		str := inter.toString(v0)
 		substr := inter.toString(v1)
+		if inter.ignorecase {
+			str = strings.ToLower(str)
+			substr = strings.ToLower(substr)
+		}
 		return Awknumber(float64(indexRuneSlice([]rune(str), []rune(substr)) + 1)), nil
 	case lexer.Length:
 		var str string
@@ -232,7 +320,10 @@ func (inter *interpreter) evalBuiltinCall(called lexer.Token, args []parser.Expr
 		}
 		return Awknumber(float64(len([]rune(str)))), nil
 	case lexer.Match:
-		if len(args) != 2 {
+		if len(args) == 2 {
+			args = append(args, nil)
+		}
+		if len(args) != 3 {
 			return Awknull, inter.runtimeError(called, "incorrect number of arguments")
 		}
 		vs, err := inter.eval(args[0])
@@ -244,20 +335,49 @@ func (inter *interpreter) evalBuiltinCall(called lexer.Token, args []parser.Expr
 		if err != nil {
 			return Awknull, err
 		}
-		loc := re.FindStringIndex(s)
-		if loc == nil {
-			loc = []int{-1, -2}
+		loc := re.FindStringSubmatchIndex(s)
+		// Positions and lengths are in characters, as in index and substr
+		start := func(i int) float64 {
+			return float64(utf8.RuneCountInString(s[:loc[2*i]]) + 1)
+		}
+		length := func(i int) float64 {
+			return float64(utf8.RuneCountInString(s[loc[2*i]:loc[2*i+1]]))
+		}
+		rstart, rlength := 0.0, -1.0
+		if loc != nil {
+			rstart, rlength = start(0), length(0)
 		}
-		rstart := float64(loc[0] + 1)
-		rlength := float64(loc[1] - loc[0])
 		inter.builtins[parser.Rstart] = Awknumber(rstart)
 		inter.builtins[parser.Rlength] = Awknumber(rlength)
+		if args[2] != nil {
+			id, isid := args[2].(*parser.IdExpr)
+			if !isid {
+				return Awknull, inter.runtimeError(args[2].Token(), "expected array")
+			}
+			arr, err := inter.getArrayVariable(id)
+			if err != nil {
+				return Awknull, err
+			}
+			clearArray(arr.Array)
+			subsep := inter.getSubsep()
+			// Element 0 is the whole match, the others are the capture
+			// groups. Groups which did not participate are left out.
+			for i := 0; i < len(loc)/2; i++ {
+				if loc[2*i] < 0 {
+					continue
+				}
+				k := fmt.Sprint(i)
+				arr.Array[k] = inter.numericString(s[loc[2*i]:loc[2*i+1]])
+				arr.Array[k+subsep+"start"] = Awknumber(start(i))
+				arr.Array[k+subsep+"length"] = Awknumber(length(i))
+			}
+		}
 		return Awknumber(rstart), nil
 	case lexer.Split:
-		if len(args) < 3 {
+		for len(args) < 4 {
 			args = append(args, nil)
 		}
-		if len(args) != 3 {
+		if len(args) != 4 {
 			return Awknull, inter.runtimeError(called, "incorrect number of arguments")
 		}
 
@@ -273,23 +393,44 @@ func (inter *interpreter) evalBuiltinCall(called lexer.Token, args []parser.Expr
 			return Awknull, inter.runtimeError(args[1].Token(), "expected array")
 		}
 
-		_, err = inter.getArrayVariable(id)
+		arr, err := inter.getArrayVariable(id)
 		if err != nil {
 			return Awknull, err
 		}
 
-		newval := Awkarray(map[string]Awkvalue{})
-		splits, err := inter.split(s, args[2])
-		if err != nil {
-			return Awknull, err
+		var splits []string
+		if args[3] == nil {
+			splits, err = inter.split(s, args[2])
+			if err != nil {
+				return Awknull, err
+			}
+		} else {
+			sepsid, isid := args[3].(*parser.IdExpr)
+			if !isid {
+				return Awknull, inter.runtimeError(args[3].Token(), "expected array")
+			}
+			sepsarr, err := inter.getArrayVariable(sepsid)
+			if err != nil {
+				return Awknull, err
+			}
+			sep, err := inter.fieldSeparator(args[2])
+			if err != nil {
+				return Awknull, err
+			}
+			var seps map[int]string
+			splits, seps = splitFsSeps(s, sep)
+			clearArray(sepsarr.Array)
+			for i, sep := range seps {
+				sepsarr.Array[fmt.Sprint(i)] = Awknormalstring(sep)
+			}
 		}
+
+		clearArray(arr.Array)
 		for i, split := range splits {
-			newval.Array[fmt.Sprint(i+1)] = Awknumericstring(split)
+			arr.Array[fmt.Sprint(i+1)] = inter.numericString(split)
 		}
 
-		inter.setVariableArrayAllowed(id, newval)
-
-		return Awknumber(float64(len(newval.Array))), nil
+		return Awknumber(float64(len(splits))), nil
 	case lexer.Sprintf:
 		if len(args) == 0 {
 			args = append(args, nil)
@@ -318,28 +459,23 @@ func (inter *interpreter) evalBuiltinCall(called lexer.Token, args []parser.Expr
 		if err != nil {
 			return Awknull, err
 		}
-		m := int(vm.Float()) - 1
-		if m < 0 {
-			m = 0
-		} else if m > len(s) {
-			m = len(s)
-		}
-		var n int
-		if args[2] == nil {
-			n = len(s)
-		} else {
+		// The characters from position m (included) to m+n (excluded) are
+		// returned, with m and n rounded to the nearest integer
+		start := math.Round(inter.toNumber(vm))
+		end := math.Inf(1)
+		if args[2] != nil {
 			vn, err := inter.eval(args[2])
 			if err != nil {
 				return Awknull, err
 			}
-			n = int(vn.Float())
+			end = start + math.Round(inter.toNumber(vn))
 		}
-		if n < 0 {
-			n = 0
-		} else if n+m > len(s) {
-			n = len(s) - m
+		start = math.Max(start, 1)
+		end = math.Min(end, float64(len(s)+1))
+		if math.IsNaN(start) || math.IsNaN(end) || end <= start {
+			return Awknormalstring(""), nil
 		}
-		return Awknormalstring(string(s[m : m+n])), nil
+		return Awknormalstring(string(s[int(start)-1 : int(end)-1])), nil
 	case lexer.Tolower:
 		if len(args) != 1 {
 			return Awknull, inter.runtimeError(called, "incorrect number of arguments")
@@ -348,7 +484,7 @@ func (inter *interpreter) evalBuiltinCall(called lexer.Token, args []parser.Expr
 		if err != nil {
 			return Awknull, err
 		}
-		return Awknormalstring(strings.ToLower(inter.toString(v))), nil
+		return Awknormalstring(inter.casing.toLower(inter.toString(v))), nil
 	case lexer.Toupper:
 		if len(args) != 1 {
 			return Awknull, inter.runtimeError(called, "incorrect number of arguments")
@@ -357,7 +493,7 @@ func (inter *interpreter) evalBuiltinCall(called lexer.Token, args []parser.Expr
 		if err != nil {
 			return Awknull, err
 		}
-		return Awknormalstring(strings.ToUpper(inter.toString(v))), nil
+		return Awknormalstring(inter.casing.toUpper(inter.toString(v))), nil
 	// IO Functions
 	case lexer.Close:
 		if len(args) != 1 {
@@ -368,28 +504,50 @@ func (inter *interpreter) evalBuiltinCall(called lexer.Token, args []parser.Expr
 			return Awknull, err
 		}
 		str := inter.toString(file)
-		opr := inter.outprograms.close(str)
-		oprn := 0
-		if opr != nil {
-			oprn = 1
+		status := -1
+		for _, streams := range []*closableStreams{inter.outprograms, inter.inprograms} {
+			if found, err := streams.closeIfOpen(str); found {
+				status = exitStatus(err)
+				inter.builtins[parser.Procinfo].Array["close_status"] = Awknumber(float64(status))
+			}
 		}
-		of := inter.outfiles.close(str)
-		ofn := 0
-		if of != nil {
-			ofn = 1
+		if found, err := inter.outfiles.closeIfOpen(str); found {
+			status = exitStatus(err)
 		}
-		ipr := inter.inprograms.close(str)
-		iprn := 0
-		if ipr != nil {
-			iprn = 1
+		if found, err := inter.infiles.closeIfOpen(str); found {
+			status = exitStatus(err)
 		}
-		inf := inter.infiles.close(str)
-		infn := 0
-		if inf != nil {
-			infn = 1
+		return Awknumber(float64(status)), nil
+	case lexer.Fflush:
+		if len(args) > 1 {
+			return Awknull, inter.runtimeError(called, "incorrect number of arguments")
 		}
-
-		return Awknumber(float64(oprn | ofn | iprn | infn)), nil
+		// fflush() and fflush("") flush everything
+		if len(args) == 0 {
+			if len(inter.flushAll()) > 0 {
+				return Awknumber(-1), nil
+			}
+			return Awknumber(0), nil
+		}
+		v, err := inter.eval(args[0])
+		if err != nil {
+			return Awknull, err
+		}
+		name := inter.toString(v)
+		if name == "" {
+			if len(inter.flushAll()) > 0 {
+				return Awknumber(-1), nil
+			}
+			return Awknumber(0), nil
+		}
+		found, err := inter.outprograms.flush(name)
+		if !found {
+			found, err = inter.outfiles.flush(name)
+		}
+		if !found || err != nil {
+			return Awknumber(-1), nil
+		}
+		return Awknumber(0), nil
 	case lexer.System:
 		if len(args) != 1 {
 			return Awknull, inter.runtimeError(called, "incorrect number of arguments")
@@ -399,8 +557,51 @@ func (inter *interpreter) evalBuiltinCall(called lexer.Token, args []parser.Expr
 			return Awknull, err
 		}
 		cmdstr := inter.toString(v)
+		inter.flushAll()
 
-		return Awknumber(float64(system(cmdstr, inter.stdin, inter.stdout, inter.stderr))), nil
+		cmd, err := inter.command(cmdstr)
+		if err != nil {
+			inter.setErrno(err)
+			return Awknumber(-1), nil
+		}
+		return Awknumber(float64(system(cmd, inter.stdin, inter.stdout, inter.stderr))), nil
+	case lexer.Warn:
+		if len(args) != 1 {
+			return Awknull, inter.runtimeError(called, "incorrect number of arguments")
+		}
+		v, err := inter.eval(args[0])
+		if err != nil {
+			return Awknull, err
+		}
+		// Diagnostics are written like runtime errors
+		fmt.Fprintf(inter.stderr, "%s: at %s: %s\n", inter.programname, inter.items.Sources.Position(called.Line), inter.toString(v))
+		return Awknull, nil
+	// Array functions
+	case lexer.Copyarr:
+		if len(args) != 2 {
+			return Awknull, inter.runtimeError(called, "incorrect number of arguments")
+		}
+		dstid, isdstid := args[0].(*parser.IdExpr)
+		srcid, issrcid := args[1].(*parser.IdExpr)
+		if !isdstid || !issrcid {
+			return Awknull, inter.runtimeError(called, "expected array")
+		}
+		dst, err := inter.getArrayVariable(dstid)
+		if err != nil {
+			return Awknull, err
+		}
+		src, err := inter.getArrayVariable(srcid)
+		if err != nil {
+			return Awknull, err
+		}
+		// The elements are copied before clearing dst, which could be the
+		// same array as src
+		elems := copyArray(src.Array)
+		clearArray(dst.Array)
+		for k, v := range elems {
+			dst.Array[k] = v
+		}
+		return Awknumber(float64(len(dst.Array))), nil
 	}
 	return Awknull, nil
 }
@@ -416,163 +617,171 @@ func (inter *interpreter) evalCall(ce *parser.CallExpr) (Awkvalue, error) {
 	}
 }
 
-func system(cmdstr string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
-	cmd := exec.Command("sh", "-c", cmdstr)
+func system(cmd *exec.Cmd, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
 	cmd.Stdin = stdin
 	cmd.Stdout = stdout
 	cmd.Stderr = stderr
-	if err := cmd.Run(); err != nil {
-		if exitError, ok := err.(*exec.ExitError); ok {
-			return exitError.ExitCode()
-		}
-		return -1
+	return exitStatus(cmd.Run())
+}
+
+// A classified field separator
+type separator struct {
+	fs   string
+	kind parser.FsKind
+	re   *regexp.Regexp // Only for FsRegex
+}
+
+func newSeparator(fs string, re *regexp.Regexp) separator {
+	if re != nil {
+		return separator{fs, parser.FsRegex, re}
 	}
-	return 0
+	return separator{fs, parser.ClassifyFs(fs), nil}
 }
 
-func (inter *interpreter) computeFmtConversions(printtok lexer.Token, s string) (convs []func(Awkvalue) interface{}, err error) {
-	if stored, ok := inter.fprintfcache[s]; ok {
-		return stored, nil
+// Like newSeparator, but if IGNORECASE is set the separator ignores case.
+// A literal separator longer than a character becomes a regex to do so.
+func (inter *interpreter) foldSeparator(fs string, re *regexp.Regexp) separator {
+	if inter.ignorecase {
+		if re != nil {
+			re = foldRegex(re)
+		} else if utf8.RuneCountInString(fs) > 1 {
+			re = regexp.MustCompile("(?i)" + regexp.QuoteMeta(fs))
+		}
 	}
+	return newSeparator(fs, re)
+}
 
-	tostring := func(v Awkvalue) interface{} {
-		return inter.toString(v)
+// Returns the field separator given by the expression e (FS if e is nil).
+// FS is classified when it is assigned.
+func (inter *interpreter) fieldSeparator(e parser.Expr) (separator, error) {
+	if e == nil {
+		return inter.fields.sep, nil
 	}
-	tochar := func(v Awkvalue) interface{} {
-		s := inter.toString(v)
-		if len(s) == 0 {
-			return '\000'
-		}
-		return s[0]
+	if rexpr, ok := e.(*parser.RegexExpr); ok {
+		re, err := inter.evalRegex(rexpr)
+		return newSeparator(rexpr.Regex.Lexeme, re), err
 	}
-	tofloat := func(v Awkvalue) interface{} {
-		return v.Float()
+	vfs, err := inter.eval(e)
+	if err != nil {
+		return separator{}, err
 	}
-	toint := func(v Awkvalue) interface{} {
-		return int(v.Float())
+	fs := inter.toString(vfs)
+	if parser.ClassifyFs(fs) != parser.FsRegex {
+		return inter.foldSeparator(fs, nil), nil
 	}
+	re, err := inter.evalRegexFromString(e.Token(), fs)
+	return newSeparator(fs, re), err
+}
 
-	for i := 0; i < len(s); i++ {
-		if s[i] != '%' {
-			continue
-		}
-		i++
-		if i < len(s) && s[i] == '%' {
-			continue
-		}
-		// Flags
-		for i < len(s) && strings.Contains("+-# 0", s[i:i+1]) {
-			i++
-		}
-		if i < len(s) && s[i] == '*' {
-			convs = append(convs, toint)
-			i++
-		}
+func (inter *interpreter) split(s string, e parser.Expr) ([]string, error) {
+	return inter.appendSplit(nil, s, e)
+}
 
-		// Field width
-		for i < len(s) && s[i] >= '0' && s[i] <= '9' {
-			i++
-		}
+// Like split, but appends the fields to dst, so that its backing array can
+// be reused from one record to the next
+func (inter *interpreter) appendSplit(dst []string, s string, e parser.Expr) ([]string, error) {
+	if e == nil {
+		return inter.fields.split(dst, s), nil
+	}
+	sep, err := inter.fieldSeparator(e)
+	if err != nil {
+		return nil, err
+	}
+	return appendSplitFs(dst, s, sep), nil
+}
 
-		// Precision
-		if s[i] == '*' {
-			convs = append(convs, toint)
-		} else if i < len(s) && s[i] == '.' {
-			i++
-			for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+// Splits a string using a field separator, appending the fields to dst
+func appendSplitFs(dst []string, s string, sep separator) []string {
+	fs := sep.fs
+	if len(s) == 0 {
+		return dst
+	} else if sep.kind == parser.FsRegex {
+		return append(dst, sep.re.Split(s, -1)...)
+	} else if sep.kind == parser.FsBlanks {
+		// Blanks are ASCII, so they can be looked for byte by byte
+		for i := 0; i < len(s); {
+			for i < len(s) && isFieldBlank(rune(s[i])) {
 				i++
 			}
+			start := i
+			for i < len(s) && !isFieldBlank(rune(s[i])) {
+				i++
+			}
+			if i > start {
+				dst = append(dst, s[start:i])
+			}
 		}
-
-		if i >= len(s) {
-			return nil, inter.runtimeError(printtok, "expected format type at end of string")
-		}
-
-		// Conversion specifier characters
-		switch s[i] {
-		case 'a', 'A', 'f', 'F', 'e', 'E', 'g', 'G':
-			convs = append(convs, tofloat)
-		case 'd', 'i', 'o', 'u', 'x', 'X':
-			convs = append(convs, toint)
-		case 'c':
-			convs = append(convs, tochar)
-		case 's':
-			convs = append(convs, tostring)
-		default:
-			return nil, inter.runtimeError(printtok, fmt.Sprintf("unknown format %c in string %q", s[i], s))
+		return dst
+	} else if fs == "" {
+		// Every character is a field
+		return append(dst, strings.Split(s, "")...)
+	} else {
+		for {
+			i := strings.Index(s, fs)
+			if i < 0 {
+				return append(dst, s)
+			}
+			dst = append(dst, s[:i])
+			s = s[i+len(fs):]
 		}
 	}
-	if len(inter.fprintfcache) < 100 {
-		inter.fprintfcache[s] = convs
-	}
-	return convs, nil
 }
 
-func (inter *interpreter) fprintf(w io.Writer, print lexer.Token, exprs []parser.Expr) error {
-	format, err := inter.eval(exprs[0])
-	if err != nil {
-		return err
-	}
-	formatstr := inter.toString(format)
-	convs, err := inter.computeFmtConversions(print, formatstr)
-	if err != nil {
-		return err
-	}
-	if len(convs) > len(exprs[1:]) {
-		return inter.runtimeError(print, "run out of arguments for formatted output")
-	}
-	args := make([]interface{}, 0, len(convs))
-	for _, expr := range exprs[1:] {
-		arg, err := inter.eval(expr)
-		if err != nil {
-			return err
-		}
-		if arg.Typ == Array {
-			return inter.runtimeError(print, "cannot print array")
-		}
-		args = append(args, convs[0](arg))
-		convs = convs[1:]
-		if len(convs) == 0 {
-			break
-		}
-	}
-	fmt.Fprintf(w, formatstr, args...)
-	return nil
+// Characters separating fields when FS is a single space
+func isFieldBlank(r rune) bool {
+	return r == ' ' || r == '\t' || r == '\n'
 }
 
-func (inter *interpreter) split(s string, e parser.Expr) ([]string, error) {
-	fs := inter.getFs()
-	if e != nil {
-		if rexpr, ok := e.(*parser.RegexExpr); ok {
-			re, err := inter.evalRegex(rexpr)
-			if err != nil {
-				return nil, err
+// Like appendSplitFs, but also returns the separators: seps[i] is the
+// separator between fields i and i+1. With the default field separator,
+// leading and trailing blanks are stored in seps[0] and seps[n].
+func splitFsSeps(s string, sep separator) ([]string, map[int]string) {
+	var fields []string
+	seps := map[int]string{}
+	fs, re := sep.fs, sep.re
+	if len(s) == 0 {
+		return nil, seps
+	} else if sep.kind == parser.FsRegex {
+		// Same as regexp.Split
+		beg, end := 0, 0
+		for _, match := range re.FindAllStringIndex(s, -1) {
+			end = match[0]
+			if match[1] != 0 {
+				fields = append(fields, s[beg:end])
+				seps[len(fields)] = s[end:match[1]]
+			}
+			beg = match[1]
+		}
+		if end != len(s) {
+			fields = append(fields, s[beg:])
+		}
+	} else if sep.kind == parser.FsBlanks {
+		start, sepstart := -1, 0
+		for i, r := range s {
+			if isFieldBlank(r) {
+				if start >= 0 {
+					fields = append(fields, s[start:i])
+					start, sepstart = -1, i
+				}
+			} else if start < 0 {
+				if i > sepstart {
+					seps[len(fields)] = s[sepstart:i]
+				}
+				start = i
 			}
-			return re.Split(s, -1), nil
 		}
-		vfs, err := inter.eval(e)
-		if err != nil {
-			return nil, err
+		if start >= 0 {
+			fields = append(fields, s[start:])
+		} else {
+			seps[len(fields)] = s[sepstart:]
 		}
-		fs = inter.toString(vfs)
-	}
-	if len(s) == 0 {
-		return nil, nil
-	} else if fs == " " {
-		return strings.Fields(s), nil
-	} else if len(fs) <= 1 {
-		return strings.Split(s, fs), nil
 	} else {
-		re := inter.fsregex
-		if e != nil {
-			var err error
-			re, err = inter.evalRegexFromString(e.Token(), fs)
-			if err != nil {
-				return nil, err
-			}
+		fields = strings.Split(s, fs)
+		for i := 1; i < len(fields); i++ {
+			seps[i] = fs
 		}
-		return re.Split(s, -1), nil
 	}
+	return fields, seps
 }
 
 func generalsub(inter *interpreter, called lexer.Token, args []parser.Expr, global bool) (Awkvalue, error) {
@@ -0,0 +1,83 @@
+/*
+ * Copyright (C) 2021 Andrea Fiori <andrea.fiori.1998@gmail.com>
+ *
+ * Licensed under GPLv2, see file LICENSE in this source tree.
+ */
+
+package interpreter
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+
+	"github.com/fioriandrea/aawk/parser"
+)
+
+// A single run of a compiled program. Global and built-in variables can be
+// read and set both before and after the run, for example to pass values
+// to the program or to collect the counters it accumulated in END.
+type Interp struct {
+	inter interpreter
+	ran   bool
+}
+
+func NewInterp(params RunParams) *Interp {
+	it := &Interp{}
+	it.inter.initialize(params)
+	return it
+}
+
+// Runs the program. Like Exec, the result contains an ErrorExit if the
+// program terminated without errors. An Interp can be run only once.
+func (it *Interp) Run() (errs []error) {
+	if it.ran {
+		return []error{errors.New("program already run")}
+	}
+	it.ran = true
+	if it.inter.initerr != nil {
+		return []error{it.inter.initerr}
+	}
+	defer recoverInternalError(&errs)
+	errs = make([]error, 0)
+	// Files and commands are closed even after an internal error
+	defer func() {
+		errs = append(errs, it.inter.cleanup()...)
+	}()
+	err := it.inter.run()
+	if err == errBrokenPipe {
+		// The status of a process killed by SIGPIPE
+		err = ErrorExit{Status: 128 + int(syscall.SIGPIPE)}
+	}
+	if err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// Returns the value of a global or built-in variable. Variables which are
+// not used by the program do not exist.
+func (it *Interp) GetGlobal(name string) (Awkvalue, bool) {
+	if i, ok := parser.BuiltinVar(name, it.inter.posix); ok {
+		return it.inter.builtins[i], true
+	}
+	if i, ok := it.inter.items.Globalindices[name]; ok {
+		v := derefArray(&it.inter.globals[i])
+		v.ref = nil
+		return v, true
+	}
+	return Awknull, false
+}
+
+// Sets a global or built-in variable, with the same effects as an assignment
+// in the program (e.g. setting NF rebuilds $0)
+func (it *Interp) SetGlobal(name string, v Awkvalue) error {
+	if i, ok := parser.BuiltinVar(name, it.inter.posix); ok {
+		return it.inter.setBuiltin(i, v)
+	}
+	if i, ok := it.inter.items.Globalindices[name]; ok {
+		it.inter.globals[i] = v
+		return nil
+	}
+	return fmt.Errorf("no global variable named %s", name)
+}
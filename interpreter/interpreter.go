@@ -16,21 +16,78 @@ import (
 	"os"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/fioriandrea/aawk/lexer"
 	"github.com/fioriandrea/aawk/parser"
+	"golang.org/x/text/collate"
 )
 
 type CommandLine struct {
-	Fs             string
-	Preassignments []string
-	Program        io.Reader
-	Programname    string
-	Arguments      []string
-	Natives        map[string]NativeFunction
-	Stdin          io.Reader
-	Stdout         io.Writer
-	Stderr         io.Writer
+	Fs                string
+	Preassignments    []string
+	Program           io.Reader
+	ProgramFiles      []parser.ProgramFile // Read in place of Program if not empty
+	Programname       string               // Prefixes the diagnostics, "aawk" if empty, and is ARGV[0]
+	Arguments         []string
+	NoAssignOperands  bool // Operands of the form var=value are file names
+	Natives           map[string]NativeFunction
+	FieldNatives      map[string]FieldNativeFunction // Natives with access to the fields, their names must differ from the ones in Natives
+	Stdin             io.Reader
+	Stdout            io.Writer
+	Stderr            io.Writer
+	Compat            bool // Accept calls with more arguments than parameters
+	Posix             bool
+	DeterministicRand bool
+	PrintfOrs         bool
+	LazyElements      bool   // Referring to a missing array element as a value does not create it
+	Crlf              bool   // Lines written to Stdout and to files end with "\r\n", see crlfWriter
+	StripBom          bool   // A UTF-8 byte order mark is removed from the first record of every input file
+	Encoding          string // Encoding of the files read and written, UTF-8 if empty, see encoding.go
+	Collate           string // Locale whose collation orders strings, byte order if empty, see collate.go
+	CaseLocale        string // Locale of toupper and tolower, see casing.go
+	CharactersAsBytes bool   // toupper and tolower change only ASCII letters and printf %c prints bytes
+	MaxOpenFiles      int
+	MaxCallDepth      int    // Maximum number of nested calls of user defined functions, 0 for no limit
+	CatchSignals      bool   // SIGINT and SIGTERM stop the program cleanly and SIGHUP closes the output files, see signals.go
+	EndOnSignal       bool   // Like CatchSignals, but the END actions are run when stopping
+	Shell             string // Shell running the commands, AWKSHELL, sh or cmd.exe if empty
+	DirectExec        bool   // Run commands directly, splitting them into words, instead of through the shell
+	DumpStreams       bool   // Describe the files and commands opened by redirections on Stderr at exit
+	Stats             bool   // Print the RunStats on Stderr at exit
+	Parallel          int    // Number of interpreters running the main rules at once, see parser.PlanParallel
+	Lint              bool
+	Environ           []string      // Environment of the program and of the commands it runs, nil for the one of the process
+	Records           RecordReader  // Records of the main input, instead of the files in Arguments and Stdin
+	PrintFunc         PrintFunc     // Receives the output of unredirected print statements instead of Stdout
+	Runner            CommandRunner // Runs the commands instead of Shell, see command.go
+	Files             FileOpener    // Opens the files named by the program, OSFiles if nil, FSFiles for an fs.FS
+	StatsFunc         StatsFunc     // Receives the RunStats at exit
+	BeforeRecord      RecordHook    // Called before the main rules process a record
+	AfterRecord       RecordHook    // Called after the main rules processed a record
+}
+
+// The record of the main input being processed
+type RecordInfo struct {
+	NR       int
+	FNR      int
+	Filename string
+	Record   string // $0
+}
+
+// Called by the main loop for every record. Returning false stops reading
+// input, as if it ended: the END actions are still run.
+type RecordHook func(info RecordInfo) bool
+
+// Called with the printed values and the record they form (joined by OFS,
+// without ORS). Output of printf is still written to Stdout.
+type PrintFunc func(fields []string, record string)
+
+func (cl CommandLine) programName() string {
+	if cl.Programname == "" {
+		return "aawk"
+	}
+	return cl.Programname
 }
 
 type RunParams struct {
@@ -38,6 +95,9 @@ type RunParams struct {
 	parser.CompiledProgram
 }
 
+// Returned by Exec and ExecuteCL when the program terminates without errors,
+// either by calling exit or by running to completion (in which case Status
+// is 0, unless a previous exit set it otherwise).
 type ErrorExit struct {
 	Status int
 }
@@ -46,23 +106,30 @@ func (ee ErrorExit) Error() string {
 	return "exit"
 }
 
+// Wraps the errors which prevented the program from being run, found while
+// parsing and resolving it or checking its command line. Errors returned by
+// ExecuteCL which are neither a CompileError nor an ErrorExit happened while
+// running it.
+type CompileError struct {
+	Err error
+}
+
+func (ce CompileError) Error() string {
+	return ce.Err.Error()
+}
+
+func (ce CompileError) Unwrap() error {
+	return ce.Err
+}
+
 func ExecuteCL(cl CommandLine) []error {
-	nativeNames := func(natives map[string]NativeFunction) map[string]bool {
-		names := make(map[string]bool)
-		for name := range natives {
-			names[name] = true
-		}
-		return names
-	}
-	compiled, errs := parser.ParseCl(parser.CommandLine{
-		Program:        cl.Program,
-		Fs:             cl.Fs,
-		Preassignments: cl.Preassignments,
-		Natives:        nativeNames(cl.Natives),
-	})
+	compiled, errs := CompileCL(cl)
 	if len(errs) > 0 {
 		return errs
 	}
+	for _, warning := range compiled.Warnings {
+		fmt.Fprintf(cl.Stderr, "%s: %s\n", cl.programName(), warning)
+	}
 
 	errs = Exec(RunParams{
 		CompiledProgram: compiled,
@@ -74,16 +141,88 @@ func ExecuteCL(cl CommandLine) []error {
 	return nil
 }
 
-func Exec(params RunParams) []error {
-	errs := make([]error, 0)
-	var inter interpreter
-	inter.initialize(params)
-	err := inter.run()
-	if err != nil {
-		errs = append(errs, err)
+// Parses and resolves the program of the command line without running it.
+// The errors are CompileErrors.
+func CompileCL(cl CommandLine) (compiled parser.CompiledProgram, errs []error) {
+	defer recoverInternalError(&errs)
+	defer wrapCompileErrors(&errs)
+	if err := checkCL(cl); err != nil {
+		return compiled, []error{err}
+	}
+	return parser.ParseCl(parser.CommandLine{
+		Program:        cl.Program,
+		ProgramFiles:   cl.ProgramFiles,
+		Fs:             cl.Fs,
+		Preassignments: cl.Preassignments,
+		Natives:        nativeNames(cl.Natives, cl.FieldNatives),
+		Compat:         cl.Compat,
+		Posix:          cl.Posix,
+		Lint:           cl.Lint,
+	})
+}
+
+// Reads a program written by parser.WriteProgram, in place of the program
+// of the command line, which is checked as CompileCL does. The errors are
+// CompileErrors.
+func LoadCL(cl CommandLine, r io.Reader) (compiled parser.CompiledProgram, errs []error) {
+	defer recoverInternalError(&errs)
+	defer wrapCompileErrors(&errs)
+	if err := checkCL(cl); err != nil {
+		return compiled, []error{err}
+	}
+	return parser.LoadProgram(parser.CommandLine{
+		Fs:             cl.Fs,
+		Preassignments: cl.Preassignments,
+		Natives:        nativeNames(cl.Natives, cl.FieldNatives),
+		Posix:          cl.Posix,
+	}, r)
+}
+
+func wrapCompileErrors(errs *[]error) {
+	for i, err := range *errs {
+		(*errs)[i] = CompileError{err}
+	}
+}
+
+// Checks the options of the command line which do not concern the program
+func checkCL(cl CommandLine) error {
+	if _, err := lookupCharset(cl.Encoding); err != nil {
+		return err
+	}
+	if _, err := newCollator(cl.Collate); err != nil {
+		return err
+	}
+	if _, err := newCasing(cl.CaseLocale, cl.CharactersAsBytes, cl.Posix); err != nil {
+		return err
+	}
+	return nil
+}
+
+func nativeNames(natives map[string]NativeFunction, fieldnatives map[string]FieldNativeFunction) map[string]bool {
+	names := make(map[string]bool)
+	for name := range natives {
+		names[name] = true
+	}
+	for name := range fieldnatives {
+		names[name] = true
+	}
+	return names
+}
+
+// Runs a compiled program. Every run has its own state, so programs can be run
+// concurrently as long as they do not share the readers and writers of their
+// command lines.
+func Exec(params RunParams) (errs []error) {
+	defer recoverInternalError(&errs)
+	return NewInterp(params).Run()
+}
+
+// Turns a panic into an error, so that a bug in aawk does not bring down the
+// program embedding it
+func recoverInternalError(errs *[]error) {
+	if r := recover(); r != nil {
+		*errs = append(*errs, fmt.Errorf("internal error: %v", r))
 	}
-	errs = append(errs, inter.cleanup()...)
-	return errs
 }
 
 type interpreter struct {
@@ -91,56 +230,105 @@ type interpreter struct {
 	items parser.ResolvedItems
 
 	// Stacks
-	ftable     []func(lexer.Token, []parser.Expr) (Awkvalue, error)
-	builtins   []Awkvalue
-	fields     []Awkvalue
-	globals    []Awkvalue
-	stack      []Awkvalue
-	stackcount int
-	locals     []Awkvalue
+	ftable    []func(lexer.Token, []parser.Expr) (Awkvalue, error)
+	builtins  []Awkvalue
+	fields    fieldbuf
+	globals   []Awkvalue
+	stack     callStack
+	locals    []Awkvalue
+	calldepth int
+	callsite  lexer.Token // Call of the function being run
+	highdepth int         // Highest calldepth reached
+	maxdepth  int
+	tailfunc  *parser.FunctionDef // Function whose frame can be reused by its tail calls
 
 	// IO
 	stdin       io.Reader
 	stdout      io.Writer
 	stderr      io.Writer
-	outprograms closableStreams
-	outfiles    closableStreams
-	inprograms  closableStreams
-	infiles     closableStreams
+	bufstdout   *bufio.Writer
+	autoflush   bool
+	writeerr    error // Write error already reported by print or printf
+	outprograms *closableStreams
+	outfiles    outputFiles
+	inprograms  *closableStreams
+	infiles     *closableStreams
 	argindex    int
-	currentFile io.ByteReader
-	stdinFile   io.ByteReader
+	fileopened  bool
+	currentFile inputReader
+	stdinFile   inputReader
+	stdintimed  *timedReader
+	records     RecordReader
+	printfunc   PrintFunc
+	beforehook  RecordHook
+	afterhook   RecordHook
 	rng         rng
+	environ     []string
+	shell       string
+	directexec  bool
+	runner      CommandRunner
+	files       FileOpener
+	exitstatus  int
 
 	// Caches
 	rangematched map[int]bool
-	fprintfcache map[string][]func(Awkvalue) interface{}
-	fsregex      *regexp.Regexp
+	fprintfcache map[string][]fmtspec
+	convfmt      string
+	ofmt         string
+	ofs          string
+	ors          string
+	subsep       string
+	ignorecase   bool
+	folded       map[*regexp.Regexp]*regexp.Regexp // Regex constants ignoring case
+	rsre         *regexp.Regexp                    // RS, if it is a regular expression
+
+	// Options
+	params      RunParams
+	programname string
+	posix       bool
+	printfors   bool
+	lazyelems   bool
+	crlf        bool
+	stripbom    bool
+	charset     *charset
+	collator    *collate.Collator
+	casing      casing
+	bytes       bool
+	initerr     error // Reported by Run
+	parallel    int
+	dumpstreams bool
+	stats       *statsState
+	signals     *signalState
 }
 
 var errNext = errors.New("next")
+var errNextfile = errors.New("nextfile")
 var errBreak = errors.New("break")
 var errContinue = errors.New("continue")
 
+// Standard output is a pipe which is no longer read
+var errBrokenPipe = errors.New("broken pipe")
+
 type errorReturn Awkvalue
 
 func (er errorReturn) Error() string {
 	return "return"
 }
 
+// The seed is kept as given to srand, so that srand can return it unchanged
 type rng struct {
 	*rand.Rand
-	rngseed int64
+	rngseed float64
 }
 
-func (r *rng) setSeed(i int64) {
-	r.rngseed = i
-	r.Seed(i)
+func (r *rng) setSeed(seed float64) {
+	r.rngseed = seed
+	r.Seed(int64(seed))
 }
 
-func newRNG(seed int64) rng {
+func newRNG(seed float64) rng {
 	return rng{
-		Rand:    rand.New(rand.NewSource(seed)),
+		Rand:    rand.New(rand.NewSource(int64(seed))),
 		rngseed: seed,
 	}
 }
@@ -161,6 +349,8 @@ func (inter *interpreter) execute(stat parser.Stat) error {
 		return inter.executeForEach(v)
 	case *parser.NextStat:
 		return errNext
+	case *parser.NextfileStat:
+		return errNextfile
 	case *parser.BreakStat:
 		return errBreak
 	case *parser.ContinueStat:
@@ -191,7 +381,8 @@ func (inter *interpreter) executeExpr(es *parser.ExprStat) error {
 }
 
 func (inter *interpreter) executePrint(ps *parser.PrintStat) error {
-	w := inter.stdout
+	var w io.Writer = inter.bufstdout
+	tostdout := true
 	if ps.File != nil {
 		file, err := inter.eval(ps.File)
 		if err != nil {
@@ -199,55 +390,133 @@ func (inter *interpreter) executePrint(ps *parser.PrintStat) error {
 		}
 		filestr := file.String(inter.getConvfmt())
 		var cl io.Closer
+		streams := inter.outfiles.streams
 		switch ps.RedirOp.Type {
 		case lexer.Pipe:
+			streams = inter.outprograms
 			cl, err = inter.outprograms.get(filestr, func(name string) (io.Closer, error) {
-				return spawnOutCommand(name, inter.stdout, inter.stderr)
+				inter.flushStdout()
+				cmd, err := inter.command(name)
+				if err != nil {
+					return nil, err
+				}
+				return spawnOutCommand(cmd, inter.stdout, inter.stderr)
 			})
 		case lexer.Greater:
-			cl, err = inter.outfiles.get(filestr, func(name string) (io.Closer, error) { return spawnOutFile(name, os.O_TRUNC) })
+			cl, err = inter.outfiles.get(filestr, os.O_TRUNC, inter.spawnOutFile)
 		case lexer.DoubleGreater:
-			cl, err = inter.outfiles.get(filestr, func(name string) (io.Closer, error) {
-				return spawnOutFile(name, os.O_APPEND)
-			})
+			cl, err = inter.outfiles.get(filestr, os.O_APPEND, inter.spawnOutFile)
 		}
 		if err != nil {
 			return inter.runtimeError(ps.Token(), err.Error())
 		}
-		w = cl.(io.Writer)
+		w = streams.writer(filestr, cl)
+		tostdout = ps.RedirOp.Type != lexer.Pipe && specialFd(filestr) == 1
 	}
+	var err error
 	switch ps.Print.Type {
 	case lexer.Print:
-		return inter.executeSimplePrint(w, ps)
+		if ps.File == nil && inter.printfunc != nil {
+			err = inter.executeCapturedPrint(ps)
+		} else {
+			err = inter.executeSimplePrint(w, ps)
+		}
 	case lexer.Printf:
-		return inter.executePrintf(w, ps)
+		err = inter.executePrintf(w, ps)
 	}
-	return nil
+	if err == nil && inter.autoflush {
+		if ferr := inter.bufstdout.Flush(); ferr != nil {
+			err = writeError{ferr}
+		}
+	}
+	if we, ok := err.(writeError); ok {
+		return inter.outputFailed(ps, tostdout, we.err)
+	}
+	return err
+}
+
+// Output to a standard output whose reader went away stops the program, as
+// if it had been killed by SIGPIPE. Output to a command which stopped
+// reading is discarded. Other write errors are fatal.
+func (inter *interpreter) outputFailed(ps *parser.PrintStat, tostdout bool, err error) error {
+	if isBrokenPipe(err) {
+		if tostdout {
+			return errBrokenPipe
+		}
+		if ps.RedirOp.Type == lexer.Pipe {
+			return nil
+		}
+	}
+	// Buffered writers keep returning the error, which is not reported again
+	// when they are closed
+	inter.writeerr = err
+	return inter.runtimeError(ps.Token(), err.Error())
 }
 
 func (inter *interpreter) executeSimplePrint(w io.Writer, ps *parser.PrintStat) error {
+	var s string
 	if ps.Exprs == nil {
-		fmt.Fprint(w, inter.toString(inter.getField(0)))
+		s = inter.toString(inter.getField(0))
 	} else {
-		buff := make([]string, 0, 10)
-		for _, expr := range ps.Exprs {
-			v, err := inter.eval(expr)
-			if err != nil {
-				return err
-			}
-			if v.Typ == Array {
-				return inter.runtimeError(ps.Token(), "cannot print array")
-			}
-			buff = append(buff, v.String(inter.getOfmt()))
+		buff, err := inter.printValues(ps)
+		if err != nil {
+			return err
+		}
+		s = strings.Join(buff, inter.getOfs())
+	}
+	if _, err := io.WriteString(w, s); err != nil {
+		return writeError{err}
+	}
+	if _, err := io.WriteString(w, inter.getOrs()); err != nil {
+		return writeError{err}
+	}
+	return nil
+}
+
+// Delivers the output of print to the callback of the embedder. Without
+// expressions, the fields are the ones of $0.
+func (inter *interpreter) executeCapturedPrint(ps *parser.PrintStat) error {
+	if ps.Exprs == nil {
+		nf := int(inter.toNumber(inter.builtins[parser.Nf]))
+		fields := make([]string, 0, nf)
+		for i := 1; i <= nf; i++ {
+			fields = append(fields, inter.toString(inter.getField(i)))
 		}
-		fmt.Fprint(w, strings.Join(buff, inter.toString(inter.builtins[parser.Ofs])))
+		inter.printfunc(fields, inter.toString(inter.getField(0)))
+		return nil
+	}
+	fields, err := inter.printValues(ps)
+	if err != nil {
+		return err
 	}
-	fmt.Fprint(w, inter.toString(inter.builtins[parser.Ors]))
+	inter.printfunc(fields, strings.Join(fields, inter.getOfs()))
 	return nil
 }
 
+// Returns the expressions of a print statement converted to strings
+func (inter *interpreter) printValues(ps *parser.PrintStat) ([]string, error) {
+	buff := make([]string, 0, len(ps.Exprs))
+	for _, expr := range ps.Exprs {
+		v, err := inter.eval(expr)
+		if err != nil {
+			return nil, err
+		}
+		if v.Typ == Array {
+			return nil, inter.runtimeError(ps.Token(), "cannot print array")
+		}
+		buff = append(buff, v.String(inter.getOfmt()))
+	}
+	return buff, nil
+}
+
 func (inter *interpreter) executePrintf(w io.Writer, ps *parser.PrintStat) error {
-	return inter.fprintf(w, ps.Print, ps.Exprs)
+	err := inter.fprintf(w, ps.Print, ps.Exprs)
+	if err == nil && inter.printfors {
+		if _, err := io.WriteString(w, inter.getOrs()); err != nil {
+			return writeError{err}
+		}
+	}
+	return err
 }
 
 func (inter *interpreter) executeIf(ifs *parser.IfStat) error {
@@ -268,6 +537,9 @@ func (inter *interpreter) executeFor(fs *parser.ForStat) error {
 		return err
 	}
 	for {
+		if err := inter.checkSignals(); err != nil {
+			return err
+		}
 		cond, err := inter.eval(fs.Cond)
 		if err != nil {
 			return err
@@ -290,11 +562,27 @@ func (inter *interpreter) executeFor(fs *parser.ForStat) error {
 }
 
 func (inter *interpreter) executeForEach(fes *parser.ForEachStat) error {
-	arr, err := inter.getArrayVariable(fes.Array)
+	arr, err := inter.getArray(fes.Array)
 	if err != nil {
 		return err
 	}
+	keys := make([]string, 0, len(arr.Array))
 	for k := range arr.Array {
+		keys = append(keys, k)
+	}
+	if err := inter.sortKeys(fes.Token(), keys, arr.Array); err != nil {
+		return err
+	}
+	// Keys are collected before iterating, so elements added by the body
+	// are not visited, whereas elements deleted before being visited are
+	// skipped
+	for _, k := range keys {
+		if err := inter.checkSignals(); err != nil {
+			return err
+		}
+		if _, ok := arr.Array[k]; !ok {
+			continue
+		}
 		_, err := inter.evalAssignToLhs(fes.Id, Awknormalstring(k))
 		if err != nil {
 			return err
@@ -310,6 +598,9 @@ func (inter *interpreter) executeForEach(fes *parser.ForEachStat) error {
 }
 
 func (inter *interpreter) executeReturn(rs *parser.ReturnStat) error {
+	if call, ok := rs.ReturnVal.(*parser.CallExpr); ok && inter.tailfunc != nil && call.Called.Id.Lexeme == inter.tailfunc.Name.Lexeme {
+		return inter.tailCall(call)
+	}
 	v, err := inter.eval(rs.ReturnVal)
 	if err != nil {
 		return err
@@ -318,19 +609,23 @@ func (inter *interpreter) executeReturn(rs *parser.ReturnStat) error {
 }
 
 func (inter *interpreter) executeExit(es *parser.ExitStat) error {
-	v, err := inter.eval(es.Status)
-	if err != nil {
-		return err
+	// exit without an expression keeps the status of a previous exit
+	if es.Status != nil {
+		v, err := inter.eval(es.Status)
+		if err != nil {
+			return err
+		}
+		inter.exitstatus = int(inter.toNumber(v))
 	}
 	return ErrorExit{
-		Status: int(v.Float()),
+		Status: inter.exitstatus,
 	}
 }
 
 func (inter *interpreter) executeDelete(ds *parser.DeleteStat) error {
 	switch lhs := ds.Lhs.(type) {
 	case *parser.IndexingExpr:
-		v, err := inter.getArrayVariable(lhs.Id)
+		v, err := inter.getIndexedArray(lhs)
 		if err != nil {
 			return err
 		}
@@ -341,11 +636,12 @@ func (inter *interpreter) executeDelete(ds *parser.DeleteStat) error {
 		delete(v.Array, inter.toString(ind))
 		return nil
 	case *parser.IdExpr:
-		_, err := inter.getArrayVariable(lhs)
+		v, err := inter.getArrayVariable(lhs)
 		if err != nil {
 			return err
 		}
-		return inter.setVariableArrayAllowed(lhs, Awkarray(map[string]Awkvalue{}))
+		clearArray(v.Array)
+		return nil
 	}
 	return nil
 }
@@ -389,13 +685,20 @@ func (inter *interpreter) eval(expr parser.Expr) (Awkvalue, error) {
 }
 
 func (inter *interpreter) evalArrayAllowed(expr parser.Expr) (Awkvalue, error) {
-	if id, ok := expr.(*parser.IdExpr); ok {
-		return inter.getVariable(id), nil
+	switch v := expr.(type) {
+	case *parser.IdExpr:
+		return inter.getVariable(v), nil
+	case *parser.IndexingExpr:
+		val, _, err := inter.evalIndexing(v)
+		return val, err
 	}
 	return inter.eval(expr)
 }
 
 func (inter *interpreter) evalBinary(b *parser.BinaryExpr) (Awkvalue, error) {
+	if b.Op.Type == lexer.Concat {
+		return inter.evalConcat(b)
+	}
 	left, err := inter.eval(b.Left)
 	if err != nil {
 		return Awknull, err
@@ -407,26 +710,63 @@ func (inter *interpreter) evalBinary(b *parser.BinaryExpr) (Awkvalue, error) {
 	return inter.computeBinary(left, b.Op, right)
 }
 
+// A chain of concatenations such as a b c is built as a single string,
+// without the intermediate a b
+func (inter *interpreter) evalConcat(b *parser.BinaryExpr) (Awkvalue, error) {
+	var buf [8]string
+	parts, err := inter.concatOperands(buf[:0], b)
+	if err != nil {
+		return Awknull, err
+	}
+	n := 0
+	for _, part := range parts {
+		n += len(part)
+	}
+	var sb strings.Builder
+	sb.Grow(n)
+	for _, part := range parts {
+		sb.WriteString(part)
+	}
+	return Awknormalstring(sb.String()), nil
+}
+
+// Appends the operands of a chain of concatenations to dst, from left to
+// right
+func (inter *interpreter) concatOperands(dst []string, e parser.Expr) ([]string, error) {
+	if b, ok := e.(*parser.BinaryExpr); ok && b.Op.Type == lexer.Concat {
+		dst, err := inter.concatOperands(dst, b.Left)
+		if err != nil {
+			return nil, err
+		}
+		return inter.concatOperands(dst, b.Right)
+	}
+	v, err := inter.eval(e)
+	if err != nil {
+		return nil, err
+	}
+	return append(dst, inter.toString(v)), nil
+}
+
 func (inter *interpreter) computeBinary(left Awkvalue, op lexer.Token, right Awkvalue) (Awkvalue, error) {
 	switch op.Type {
 	case lexer.Plus:
-		return Awknumber(left.Float() + right.Float()), nil
+		return Awknumber(inter.toNumber(left) + inter.toNumber(right)), nil
 	case lexer.Minus:
-		return Awknumber(left.Float() - right.Float()), nil
+		return Awknumber(inter.toNumber(left) - inter.toNumber(right)), nil
 	case lexer.Star:
-		return Awknumber(left.Float() * right.Float()), nil
+		return Awknumber(inter.toNumber(left) * inter.toNumber(right)), nil
 	case lexer.Slash:
-		if right.Float() == 0 {
+		if inter.toNumber(right) == 0 {
 			return Awknull, inter.runtimeError(op, "attempt to divide by 0")
 		}
-		return Awknumber(left.Float() / right.Float()), nil
+		return Awknumber(inter.toNumber(left) / inter.toNumber(right)), nil
 	case lexer.Percent:
-		if right.Float() == 0 {
+		if inter.toNumber(right) == 0 {
 			return Awknull, inter.runtimeError(op, "attempt to divide by 0")
 		}
-		return Awknumber(math.Mod(left.Float(), right.Float())), nil
+		return Awknumber(math.Mod(inter.toNumber(left), inter.toNumber(right))), nil
 	case lexer.Caret:
-		return Awknumber(math.Pow(left.Float(), right.Float())), nil
+		return Awknumber(math.Pow(inter.toNumber(left), inter.toNumber(right))), nil
 	case lexer.Concat:
 		return Awknormalstring(inter.toString(left) + inter.toString(right)), nil
 	case lexer.Equal:
@@ -492,10 +832,13 @@ func (inter *interpreter) evalDollar(de *parser.DollarExpr) (Awkvalue, Awkvalue,
 	if err != nil {
 		return Awknull, Awknull, err
 	}
-	return inter.getField(int(ind.Float())), ind, nil
+	return inter.getField(int(inter.toNumber(ind))), ind, nil
 }
 
-// In case of error, always fail silently and return -1 (this is what other implementation do)
+// Errors opening or reading a file or a command, including a command killed
+// while its output is read, make getline return -1 and set ERRNO, as in
+// other implementations. This includes operands of the main input which
+// cannot be read.
 func (inter *interpreter) evalGetline(gl *parser.GetlineExpr) (Awkvalue, error) {
 	var err error
 	var filestr string
@@ -513,26 +856,32 @@ func (inter *interpreter) evalGetline(gl *parser.GetlineExpr) (Awkvalue, error)
 	switch gl.Op.Type {
 	case lexer.Pipe:
 		cl, err := inter.inprograms.get(filestr, func(name string) (io.Closer, error) {
-			return spawnInCommand(name, inter.stdin, inter.stderr)
+			inter.flushStdout()
+			cmd, err := inter.command(name)
+			if err != nil {
+				return nil, err
+			}
+			ic, err := spawnInCommand(cmd, inter.stdin, inter.stderr, inter.readTimeout(name), inter.interruptChan())
+			if err != nil {
+				return nil, err
+			}
+			return ic, nil
 		})
 		if err != nil {
+			inter.setErrno(err)
 			return Awknumber(-1), nil
 		}
 		fetchRecord = func() (string, error) {
-			return inter.nextRecord(cl.(io.ByteReader))
+			return inter.nextRecord(inter.inprograms.reader(filestr, cl))
 		}
+	case lexer.Less:
+		cl, err := inter.infiles.get(filestr, inter.spawnInFile)
 		if err != nil {
+			inter.setErrno(err)
 			return Awknumber(-1), nil
 		}
-	case lexer.Less:
-		cl, err := inter.infiles.get(filestr, func(name string) (io.Closer, error) {
-			return spawnInFile(name)
-		})
 		fetchRecord = func() (string, error) {
-			return inter.nextRecord(cl.(io.ByteReader))
-		}
-		if err != nil {
-			return Awknumber(-1), nil
+			return inter.nextRecord(inter.infiles.reader(filestr, cl))
 		}
 	default:
 		fetchRecord = inter.nextRecordCurrentFile
@@ -540,6 +889,9 @@ func (inter *interpreter) evalGetline(gl *parser.GetlineExpr) (Awkvalue, error)
 
 	var record string
 	record, err = fetchRecord()
+	if err == errInterrupted {
+		return Awknull, err
+	}
 
 	// Handle return value
 	retval := Awknumber(0)
@@ -549,10 +901,18 @@ func (inter *interpreter) evalGetline(gl *parser.GetlineExpr) (Awkvalue, error)
 		retval.N = 0
 	} else {
 		retval.N = -1
+		inter.setErrno(err)
+	}
+
+	// As POSIX requires, reading from a command counts the record in NR
+	// but not in FNR, and reading from a file counts it in neither. The
+	// main input counts it in both, see nextRecordCurrentFile.
+	if gl.Op.Type == lexer.Pipe && retval.N > 0 {
+		inter.builtins[parser.Nr] = Awknumber(inter.toNumber(inter.builtins[parser.Nr]) + 1)
 	}
 
 	// Handle variable assignment
-	recstr := Awknumericstring(record)
+	recstr := inter.numericString(record)
 	if gl.Variable != nil && retval.N > 0 {
 		_, err := inter.evalAssignToLhs(gl.Variable, recstr)
 		if err != nil {
@@ -577,11 +937,14 @@ func (inter *interpreter) evalIn(ine *parser.InExpr) (Awkvalue, error) {
 	if err != nil {
 		return Awknull, err
 	}
-	v, err := inter.getArrayVariable(ine.Right)
-	if err != nil {
+	str := inter.toString(elem)
+	var v Awkvalue
+	if id, ok := ine.Right.(*parser.IdExpr); ok && isProcinfo(id) {
+		inter.refreshProcinfoElement(str)
+		v = inter.builtins[parser.Procinfo]
+	} else if v, err = inter.getArray(ine.Right); err != nil {
 		return Awknull, err
 	}
-	str := inter.toString(elem)
 	_, ok := v.Array[str]
 	if ok {
 		return Awknumber(1), nil
@@ -590,30 +953,27 @@ func (inter *interpreter) evalIn(ine *parser.InExpr) (Awkvalue, error) {
 	}
 }
 
+// A regex used as a value is matched against $0
 func (inter *interpreter) evalRegexExpr(re *parser.RegexExpr) (Awkvalue, error) {
-	expr := &parser.MatchExpr{
-		Left: &parser.DollarExpr{
-			Dollar: lexer.Token{
-				Lexeme: "$",
-				Type:   lexer.Dollar,
-				Line:   re.Regex.Line,
-			},
-			Field: &parser.NumberExpr{
-				Num: lexer.Token{
-					Lexeme: "0",
-					Type:   lexer.Number,
-					Line:   re.Regex.Line,
-				},
-			},
-		},
-		Op: lexer.Token{
-			Lexeme: "~",
-			Type:   lexer.Tilde,
-			Line:   re.Regex.Line,
-		},
-		Right: re,
-	}
-	return inter.evalMatchExpr(expr)
+	if inter.matchRegexExpr(re, inter.toString(inter.getField(0))) {
+		return Awknumber(1), nil
+	}
+	return Awknumber(0), nil
+}
+
+// Matches a regex constant, looking for its required literal first
+func (inter *interpreter) matchRegexExpr(re *parser.RegexExpr, s string) bool {
+	if inter.ignorecase {
+		return inter.foldCase(re.Compiled).MatchString(s)
+	}
+	if re.Literal != "" {
+		if !strings.Contains(s, re.Literal) {
+			return false
+		} else if re.IsLiteral {
+			return true
+		}
+	}
+	return re.Compiled.MatchString(s)
 }
 
 func (inter *interpreter) evalMatchExpr(me *parser.MatchExpr) (Awkvalue, error) {
@@ -621,11 +981,16 @@ func (inter *interpreter) evalMatchExpr(me *parser.MatchExpr) (Awkvalue, error)
 	if err != nil {
 		return Awknull, err
 	}
-	rightre, err := inter.evalRegex(me.Right)
-	if err != nil {
-		return Awknull, err
+	var res bool
+	if re, ok := me.Right.(*parser.RegexExpr); ok {
+		res = inter.matchRegexExpr(re, inter.toString(left))
+	} else {
+		rightre, err := inter.evalRegex(me.Right)
+		if err != nil {
+			return Awknull, err
+		}
+		res = rightre.MatchString(inter.toString(left))
 	}
-	res := rightre.MatchString(inter.toString(left))
 	if me.Op.Type == lexer.NotTilde {
 		res = !res
 	}
@@ -639,7 +1004,7 @@ func (inter *interpreter) evalMatchExpr(me *parser.MatchExpr) (Awkvalue, error)
 func (inter *interpreter) evalRegex(e parser.Expr) (*regexp.Regexp, error) {
 	switch v := e.(type) {
 	case *parser.RegexExpr:
-		return v.Compiled, nil
+		return inter.foldCase(v.Compiled), nil
 	default:
 		rev, err := inter.eval(e)
 		if err != nil {
@@ -650,13 +1015,33 @@ func (inter *interpreter) evalRegex(e parser.Expr) (*regexp.Regexp, error) {
 }
 
 func (inter *interpreter) evalRegexFromString(retok lexer.Token, str string) (*regexp.Regexp, error) {
-	res, err := regexp.Compile(str)
+	res, err := lexer.CompileRegex(str)
 	if err != nil {
 		return nil, inter.runtimeError(retok, fmt.Sprint(err))
 	}
+	if inter.ignorecase {
+		res = foldRegex(res)
+	}
 	return res, nil
 }
 
+// Returns re, or the same regex ignoring case if IGNORECASE is set
+func (inter *interpreter) foldCase(re *regexp.Regexp) *regexp.Regexp {
+	if !inter.ignorecase {
+		return re
+	}
+	folded, ok := inter.folded[re]
+	if !ok {
+		folded = foldRegex(re)
+		inter.folded[re] = folded
+	}
+	return folded
+}
+
+func foldRegex(re *regexp.Regexp) *regexp.Regexp {
+	return regexp.MustCompile("(?i)" + re.String())
+}
+
 func (inter *interpreter) evalAnd(bb *parser.BinaryBoolExpr) (Awkvalue, error) {
 	left, err := inter.eval(bb.Left)
 	if err != nil {
@@ -696,28 +1081,24 @@ func (inter *interpreter) evalOr(bb *parser.BinaryBoolExpr) (Awkvalue, error) {
 }
 
 func (inter *interpreter) compareValues(left, right Awkvalue) float64 {
-	nusl := left.Typ == Numericstring
-	nusr := right.Typ == Numericstring
-
 	nosl := left.Typ == Normalstring
 	nosr := right.Typ == Normalstring
 
 	/* Comparisons (with the '<', "<=", "!=", "==", '>', and ">=" operators)
 	shall be made numerically if both operands are numeric, if one is
 	numeric and the other has a string value that is a numeric string, or
-	if one is numeric and the other has the uninitialized value. */
-	if nosl || nosr || (left.Typ == Null && right.Typ == Null) || (nusl && nusr) {
+	if one is numeric and the other has the uninitialized value. Two
+	numeric strings are compared numerically as well. */
+	if nosl || nosr || (left.Typ == Null && right.Typ == Null) {
 		strl := inter.toString(left)
 		strr := inter.toString(right)
-		if strl == strr {
-			return 0
-		} else if strl < strr {
-			return -1
-		} else {
-			return 1
+		if inter.ignorecase {
+			strl = strings.ToLower(strl)
+			strr = strings.ToLower(strr)
 		}
+		return float64(inter.compareStrings(strl, strr))
 	}
-	return left.Float() - right.Float()
+	return inter.toNumber(left) - inter.toNumber(right)
 }
 
 func (inter *interpreter) evalUnary(u *parser.UnaryExpr) (Awkvalue, error) {
@@ -728,9 +1109,9 @@ func (inter *interpreter) evalUnary(u *parser.UnaryExpr) (Awkvalue, error) {
 	res := Awknumber(0)
 	switch u.Op.Type {
 	case lexer.Minus:
-		res.N = -right.Float()
+		res.N = -inter.toNumber(right)
 	case lexer.Plus:
-		res.N = right.Float()
+		res.N = inter.toNumber(right)
 	case lexer.Not:
 		if right.Bool() {
 			res = Awknumber(0)
@@ -755,7 +1136,7 @@ func (inter *interpreter) evalAssignToLhs(lhs parser.LhsExpr, val Awkvalue) (Awk
 }
 
 func (inter *interpreter) evalSpecialAssignToLhs(lhs parser.LhsExpr, op lexer.Token, val Awkvalue) (Awkvalue, error) {
-	vlhs, index, err := inter.evalLhs(lhs)
+	vlhs, loc, err := inter.evalLhs(lhs)
 	if err != nil {
 		return Awknull, err
 	}
@@ -782,7 +1163,7 @@ func (inter *interpreter) evalSpecialAssignToLhs(lhs parser.LhsExpr, op lexer.To
 		val = vbin
 	}
 
-	return inter.evalAssignToLhsIndex(lhs, index, val)
+	return inter.evalAssignToLocation(lhs, loc, val)
 }
 
 func (inter *interpreter) evalPreIncrement(pr *parser.PreIncrementExpr) (Awkvalue, error) {
@@ -801,25 +1182,37 @@ func (inter *interpreter) evalPostIncrement(po *parser.PostIncrementExpr) (Awkva
 	return val, nil
 }
 
-func (inter *interpreter) evalLhs(lhs parser.LhsExpr) (Awkvalue, Awkvalue, error) {
+// Where the value of an lvalue is stored, so that it can be assigned
+// without evaluating its subscripts again
+type location struct {
+	index Awkvalue            // Field number or array subscript
+	array map[string]Awkvalue // Array holding the element
+}
+
+func (inter *interpreter) evalLhs(lhs parser.LhsExpr) (Awkvalue, location, error) {
 	switch l := lhs.(type) {
 	case *parser.IdExpr:
 		v, err := inter.evalId(l)
-		return v, Awknull, err
+		return v, location{}, err
 	case *parser.DollarExpr:
-		return inter.evalDollar(l)
+		v, index, err := inter.evalDollar(l)
+		return v, location{index: index}, err
 	case *parser.IndexingExpr:
-		return inter.evalIndexing(l)
+		v, loc, err := inter.evalIndexing(l)
+		if err == nil && v.Typ == Array {
+			err = inter.runtimeError(l.Token(), fmt.Sprintf("cannot use subarray of %s in scalar context%s", l.Id.Id.Lexeme, inter.arrayUse(v)))
+		}
+		return v, loc, err
 	}
-	return Awknull, Awknull, nil
+	return Awknull, location{}, nil
 }
 
 func (inter *interpreter) evalIncrement(inc *parser.IncrementExpr) (Awkvalue, Awkvalue, error) {
-	varval, index, err := inter.evalLhs(inc.Lhs)
+	varval, loc, err := inter.evalLhs(inc.Lhs)
 	if err != nil {
 		return Awknull, Awknull, err
 	}
-	val := Awknumber(varval.Float())
+	val := Awknumber(inter.toNumber(varval))
 	ival := Awknumber(0)
 	switch inc.Op.Type {
 	case lexer.Increment:
@@ -827,14 +1220,14 @@ func (inter *interpreter) evalIncrement(inc *parser.IncrementExpr) (Awkvalue, Aw
 	case lexer.Decrement:
 		ival.N = val.N - 1
 	}
-	_, err = inter.evalAssignToLhsIndex(inc.Lhs, index, ival)
+	_, err = inter.evalAssignToLocation(inc.Lhs, loc, ival)
 	if err != nil {
 		return Awknull, Awknull, err
 	}
 	return val, ival, nil
 }
 
-func (inter *interpreter) evalAssignToLhsIndex(lhs parser.LhsExpr, index Awkvalue, val Awkvalue) (Awkvalue, error) {
+func (inter *interpreter) evalAssignToLocation(lhs parser.LhsExpr, loc location, val Awkvalue) (Awkvalue, error) {
 	switch left := lhs.(type) {
 	case *parser.IdExpr:
 		err := inter.setVariable(left, val)
@@ -842,13 +1235,9 @@ func (inter *interpreter) evalAssignToLhsIndex(lhs parser.LhsExpr, index Awkvalu
 			return Awknull, err
 		}
 	case *parser.DollarExpr:
-		inter.setField(int(index.Float()), val)
+		inter.setField(int(inter.toNumber(loc.index)), val)
 	case *parser.IndexingExpr:
-		arrval, err := inter.getArrayVariable(left.Id)
-		if err != nil {
-			return Awknull, err
-		}
-		arrval.Array[inter.toString(index)] = val
+		loc.array[inter.toString(loc.index)] = val
 	}
 	return val, nil
 }
@@ -868,119 +1257,175 @@ func (inter *interpreter) evalTernary(te *parser.TernaryExpr) (Awkvalue, error)
 func (inter *interpreter) evalId(i *parser.IdExpr) (Awkvalue, error) {
 	v := inter.getVariable(i)
 	if v.Typ == Array {
-		return Awknull, inter.runtimeError(i.Token(), "cannot use array in scalar context")
+		return Awknull, inter.runtimeError(i.Token(), fmt.Sprintf("cannot use array %s in scalar context%s", i.Id.Lexeme, inter.arrayUse(v)))
 	}
+	// The value, not the arrayref, is assigned or passed on
+	v.ref = nil
 	return v, nil
 }
 
-func (inter *interpreter) evalIndexing(i *parser.IndexingExpr) (Awkvalue, Awkvalue, error) {
-	v, err := inter.getArrayVariable(i.Id)
+// Evaluates an array element, which could hold a subarray
+func (inter *interpreter) evalIndexing(i *parser.IndexingExpr) (Awkvalue, location, error) {
+	v, err := inter.getIndexedArray(i)
 	if err != nil {
-		return Awknull, Awknull, err
+		return Awknull, location{}, err
 	}
 	index, err := inter.evalIndex(i.Index)
 	if err != nil {
-		return Awknull, Awknull, err
+		return Awknull, location{}, err
+	}
+	if isProcinfo(i.Id) && len(i.Subarrays) == 0 {
+		inter.refreshProcinfoElement(index.Str)
 	}
 	res, ok := v.Array[index.Str]
-	// Mentioning an index makes it part of the array keys
-	if !ok {
+	// Mentioning an index makes it part of the array keys, unless asked
+	// otherwise. Assigning the element through the location creates it.
+	if !ok && !inter.lazyelems {
 		v.Array[index.Str] = Awknull
 	}
-	return res, index, nil
+	return res, location{index: index, array: v.Array}, nil
 }
 
-func (inter *interpreter) evalIndex(ind []parser.Expr) (Awkvalue, error) {
-	indices := make([]string, 0, 5)
-	for _, expr := range ind {
-		res, err := inter.eval(expr)
+// Returns the array holding the element referred to by i, creating the
+// subarrays selected by the leading subscripts of a[i][j] if needed
+func (inter *interpreter) getIndexedArray(i *parser.IndexingExpr) (Awkvalue, error) {
+	if isProcinfo(i.Id) && len(i.Subarrays) == 0 {
+		// Refreshed by the caller, which knows the element looked up
+		return inter.builtins[parser.Procinfo], nil
+	}
+	arr, err := inter.getArrayVariable(i.Id)
+	if err != nil {
+		return Awknull, err
+	}
+	for _, sub := range i.Subarrays {
+		index, err := inter.evalIndex(sub)
+		if err != nil {
+			return Awknull, err
+		}
+		arr, err = inter.getSubarray(i, arr, index.Str)
 		if err != nil {
 			return Awknull, err
 		}
-		indices = append(indices, inter.toString(res))
 	}
-	return Awknormalstring(strings.Join(indices, inter.toString(inter.builtins[parser.Subsep]))), nil
+	return arr, nil
 }
 
-func (inter *interpreter) getField(i int) Awkvalue {
-	if i < 0 || i >= len(inter.fields) {
-		return Awknormalstring("")
+func (inter *interpreter) getSubarray(i *parser.IndexingExpr, arr Awkvalue, index string) (Awkvalue, error) {
+	v := arr.Array[index]
+	switch v.Typ {
+	case Array:
+		return v, nil
+	case Null:
+		v = nullToArray(v, i.Token())
+		arr.Array[index] = v
+		return v, nil
+	default:
+		return Awknull, inter.runtimeError(i.Token(), fmt.Sprintf("cannot use scalar element of %s in array context", i.Id.Id.Lexeme))
 	}
-	return inter.fields[i]
 }
 
-// Sets field at position i and recomputes NF if necessary
-func (inter *interpreter) setField(i int, v Awkvalue) {
-	// https://stackoverflow.com/questions/51632945/in-awk-why-does-a-nonexistent-field-like-nf1-not-equal-zero/51638902
-	if i >= 1 && i < len(inter.fields) {
-		inter.fields[i] = Awkstring(inter.toString(v), v.Typ)
-		tojoin := make([]string, 0, len(inter.fields[1:]))
-		for _, field := range inter.fields[1:] {
-			tojoin = append(tojoin, inter.toString(field))
-		}
-		inter.fields[0] = Awknormalstring(strings.Join(tojoin, inter.getOfs()))
-	} else if i >= len(inter.fields) {
-		for i >= len(inter.fields) {
-			inter.fields = append(inter.fields, Awknormalstring(""))
+// Returns the array referred to by an array name or by an element holding a
+// subarray
+func (inter *interpreter) getArray(e parser.LhsExpr) (Awkvalue, error) {
+	if i, ok := e.(*parser.IndexingExpr); ok {
+		arr, err := inter.getIndexedArray(i)
+		if err != nil {
+			return Awknull, err
 		}
-		inter.setField(i, v)
-	} else if i == 0 {
-		str := inter.toString(v)
-		splits, _ := inter.split(str, nil)
-		vsplits := make([]Awkvalue, 0, len(splits))
-		for _, sp := range splits {
-			vsplits = append(vsplits, Awkstring(sp, v.Typ))
+		index, err := inter.evalIndex(i.Index)
+		if err != nil {
+			return Awknull, err
 		}
-		inter.setSplittedFields(v, vsplits)
-		inter.builtins[parser.Nf] = Awknumber(float64(len(inter.fields) - 1))
+		return inter.getSubarray(i, arr, index.Str)
 	}
+	return inter.getArrayVariable(e.(*parser.IdExpr))
 }
 
-// Set fields array with given fields.
-func (inter *interpreter) setSplittedFields(d0 Awkvalue, splits []Awkvalue) {
-	inter.fields = inter.fields[0:0]
-	inter.fields = append(inter.fields, d0)
-	inter.fields = append(inter.fields, splits...)
+func (inter *interpreter) evalIndex(ind []parser.Expr) (Awkvalue, error) {
+	if len(ind) == 1 {
+		res, err := inter.eval(ind[0])
+		if err != nil {
+			return Awknull, err
+		}
+		return Awknormalstring(inter.toString(res)), nil
+	}
+	var buf [4]string
+	indices := buf[:0]
+	for _, expr := range ind {
+		res, err := inter.eval(expr)
+		if err != nil {
+			return Awknull, err
+		}
+		indices = append(indices, inter.toString(res))
+	}
+	return Awknormalstring(strings.Join(indices, inter.getSubsep())), nil
 }
 
 func (inter *interpreter) setBuiltin(i int, v Awkvalue) error {
 	switch i {
 	case parser.Fs:
-		re, err := parser.CompileFs(inter.toString(v))
+		fs := inter.toString(v)
+		re, err := parser.CompileFs(fs)
 		if err != nil {
 			return err
 		}
-		inter.fsregex = re
+		inter.fields.sep = inter.foldSeparator(fs, re)
 		inter.builtins[parser.Fs] = v
+	case parser.Ignorecase:
+		inter.builtins[parser.Ignorecase] = v
+		inter.ignorecase = v.Bool()
+		if err := inter.setBuiltin(parser.Rs, inter.builtins[parser.Rs]); err != nil {
+			return err
+		}
+		return inter.setBuiltin(parser.Fs, inter.builtins[parser.Fs])
 	case parser.Nf:
-		inter.builtins[parser.Nf] = v
-		nf := int(v.Float())
-		if nf < 0 {
-			nf = 0
-		}
-		splits, _ := inter.split(inter.toString(inter.getField(0)), nil)
-		if len(splits) > nf {
-			splits = splits[:nf]
-		}
-		vsplits := make([]Awkvalue, 0, len(splits))
-		for i, sp := range splits {
-			// Keep previous type
-			typ := inter.getField(i + 1).Typ
-			vsplits = append(vsplits, Awkstring(sp, typ))
-		}
-		inter.setSplittedFields(Awknormalstring(strings.Join(splits, inter.getOfs())), vsplits)
+		return inter.setNF(int(inter.toNumber(v)))
+	case parser.Rs:
+		rs := inter.toString(v)
+		re, err := parser.CompileRs(rs, inter.posix)
+		if err != nil {
+			return err
+		}
+		if re != nil && inter.ignorecase {
+			re = foldRegex(re)
+			re.Longest()
+		}
+		inter.rsre = re
+		inter.builtins[parser.Rs] = v
+		inter.fields.paragraph = rs == ""
+	case parser.Convfmt, parser.Ofmt, parser.Ofs, parser.Ors, parser.Subsep:
+		inter.builtins[i] = v
+		inter.cacheSeparators()
 	default:
 		inter.builtins[i] = v
 	}
 	return nil
 }
 
+// The built-in variables read for every record, output or subscript are
+// converted once when they are assigned. They all depend on CONVFMT, so they
+// are converted together.
+func (inter *interpreter) cacheSeparators() {
+	inter.convfmt = formatString(inter.builtins[parser.Convfmt])
+	inter.ofmt = formatString(inter.builtins[parser.Ofmt])
+	inter.ofs = inter.toString(inter.builtins[parser.Ofs])
+	inter.ors = inter.toString(inter.builtins[parser.Ors])
+	inter.subsep = inter.toString(inter.builtins[parser.Subsep])
+	inter.fields.ofs = inter.ofs
+	inter.fields.convfmt = inter.convfmt
+}
+
 func (inter *interpreter) getVariable(id *parser.IdExpr) Awkvalue {
 	if id.Index >= 0 {
-		return inter.globals[id.Index]
+		return derefArray(&inter.globals[id.Index])
 	} else if id.Index < 0 && id.LocalIndex >= 0 {
-		return inter.locals[id.LocalIndex]
+		return derefArray(&inter.locals[id.LocalIndex])
 	} else {
+		if id.BuiltinIndex == parser.Procinfo {
+			// The whole array is used, as by for (k in PROCINFO)
+			inter.updateStreamInfo()
+			inter.updateCallInfo()
+		}
 		return inter.builtins[id.BuiltinIndex]
 	}
 }
@@ -991,14 +1436,26 @@ func (inter *interpreter) getArrayVariable(id *parser.IdExpr) (Awkvalue, error)
 	case Array:
 		return v, nil
 	case Null:
-		err := inter.setVariable(id, nullToArray(v))
+		err := inter.setVariableArrayAllowed(id, nullToArray(v, id.Token()))
 		if err != nil {
 			return Awknull, err
 		}
 		return inter.getArrayVariable(id)
 	default:
-		return Awknull, inter.runtimeError(id.Token(), "cannot use scalar in array context")
+		return Awknull, inter.runtimeError(id.Token(), fmt.Sprintf("cannot use scalar %s in array context%s", id.Id.Lexeme, inter.scalarUse(id)))
+	}
+}
+
+// Describes where the scalar held by a variable comes from, for the errors
+// about conflicting uses. The resolver rejects the conflicts between the uses
+// of a variable in the program, so a parameter can only hold a scalar passed
+// by the call of its function, and a global one assigned from outside the
+// program (-v, an operand or the embedder).
+func (inter *interpreter) scalarUse(id *parser.IdExpr) string {
+	if id.LocalIndex < 0 {
+		return ", it is assigned a scalar outside the program"
 	}
+	return fmt.Sprintf(", it is passed a scalar at %s", inter.items.Sources.Position(inter.callsite.Line))
 }
 
 func (inter *interpreter) setVariableArrayAllowed(id *parser.IdExpr, v Awkvalue) error {
@@ -1018,7 +1475,7 @@ func (inter *interpreter) setVariableArrayAllowed(id *parser.IdExpr, v Awkvalue)
 func (inter *interpreter) setVariable(id *parser.IdExpr, v Awkvalue) error {
 	old := inter.getVariable(id)
 	if old.Typ == Array {
-		return inter.runtimeError(id.Token(), "cannot use array in scalar context")
+		return inter.runtimeError(id.Token(), fmt.Sprintf("cannot use array %s in scalar context%s", id.Id.Lexeme, inter.arrayUse(old)))
 	}
 	return inter.setVariableArrayAllowed(id, v)
 }
@@ -1027,12 +1484,22 @@ func (inter *interpreter) getFs() string {
 	return inter.toString(inter.builtins[parser.Fs])
 }
 
+// OFMT is used when printing numbers, CONVFMT for any other number to string
+// conversion. Both fall back to the default format if they have been assigned
+// a number.
 func (inter *interpreter) getOfmt() string {
-	return inter.builtins[parser.Ofmt].Str
+	return inter.ofmt
 }
 
 func (inter *interpreter) getConvfmt() string {
-	return inter.builtins[parser.Convfmt].Str
+	return inter.convfmt
+}
+
+func formatString(v Awkvalue) string {
+	if v.Typ == Number || v.Typ == Null {
+		return "%.6g"
+	}
+	return v.Str
 }
 
 func (inter *interpreter) getRs() string {
@@ -1040,41 +1507,57 @@ func (inter *interpreter) getRs() string {
 }
 
 func (inter *interpreter) getOfs() string {
-	return inter.toString(inter.builtins[parser.Ofs])
+	return inter.ofs
+}
+
+// Sets ERRNO to describe an I/O error
+func (inter *interpreter) setErrno(err error) {
+	if perr, ok := err.(*os.PathError); ok {
+		err = perr.Err
+	}
+	inter.builtins[parser.Errno] = Awknormalstring(err.Error())
+}
+
+func (inter *interpreter) getOrs() string {
+	return inter.ors
+}
+
+func (inter *interpreter) getSubsep() string {
+	return inter.subsep
 }
 
 func (inter *interpreter) runtimeError(tok lexer.Token, msg string) error {
-	return fmt.Errorf("at line %d (%s): runtime error: %s", tok.Line, tok.Lexeme, msg)
+	return fmt.Errorf("at %s (%s): runtime error: %s", inter.items.Sources.Position(tok.Line), tok.Lexeme, msg)
 }
 
+// Runs the program. An exit in BEGIN or in the main rules skips the
+// remaining input but still runs END; an exit in END terminates immediately.
 func (inter *interpreter) run() error {
-	var skipNormals bool
-	var errexit ErrorExit
-
 	err := inter.runBegins()
-	if ee, ok := err.(ErrorExit); ok {
-		errexit = ee
-		skipNormals = true
-	} else if err != nil {
+	if err == errInterrupted {
+		return inter.interrupted()
+	} else if _, ok := err.(ErrorExit); !ok && err != nil {
 		return err
 	}
 
-	if !skipNormals {
+	if err == nil {
 		err := inter.runNormals()
-		if ee, ok := err.(ErrorExit); ok {
-			errexit = ee
-		} else if err != nil {
+		if err == errInterrupted {
+			return inter.interrupted()
+		} else if _, ok := err.(ErrorExit); !ok && err != nil {
 			return err
 		}
 	}
 
 	err = inter.runEnds()
-	if ee, ok := err.(ErrorExit); ok {
-		errexit = ee
-	} else if err != nil {
+	if err == errInterrupted {
+		return inter.interrupted()
+	} else if _, ok := err.(ErrorExit); !ok && err != nil {
 		return err
 	}
-	return errexit
+	return ErrorExit{
+		Status: inter.exitstatus,
+	}
 }
 
 func (inter *interpreter) runBegins() error {
@@ -1087,11 +1570,23 @@ func (inter *interpreter) runBegins() error {
 }
 
 func (inter *interpreter) runNormals() error {
-	if len(inter.items.Normals) == 0 {
+	// Input is read only if there are main rules or END actions
+	if len(inter.items.Normals) == 0 && len(inter.items.Ends) == 0 {
 		return nil
 	}
 
+	if inter.parallel > 1 && len(inter.items.Normals) > 0 {
+		plan, err := inter.parallelPlan()
+		if err == nil {
+			return inter.runNormalsParallel(plan)
+		}
+		fmt.Fprintf(inter.stderr, "%s: warning: running sequentially: %s\n", inter.programname, err)
+	}
+
 	for {
+		if err := inter.checkSignals(); err != nil {
+			return err
+		}
 		text, err := inter.nextRecordCurrentFile()
 		if err != nil && err != io.EOF {
 			return err
@@ -1099,16 +1594,39 @@ func (inter *interpreter) runNormals() error {
 		if err != nil && err == io.EOF {
 			break
 		}
+		if !inter.callRecordHook(inter.beforehook, text) {
+			break
+		}
 		err = inter.processRecord(text)
-		if err != nil {
+		if err == errNextfile {
+			if _, err := inter.nextFile(); err != nil {
+				return err
+			}
+		} else if err != nil {
 			return err
 		}
+		if !inter.callRecordHook(inter.afterhook, inter.toString(inter.getField(0))) {
+			break
+		}
 	}
 	return nil
 }
 
+// Returns whether the main loop should go on
+func (inter *interpreter) callRecordHook(hook RecordHook, record string) bool {
+	if hook == nil {
+		return true
+	}
+	return hook(RecordInfo{
+		NR:       int(inter.toNumber(inter.builtins[parser.Nr])),
+		FNR:      int(inter.toNumber(inter.builtins[parser.Fnr])),
+		Filename: inter.toString(inter.builtins[parser.Filename]),
+		Record:   record,
+	})
+}
+
 func (inter *interpreter) processRecord(record string) error {
-	inter.setField(0, Awknumericstring(record))
+	inter.setField(0, inter.numericString(record))
 	for i, normal := range inter.items.Normals {
 		var toexecute bool
 		switch pat := normal.Pattern.(type) {
@@ -1119,26 +1637,14 @@ func (inter *interpreter) processRecord(record string) error {
 			}
 			toexecute = res.Bool()
 		case *parser.RangePattern:
-			if inter.rangematched[i] {
-				toexecute = true
-			}
-			res0, err := inter.eval(pat.Expr1)
-			if err != nil {
-				return err
-			}
-			if res0.Bool() {
-				inter.rangematched[i] = true
-				toexecute = true
-			}
-			res1, err := inter.eval(pat.Expr1)
+			var err error
+			toexecute, err = inter.matchRange(i, pat)
 			if err != nil {
 				return err
 			}
-			if res1.Bool() {
-				delete(inter.rangematched, i)
-			}
 		}
 		if toexecute {
+			inter.countMatch(i)
 			if err := inter.execute(normal.Action); err != nil {
 				if err == errNext {
 					break
@@ -1150,6 +1656,28 @@ func (inter *interpreter) processRecord(record string) error {
 	return nil
 }
 
+// Returns whether the record belongs to the range of the i-th rule. Outside
+// of the range only the start pattern is evaluated; once it matches, the
+// end pattern is evaluated on every record, the starting one included, and
+// the record matching it is the last of the range.
+func (inter *interpreter) matchRange(i int, pat *parser.RangePattern) (bool, error) {
+	if !inter.rangematched[i] {
+		start, err := inter.eval(pat.Expr0)
+		if err != nil || !start.Bool() {
+			return false, err
+		}
+		inter.rangematched[i] = true
+	}
+	end, err := inter.eval(pat.Expr1)
+	if err != nil {
+		return false, err
+	}
+	if end.Bool() {
+		delete(inter.rangematched, i)
+	}
+	return true, nil
+}
+
 func (inter *interpreter) runEnds() error {
 	for _, end := range inter.items.Ends {
 		if err := inter.execute(end.Action); err != nil {
@@ -1164,16 +1692,44 @@ func (inter *interpreter) runEnds() error {
 // Assumes params is completely correct (e.g. FS is a valid regex)
 func (inter *interpreter) initialize(params RunParams) {
 	inter.items = params.ResolvedItems
+	inter.params = params
+	inter.programname = params.programName()
+	inter.parallel = params.Parallel
+	inter.dumpstreams = params.DumpStreams
+	inter.initializeStats(params)
+	inter.environ = params.Environ
+	inter.shell = shellOf(params)
+	inter.directexec = params.DirectExec
+	inter.runner = params.Runner
+	inter.files = params.Files
+	if inter.files == nil {
+		inter.files = OSFiles{}
+	}
+	inter.posix = params.Posix
+	inter.printfors = params.PrintfOrs
+	inter.lazyelems = params.LazyElements
+	inter.crlf = params.Crlf
+	inter.stripbom = params.StripBom
+	inter.charset, inter.initerr = lookupCharset(params.Encoding)
+	collator, err := newCollator(params.Collate)
+	if inter.initerr == nil {
+		inter.initerr = err
+	}
+	inter.collator = collator
+	inter.bytes = params.CharactersAsBytes
+	inter.casing, err = newCasing(params.CaseLocale, params.CharactersAsBytes, params.Posix)
+	if inter.initerr == nil {
+		inter.initerr = err
+	}
 
 	// Stacks
 
 	inter.builtins = make([]Awkvalue, len(lexer.Builtinvars))
+	inter.fields.hex = !params.Posix
 	inter.initializeBuiltinVariables(params)
 
 	inter.globals = make([]Awkvalue, len(params.ResolvedItems.Globalindices))
 
-	inter.stack = make([]Awkvalue, 10000)
-
 	inter.ftable = make([]func(lexer.Token, []parser.Expr) (Awkvalue, error), len(params.ResolvedItems.Functionindices))
 	inter.initializeFunctions(params)
 
@@ -1184,29 +1740,46 @@ func (inter *interpreter) initialize(params RunParams) {
 
 	// IO structures
 
-	inter.outprograms = closableStreams{}
-	inter.outfiles = closableStreams{}
-	inter.inprograms = closableStreams{}
-	inter.infiles = closableStreams{}
-	inter.rng = newRNG(0)
+	inter.outprograms = newClosableStreams("output command")
+	inter.outfiles = newOutputFiles(params.MaxOpenFiles)
+	inter.maxdepth = params.MaxCallDepth
+	inter.inprograms = newClosableStreams("input command")
+	inter.infiles = newClosableStreams("input file")
+	if params.DeterministicRand {
+		inter.rng = newRNG(0)
+	} else {
+		inter.rng = newRNG(float64(time.Now().Unix()))
+	}
 	inter.argindex = 0
+	inter.fileopened = false
 	inter.currentFile = nil
 	inter.stdin = params.Stdin
-	inter.stdout = params.Stdout
-	inter.stderr = params.Stderr
-	inter.stdinFile = bufio.NewReader(inter.stdin)
+	inter.stdout = newLockedWriter(params.Stdout)
+	inter.stderr = newLockedWriter(params.Stderr)
+	inter.bufstdout = bufio.NewWriter(inter.outputWriter(inter.stdout))
+	inter.autoflush = isTerminal(inter.stdout)
+	if params.CatchSignals || params.EndOnSignal {
+		inter.catchSignals(params.EndOnSignal)
+	}
+	inter.stdinFile, inter.stdintimed = newInputReader(inter.charset.reader(inter.stdin), 0, inter.interruptChan())
+	inter.records = params.Records
+	inter.printfunc = params.PrintFunc
+	inter.beforehook = params.BeforeRecord
+	inter.afterhook = params.AfterRecord
 
 	// Caches
 
 	inter.rangematched = map[int]bool{}
-	inter.fprintfcache = map[string][]func(Awkvalue) interface{}{}
+	inter.fprintfcache = map[string][]fmtspec{}
+	inter.folded = map[*regexp.Regexp]*regexp.Regexp{}
 }
 
 func (inter *interpreter) initializeBuiltinVariables(params RunParams) {
 	// General
 	inter.setBuiltin(parser.Convfmt, Awknormalstring("%.6g"))
 	inter.setBuiltin(parser.Fnr, Awknumber(0))
-	inter.setBuiltin(parser.Fs, Awknumericstring(params.Fs))
+	inter.setBuiltin(parser.Fs, Awknumericstring(lexer.Unescape(params.Fs)))
+	inter.setBuiltin(parser.Ignorecase, Awknumber(0))
 	inter.setBuiltin(parser.Nr, Awknumber(0))
 	inter.setBuiltin(parser.Ofmt, Awknormalstring("%.6g"))
 	inter.setBuiltin(parser.Ofs, Awknormalstring(" "))
@@ -1217,29 +1790,44 @@ func (inter *interpreter) initializeBuiltinVariables(params RunParams) {
 	// ARGC and ARGV
 	argc := len(params.Arguments) + 1
 	argv := map[string]Awkvalue{}
-	argv["0"] = Awknumericstring(params.Programname)
+	argv["0"] = inter.numericString(params.Programname)
 	for i := 1; i <= argc-1; i++ {
-		argv[fmt.Sprintf("%d", i)] = Awknumericstring(params.Arguments[i-1])
+		argv[fmt.Sprintf("%d", i)] = inter.numericString(params.Arguments[i-1])
 	}
 	inter.setBuiltin(parser.Argc, Awknumber(float64(argc)))
 	inter.setBuiltin(parser.Argv, Awkarray(argv))
 
 	// ENVIRON
 	environ := Awkarray(map[string]Awkvalue{})
-	for _, envpair := range os.Environ() {
-		splits := strings.Split(envpair, "=")
-		environ.Array[splits[0]] = Awknumericstring(splits[1])
+	envpairs := params.Environ
+	if envpairs == nil {
+		envpairs = os.Environ()
+	}
+	for _, envpair := range envpairs {
+		splits := strings.SplitN(envpair, "=", 2)
+		if len(splits) == 2 {
+			environ.Array[splits[0]] = inter.numericString(splits[1])
+		}
 	}
 	inter.setBuiltin(parser.Environ, environ)
 
+	// PROCINFO
+	procinfo := Awkarray(map[string]Awkvalue{})
+	procinfo.Array["pid"] = Awknumber(float64(os.Getpid()))
+	procinfo.Array["ppid"] = Awknumber(float64(os.Getppid()))
+	inter.setBuiltin(parser.Procinfo, procinfo)
+
 }
 
+// Assigns a var=value string from the command line. The value is processed
+// like a string literal and is a numeric string candidate.
 func (inter *interpreter) assignCommandLineString(assign string) {
-	splits := strings.Split(assign, "=")
-	if i, ok := lexer.Builtinvars[splits[0]]; ok {
-		inter.setBuiltin(i, Awknumericstring(splits[1]))
+	splits := strings.SplitN(assign, "=", 2)
+	v := inter.numericString(lexer.Unescape(splits[1]))
+	if i, ok := parser.BuiltinVar(splits[0], inter.posix); ok {
+		inter.setBuiltin(i, v)
 	} else if i, ok := inter.items.Globalindices[splits[0]]; ok {
-		inter.globals[i] = Awknumericstring(splits[1])
+		inter.globals[i] = v
 	}
 }
 
@@ -1251,21 +1839,88 @@ func (inter *interpreter) initializeFunctions(params RunParams) {
 			return inter.evalNativeFunction(fname, nf, args)
 		}
 	}
+	for name, nf := range params.FieldNatives {
+		nf := nf
+		inter.ftable[params.ResolvedItems.Functionindices[name]] = func(fname lexer.Token, args []parser.Expr) (Awkvalue, error) {
+			return inter.evalNativeFunction(fname, func(nargs ...NativeVal) (NativeVal, error) {
+				return nf(nativeFields{inter}, nargs...)
+			}, args)
+		}
+	}
 
 	// User defined
 	for _, fi := range params.ResolvedItems.Functions {
 		fi := fi
 		inter.ftable[params.ResolvedItems.Functionindices[fi.Name.Lexeme]] = func(fname lexer.Token, args []parser.Expr) (Awkvalue, error) {
-			return inter.evalUserCall(fi, args)
+			return inter.evalUserCall(fname, fi, args)
 		}
 	}
 }
 
+// Stores in PROCINFO the current depth of calls, the highest one reached so
+// far and the highest number of local variables they used at once
+func isProcinfo(id *parser.IdExpr) bool {
+	return id.Index < 0 && id.LocalIndex < 0 && id.BuiltinIndex == parser.Procinfo
+}
+
+// Updates the entries of PROCINFO describing the interpreter before one of
+// its elements is looked up. Those about the streams are updated only if
+// the element is one of them, since it takes a walk over every stream
+// opened so far.
+func (inter *interpreter) refreshProcinfoElement(key string) {
+	inter.updateCallInfo()
+	if isStreamInfo(key, inter.getSubsep()) {
+		inter.updateStreamInfo()
+	}
+}
+
+func (inter *interpreter) updateCallInfo() {
+	procinfo := inter.builtins[parser.Procinfo].Array
+	procinfo["call_depth"] = Awknumber(float64(inter.calldepth))
+	procinfo["max_call_depth"] = Awknumber(float64(inter.highdepth))
+	procinfo["max_locals"] = Awknumber(float64(inter.stack.high))
+}
+
+// Flushes stdout before a command is started, so that what the program
+// printed so far comes before what the command prints. A failure is
+// reported by the next write to stdout, or at exit.
+func (inter *interpreter) flushStdout() {
+	inter.bufstdout.Flush()
+}
+
+// Flushes stdout and every output stream
+func (inter *interpreter) flushAll() []error {
+	errors := make([]error, 0)
+	if err := inter.bufstdout.Flush(); err != nil {
+		errors = append(errors, err)
+	}
+	errors = append(errors, inter.outprograms.flushAll()...)
+	errors = append(errors, inter.outfiles.flushAll()...)
+	return errors
+}
+
 func (inter *interpreter) cleanup() []error {
 	errors := make([]error, 0)
-	errors = append(errors, inter.outprograms.closeAll()...)
-	errors = append(errors, inter.outfiles.closeAll()...)
-	errors = append(errors, inter.inprograms.closeAll()...)
-	errors = append(errors, inter.infiles.closeAll()...)
+	if err := inter.bufstdout.Flush(); err != nil && !isBrokenPipe(err) && err != inter.writeerr {
+		errors = append(errors, err)
+	}
+	if inter.dumpstreams {
+		inter.dumpStreams(inter.stderr)
+	}
+	inter.reportStats()
+	inter.stopSignals()
+	inter.stdintimed.stop()
+	for _, errs := range [][]error{
+		inter.outprograms.closeAll(),
+		inter.outfiles.closeAll(),
+		inter.inprograms.closeAll(),
+		inter.infiles.closeAll(),
+	} {
+		for _, err := range errs {
+			if err != inter.writeerr {
+				errors = append(errors, err)
+			}
+		}
+	}
 	return errors
 }
@@ -8,20 +8,48 @@ package interpreter
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/fioriandrea/aawk/lexer"
 	"github.com/fioriandrea/aawk/parser"
 )
 
-type closableStreams map[string]io.Closer
+// Streams opened by redirections, by name. They are flushed and closed in
+// the order they were opened. What is read from and written to them is
+// counted, also after they are closed, for PROCINFO and --dump-streams.
+type closableStreams struct {
+	kind    string
+	streams map[string]io.Closer
+	order   []string // Names of the open streams, oldest first
+	stats   map[string]*streamStats
+}
+
+type streamStats struct {
+	opened  int
+	read    int64
+	written int64
+}
+
+func newClosableStreams(kind string) *closableStreams {
+	return &closableStreams{
+		kind:    kind,
+		streams: map[string]io.Closer{},
+		stats:   map[string]*streamStats{},
+	}
+}
 
-func (st closableStreams) get(name string, spawner func(string) (io.Closer, error)) (io.Closer, error) {
-	s, ok := st[name]
+func (st *closableStreams) get(name string, spawner func(string) (io.Closer, error)) (io.Closer, error) {
+	s, ok := st.streams[name]
 	if ok {
 		return s, nil
 	}
@@ -29,46 +57,360 @@ func (st closableStreams) get(name string, spawner func(string) (io.Closer, erro
 	if err != nil {
 		return nil, err
 	}
-	st[name] = s
+	st.add(name, s)
 	return s, nil
 }
 
-func (st closableStreams) close(name string) error {
-	s, ok := st[name]
+func (st *closableStreams) add(name string, s io.Closer) {
+	st.streams[name] = s
+	st.order = append(st.order, name)
+	st.statsOf(name).opened++
+}
+
+func (st *closableStreams) statsOf(name string) *streamStats {
+	stats, ok := st.stats[name]
 	if !ok {
-		return nil
+		stats = &streamStats{}
+		st.stats[name] = stats
 	}
-	delete(st, name)
-	return s.Close()
+	return stats
+}
+
+// Returns a writer to the named stream which counts the bytes written
+func (st *closableStreams) writer(name string, s io.Closer) io.Writer {
+	return countingWriter{s.(io.Writer), &st.statsOf(name).written}
 }
 
-func (st closableStreams) closeAll() []error {
+// Returns a reader of the named stream which counts the bytes read
+func (st *closableStreams) reader(name string, s io.Closer) inputReader {
+	return countingReader{s.(inputReader), &st.statsOf(name).read}
+}
+
+func (st *closableStreams) close(name string) error {
+	_, err := st.closeIfOpen(name)
+	return err
+}
+
+// Closes the named stream. Returns false if no such stream is open.
+func (st *closableStreams) closeIfOpen(name string) (bool, error) {
+	s, ok := st.streams[name]
+	if !ok {
+		return false, nil
+	}
+	delete(st.streams, name)
+	for i, n := range st.order {
+		if n == name {
+			st.order = append(st.order[:i], st.order[i+1:]...)
+			break
+		}
+	}
+	return true, s.Close()
+}
+
+// Flushes the named stream. Returns false if no such stream is open.
+func (st *closableStreams) flush(name string) (bool, error) {
+	s, ok := st.streams[name]
+	if !ok {
+		return false, nil
+	}
+	if f, ok := s.(flusher); ok {
+		return true, f.Flush()
+	}
+	return true, nil
+}
+
+func (st *closableStreams) flushAll() []error {
 	errors := make([]error, 0)
-	for name := range st {
-		err := st.close(name)
-		if err != nil {
+	for _, name := range st.order {
+		if _, err := st.flush(name); err != nil {
 			errors = append(errors, err)
 		}
 	}
 	return errors
 }
 
+// Closes every stream at exit. The exit status of a command reaches the
+// program only through close, so commands which failed are not errors here.
+func (st *closableStreams) closeAll() []error {
+	errs := make([]error, 0)
+	for len(st.order) > 0 {
+		var ee *exec.ExitError
+		if err := st.close(st.order[0]); err != nil && !errors.As(err, &ee) {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (cw countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	*cw.n += int64(n)
+	return n, err
+}
+
+type countingReader struct {
+	r inputReader
+	n *int64
+}
+
+func (cr countingReader) ReadSlice(delim byte) ([]byte, error) {
+	b, err := cr.r.ReadSlice(delim)
+	*cr.n += int64(len(b))
+	return b, err
+}
+
+func (cr countingReader) Peek(n int) ([]byte, error) {
+	return cr.r.Peek(n)
+}
+
+func (cr countingReader) Discard(n int) (int, error) {
+	n, err := cr.r.Discard(n)
+	*cr.n += int64(n)
+	return n, err
+}
+
+func (cr countingReader) Buffered() int {
+	return cr.r.Buffered()
+}
+
+// The registries of the streams opened by redirections, in the order they
+// are closed
+func (inter *interpreter) streamRegistries() []*closableStreams {
+	return []*closableStreams{inter.outprograms, inter.outfiles.streams, inter.inprograms, inter.infiles}
+}
+
+// Stores in PROCINFO["open_streams"] the number of open streams and, for
+// every stream opened so far, how many times it was opened and how many
+// bytes were read from and written to it in PROCINFO[name, "opened"],
+// PROCINFO[name, "bytes_read"] and PROCINFO[name, "bytes_written"]
+func (inter *interpreter) updateStreamInfo() {
+	procinfo := inter.builtins[parser.Procinfo].Array
+	subsep := inter.getSubsep()
+	open := 0
+	// A name can be used both for reading and for writing
+	totals := map[string]streamStats{}
+	for _, st := range inter.streamRegistries() {
+		open += len(st.streams)
+		for name, stats := range st.stats {
+			t := totals[name]
+			t.opened += stats.opened
+			t.read += stats.read
+			t.written += stats.written
+			totals[name] = t
+		}
+	}
+	procinfo["open_streams"] = Awknumber(float64(open))
+	for name, t := range totals {
+		procinfo[name+subsep+"opened"] = Awknumber(float64(t.opened))
+		procinfo[name+subsep+"bytes_read"] = Awknumber(float64(t.read))
+		procinfo[name+subsep+"bytes_written"] = Awknumber(float64(t.written))
+	}
+}
+
+// Reports whether key is one of the elements set by updateStreamInfo
+func isStreamInfo(key string, subsep string) bool {
+	if key == "open_streams" {
+		return true
+	}
+	for _, suffix := range []string{"opened", "bytes_read", "bytes_written"} {
+		if strings.HasSuffix(key, suffix) && strings.HasSuffix(strings.TrimSuffix(key, suffix), subsep) {
+			return true
+		}
+	}
+	return false
+}
+
+// Writes a line for every stream opened so far, telling whether it is
+// still open
+func (inter *interpreter) dumpStreams(w io.Writer) {
+	for _, st := range inter.streamRegistries() {
+		names := make([]string, 0, len(st.stats))
+		for name := range st.stats {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			stats := st.stats[name]
+			state := "closed"
+			if _, ok := st.streams[name]; ok {
+				state = "open"
+			}
+			fmt.Fprintf(w, "%s: %s %q: %s, opened %d, read %d, written %d\n",
+				inter.programname, st.kind, name, state, stats.opened, stats.read, stats.written)
+		}
+	}
+}
+
+// Files opened by output redirections. When too many files are open, the
+// least recently used one is closed to make room, and it is transparently
+// reopened in append mode when it is written to again.
+type outputFiles struct {
+	streams *closableStreams
+	max     int // Maximum number of open files, 0 for no limit
+	lastuse map[string]int
+	clock   int
+	evicted map[string]bool
+}
+
+func newOutputFiles(max int) outputFiles {
+	return outputFiles{
+		streams: newClosableStreams("output file"),
+		max:     max,
+		lastuse: map[string]int{},
+		evicted: map[string]bool{},
+	}
+}
+
+func (of *outputFiles) get(name string, mode int, spawner func(string, int) (io.Closer, error)) (io.Closer, error) {
+	of.clock++
+	if s, ok := of.streams.streams[name]; ok {
+		of.lastuse[name] = of.clock
+		return s, nil
+	}
+	if of.max > 0 && len(of.streams.streams) >= of.max {
+		if err := of.evict(); err != nil {
+			return nil, err
+		}
+	}
+	if of.evicted[name] {
+		mode = os.O_APPEND
+	}
+	s, err := spawner(name, mode)
+	// The process could run out of file descriptors before reaching max
+	for isTooManyFiles(err) && len(of.streams.streams) > 0 {
+		if err := of.evict(); err != nil {
+			return nil, err
+		}
+		s, err = spawner(name, mode)
+	}
+	if err != nil {
+		return nil, err
+	}
+	delete(of.evicted, name)
+	of.streams.add(name, s)
+	of.lastuse[name] = of.clock
+	return s, nil
+}
+
+// Closes the least recently used file
+func (of *outputFiles) evict() error {
+	var lru string
+	for name := range of.streams.streams {
+		if lru == "" || of.lastuse[name] < of.lastuse[lru] {
+			lru = name
+		}
+	}
+	delete(of.lastuse, lru)
+	of.evicted[lru] = true
+	return of.streams.close(lru)
+}
+
+// Closes every file, as evict does. Returns the first error.
+func (of *outputFiles) evictAll() error {
+	var first error
+	for len(of.streams.order) > 0 {
+		name := of.streams.order[0]
+		delete(of.lastuse, name)
+		of.evicted[name] = true
+		if err := of.streams.close(name); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Closes the named file. Files closed to make room count as open.
+func (of *outputFiles) closeIfOpen(name string) (bool, error) {
+	if of.evicted[name] {
+		delete(of.evicted, name)
+		return true, nil
+	}
+	delete(of.lastuse, name)
+	return of.streams.closeIfOpen(name)
+}
+
+func (of *outputFiles) flush(name string) (bool, error) {
+	if of.evicted[name] {
+		return true, nil
+	}
+	return of.streams.flush(name)
+}
+
+func (of *outputFiles) flushAll() []error {
+	return of.streams.flushAll()
+}
+
+func (of *outputFiles) closeAll() []error {
+	return of.streams.closeAll()
+}
+
+// Error writing the output of print or printf, as opposed to an error
+// evaluating what to print
+type writeError struct {
+	err error
+}
+
+func (we writeError) Error() string {
+	return we.err.Error()
+}
+
+func isBrokenPipe(err error) bool {
+	return errors.Is(err, syscall.EPIPE) || errors.Is(err, io.ErrClosedPipe)
+}
+
+func isTooManyFiles(err error) bool {
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE)
+}
+
+// Terminals are written to without buffering, so that interactive use works
+// as expected
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+type flusher interface {
+	Flush() error
+}
+
 type ByteReadCloser interface {
 	io.ByteReader
 	io.Closer
 }
 
 type outcommand struct {
-	cmd   *exec.Cmd
-	stdin io.WriteCloser
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	writer *bufio.Writer
 }
 
 func (c outcommand) Write(p []byte) (int, error) {
-	n, err := c.stdin.Write(p)
+	n, err := c.writer.Write(p)
 	return n, err
 }
 
+func (c outcommand) Flush() error {
+	return c.writer.Flush()
+}
+
 func (c outcommand) Close() error {
+	if err := c.writer.Flush(); err != nil {
+		c.stdin.Close()
+		c.cmd.Wait()
+		return err
+	}
 	if err := c.stdin.Close(); err != nil {
 		return err
 	}
@@ -78,8 +420,7 @@ func (c outcommand) Close() error {
 	return nil
 }
 
-func spawnOutCommand(name string, stdout io.Writer, stderr io.Writer) (outcommand, error) {
-	cmd := exec.Command("sh", "-c", name)
+func spawnOutCommand(cmd *exec.Cmd, stdout io.Writer, stderr io.Writer) (outcommand, error) {
 	cmd.Stdout = stdout
 	cmd.Stderr = stderr
 	stdin, err := cmd.StdinPipe()
@@ -90,185 +431,628 @@ func spawnOutCommand(name string, stdout io.Writer, stderr io.Writer) (outcomman
 		return outcommand{}, err
 	}
 	res := outcommand{
-		stdin: stdin,
-		cmd:   cmd,
+		stdin:  stdin,
+		cmd:    cmd,
+		writer: bufio.NewWriter(stdin),
 	}
 	return res, nil
 }
 
-func spawnOutFile(name string, mode int) (*os.File, error) {
-	return os.OpenFile(name, os.O_CREATE|os.O_WRONLY|mode, 0600)
+type outfile struct {
+	*bufio.Writer
+	file io.Closer
 }
 
-type incommand struct {
-	stdout *bufio.Reader
-	cmd    *exec.Cmd
+func (of outfile) Close() error {
+	if err := of.Flush(); err != nil {
+		of.file.Close()
+		return err
+	}
+	return of.file.Close()
 }
 
-func (ic incommand) ReadByte() (byte, error) {
-	return ic.stdout.ReadByte()
+// Converts the error returned by closing a stream or running a command to an
+// exit status: the status of the command if it exited, -1 if it was killed
+// by a signal or if some other error occurred
+func exitStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exitError, ok := err.(*exec.ExitError); ok {
+		return exitError.ExitCode()
+	}
+	return -1
 }
 
-func (ic incommand) Close() error {
-	if err := ic.cmd.Wait(); err != nil {
-		return err
+// Returns the file descriptor referred to by the special file names
+// /dev/stdin, /dev/stdout, /dev/stderr and /dev/fd/0 to /dev/fd/2, or -1 for
+// other names. Other descriptors are not special: /dev/fd/3 is opened as a
+// file like any other name.
+func specialFd(name string) int {
+	switch name {
+	case "/dev/stdin", "/dev/fd/0":
+		return 0
+	case "/dev/stdout", "/dev/fd/1":
+		return 1
+	case "/dev/stderr", "/dev/fd/2":
+		return 2
+	}
+	return -1
+}
+
+// Stream reading from or writing to one of the standard streams of the
+// interpreter. Closing it does not close the underlying stream.
+type stdstream struct {
+	inputReader
+	io.Writer
+}
+
+func (s stdstream) Flush() error {
+	if f, ok := s.Writer.(flusher); ok {
+		return f.Flush()
 	}
 	return nil
 }
 
-func spawnInCommand(name string, stdin io.Reader, stderr io.Writer) (incommand, error) {
-	cmd := exec.Command("sh", "-c", name)
+func (s stdstream) Close() error {
+	return s.Flush()
+}
+
+// Writer which can be written concurrently by the interpreter and by the
+// goroutines copying the output of the commands it runs
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// Files are passed to commands directly, so they need no locking
+func newLockedWriter(w io.Writer) io.Writer {
+	if _, ok := w.(*os.File); ok {
+		return w
+	}
+	return &lockedWriter{w: w}
+}
+
+func (lw *lockedWriter) Write(p []byte) (int, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	return lw.w.Write(p)
+}
+
+// Opens a file for output. The special files for standard output and
+// standard error refer to the streams the interpreter was given.
+func (inter *interpreter) spawnOutFile(name string, mode int) (io.Closer, error) {
+	switch specialFd(name) {
+	case 1:
+		return stdstream{Writer: inter.bufstdout}, nil
+	case 2:
+		return stdstream{Writer: inter.stderr}, nil
+	}
+	return spawnOutFile(inter.files, name, mode, inter.outputWriter)
+}
+
+func spawnOutFile(files FileOpener, name string, mode int, wrap func(io.Writer) io.Writer) (outfile, error) {
+	file, err := files.Create(name, mode == os.O_APPEND)
+	if err != nil {
+		return outfile{}, err
+	}
+	return outfile{
+		Writer: bufio.NewWriter(wrap(file)),
+		file:   file,
+	}, nil
+}
+
+// Translates what is written to standard output or to a file as asked by
+// the options. The output of commands is written as it is.
+func (inter *interpreter) outputWriter(w io.Writer) io.Writer {
+	if inter.crlf {
+		w = &crlfWriter{w: w}
+	}
+	return inter.charset.writer(w)
+}
+
+// Writes "\r\n" in place of the "\n" which are not already preceded by
+// "\r", as the text streams of Windows do
+type crlfWriter struct {
+	w    io.Writer
+	last byte
+}
+
+func (cw *crlfWriter) Write(p []byte) (int, error) {
+	buf := make([]byte, 0, len(p)+len(p)/8)
+	for _, c := range p {
+		if c == '\n' && cw.last != '\r' {
+			buf = append(buf, '\r')
+		}
+		buf = append(buf, c)
+		cw.last = c
+	}
+	if _, err := cw.w.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+var errReadTimeout = errors.New("connection timed out")
+
+type readResult struct {
+	data []byte
+	err  error
+}
+
+// Reader whose reads give up after waiting for timeout, if positive, or when
+// interrupt is closed. The underlying reader is read by a separate
+// goroutine, started by the first read, so that waiting can be abandoned.
+type timedReader struct {
+	r         io.Reader
+	results   chan readResult
+	done      chan struct{}
+	started   bool
+	pending   []byte
+	err       error
+	timeout   time.Duration
+	interrupt <-chan struct{}
+}
+
+func newTimedReader(r io.Reader, timeout time.Duration, interrupt <-chan struct{}) *timedReader {
+	return &timedReader{
+		r:         r,
+		results:   make(chan readResult),
+		done:      make(chan struct{}),
+		timeout:   timeout,
+		interrupt: interrupt,
+	}
+}
+
+func (tr *timedReader) start() {
+	tr.started = true
+	go func() {
+		for {
+			buf := make([]byte, 4096)
+			n, err := tr.r.Read(buf)
+			select {
+			case tr.results <- readResult{buf[:n], err}:
+			case <-tr.done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+}
+
+func (tr *timedReader) Read(p []byte) (int, error) {
+	if !tr.started {
+		tr.start()
+	}
+	for len(tr.pending) == 0 {
+		if tr.err != nil {
+			return 0, tr.err
+		}
+		var timeout <-chan time.Time
+		if tr.timeout > 0 {
+			timer := time.NewTimer(tr.timeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case res := <-tr.results:
+			tr.pending, tr.err = res.data, res.err
+		case <-timeout:
+			return 0, errReadTimeout
+		case <-tr.interrupt:
+			return 0, errInterrupted
+		}
+	}
+	n := copy(p, tr.pending)
+	tr.pending = tr.pending[n:]
+	return n, nil
+}
+
+// Stops the reading goroutine. It can be called on a nil reader.
+func (tr *timedReader) stop() {
+	if tr != nil {
+		close(tr.done)
+	}
+}
+
+// Input which records are read from, as a bufio.Reader. Records separated
+// by a regular expression are looked for in what Peek returns.
+type inputReader interface {
+	ReadSlice(delim byte) ([]byte, error)
+	Peek(n int) ([]byte, error)
+	Discard(n int) (int, error)
+	Buffered() int
+}
+
+// Reads from r, waiting at most timeout for data if timeout is positive and
+// until interrupt is closed if it is not nil. The returned timedReader, if
+// not nil, must be stopped when done.
+func newInputReader(r io.Reader, timeout time.Duration, interrupt <-chan struct{}) (*bufio.Reader, *timedReader) {
+	if timeout > 0 || interrupt != nil {
+		tr := newTimedReader(r, timeout, interrupt)
+		return bufio.NewReader(tr), tr
+	}
+	return bufio.NewReader(r), nil
+}
+
+type incommand struct {
+	stdout  *bufio.Reader
+	timed   *timedReader
+	pipe    io.Closer
+	cmd     *exec.Cmd
+	waited  bool
+	waiterr error
+}
+
+// The command is waited for as soon as its output ends. If it was killed,
+// the end of its output is reported as an error instead of io.EOF, since
+// what was read may be incomplete. An exit status other than 0 is only
+// returned by Close.
+func (ic *incommand) ReadSlice(delim byte) ([]byte, error) {
+	if !ic.waited {
+		line, err := ic.stdout.ReadSlice(delim)
+		if err != io.EOF || len(line) > 0 {
+			return line, err
+		}
+	}
+	return nil, ic.end()
+}
+
+func (ic *incommand) Peek(n int) ([]byte, error) {
+	if !ic.waited {
+		b, err := ic.stdout.Peek(n)
+		if err != io.EOF || len(b) > 0 {
+			return b, err
+		}
+	}
+	return nil, ic.end()
+}
+
+func (ic *incommand) Discard(n int) (int, error) {
+	return ic.stdout.Discard(n)
+}
+
+func (ic *incommand) Buffered() int {
+	return ic.stdout.Buffered()
+}
+
+// Waits for the command once its output ended, returning io.EOF or how it
+// failed
+func (ic *incommand) end() error {
+	if !ic.waited {
+		ic.waited = true
+		ic.waiterr = ic.cmd.Wait()
+	}
+	if ee, ok := ic.waiterr.(*exec.ExitError); ok && ee.ExitCode() == -1 {
+		return fmt.Errorf("command ended by %s", ee)
+	} else if ic.waiterr != nil && !ok {
+		return ic.waiterr
+	}
+	return io.EOF
+}
+
+func (ic *incommand) Close() error {
+	// Close the pipe first, so that a command which has not been read
+	// completely does not block forever
+	ic.timed.stop()
+	if ic.waited {
+		return ic.waiterr
+	}
+	ic.pipe.Close()
+	return ic.cmd.Wait()
+}
+
+func spawnInCommand(cmd *exec.Cmd, stdin io.Reader, stderr io.Writer, timeout time.Duration, interrupt <-chan struct{}) (*incommand, error) {
 	cmd.Stdin = stdin
 	cmd.Stderr = stderr
 	stdoutp, err := cmd.StdoutPipe()
 	if err != nil {
-		return incommand{}, err
+		return nil, err
 	}
 	if err := cmd.Start(); err != nil {
-		return incommand{}, err
+		return nil, err
 	}
-	res := incommand{
-		stdout: bufio.NewReader(stdoutp),
-		cmd:    cmd,
+	res := &incommand{
+		pipe: stdoutp,
+		cmd:  cmd,
 	}
+	res.stdout, res.timed = newInputReader(stdoutp, timeout, interrupt)
 	return res, nil
 }
 
 type infile struct {
-	reader io.ByteReader
-	file   *os.File
+	reader *bufio.Reader
+	timed  *timedReader
+	file   io.Closer
+}
+
+func (inf infile) ReadSlice(delim byte) ([]byte, error) {
+	return inf.reader.ReadSlice(delim)
+}
+
+func (inf infile) Peek(n int) ([]byte, error) {
+	return inf.reader.Peek(n)
 }
 
-func (inf infile) ReadByte() (byte, error) {
-	return inf.reader.ReadByte()
+func (inf infile) Discard(n int) (int, error) {
+	return inf.reader.Discard(n)
+}
+
+func (inf infile) Buffered() int {
+	return inf.reader.Buffered()
 }
 
 func (inf infile) Close() error {
+	inf.timed.stop()
 	return inf.file.Close()
 }
 
-func spawnInFile(name string) (infile, error) {
-	file, err := os.Open(name)
+// Opens a file for input. "-" and the special files for standard input
+// refer to the standard input the interpreter was given.
+func (inter *interpreter) spawnInFile(name string) (io.Closer, error) {
+	if name == "-" || specialFd(name) == 0 {
+		return stdstream{inputReader: inter.stdinFile}, nil
+	}
+	return spawnInFile(inter.files, name, inter.charset, inter.readTimeout(name), inter.interruptChan())
+}
+
+func spawnInFile(files FileOpener, name string, cs *charset, timeout time.Duration, interrupt <-chan struct{}) (infile, error) {
+	file, err := files.Open(name)
 	if err != nil {
 		return infile{}, err
 	}
-	reader := bufio.NewReader(file)
-	return infile{
-		reader: reader,
-		file:   file,
-	}, nil
+	inf := infile{file: file}
+	inf.reader, inf.timed = newInputReader(cs.reader(file), timeout, interrupt)
+	return inf, nil
 }
 
-func (inter *interpreter) nextRecord(r io.ByteReader) (string, error) {
-	return nextRecord(r, inter.getRs())
+// Returns the timeout for reading from the named file or command, given in
+// milliseconds by PROCINFO[name, "READ_TIMEOUT"] or PROCINFO["READ_TIMEOUT"]
+// when the file is opened. 0 means no timeout.
+func (inter *interpreter) readTimeout(name string) time.Duration {
+	procinfo := inter.builtins[parser.Procinfo].Array
+	v, ok := procinfo[name+inter.getSubsep()+"READ_TIMEOUT"]
+	if !ok {
+		v = procinfo["READ_TIMEOUT"]
+	}
+	return time.Duration(inter.toNumber(v) * float64(time.Millisecond))
 }
 
-func (inter *interpreter) nextRecordCurrentFile() (string, error) {
-	s, err := inter.nextRecord(inter.currentFile)
+// Source of the records of the main input, used instead of the files named
+// in ARGV and standard input. RS does not apply to them. ReadRecord returns
+// io.EOF when there are no more records.
+type RecordReader interface {
+	ReadRecord() (string, error)
+}
+
+// RecordReader receiving records from a channel until it is closed
+type ChanRecords <-chan string
+
+func (ch ChanRecords) ReadRecord() (string, error) {
+	record, ok := <-ch
+	if !ok {
+		return "", io.EOF
+	}
+	return record, nil
+}
+
+// Reads the next record of r, setting RT to the text which terminated it
+func (inter *interpreter) nextRecord(r inputReader) (string, error) {
+	record, rt, err := nextRecord(r, inter.getRs(), inter.rsre)
 	if err == nil {
-		inter.builtins[parser.Nr] = Awknumber(inter.builtins[parser.Nr].Float() + 1)
-		inter.builtins[parser.Fnr] = Awknumber(inter.builtins[parser.Fnr].Float() + 1)
-		return s, err
-	} else if err != io.EOF {
-		return "", err
+		inter.builtins[parser.Rt] = Awknormalstring(rt)
+	}
+	return record, err
+}
+
+// Reads the next record of the main input, advancing through ARGV as files
+// run out. Only this function updates both NR and FNR.
+func (inter *interpreter) nextRecordCurrentFile() (string, error) {
+	if inter.records != nil {
+		s, err := inter.records.ReadRecord()
+		if err != nil {
+			return "", err
+		}
+		s = inter.firstRecord(s)
+		inter.countRecord()
+		inter.builtins[parser.Nr] = Awknumber(inter.toNumber(inter.builtins[parser.Nr]) + 1)
+		inter.builtins[parser.Fnr] = Awknumber(inter.toNumber(inter.builtins[parser.Fnr]) + 1)
+		return s, nil
+	}
+	for {
+		s, err := inter.nextRecord(inter.currentFile)
+		if err == nil {
+			s = inter.firstRecord(s)
+			inter.countRecord()
+			inter.builtins[parser.Nr] = Awknumber(inter.toNumber(inter.builtins[parser.Nr]) + 1)
+			inter.builtins[parser.Fnr] = Awknumber(inter.toNumber(inter.builtins[parser.Fnr]) + 1)
+			return s, nil
+		} else if err != io.EOF {
+			return "", err
+		}
+		more, err := inter.nextFile()
+		if err != nil {
+			return "", err
+		} else if !more {
+			return "", io.EOF
+		}
 	}
+}
+
+// Removes the byte order mark which begins the first record of a file, if
+// asked to. Editors and spreadsheets of Windows add one to UTF-8 files.
+func (inter *interpreter) firstRecord(s string) string {
+	if inter.stripbom && inter.toNumber(inter.builtins[parser.Fnr]) == 0 {
+		return strings.TrimPrefix(s, "\uFEFF")
+	}
+	return s
+}
+
+func (inter *interpreter) isAssignOperand(arg string) bool {
+	return !inter.params.NoAssignOperands && lexer.CommandLineAssignRegex.MatchString(arg)
+}
+
+// Closes the current input file and opens the next one named in ARGV,
+// resetting FNR. ARGV[0] is never an operand, and empty or missing elements
+// below ARGC are skipped. Standard input is used if no file operand is
+// found, even if there were assignment operands. Returns false when there
+// is no more input.
+// ARGC and ARGV are read again on every call, so that the program can add or
+// remove operands while the input is being processed.
+func (inter *interpreter) nextFile() (bool, error) {
 	if cl, ok := inter.currentFile.(io.Closer); ok {
 		if err := cl.Close(); err != nil {
-			return "", err
+			return false, err
 		}
 	}
+	inter.currentFile = nil
 	for {
-		inter.argindex++
-		if inter.argindex > int(inter.builtins[parser.Argc].Float()) {
+		// Never move past ARGC, so that operands appended later on are
+		// not skipped
+		if inter.argindex+1 >= int(inter.toNumber(inter.builtins[parser.Argc])) {
 			// No file has ever been processed, so start processing stdin
-			if inter.currentFile == nil {
-				inter.currentFile = inter.stdinFile
-				return inter.nextRecordCurrentFile()
+			if !inter.fileopened {
+				inter.fileopened = true
+				inter.currentFile = inter.countFile("-", inter.stdinFile)
+				return true, nil
 			}
-			break
+			return false, nil
 		}
+		inter.argindex++
 		fname := inter.toString(inter.builtins[parser.Argv].Array[fmt.Sprintf("%d", inter.argindex)])
 		if fname == "" {
 			continue
-		} else if lexer.CommandLineAssignRegex.MatchString(fname) {
+		} else if inter.isAssignOperand(fname) {
 			inter.assignCommandLineString(fname)
 			continue
-		} else if fname == "-" {
+		} else if fname == "-" || specialFd(fname) == 0 {
 			inter.currentFile = inter.stdinFile
 		} else {
-			file, err := os.Open(fname)
+			file, err := inter.files.Open(fname)
 			if err != nil {
-				return "", err
-			}
-			inter.currentFile = infile{
-				reader: bufio.NewReader(file),
-				file:   file,
+				return false, err
 			}
+			inf := infile{file: file}
+			inf.reader, inf.timed = newInputReader(inter.charset.reader(file), 0, inter.interruptChan())
+			inter.currentFile = inf
 		}
+		inter.currentFile = inter.countFile(fname, inter.currentFile)
+		inter.fileopened = true
 		inter.builtins[parser.Filename] = Awknormalstring(fname)
-		return inter.nextRecordCurrentFile()
+		inter.builtins[parser.Fnr] = Awknumber(0)
+		return true, nil
 	}
-	return s, io.EOF
 }
 
-func nextRecord(reader io.ByteReader, delim string) (string, error) {
-	if reader == nil {
-		return "", io.EOF
-	} else if delim == "" {
-		return nextMultilineRecord(reader)
-	} else {
-		return nextSimpleRecord(reader, delim[0])
+// Reads the next record, returning it together with the separator which
+// terminated it, empty at the end of the input. rsre is the regular
+// expression of RS if RS is one.
+func nextRecord(reader inputReader, rs string, rsre *regexp.Regexp) (string, string, error) {
+	switch {
+	case reader == nil:
+		return "", "", io.EOF
+	case rs == "":
+		return nextParagraph(reader)
+	case rsre != nil:
+		return nextRegexRecord(reader, rsre)
+	default:
+		return nextSimpleRecord(reader, rs[0])
 	}
 }
 
-func nextMultilineRecord(reader io.ByteReader) (string, error) {
-	var buff strings.Builder
-	err := skipBlanks(&buff, reader)
-	if err != nil {
-		return "", err
-	}
+var paragraphSeparator = regexp.MustCompile(`\n\n+`)
+
+// Reads a record separated by blank lines. The newlines before the first
+// record are skipped, and the ones ending the input terminate the last one.
+func nextParagraph(reader inputReader) (string, string, error) {
 	for {
-		s, err := nextSimpleRecord(reader, '\n')
+		b, err := reader.Peek(1)
 		if err != nil {
-			return handleEndOfInput(buff.String(), err)
+			return "", "", err
 		}
-		if s == "" {
+		if b[0] != '\n' {
 			break
 		}
-		fmt.Fprintf(&buff, "\n%s", s)
+		reader.Discard(1)
+	}
+	record, rt, err := nextRegexRecord(reader, paragraphSeparator)
+	if err == nil && rt == "" {
+		trimmed := strings.TrimRight(record, "\n")
+		record, rt = trimmed, record[len(trimmed):]
 	}
-	return buff.String(), nil
+	return record, rt, err
 }
 
-func nextSimpleRecord(reader io.ByteReader, delim byte) (string, error) {
-	var buff strings.Builder
+// Reads up to the next non empty match of re. A match reaching the end of
+// what has been read could be longer, so it is accepted only once more is
+// read or the input ends.
+func nextRegexRecord(reader inputReader, re *regexp.Regexp) (string, string, error) {
+	var buff []byte
 	for {
-		c, err := reader.ReadByte()
+		chunk, err := reader.Peek(1)
+		if err == nil {
+			chunk, err = reader.Peek(reader.Buffered())
+		}
 		if err != nil {
-			return handleEndOfInput(buff.String(), err)
+			if loc := separatorMatch(re, buff); loc != nil && err == io.EOF {
+				return string(buff[:loc[0]]), string(buff[loc[0]:loc[1]]), nil
+			}
+			record, err := handleEndOfInput(string(buff), err)
+			return record, "", err
 		}
-		if c == delim {
-			break
+		data := append(buff, chunk...)
+		if loc := separatorMatch(re, data); loc != nil && loc[1] < len(data) {
+			reader.Discard(loc[1] - len(buff))
+			return string(data[:loc[0]]), string(data[loc[0]:loc[1]]), nil
 		}
-		buff.WriteByte(c)
+		reader.Discard(len(chunk))
+		buff = data
 	}
-	return buff.String(), nil
 }
 
-func skipBlanks(buff io.Writer, reader io.ByteReader) error {
-	for {
-		s, err := nextSimpleRecord(reader, '\n')
-		if err != nil {
-			return err
-		}
-		if s != "" {
-			fmt.Fprintf(buff, "%s", s)
-			break
+// Returns the position of the first non empty match of re in data
+func separatorMatch(re *regexp.Regexp, data []byte) []int {
+	loc := re.FindIndex(data)
+	if loc == nil || loc[0] < loc[1] {
+		return loc
+	}
+	for _, loc := range re.FindAllIndex(data, -1) {
+		if loc[0] < loc[1] {
+			return loc
 		}
 	}
 	return nil
 }
 
+// Reads up to the next delim. The record is copied once from the buffer of
+// the reader, unless it does not fit in it.
+func nextSimpleRecord(reader inputReader, delim byte) (string, string, error) {
+	line, err := reader.ReadSlice(delim)
+	if err == nil {
+		return string(line[:len(line)-1]), string(delim), nil
+	} else if err != bufio.ErrBufferFull {
+		record, err := handleEndOfInput(string(line), err)
+		return record, "", err
+	}
+	buff := append([]byte(nil), line...)
+	for err == bufio.ErrBufferFull {
+		line, err = reader.ReadSlice(delim)
+		buff = append(buff, line...)
+	}
+	if err == nil {
+		return string(buff[:len(buff)-1]), string(delim), nil
+	}
+	record, err := handleEndOfInput(string(buff), err)
+	return record, "", err
+}
+
+// Ends the record which the end of the input cut, in the same way for every
+// RS: the text read since the last separator is the last record, unless it
+// is empty. A separator ending the input does not start an empty record,
+// but two separators do ("a\n\n" holds the records "a" and "" with the
+// default RS).
 func handleEndOfInput(cum string, err error) (string, error) {
 	if err != io.EOF {
 		return "", err
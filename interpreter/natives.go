@@ -7,6 +7,8 @@
 package interpreter
 
 import (
+	"fmt"
+
 	"github.com/fioriandrea/aawk/lexer"
 	"github.com/fioriandrea/aawk/parser"
 )
@@ -24,8 +26,10 @@ func (s NativeStr) String() string {
 	return string(s)
 }
 
+// Hexadecimal integers are converted as the interpreter does outside POSIX
+// mode
 func (s NativeStr) Float() float64 {
-	return Awknormalstring(s.String()).Float()
+	return stringToNumber(string(s), true)
 }
 
 func (s NativeStr) Bool() bool {
@@ -33,7 +37,21 @@ func (s NativeStr) Bool() bool {
 }
 
 func (s NativeStr) Int() int {
-	return int(Awknormalstring(s.String()).Float())
+	return int(s.Float())
+}
+
+// A string passed to a native function in POSIX mode, where hexadecimal
+// integers are not converted
+type posixNativeStr struct {
+	NativeStr
+}
+
+func (s posixNativeStr) Float() float64 {
+	return stringToNumber(string(s.NativeStr), false)
+}
+
+func (s posixNativeStr) Int() int {
+	return int(s.Float())
 }
 
 type NativeNum float64
@@ -56,6 +74,46 @@ func (n NativeNum) Int() int {
 
 type NativeFunction func(...NativeVal) (NativeVal, error)
 
+// A native function which can read and modify the fields of the current
+// record
+type FieldNativeFunction func(Fields, ...NativeVal) (NativeVal, error)
+
+// The fields of the current record, as seen by the program
+type Fields interface {
+	NF() int
+	// Returns $i, or the empty string if i is out of range
+	Field(i int) string
+	// Assigns $i like the program would: setting $0 splits it again,
+	// setting another field rebuilds $0 and may increase NF
+	SetField(i int, v string) error
+	// Assigns NF, rebuilding $0
+	SetNF(nf int) error
+}
+
+type nativeFields struct {
+	inter *interpreter
+}
+
+func (f nativeFields) NF() int {
+	return int(f.inter.toNumber(f.inter.builtins[parser.Nf]))
+}
+
+func (f nativeFields) Field(i int) string {
+	return f.inter.toString(f.inter.getField(i))
+}
+
+func (f nativeFields) SetField(i int, v string) error {
+	if i < 0 {
+		return fmt.Errorf("cannot access negative field %d", i)
+	}
+	f.inter.setField(i, f.inter.numericString(v))
+	return nil
+}
+
+func (f nativeFields) SetNF(nf int) error {
+	return f.inter.setBuiltin(parser.Nf, Awknumber(float64(nf)))
+}
+
 func (inter *interpreter) evalNativeFunction(called lexer.Token, nf NativeFunction, exprargs []parser.Expr) (Awkvalue, error) {
 	// Collect arguments
 	args := make([]Awkvalue, 0)
@@ -65,11 +123,14 @@ func (inter *interpreter) evalNativeFunction(called lexer.Token, nf NativeFuncti
 		if err != nil {
 			return Awknull, err
 		}
+		if awkarg.Typ == Array {
+			return Awknull, inter.runtimeError(expr.Token(), "cannot pass an array to a native function")
+		}
 		args = append(args, awkarg)
 	}
 	nativeargs := make([]NativeVal, 0, len(args))
 	for _, arg := range args {
-		nativeargs = append(nativeargs, awkValToNativeVal(arg))
+		nativeargs = append(nativeargs, inter.awkValToNativeVal(arg))
 	}
 	res, err := nf(nativeargs...)
 	if err != nil {
@@ -78,11 +139,14 @@ func (inter *interpreter) evalNativeFunction(called lexer.Token, nf NativeFuncti
 	return nativeValToAwkVal(res), nil
 }
 
-func awkValToNativeVal(v Awkvalue) NativeVal {
+func (inter *interpreter) awkValToNativeVal(v Awkvalue) NativeVal {
 	switch v.Typ {
 	case Normalstring:
+		if inter.posix {
+			return posixNativeStr{NativeStr(v.Str)}
+		}
 		return NativeStr(v.Str)
-	case Numericstring:
+	case Number, Numericstring:
 		return NativeNum(v.N)
 	case Null:
 		return nil
@@ -93,13 +157,14 @@ func awkValToNativeVal(v Awkvalue) NativeVal {
 
 func nativeValToAwkVal(nv NativeVal) Awkvalue {
 	switch vv := nv.(type) {
-	case NativeStr:
+	case NativeStr, posixNativeStr:
 		return Awknormalstring(vv.String())
 	case NativeNum:
 		return Awknumber(vv.Float())
 	case nil:
 		return Awknull
 	default:
-		panic("unreachable")
+		// Other implementations provided by the embedder
+		return Awknormalstring(vv.String())
 	}
 }
@@ -0,0 +1,47 @@
+/*
+ * Copyright (C) 2021 Andrea Fiori <andrea.fiori.1998@gmail.com>
+ *
+ * Licensed under GPLv2, see file LICENSE in this source tree.
+ */
+
+package interpreter
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestNativeStringToNumber(t *testing.T) {
+	natives := map[string]NativeFunction{
+		"num": func(args ...NativeVal) (NativeVal, error) {
+			return NativeNum(args[0].Float() + float64(args[0].Int())), nil
+		},
+	}
+	for _, test := range []struct {
+		posix    bool
+		expected string
+	}{
+		{false, "32 24\n"},
+		{true, "0 24\n"},
+	} {
+		p, errs := NewProgram(CommandLine{
+			Fs:      " ",
+			Program: strings.NewReader(`BEGIN { print num("0x10"), num(" 12abc") }`),
+			Natives: natives,
+			Posix:   test.posix,
+		})
+		if len(errs) > 0 {
+			t.Fatal(errs[0])
+		}
+		var out bytes.Buffer
+		for _, err := range p.Run(strings.NewReader(""), &out, &out) {
+			if _, ok := err.(ErrorExit); !ok {
+				t.Fatal(err)
+			}
+		}
+		if out.String() != test.expected {
+			t.Errorf("posix %v: printed %q, expected %q", test.posix, out.String(), test.expected)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+/*
+ * Copyright (C) 2021 Andrea Fiori <andrea.fiori.1998@gmail.com>
+ *
+ * Licensed under GPLv2, see file LICENSE in this source tree.
+ */
+
+package interpreter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/fioriandrea/aawk/lexer"
+	"github.com/fioriandrea/aawk/parser"
+)
+
+// Records are handed to the workers in batches, so that synchronization
+// does not cost more than processing them
+const batchSize = 256
+
+type parallelRecord struct {
+	text     string
+	nr       float64
+	fnr      float64
+	filename Awkvalue
+	rt       Awkvalue
+}
+
+type recordBatch struct {
+	seq     int
+	records []parallelRecord
+}
+
+type batchResult struct {
+	seq    int
+	out    []byte
+	fields []Awkvalue // The fields of the last record, as left by the rules
+	err    error
+}
+
+// Returns the plan to run the main rules in parallel, or an error
+// explaining why they cannot be
+func (inter *interpreter) parallelPlan() (parser.ParallelPlan, error) {
+	if inter.printfunc != nil || inter.beforehook != nil || inter.afterhook != nil {
+		return parser.ParallelPlan{}, errors.New("print callbacks and record hooks need the records in order")
+	}
+	argc := int(inter.toNumber(inter.builtins[parser.Argc]))
+	for i := inter.argindex + 1; i < argc; i++ {
+		arg := inter.toString(inter.builtins[parser.Argv].Array[fmt.Sprintf("%d", i)])
+		if inter.isAssignOperand(arg) {
+			return parser.ParallelPlan{}, fmt.Errorf("assignment %s among the operands", arg)
+		}
+	}
+	return parser.PlanParallel(inter.items)
+}
+
+// Reads the input in this goroutine's stead and runs the main rules on
+// batches of records in separate interpreters, each starting from the
+// state left by BEGIN. The output of the batches is written in the order
+// of the input, and the accumulators of the workers are added to the ones
+// of this interpreter.
+func (inter *interpreter) runNormalsParallel(plan parser.ParallelPlan) error {
+	workers := make([]*interpreter, inter.parallel)
+	for i := range workers {
+		workers[i] = inter.newWorker(plan)
+	}
+
+	batches := make(chan recordBatch)
+	results := make(chan batchResult)
+	done := make(chan struct{})
+	readerdone := make(chan struct{})
+
+	var readerr error
+	go func() {
+		defer close(readerdone)
+		defer close(batches)
+		batch := recordBatch{}
+		send := func() bool {
+			select {
+			case batches <- batch:
+				batch = recordBatch{seq: batch.seq + 1}
+				return true
+			case <-done:
+				return false
+			}
+		}
+		for {
+			text, err := inter.nextRecordCurrentFile()
+			if err != nil {
+				if err != io.EOF {
+					readerr = err
+				}
+				break
+			}
+			batch.records = append(batch.records, parallelRecord{
+				text:     text,
+				nr:       inter.builtins[parser.Nr].N,
+				fnr:      inter.builtins[parser.Fnr].N,
+				filename: inter.builtins[parser.Filename],
+				rt:       inter.builtins[parser.Rt],
+			})
+			if len(batch.records) == batchSize && !send() {
+				return
+			}
+		}
+		if len(batch.records) > 0 {
+			send()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for _, w := range workers {
+		w := w
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				select {
+				case results <- w.processBatch(batch):
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	pending := map[int]batchResult{}
+	next := 0
+	var last []Awkvalue
+	var err error
+	for res := range results {
+		if err != nil {
+			continue
+		}
+		if res.err != nil {
+			err = res.err
+			close(done)
+			continue
+		}
+		pending[res.seq] = res
+		for res, ok := pending[next]; ok && err == nil; res, ok = pending[next] {
+			last = res.fields
+			if _, werr := inter.bufstdout.Write(res.out); werr != nil {
+				err = werr
+				if isBrokenPipe(werr) {
+					err = errBrokenPipe
+				}
+				close(done)
+			}
+			delete(pending, next)
+			next++
+		}
+	}
+	<-readerdone
+	if err != nil {
+		return err
+	}
+	if readerr != nil {
+		return readerr
+	}
+
+	for index := range plan.Accumulators {
+		for _, w := range workers {
+			inter.globals[index] = inter.addAccumulator(inter.globals[index], w.globals[index])
+		}
+	}
+	if inter.stats != nil {
+		for _, w := range workers {
+			for i, n := range w.stats.matched {
+				inter.stats.matched[i] += n
+			}
+		}
+	}
+	// END sees the last record as the rules left it
+	if last != nil {
+		inter.fields.fields = last
+		inter.builtins[parser.Nf] = Awknumber(float64(inter.fields.nf()))
+	}
+	return nil
+}
+
+// Creates an interpreter with a copy of the variables of inter, except for
+// the accumulators, which start empty
+func (inter *interpreter) newWorker(plan parser.ParallelPlan) *interpreter {
+	w := &interpreter{}
+	w.initialize(inter.params)
+	w.parallel = 0
+	w.autoflush = false
+	for i, v := range inter.globals {
+		if !plan.Accumulators[i] {
+			w.globals[i] = copyValue(v)
+		}
+	}
+	for i, v := range inter.builtins {
+		if i != parser.Nf {
+			w.setBuiltin(i, copyValue(v))
+		}
+	}
+	return w
+}
+
+func (inter *interpreter) processBatch(batch recordBatch) batchResult {
+	var out bytes.Buffer
+	inter.bufstdout.Reset(&out)
+	for _, r := range batch.records {
+		inter.builtins[parser.Nr] = Awknumber(r.nr)
+		inter.builtins[parser.Fnr] = Awknumber(r.fnr)
+		inter.builtins[parser.Filename] = r.filename
+		inter.builtins[parser.Rt] = r.rt
+		if err := inter.processRecord(r.text); err != nil {
+			return batchResult{seq: batch.seq, err: err}
+		}
+	}
+	if err := inter.bufstdout.Flush(); err != nil {
+		return batchResult{seq: batch.seq, err: err}
+	}
+	fields := append([]Awkvalue(nil), inter.fields.fields...)
+	return batchResult{seq: batch.seq, out: out.Bytes(), fields: fields}
+}
+
+func copyValue(v Awkvalue) Awkvalue {
+	v = derefArray(&v)
+	if v.Typ == Array {
+		return Awkarray(copyArray(v.Array))
+	}
+	v.ref = nil
+	return v
+}
+
+// Adds the value accumulated by a worker to the one of the interpreter.
+// Arrays are added element by element.
+func (inter *interpreter) addAccumulator(into, v Awkvalue) Awkvalue {
+	switch v.Typ {
+	case Null:
+		return into
+	case Array:
+		into = nullToArray(into, lexer.Token{})
+		for k, e := range v.Array {
+			into.Array[k] = Awknumber(inter.toNumber(into.Array[k]) + inter.toNumber(e))
+		}
+		return into
+	default:
+		return Awknumber(inter.toNumber(into) + inter.toNumber(v))
+	}
+}
@@ -0,0 +1,68 @@
+/*
+ * Copyright (C) 2021 Andrea Fiori <andrea.fiori.1998@gmail.com>
+ *
+ * Licensed under GPLv2, see file LICENSE in this source tree.
+ */
+
+package interpreter
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Runs program over input with the given number of workers, returning
+// stdout and stderr
+func runWorkers(t *testing.T, program string, input string, parallel int) (string, string) {
+	p, errs := NewProgram(CommandLine{
+		Fs:       " ",
+		Program:  strings.NewReader(program),
+		Parallel: parallel,
+	})
+	if len(errs) > 0 {
+		t.Fatal(errs[0])
+	}
+	var stdout, stderr bytes.Buffer
+	for _, err := range p.Run(strings.NewReader(input), &stdout, &stderr) {
+		if _, ok := err.(ErrorExit); !ok {
+			t.Fatalf("%s: %s", program, err)
+		}
+	}
+	return stdout.String(), stderr.String()
+}
+
+func TestParallel(t *testing.T) {
+	var lines strings.Builder
+	for i := 1; i <= 1000; i++ {
+		fmt.Fprintf(&lines, "k%d %d %d\n", i%7, i, i*2)
+	}
+	many := lines.String()
+	tests := []struct {
+		program, input string
+	}{
+		{`{ $2 = "x" } END { print; print NF }`, "1000 2000 3000\n"},
+		{`{ $2 = "x" } END { print; print NF }`, many},
+		{`{ $5 = "y" } END { print; print NF }`, many},
+		{`{ sub(/0/, "z") } END { print; print $1 }`, many},
+		{`{ gsub(/[0-9]/, "") } END { print; print NF }`, many},
+		{`{ NF = 1 } END { print; print NF }`, many},
+		{`{ print $2 } END { print $0 }`, many},
+		{`BEGIN { n = "0x10" } { n += 1 } END { print n }`, many},
+		{`BEGIN { n = "12abc" } { n += $2 } END { print n }`, many},
+		{`{ n += $2; m++ } END { print n, m }`, many},
+		{`{ c[$1]++; s[$1] += $3 } END { for (i = 0; i < 7; i++) print c["k" i], s["k" i] }`, many},
+		{`BEGIN { s["k1"] = "0x10"; s["k2"] = "5 apples" } { s[$1] += $2 } END { print s["k1"], s["k2"], s["k3"] }`, many},
+	}
+	for _, test := range tests {
+		expected, _ := runWorkers(t, test.program, test.input, 1)
+		got, stderr := runWorkers(t, test.program, test.input, 4)
+		if stderr != "" {
+			t.Errorf("%s: not run in parallel: %s", test.program, stderr)
+		}
+		if got != expected {
+			t.Errorf("%s: parallel output\n%s\nsequential output\n%s", test.program, got, expected)
+		}
+	}
+}
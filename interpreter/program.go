@@ -0,0 +1,120 @@
+/*
+ * Copyright (C) 2021 Andrea Fiori <andrea.fiori.1998@gmail.com>
+ *
+ * Licensed under GPLv2, see file LICENSE in this source tree.
+ */
+
+package interpreter
+
+import (
+	"io"
+	"strings"
+
+	"github.com/fioriandrea/aawk/parser"
+)
+
+// A program parsed once, which can be run any number of times. Every run
+// starts from a fresh state: variables, fields, random seed and open files
+// and commands of previous runs are not visible to it.
+type Program struct {
+	cl       CommandLine
+	compiled parser.CompiledProgram
+}
+
+// Compiles the program of the command line. The other options of the command
+// line (FS, assignments, natives...) apply to every run.
+func NewProgram(cl CommandLine) (*Program, []error) {
+	compiled, errs := CompileCL(cl)
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	cl.Program = nil
+	cl.ProgramFiles = nil
+	return &Program{
+		cl:       cl,
+		compiled: compiled,
+	}, nil
+}
+
+// Warnings found while compiling the program
+func (p *Program) Warnings() []error {
+	return p.compiled.Warnings
+}
+
+// Runs the program reading from stdin and writing to stdout and stderr. The
+// arguments are the operands of the command line (files and assignments);
+// if there are none, the arguments of the compiled command line are used.
+// The result contains an ErrorExit with the exit status if the program
+// terminated without errors.
+func (p *Program) Run(stdin io.Reader, stdout, stderr io.Writer, arguments ...string) []error {
+	return p.NewInterp(stdin, stdout, stderr, arguments...).Run()
+}
+
+// Prepares a run of the program like Run does, without starting it, so that
+// its variables can be accessed before and after the run
+func (p *Program) NewInterp(stdin io.Reader, stdout, stderr io.Writer, arguments ...string) *Interp {
+	cl := p.cl
+	cl.Stdin = stdin
+	cl.Stdout = stdout
+	cl.Stderr = stderr
+	if len(arguments) > 0 {
+		cl.Arguments = arguments
+	}
+	return NewInterp(RunParams{
+		CompiledProgram: p.compiled,
+		CommandLine:     cl,
+	})
+}
+
+// Runs the program over the records read from records, writing to stdout
+// and stderr
+func (p *Program) RunRecords(records RecordReader, stdout, stderr io.Writer) []error {
+	cl := p.cl
+	cl.Records = records
+	cl.Stdin = strings.NewReader("")
+	cl.Stdout = stdout
+	cl.Stderr = stderr
+	return Exec(RunParams{
+		CompiledProgram: p.compiled,
+		CommandLine:     cl,
+	})
+}
+
+// Runs program once over input, writing its output to output, as the
+// command line aawk program would. A nil input is empty and a nil output
+// discards what is written. vars are set before BEGIN, as by -v but
+// without processing escape sequences, and can include built-in variables
+// such as FS; variables the program does not use are ignored. Diagnostics
+// are not printed: the first error is returned instead, with an ErrorExit
+// if the program exited with a non-zero status.
+func Evaluate(program string, input io.Reader, output io.Writer, vars map[string]string) error {
+	if input == nil {
+		input = strings.NewReader("")
+	}
+	if output == nil {
+		output = io.Discard
+	}
+	p, errs := NewProgram(CommandLine{
+		Fs:      " ",
+		Program: strings.NewReader(program),
+	})
+	if len(errs) > 0 {
+		return errs[0]
+	}
+	it := p.NewInterp(input, output, io.Discard)
+	for name, value := range vars {
+		if _, ok := it.GetGlobal(name); !ok {
+			// Not used by the program
+			continue
+		}
+		if err := it.SetGlobal(name, Awknumericstring(value)); err != nil {
+			return err
+		}
+	}
+	for _, err := range it.Run() {
+		if ee, ok := err.(ErrorExit); !ok || ee.Status != 0 {
+			return err
+		}
+	}
+	return nil
+}
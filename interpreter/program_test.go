@@ -0,0 +1,261 @@
+/*
+ * Copyright (C) 2021 Andrea Fiori <andrea.fiori.1998@gmail.com>
+ *
+ * Licensed under GPLv2, see file LICENSE in this source tree.
+ */
+
+package interpreter
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestConcurrentRuns(t *testing.T) {
+	p, errs := NewProgram(CommandLine{
+		Fs:                " ",
+		Program:           strings.NewReader(`BEGIN { srand(1); r = rand() } { n += $1 } END { print n, r, run }`),
+		DeterministicRand: true,
+	})
+	if len(errs) > 0 {
+		t.Fatal(errs[0])
+	}
+	var wg sync.WaitGroup
+	outs := make([]bytes.Buffer, 8)
+	for i := range outs {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			input := strings.NewReader(fmt.Sprintf("%d\n%d\n", i, i))
+			p.Run(input, &outs[i], &outs[i], fmt.Sprintf("run=%d", i), "-")
+		}()
+	}
+	wg.Wait()
+	first := strings.Fields(outs[0].String())
+	for i := range outs {
+		fields := strings.Fields(outs[i].String())
+		if len(fields) != 3 || fields[0] != fmt.Sprint(2*i) || fields[1] != first[1] || fields[2] != fmt.Sprint(i) {
+			t.Errorf("run %d printed %q", i, outs[i].String())
+		}
+	}
+}
+
+func TestProgramFreshState(t *testing.T) {
+	p, errs := NewProgram(CommandLine{
+		Fs:      " ",
+		Program: strings.NewReader(`{ n++; seen[$1]++; last = $0 } END { print n, length(seen), last, NR, $0 }`),
+	})
+	if len(errs) > 0 {
+		t.Fatal(errs[0])
+	}
+	for _, test := range []struct {
+		input, expected string
+	}{
+		{"a\nb\nc\n", "3 3 c 3 c\n"},
+		{"d\n", "1 1 d 1 d\n"},
+		{"", " 0  0 \n"},
+	} {
+		var out bytes.Buffer
+		for _, err := range p.Run(strings.NewReader(test.input), &out, &out) {
+			if _, ok := err.(ErrorExit); !ok {
+				t.Fatal(err)
+			}
+		}
+		if out.String() != test.expected {
+			t.Errorf("input %q: printed %q, expected %q", test.input, out.String(), test.expected)
+		}
+	}
+}
+
+func TestRunRecords(t *testing.T) {
+	p, errs := NewProgram(CommandLine{
+		Fs:      " ",
+		Program: strings.NewReader(`{ print NR, $2, FILENAME } END { print NR }`),
+	})
+	if len(errs) > 0 {
+		t.Fatal(errs[0])
+	}
+	ch := make(chan string)
+	go func() {
+		for _, record := range []string{"a b", "c d e", ""} {
+			ch <- record
+		}
+		close(ch)
+	}()
+	var out bytes.Buffer
+	for _, err := range p.RunRecords(ChanRecords(ch), &out, &out) {
+		if _, ok := err.(ErrorExit); !ok {
+			t.Fatal(err)
+		}
+	}
+	if expected := "1 b \n2 d \n3  \n3\n"; out.String() != expected {
+		t.Errorf("printed %q, expected %q", out.String(), expected)
+	}
+}
+
+func TestPrintFunc(t *testing.T) {
+	var printed []string
+	cl := CommandLine{
+		Program: strings.NewReader(`BEGIN { OFS = "-" } { print; print $2, NR; print "file" > "/dev/stderr"; printf "%s|", $1 }`),
+		PrintFunc: func(fields []string, record string) {
+			printed = append(printed, fmt.Sprintf("%q %s", fields, record))
+		},
+	}
+	out, stderr, errs := runCL(t, cl, "a b\nc d\n")
+	if len(errs) > 0 {
+		t.Fatal(errs[0])
+	}
+	expected := []string{
+		`["a" "b"] a b`, `["b" "1"] b-1`,
+		`["c" "d"] c d`, `["d" "2"] d-2`,
+	}
+	if !reflect.DeepEqual(printed, expected) {
+		t.Errorf("PrintFunc received %q, expected %q", printed, expected)
+	}
+	if out != "a|c|" || stderr != "file\nfile\n" {
+		t.Errorf("printed %q on stdout and %q on stderr", out, stderr)
+	}
+}
+
+func TestGlobals(t *testing.T) {
+	p, errs := NewProgram(CommandLine{
+		Fs:      " ",
+		Program: strings.NewReader(`BEGIN { print x + 1, FS == ":" } { count[$1]++ } END { print NF; total = NR }`),
+	})
+	if len(errs) > 0 {
+		t.Fatal(errs[0])
+	}
+	var out bytes.Buffer
+	it := p.NewInterp(strings.NewReader("a:b\na\n"), &out, &out)
+	for _, v := range []Awkvalue{Awknumber(41), Awknormalstring("str"), Awknumericstring("1e1")} {
+		if err := it.SetGlobal("x", v); err != nil {
+			t.Fatal(err)
+		}
+		if got, ok := it.GetGlobal("x"); !ok || !reflect.DeepEqual(got, v) {
+			t.Errorf("x set to %v is %v", v, got)
+		}
+	}
+	if err := it.SetGlobal("FS", Awknormalstring(":")); err != nil {
+		t.Fatal(err)
+	}
+	if err := it.SetGlobal("undefined", Awknumber(1)); err == nil {
+		t.Errorf("setting a variable the program does not use did not fail")
+	}
+	if _, ok := it.GetGlobal("undefined"); ok {
+		t.Errorf("a variable the program does not use exists")
+	}
+	for _, err := range it.Run() {
+		if _, ok := err.(ErrorExit); !ok {
+			t.Fatal(err)
+		}
+	}
+	if expected := "11 1\n1\n"; out.String() != expected {
+		t.Errorf("printed %q, expected %q", out.String(), expected)
+	}
+	if total, _ := it.GetGlobal("total"); total.N != 2 {
+		t.Errorf("total is %v after the run", total)
+	}
+	count, _ := it.GetGlobal("count")
+	if count.Typ != Array || count.Array["a"].N != 2 || len(count.Array) != 1 {
+		t.Errorf("count is %v after the run", count)
+	}
+}
+
+func TestRecordHooks(t *testing.T) {
+	var seen []string
+	cl := CommandLine{
+		Program: strings.NewReader(`{ $1 = toupper($1); print } END { print "end", NR }`),
+		BeforeRecord: func(info RecordInfo) bool {
+			seen = append(seen, fmt.Sprintf("before %d %d %s %s", info.NR, info.FNR, info.Filename, info.Record))
+			return info.Record != "stop"
+		},
+		AfterRecord: func(info RecordInfo) bool {
+			seen = append(seen, fmt.Sprintf("after %d %s", info.NR, info.Record))
+			return true
+		},
+	}
+	out, _, errs := runCL(t, cl, "a x\nb\nstop\nc\n")
+	if len(errs) > 0 {
+		t.Fatal(errs[0])
+	}
+	if expected := "A x\nB\nend 3\n"; out != expected {
+		t.Errorf("printed %q, expected %q", out, expected)
+	}
+	expected := []string{
+		"before 1 1  a x", "after 1 A x",
+		"before 2 2  b", "after 2 B",
+		"before 3 3  stop",
+	}
+	if !reflect.DeepEqual(seen, expected) {
+		t.Errorf("hooks saw %q, expected %q", seen, expected)
+	}
+
+	cl = CommandLine{
+		Program:     strings.NewReader(`{ print } END { print "end", NR }`),
+		AfterRecord: func(info RecordInfo) bool { return info.NR < 2 },
+	}
+	if out, _, _ := runCL(t, cl, "a\nb\nc\n"); out != "a\nb\nend 2\n" {
+		t.Errorf("stopping after the second record printed %q", out)
+	}
+}
+
+func TestFieldNatives(t *testing.T) {
+	cl := CommandLine{
+		Program: strings.NewReader(`{ print swap(1, 2), $0, NF; truncate(1); print $0, NF; print setfield(-1) }`),
+		FieldNatives: map[string]FieldNativeFunction{
+			"swap": func(f Fields, args ...NativeVal) (NativeVal, error) {
+				i, j := args[0].Int(), args[1].Int()
+				fi, fj := f.Field(i), f.Field(j)
+				if err := f.SetField(i, fj); err != nil {
+					return nil, err
+				}
+				return NativeNum(f.NF()), f.SetField(j, fi)
+			},
+			"truncate": func(f Fields, args ...NativeVal) (NativeVal, error) {
+				return nil, f.SetNF(args[0].Int())
+			},
+			"setfield": func(f Fields, args ...NativeVal) (NativeVal, error) {
+				return nil, f.SetField(args[0].Int(), "x")
+			},
+		},
+	}
+	out, _, errs := runCL(t, cl, "a b c\n")
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "negative field") {
+		t.Errorf("errors %v, expected one about a negative field", errs)
+	}
+	if expected := "3 b a c 3\nb 1\n"; out != expected {
+		t.Errorf("printed %q, expected %q", out, expected)
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	var out bytes.Buffer
+	err := Evaluate(`{ s += $2 } END { print s * k, FS }`, strings.NewReader("a:1\nb:2\n"), &out, map[string]string{"k": "10", "FS": ":", "unused": "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "30 :\n"; out.String() != expected {
+		t.Errorf("printed %q, expected %q", out.String(), expected)
+	}
+	if err := Evaluate(`BEGIN { print 1`, nil, nil, nil); err == nil {
+		t.Errorf("evaluating an invalid program did not fail")
+	}
+	if err := Evaluate(`BEGIN { x = 1; x[1] = 2 }`, nil, nil, nil); err == nil {
+		t.Errorf("evaluating an invalid use of a variable did not fail")
+	}
+	if err := Evaluate(`BEGIN { NF = -1 }`, nil, nil, nil); err == nil {
+		t.Errorf("evaluating a program failing at run time did not fail")
+	}
+	err = Evaluate(`BEGIN { exit 3 }`, nil, nil, nil)
+	if ee, ok := err.(ErrorExit); !ok || ee.Status != 3 {
+		t.Errorf("exit 3 returned %v", err)
+	}
+	if err := Evaluate(`BEGIN { exit 0 }`, nil, nil, nil); err != nil {
+		t.Errorf("exit 0 returned %v", err)
+	}
+}
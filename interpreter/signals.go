@@ -0,0 +1,104 @@
+/*
+ * Copyright (C) 2021 Andrea Fiori <andrea.fiori.1998@gmail.com>
+ *
+ * Licensed under GPLv2, see file LICENSE in this source tree.
+ */
+
+package interpreter
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+)
+
+// Signals are received by a separate goroutine, which only records them.
+// The interpreter acts on them between records and between iterations of
+// loops, and reads of input give up as soon as SIGINT or SIGTERM arrive.
+
+var errInterrupted = errors.New("interrupted")
+
+type signalState struct {
+	notify    chan os.Signal
+	interrupt chan struct{} // Closed on the first SIGINT or SIGTERM
+	first     int32         // Number of the first SIGINT or SIGTERM
+	count     int32         // SIGINT and SIGTERM received
+	handled   int32         // Those already acted upon
+	hup       int32         // Set on SIGHUP, until the output files are closed
+	runend    bool
+}
+
+func (inter *interpreter) catchSignals(runend bool) {
+	ss := &signalState{
+		notify:    make(chan os.Signal, 1),
+		interrupt: make(chan struct{}),
+		runend:    runend,
+	}
+	signal.Notify(ss.notify, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		for sig := range ss.notify {
+			if sig == syscall.SIGHUP {
+				atomic.StoreInt32(&ss.hup, 1)
+				continue
+			}
+			if atomic.CompareAndSwapInt32(&ss.first, 0, int32(sig.(syscall.Signal))) {
+				close(ss.interrupt)
+			}
+			atomic.AddInt32(&ss.count, 1)
+		}
+	}()
+	inter.signals = ss
+}
+
+func (inter *interpreter) stopSignals() {
+	if inter.signals != nil {
+		signal.Stop(inter.signals.notify)
+		close(inter.signals.notify)
+	}
+}
+
+// Closed when the program must stop, nil if signals are not caught
+func (inter *interpreter) interruptChan() <-chan struct{} {
+	if inter.signals == nil {
+		return nil
+	}
+	return inter.signals.interrupt
+}
+
+// Returns errInterrupted after SIGINT or SIGTERM. After SIGHUP, the output
+// files are closed, to be reopened in append mode when written to again,
+// so that they can be rotated.
+func (inter *interpreter) checkSignals() error {
+	ss := inter.signals
+	if ss == nil {
+		return nil
+	}
+	if atomic.LoadInt32(&ss.count) > ss.handled {
+		return errInterrupted
+	}
+	if atomic.CompareAndSwapInt32(&ss.hup, 1, 0) {
+		return inter.outfiles.evictAll()
+	}
+	return nil
+}
+
+// Terminates the program after SIGINT or SIGTERM, running the END actions
+// if asked to. Another signal stops them, and input cannot be read while
+// they run. The exit status is the one of a process killed by the first
+// signal, unless END calls exit.
+func (inter *interpreter) interrupted() error {
+	ss := inter.signals
+	status := 128 + int(atomic.LoadInt32(&ss.first))
+	if ss.runend {
+		ss.handled = atomic.LoadInt32(&ss.count)
+		err := inter.runEnds()
+		if ee, ok := err.(ErrorExit); ok {
+			return ee
+		} else if err != nil && err != errInterrupted {
+			return err
+		}
+	}
+	return ErrorExit{Status: status}
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright (C) 2021 Andrea Fiori <andrea.fiori.1998@gmail.com>
+ *
+ * Licensed under GPLv2, see file LICENSE in this source tree.
+ */
+
+package interpreter
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/fioriandrea/aawk/lexer"
+	"github.com/fioriandrea/aawk/parser"
+)
+
+// Sorts the keys of a for-in loop according to PROCINFO["sorted_in"], which
+// can either be one of the predefined orderings (e.g. "@ind_num_asc") or the
+// name of a user defined function comparing (i1, v1, i2, v2).
+func (inter *interpreter) sortKeys(fortok lexer.Token, keys []string, arr map[string]Awkvalue) error {
+	sortedin, ok := inter.builtins[parser.Procinfo].Array["sorted_in"]
+	if !ok {
+		return nil
+	}
+	order := inter.toString(sortedin)
+	if order == "" || order == "@unsorted" {
+		return nil
+	}
+
+	var cmp func(k1, k2 string) int
+	// Error raised by a user defined comparison function
+	var cmperr error
+	if strings.HasPrefix(order, "@") {
+		desc := strings.HasSuffix(order, "_desc")
+		switch strings.TrimSuffix(strings.TrimSuffix(order, "_desc"), "_asc") {
+		case "@ind_str":
+			cmp = func(k1, k2 string) int {
+				return inter.compareStrings(k1, k2)
+			}
+		case "@ind_num":
+			cmp = func(k1, k2 string) int {
+				return compareFloats(inter.toNumber(inter.numericString(k1)), inter.toNumber(inter.numericString(k2)))
+			}
+		case "@val_str":
+			cmp = func(k1, k2 string) int {
+				// Subarrays come last
+				if arr[k1].Typ == Array || arr[k2].Typ == Array {
+					return inter.compareTyped(arr[k1], arr[k2])
+				}
+				return inter.compareStrings(inter.toString(arr[k1]), inter.toString(arr[k2]))
+			}
+		case "@val_num":
+			cmp = func(k1, k2 string) int {
+				if arr[k1].Typ == Array || arr[k2].Typ == Array {
+					return inter.compareTyped(arr[k1], arr[k2])
+				}
+				return compareFloats(inter.toNumber(arr[k1]), inter.toNumber(arr[k2]))
+			}
+		case "@val_type":
+			cmp = func(k1, k2 string) int {
+				return inter.compareTyped(arr[k1], arr[k2])
+			}
+		default:
+			return inter.runtimeError(fortok, fmt.Sprintf("invalid PROCINFO[\"sorted_in\"] value %q", order))
+		}
+		if desc {
+			asc := cmp
+			cmp = func(k1, k2 string) int {
+				return asc(k2, k1)
+			}
+		}
+	} else {
+		fdef := inter.userFunction(order)
+		if fdef == nil {
+			return inter.runtimeError(fortok, fmt.Sprintf("PROCINFO[\"sorted_in\"] function %s is not defined", order))
+		}
+		cmp = func(k1, k2 string) int {
+			if cmperr != nil {
+				return 0
+			}
+			var res Awkvalue
+			res, cmperr = inter.callUserFunction(fdef, []Awkvalue{Awknormalstring(k1), arr[k1], Awknormalstring(k2), arr[k2]})
+			return compareFloats(inter.toNumber(res), 0)
+		}
+	}
+
+	// Ties are broken on the index string, so that the order is
+	// deterministic
+	sort.SliceStable(keys, func(i, j int) bool {
+		c := cmp(keys[i], keys[j])
+		if c == 0 {
+			return keys[i] < keys[j]
+		}
+		return c < 0
+	})
+	return cmperr
+}
+
+// Orders numbers before strings, and strings before arrays
+func (inter *interpreter) compareTyped(v1, v2 Awkvalue) int {
+	rank := func(v Awkvalue) int {
+		switch v.Typ {
+		case Number, Numericstring:
+			return 0
+		case Array:
+			return 2
+		default:
+			return 1
+		}
+	}
+	r1, r2 := rank(v1), rank(v2)
+	if r1 != r2 {
+		return r1 - r2
+	}
+	switch r1 {
+	case 0:
+		return compareFloats(inter.toNumber(v1), inter.toNumber(v2))
+	case 1:
+		return inter.compareStrings(inter.toString(v1), inter.toString(v2))
+	}
+	return 0
+}
+
+func compareFloats(f1, f2 float64) int {
+	if f1 < f2 {
+		return -1
+	} else if f1 > f2 {
+		return 1
+	}
+	return 0
+}
+
+func (inter *interpreter) userFunction(name string) *parser.FunctionDef {
+	for _, fdef := range inter.items.Functions {
+		if fdef.Name.Lexeme == name {
+			return fdef
+		}
+	}
+	return nil
+}
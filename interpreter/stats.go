@@ -0,0 +1,131 @@
+/*
+ * Copyright (C) 2021 Andrea Fiori <andrea.fiori.1998@gmail.com>
+ *
+ * Licensed under GPLv2, see file LICENSE in this source tree.
+ */
+
+package interpreter
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// What the program did with its main input, gathered only if asked for by
+// CommandLine.Stats or CommandLine.StatsFunc
+type RunStats struct {
+	Files   []FileStats // Files of the main input, in the order they were read
+	Records int         // Records of the main input, read by the main loop or by getline
+	Matched []int       // Records matched by each main rule, in the order of the program
+	Elapsed time.Duration
+}
+
+type FileStats struct {
+	Name    string // "-" for standard input
+	Bytes   int64
+	Records int
+}
+
+// Receives the statistics of a run when the program terminates
+type StatsFunc func(stats RunStats)
+
+type statsState struct {
+	start   time.Time
+	files   []*FileStats
+	records int
+	matched []int
+}
+
+func (inter *interpreter) initializeStats(params RunParams) {
+	if !params.Stats && params.StatsFunc == nil {
+		return
+	}
+	inter.stats = &statsState{
+		start:   time.Now(),
+		matched: make([]int, len(params.ResolvedItems.Normals)),
+	}
+}
+
+// Starts counting what is read from a file of the main input
+func (inter *interpreter) countFile(name string, r inputReader) inputReader {
+	if inter.stats == nil {
+		return r
+	}
+	fs := &FileStats{Name: name}
+	inter.stats.files = append(inter.stats.files, fs)
+	return countedFile{countingReader{r, &fs.Bytes}}
+}
+
+func (inter *interpreter) countRecord() {
+	if inter.stats == nil {
+		return
+	}
+	inter.stats.records++
+	if n := len(inter.stats.files); n > 0 {
+		inter.stats.files[n-1].Records++
+	}
+}
+
+func (inter *interpreter) countMatch(rule int) {
+	if inter.stats != nil {
+		inter.stats.matched[rule]++
+	}
+}
+
+func (inter *interpreter) runStats() RunStats {
+	rs := RunStats{
+		Records: inter.stats.records,
+		Matched: append([]int(nil), inter.stats.matched...),
+		Elapsed: time.Since(inter.stats.start),
+	}
+	for _, fs := range inter.stats.files {
+		rs.Files = append(rs.Files, *fs)
+	}
+	return rs
+}
+
+// Hands the statistics to the embedder, or prints them
+func (inter *interpreter) reportStats() {
+	if inter.stats == nil {
+		return
+	}
+	rs := inter.runStats()
+	if inter.params.StatsFunc != nil {
+		inter.params.StatsFunc(rs)
+	}
+	if inter.params.Stats {
+		inter.printStats(inter.stderr, rs)
+	}
+}
+
+func (inter *interpreter) printStats(w io.Writer, rs RunStats) {
+	var bytes int64
+	for _, fs := range rs.Files {
+		fmt.Fprintf(w, "%s: stats: file %q: %d bytes, %d records\n", inter.programname, fs.Name, fs.Bytes, fs.Records)
+		bytes += fs.Bytes
+	}
+	for i, n := range rs.Matched {
+		line := inter.items.Normals[i].Pattern.Token().Line
+		fmt.Fprintf(w, "%s: stats: rule %d at %s: %d records matched\n", inter.programname, i+1, inter.items.Sources.Position(line), n)
+	}
+	seconds := rs.Elapsed.Seconds()
+	var rate float64
+	if seconds > 0 {
+		rate = float64(bytes) / seconds / 1e6
+	}
+	fmt.Fprintf(w, "%s: stats: %d records, %d bytes in %.3fs (%.1f MB/s)\n", inter.programname, rs.Records, bytes, seconds, rate)
+}
+
+// A file of the main input whose bytes are counted. Closing it closes the
+// file, unless it is standard input.
+type countedFile struct {
+	countingReader
+}
+
+func (cf countedFile) Close() error {
+	if cl, ok := cf.r.(io.Closer); ok {
+		return cl.Close()
+	}
+	return nil
+}
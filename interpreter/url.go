@@ -0,0 +1,90 @@
+/*
+ * Copyright (C) 2021 Andrea Fiori <andrea.fiori.1998@gmail.com>
+ *
+ * Licensed under GPLv2, see file LICENSE in this source tree.
+ */
+
+package interpreter
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// FileOpener which fetches the files named by http:// and https:// URLs,
+// so that they can be file operands and getline sources. URLs cannot be
+// written to. The other names are opened by Files, OSFiles if it is nil.
+type URLFiles struct {
+	Files   FileOpener
+	Timeout time.Duration // Of the whole transfer, none if 0
+	MaxSize int64         // Bytes read at most from a URL, no limit if 0
+}
+
+func (f URLFiles) Open(name string) (io.ReadCloser, error) {
+	if !isURL(name) {
+		return f.files().Open(name)
+	}
+	client := http.Client{Timeout: f.Timeout}
+	resp, err := client.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", name, resp.Status)
+	}
+	if f.MaxSize > 0 {
+		return &limitedBody{body: resp.Body, url: name, left: f.MaxSize}, nil
+	}
+	return resp.Body, nil
+}
+
+func (f URLFiles) Create(name string, appending bool) (io.WriteCloser, error) {
+	if isURL(name) {
+		return nil, fmt.Errorf("cannot write to %s", name)
+	}
+	return f.files().Create(name, appending)
+}
+
+func (f URLFiles) files() FileOpener {
+	if f.Files == nil {
+		return OSFiles{}
+	}
+	return f.Files
+}
+
+func isURL(name string) bool {
+	return strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://")
+}
+
+// Body of a response which fails once more than left bytes are read, rather
+// than cutting the input silently
+type limitedBody struct {
+	body io.ReadCloser
+	url  string
+	left int64
+}
+
+func (lb *limitedBody) Read(p []byte) (int, error) {
+	if lb.left <= 0 {
+		// Only fail if there is more to read
+		var b [1]byte
+		if n, err := lb.body.Read(b[:]); n == 0 {
+			return 0, err
+		}
+		return 0, fmt.Errorf("%s is larger than the maximum size", lb.url)
+	}
+	if int64(len(p)) > lb.left {
+		p = p[:lb.left]
+	}
+	n, err := lb.body.Read(p)
+	lb.left -= int64(n)
+	return n, err
+}
+
+func (lb *limitedBody) Close() error {
+	return lb.body.Close()
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright (C) 2021 Andrea Fiori <andrea.fiori.1998@gmail.com>
+ *
+ * Licensed under GPLv2, see file LICENSE in this source tree.
+ */
+
+package interpreter
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func testServer(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/records":
+			w.Write([]byte("a 1\nb 2\nc 3\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestURLFilesRecords(t *testing.T) {
+	server := testServer(t)
+	cl := CommandLine{
+		Program: strings.NewReader(`{ n += $2 } END { print NR, n; print (getline line < ARGV[1]), line }`),
+		Files:   URLFiles{},
+	}
+	out, _, errs := runCL(t, cl, "", server.URL+"/records")
+	if len(errs) > 0 {
+		t.Fatal(errs[0])
+	}
+	if expected := "3 6\n1 a 1\n"; out != expected {
+		t.Errorf("printed %q, expected %q", out, expected)
+	}
+}
+
+func TestURLFilesStatus(t *testing.T) {
+	server := testServer(t)
+	if _, err := (URLFiles{}).Open(server.URL + "/missing"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("opening a missing URL: error %v", err)
+	}
+	cl := CommandLine{
+		Program: strings.NewReader(`BEGIN { print (getline line < ARGV[1]) }`),
+		Files:   URLFiles{},
+	}
+	if out, _, _ := runCL(t, cl, "", server.URL+"/missing"); out != "-1\n" {
+		t.Errorf("getline from a missing URL printed %q", out)
+	}
+}
+
+func TestURLFilesMaxSize(t *testing.T) {
+	server := testServer(t)
+	size := int64(len("a 1\nb 2\nc 3\n"))
+	for _, test := range []struct {
+		max int64
+		ok  bool
+	}{
+		{size + 1, true},
+		{size, true},
+		{size - 1, false},
+		{1, false},
+	} {
+		body, err := URLFiles{MaxSize: test.max}.Open(server.URL + "/records")
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(body)
+		body.Close()
+		if test.ok && (err != nil || int64(len(data)) != size) {
+			t.Errorf("MaxSize %d: read %q, error %v", test.max, data, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("MaxSize %d: reading %d bytes did not fail", test.max, size)
+		}
+	}
+}
+
+func TestURLFilesWrite(t *testing.T) {
+	server := testServer(t)
+	if _, err := (URLFiles{}).Create(server.URL+"/records", false); err == nil {
+		t.Errorf("creating a URL did not fail")
+	}
+	cl := CommandLine{
+		Program: strings.NewReader(`BEGIN { print "x" > ARGV[1] }`),
+		Files:   URLFiles{},
+	}
+	if _, _, errs := runCL(t, cl, "", server.URL+"/records"); len(errs) == 0 {
+		t.Errorf("writing to a URL did not fail")
+	}
+}
@@ -11,6 +11,8 @@ import (
 	"math"
 	"strconv"
 	"strings"
+
+	"github.com/fioriandrea/aawk/lexer"
 )
 
 const (
@@ -32,25 +34,149 @@ type Awkvalue struct {
 	N     float64
 	Str   string
 	Array map[string]Awkvalue
+	ref   *arrayref
+}
+
+// An uninitialized variable passed to a function is shared with the
+// parameter through an arrayref. Once either is used as an array, both are
+// the same array; until then, they are separate uninitialized values.
+// Arrays created by the program keep their arrayref too, to remember where
+// they were first used as arrays.
+type arrayref struct {
+	array   map[string]Awkvalue
+	isarray bool
+	use     lexer.Token // First use as an array, if isarray
+}
+
+// Returns the value held at p, turning it into the array of its arrayref
+// if that has been used as an array
+func derefArray(p *Awkvalue) Awkvalue {
+	if p.ref != nil && p.ref.isarray {
+		*p = Awkvalue{Typ: Array, Array: p.ref.array, ref: p.ref}
+	}
+	return *p
+}
+
+// Describes where the array was first used as such, for the errors about
+// conflicting uses. It is empty if that is not known.
+func (inter *interpreter) arrayUse(v Awkvalue) string {
+	if v.ref == nil || !v.ref.isarray || v.ref.use.Line == 0 {
+		return ""
+	}
+	return fmt.Sprintf(", it is used as an array at %s", inter.items.Sources.Position(v.ref.use.Line))
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+// Scans the longest prefix of s which is a number: an optional sign followed
+// by a decimal floating point constant or, if hex is true, an hexadecimal
+// integer. Returns the number and the length of the prefix (0 if there is
+// none).
+func scanNumber(s string, hex bool) (float64, int) {
+	i := 0
+	if i < len(s) && (s[i] == '+' || s[i] == '-') {
+		i++
+	}
+	if hex && i+2 < len(s) && s[i] == '0' && (s[i+1] == 'x' || s[i+1] == 'X') && isHexDigit(s[i+2]) {
+		i += 2
+		for i < len(s) && isHexDigit(s[i]) {
+			i++
+		}
+		n, _ := strconv.ParseFloat(s[:i]+"p0", 64)
+		return n, i
+	}
+	digits := 0
+	for i < len(s) && isDigit(s[i]) {
+		i++
+		digits++
+	}
+	if i < len(s) && s[i] == '.' {
+		i++
+		for i < len(s) && isDigit(s[i]) {
+			i++
+			digits++
+		}
+	}
+	if digits == 0 {
+		return 0, 0
+	}
+	if i < len(s) && (s[i] == 'e' || s[i] == 'E') {
+		j := i + 1
+		if j < len(s) && (s[j] == '+' || s[j] == '-') {
+			j++
+		}
+		if j < len(s) && isDigit(s[j]) {
+			for j < len(s) && isDigit(s[j]) {
+				j++
+			}
+			i = j
+		}
+	}
+	// Out of range values are returned as infinities
+	n, _ := strconv.ParseFloat(s[:i], 64)
+	return n, i
 }
 
-func stringToNumber(s string) float64 {
-	var f float64
-	fmt.Sscan(s, &f)
-	return f
+// Converts a string to a number using its longest numeric prefix, ignoring
+// leading blanks. The prefix can be an hexadecimal integer if hex is true.
+func stringToNumber(s string, hex bool) float64 {
+	n, _ := scanNumber(strings.TrimLeft(s, " \t\n"), hex)
+	return n
 }
 
+// Reports whether s looks like a number, i.e. it is made only of blanks, an
+// optional sign and a decimal floating point constant (or an hexadecimal
+// integer if hex is true)
+func parseNumericString(s string, hex bool) (float64, bool) {
+	s = strings.Trim(s, " \t\n")
+	n, l := scanNumber(s, hex)
+	return n, l > 0 && l == len(s)
+}
+
+// Strings of the integers most used as indices and counters, so that
+// converting them does not allocate
+var smallInts = func() (ints [1024]string) {
+	for i := range ints {
+		ints[i] = strconv.Itoa(i)
+	}
+	return ints
+}()
+
+// Integral values are formatted as integers, every other value with the
+// given format (OFMT or CONVFMT)
 func numberToString(n float64, format string) string {
-	if math.Trunc(n) == n {
-		return fmt.Sprintf("%d", int64(n))
-	} else {
+	switch {
+	case math.IsNaN(n):
+		return "nan"
+	case math.IsInf(n, 1):
+		return "inf"
+	case math.IsInf(n, -1):
+		return "-inf"
+	case n == 0 && math.Signbit(n):
+		return "-0"
+	case math.Trunc(n) != n:
 		return fmt.Sprintf(format, n)
+	case n >= 0 && n < float64(len(smallInts)):
+		return smallInts[int(n)]
+	case n >= math.MinInt64 && n < math.MaxInt64:
+		return strconv.FormatInt(int64(n), 10)
+	default:
+		// Beyond the range of int64
+		return strconv.FormatFloat(n, 'f', 0, 64)
 	}
 }
 
+// Converts the value to a number. Strings which are not numeric strings
+// are converted using their longest decimal numeric prefix.
 func (v Awkvalue) Float() float64 {
 	if v.Typ == Normalstring {
-		return stringToNumber(v.Str)
+		return stringToNumber(v.Str, false)
 	}
 	return v.N
 }
@@ -76,9 +202,15 @@ func Awknormalstring(s string) Awkvalue {
 	}
 }
 
+// Creates a numeric string candidate, following the POSIX definition of
+// numeric string
 func Awknumericstring(s string) Awkvalue {
-	f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
-	if err != nil {
+	return awknumericstring(s, false)
+}
+
+func awknumericstring(s string, hex bool) Awkvalue {
+	f, ok := parseNumericString(s, hex)
+	if !ok {
 		return Awknormalstring(s)
 	}
 	return Awkvalue{
@@ -110,17 +242,66 @@ func Awkarray(m map[string]Awkvalue) Awkvalue {
 	}
 }
 
+// The value of an uninitialized variable (Null) is both 0 and "", so it is
+// 0 in arithmetic and printed as an empty string, never through OFMT
 var Awknull = Awkvalue{}
 
+// Creates a numeric string candidate. Hexadecimal integers are recognized
+// unless running in POSIX mode.
+func (inter *interpreter) numericString(s string) Awkvalue {
+	return awknumericstring(s, !inter.posix)
+}
+
+func (inter *interpreter) awkstring(s string, t Awkvaluetype) Awkvalue {
+	if t == Normalstring {
+		return Awknormalstring(s)
+	}
+	return inter.numericString(s)
+}
+
 func (inter *interpreter) toString(v Awkvalue) string {
 	return v.String(inter.getConvfmt())
 }
 
-func nullToArray(v Awkvalue) Awkvalue {
-	if v.Array != nil {
-		v.Typ = Array
-	} else {
-		v = Awkarray(map[string]Awkvalue{})
+// Like Float, but strings can be hexadecimal integers unless in POSIX mode,
+// as numeric strings can
+func (inter *interpreter) toNumber(v Awkvalue) float64 {
+	if v.Typ == Normalstring {
+		return stringToNumber(v.Str, !inter.posix)
+	}
+	return v.N
+}
+
+// Arrays are cleared in place, as they could be shared with the caller of
+// the current function
+func clearArray(m map[string]Awkvalue) {
+	for k := range m {
+		delete(m, k)
+	}
+}
+
+// Copies an array, including its subarrays
+func copyArray(m map[string]Awkvalue) map[string]Awkvalue {
+	res := make(map[string]Awkvalue, len(m))
+	for k, v := range m {
+		if v.Typ == Array {
+			v = Awkarray(copyArray(v.Array))
+		}
+		res[k] = v
+	}
+	return res
+}
+
+// Turns an uninitialized value into an array, first used as such by use
+func nullToArray(v Awkvalue, use lexer.Token) Awkvalue {
+	ref := v.ref
+	if ref == nil {
+		ref = &arrayref{}
+	}
+	if !ref.isarray {
+		ref.array = map[string]Awkvalue{}
+		ref.isarray = true
+		ref.use = use
 	}
-	return v
+	return Awkvalue{Typ: Array, Array: ref.array, ref: ref}
 }
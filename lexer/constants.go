@@ -70,6 +70,7 @@ const (
 	For
 	If
 	Next
+	Nextfile
 	Print
 	Printf
 	Return
@@ -78,8 +79,10 @@ const (
 	BeginFuncs
 	Atan2
 	Close
+	Copyarr
 	Cos
 	Exp
+	Fflush
 	Gsub
 	Index
 	Int
@@ -97,6 +100,7 @@ const (
 	System
 	Tolower
 	Toupper
+	Warn
 	EndFuncs
 
 	Identifier
@@ -112,6 +116,112 @@ const (
 	TokenCount
 )
 
+// Names of the token types, the same as the constants above. Unlike the
+// values of the constants, they do not change when token types are added,
+// so tools printing or reading tokens should use them.
+var TokenNames = [TokenCount]string{
+	Eof:             "Eof",
+	Increment:       "Increment",
+	Decrement:       "Decrement",
+	Caret:           "Caret",
+	Not:             "Not",
+	Plus:            "Plus",
+	Minus:           "Minus",
+	Star:            "Star",
+	Slash:           "Slash",
+	Percent:         "Percent",
+	Less:            "Less",
+	LessEqual:       "LessEqual",
+	NotEqual:        "NotEqual",
+	Equal:           "Equal",
+	Greater:         "Greater",
+	GreaterEqual:    "GreaterEqual",
+	DoubleGreater:   "DoubleGreater",
+	Tilde:           "Tilde",
+	NotTilde:        "NotTilde",
+	DoubleAnd:       "DoubleAnd",
+	DoublePipe:      "DoublePipe",
+	Pipe:            "Pipe",
+	QuestionMark:    "QuestionMark",
+	Colon:           "Colon",
+	Comma:           "Comma",
+	ExpAssign:       "ExpAssign",
+	ModAssign:       "ModAssign",
+	MulAssign:       "MulAssign",
+	DivAssign:       "DivAssign",
+	PlusAssign:      "PlusAssign",
+	MinusAssign:     "MinusAssign",
+	Assign:          "Assign",
+	RightCurly:      "RightCurly",
+	LeftSquare:      "LeftSquare",
+	RightSquare:     "RightSquare",
+	LeftParen:       "LeftParen",
+	RightParen:      "RightParen",
+	Dollar:          "Dollar",
+	Semicolon:       "Semicolon",
+	Newline:         "Newline",
+	Begin:           "Begin",
+	End:             "End",
+	Function:        "Function",
+	Getline:         "Getline",
+	In:              "In",
+	Else:            "Else",
+	LeftCurly:       "LeftCurly",
+	Break:           "Break",
+	Continue:        "Continue",
+	Delete:          "Delete",
+	Do:              "Do",
+	Exit:            "Exit",
+	For:             "For",
+	If:              "If",
+	Next:            "Next",
+	Nextfile:        "Nextfile",
+	Print:           "Print",
+	Printf:          "Printf",
+	Return:          "Return",
+	While:           "While",
+	BeginFuncs:      "BeginFuncs",
+	Atan2:           "Atan2",
+	Close:           "Close",
+	Copyarr:         "Copyarr",
+	Cos:             "Cos",
+	Exp:             "Exp",
+	Fflush:          "Fflush",
+	Gsub:            "Gsub",
+	Index:           "Index",
+	Int:             "Int",
+	Length:          "Length",
+	Log:             "Log",
+	Match:           "Match",
+	Rand:            "Rand",
+	Sin:             "Sin",
+	Split:           "Split",
+	Sprintf:         "Sprintf",
+	Sqrt:            "Sqrt",
+	Srand:           "Srand",
+	Sub:             "Sub",
+	Substr:          "Substr",
+	System:          "System",
+	Tolower:         "Tolower",
+	Toupper:         "Toupper",
+	Warn:            "Warn",
+	EndFuncs:        "EndFuncs",
+	Identifier:      "Identifier",
+	IdentifierParen: "IdentifierParen",
+	Regex:           "Regex",
+	String:          "String",
+	Number:          "Number",
+	Concat:          "Concat",
+	Error:           "Error",
+}
+
+func (tt TokenType) String() string {
+	if tt < 0 || tt >= TokenCount {
+		return "Unknown"
+	}
+	return TokenNames[tt]
+}
+
 var Keywords = map[string]TokenType{
 	"BEGIN":    Begin,
 	"break":    Break,
@@ -127,6 +237,7 @@ var Keywords = map[string]TokenType{
 	"if":       If,
 	"in":       In,
 	"next":     Next,
+	"nextfile": Nextfile,
 	"printf":   Printf,
 	"print":    Print,
 	"return":   Return,
@@ -138,6 +249,7 @@ var Builtinfuncs = map[string]TokenType{
 	"close":   Close,
 	"cos":     Cos,
 	"exp":     Exp,
+	"fflush":  Fflush,
 	"gsub":    Gsub,
 	"index":   Index,
 	"int":     Int,
@@ -157,42 +269,58 @@ var Builtinfuncs = map[string]TokenType{
 	"toupper": Toupper,
 }
 
+// Built-in functions whose names are not reserved: they are lexed as
+// identifiers, and a call resolves to the built-in only if the program does
+// not use the name for a function or variable of its own
+var Extensionfuncs = map[string]TokenType{
+	"copyarr": Copyarr,
+	"warn":    Warn,
+}
+
 const (
 	Argc = iota
 	Argv
 	Convfmt
 	Environ
+	Errno
 	Filename
 	Fnr
 	Fs
+	Ignorecase
 	Nf
 	Nr
 	Ofmt
 	Ofs
 	Ors
+	Procinfo
 	Rlength
 	Rs
 	Rstart
+	Rt
 	Subsep
 )
 
 var Builtinvars = map[string]int{
-	"ARGC":     Argc,
-	"ARGV":     Argv,
-	"CONVFMT":  Convfmt,
-	"ENVIRON":  Environ,
-	"FILENAME": Filename,
-	"FNR":      Fnr,
-	"FS":       Fs,
-	"NF":       Nf,
-	"NR":       Nr,
-	"OFMT":     Ofmt,
-	"OFS":      Ofs,
-	"ORS":      Ors,
-	"RLENGTH":  Rlength,
-	"RS":       Rs,
-	"RSTART":   Rstart,
-	"SUBSEP":   Subsep,
+	"ARGC":       Argc,
+	"ARGV":       Argv,
+	"CONVFMT":    Convfmt,
+	"ENVIRON":    Environ,
+	"ERRNO":      Errno,
+	"FILENAME":   Filename,
+	"FNR":        Fnr,
+	"FS":         Fs,
+	"IGNORECASE": Ignorecase,
+	"NF":         Nf,
+	"NR":         Nr,
+	"OFMT":       Ofmt,
+	"OFS":        Ofs,
+	"ORS":        Ors,
+	"PROCINFO":   Procinfo,
+	"RLENGTH":    Rlength,
+	"RS":         Rs,
+	"RSTART":     Rstart,
+	"RT":         Rt,
+	"SUBSEP":     Subsep,
 }
 
 type trienode struct {
@@ -350,7 +478,7 @@ var punctuations = trienode{
 	},
 }
 
-var CommandLineAssignRegex = regexp.MustCompile(`^[_a-zA-Z0-9]+=.*`)
+var CommandLineAssignRegex = regexp.MustCompile(`^[_a-zA-Z][_a-zA-Z0-9]*=`)
 
 func IsBuiltinFunction(t TokenType) bool {
 	return t > BeginFuncs && t < EndFuncs
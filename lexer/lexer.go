@@ -8,7 +8,6 @@ package lexer
 
 import (
 	"fmt"
-	"regexp"
 	"strings"
 	"unicode"
 )
@@ -19,17 +18,35 @@ type Token struct {
 	Line   int
 }
 
+// Describes the token in diagnostics: its lexeme, or a description for the
+// tokens whose lexeme cannot be read as it is
+func (t Token) String() string {
+	switch t.Type {
+	case Eof:
+		return "end of program"
+	case Newline:
+		return "newline"
+	}
+	return t.Lexeme
+}
+
 type Lexer struct {
 	line          int
 	currentRune   rune
 	program       []rune
+	atend         bool // currentRune is past the end of the program, which may contain NULs
 	previousToken Token
+	posix         bool
 }
 
-func NewLexer(program []byte) Lexer {
+// Creates a new lexer for the given program. Hexadecimal constants are
+// recognized unless posix is true.
+func NewLexer(program []byte, posix bool) Lexer {
+	runes := []rune(string(program))
 	lex := Lexer{
 		line:    1,
-		program: []rune(string(program))[0:0],
+		program: runes[0:0:len(runes)],
+		posix:   posix,
 	}
 	lex.advance()
 	return lex
@@ -101,7 +118,7 @@ func (l *Lexer) NextRegex() Token {
 		return l.makeErrorToken("unterminated regex")
 	}
 	l.advance()
-	_, err := regexp.Compile(lexeme.String())
+	_, err := CompileRegex(lexeme.String())
 	if err != nil {
 		return l.makeErrorToken(err.Error())
 	}
@@ -119,88 +136,86 @@ func (l *Lexer) newLine() Token {
 }
 
 func (l *Lexer) string() Token {
-	var lexeme strings.Builder
+	var raw strings.Builder
 	l.advance()
-	var c rune
 	for l.currentRune != '\n' && !l.atEnd() {
 		if l.currentRune == '\\' {
-			l.advance()
-			switch l.currentRune {
-			case '"':
-				c = '"'
-				l.advance()
-			case '/':
-				c = '/'
-				l.advance()
-			case '\\':
-				c = '\\'
-				l.advance()
-			case 'n':
-				c = '\n'
-				l.advance()
-			case 't':
-				c = '\t'
-				l.advance()
-			case 'r':
-				c = '\r'
-				l.advance()
-			case 'a':
-				c = '\a'
-				l.advance()
-			case 'b':
-				c = '\b'
-				l.advance()
-			case 'f':
-				c = '\f'
-				l.advance()
-			case 'v':
-				c = '\v'
-				l.advance()
-			case '0', '1', '2', '3', '4', '5', '6', '7':
-				cc := l.currentRune
-				seq := hexToInt(cc)
-				cc = l.advance()
-				if isOctalDigit(cc) {
-					seq = seq*8 + hexToInt(cc)
-					cc = l.advance()
-					if isOctalDigit(cc) {
-						seq = seq*8 + hexToInt(cc)
-						l.advance()
-					}
-				}
-				c = rune(seq)
-			case 'x':
-				l.advance()
-				cc := l.currentRune
-				if !isHexDigit(cc) {
-					c = 'x'
-					break
-				}
-				seq := hexToInt(cc)
-				cc = l.advance()
-				if isHexDigit(cc) {
-					seq = seq*16 + hexToInt(cc)
-					l.advance()
-				}
-				c = rune(seq)
-			default:
-				c = l.currentRune
-				l.advance()
+			l.advanceCurrentInside(&raw)
+			if l.atEnd() {
+				break
 			}
+			l.advanceCurrentInside(&raw)
 		} else if l.currentRune == '"' {
 			break
 		} else {
-			c = l.currentRune
-			l.advance()
+			l.advanceCurrentInside(&raw)
 		}
-		fmt.Fprintf(&lexeme, "%c", c)
 	}
 
 	if l.currentRune != '"' {
 		return l.makeErrorToken("unterminated string")
 	}
 	l.advance()
-	return l.makeToken(String, lexeme.String())
+	return l.makeToken(String, Unescape(raw.String()))
+}
+
+// Processes the escape sequences of a string literal. It is used for
+// program strings as well as for command line assignments.
+func Unescape(s string) string {
+	var res strings.Builder
+	rs := []rune(s)
+	for i := 0; i < len(rs); i++ {
+		if rs[i] != '\\' || i+1 >= len(rs) {
+			res.WriteRune(rs[i])
+			continue
+		}
+		i++
+		var c rune
+		switch rs[i] {
+		case '"':
+			c = '"'
+		case '/':
+			c = '/'
+		case '\\':
+			c = '\\'
+		case 'n':
+			c = '\n'
+		case 't':
+			c = '\t'
+		case 'r':
+			c = '\r'
+		case 'a':
+			c = '\a'
+		case 'b':
+			c = '\b'
+		case 'f':
+			c = '\f'
+		case 'v':
+			c = '\v'
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			seq := hexToInt(rs[i])
+			for j := 0; j < 2 && i+1 < len(rs) && isOctalDigit(rs[i+1]); j++ {
+				i++
+				seq = seq*8 + hexToInt(rs[i])
+			}
+			c = rune(seq)
+		case 'x':
+			if i+1 >= len(rs) || !isHexDigit(rs[i+1]) {
+				c = 'x'
+				break
+			}
+			seq := 0
+			for j := 0; j < 2 && i+1 < len(rs) && isHexDigit(rs[i+1]); j++ {
+				i++
+				seq = seq*16 + hexToInt(rs[i])
+			}
+			c = rune(seq)
+		default:
+			c = rs[i]
+		}
+		res.WriteRune(c)
+	}
+	return res.String()
 }
 
 func (l *Lexer) identifier() Token {
@@ -225,6 +240,18 @@ func (l *Lexer) identifier() Token {
 
 func (l *Lexer) number() Token {
 	var lexeme strings.Builder
+	if !l.posix && l.currentRune == '0' && (l.peek() == 'x' || l.peek() == 'X') {
+		l.advanceCurrentInside(&lexeme)
+		l.advanceCurrentInside(&lexeme)
+		if !isHexDigit(l.currentRune) {
+			l.unread(1)
+			return l.makeToken(Number, "0")
+		}
+		for isHexDigit(l.currentRune) {
+			l.advanceCurrentInside(&lexeme)
+		}
+		return l.makeTokenFromBuilder(Number, lexeme)
+	}
 	for unicode.IsDigit(l.currentRune) {
 		l.advanceCurrentInside(&lexeme)
 	}
@@ -292,17 +319,29 @@ func (l *Lexer) makeErrorToken(msg string) Token {
 }
 
 func (l *Lexer) advance() rune {
-	var c rune
-	if len(l.program) < cap(l.program) {
-		l.program = l.program[:len(l.program)+1]
-		c = l.program[len(l.program)-1]
+	if len(l.program) == cap(l.program) {
+		l.currentRune = 0
+		l.atend = true
+		return l.currentRune
 	}
-	l.currentRune = c
+	l.program = l.program[:len(l.program)+1]
+	l.currentRune = l.program[len(l.program)-1]
 	return l.currentRune
 }
 
+func (l *Lexer) peek() rune {
+	if len(l.program) < cap(l.program) {
+		return l.program[:len(l.program)+1][len(l.program)]
+	}
+	return 0
+}
+
 func (l *Lexer) deadvance() {
-	l.program = l.program[:len(l.program)-1]
+	if l.atend {
+		l.atend = false
+	} else {
+		l.program = l.program[:len(l.program)-1]
+	}
 	l.currentRune = l.program[len(l.program)-1]
 }
 
@@ -322,7 +361,7 @@ func (l *Lexer) unread(ntounread int) {
 }
 
 func (l *Lexer) atEnd() bool {
-	return l.currentRune == '\000'
+	return l.atend
 }
 
 func isHexDigit(c rune) bool {
@@ -335,7 +374,7 @@ func hexToInt(c rune) int {
 	if c >= '0' && c <= '9' {
 		return int(c - '0')
 	}
-	return int(c - 'a')
+	return int(c-'a') + 10
 }
 
 func isOctalDigit(c rune) bool {
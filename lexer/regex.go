@@ -0,0 +1,82 @@
+/*
+ * Copyright (C) 2021 Andrea Fiori <andrea.fiori.1998@gmail.com>
+ *
+ * Licensed under GPLv2, see file LICENSE in this source tree.
+ */
+
+package lexer
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Compiles an extended regular expression of the program or of the input
+func CompileRegex(re string) (*regexp.Regexp, error) {
+	return regexp.Compile(TranslateRegex(re))
+}
+
+// Rewrites the GNU regex operators which Go lacks: \y, \< and \> match a
+// word boundary (\< and \> do not check which side the word is on), \` and
+// \' the beginning and the end of the string. Bracket expressions are left
+// alone.
+func TranslateRegex(re string) string {
+	if !strings.Contains(re, `\`) {
+		return re
+	}
+	var sb strings.Builder
+	for i := 0; i < len(re); i++ {
+		switch {
+		case re[i] == '[':
+			end := bracketEnd(re, i)
+			sb.WriteString(re[i:end])
+			i = end - 1
+		case re[i] == '\\' && i+1 < len(re):
+			i++
+			switch re[i] {
+			case 'y', '<', '>':
+				sb.WriteString(`\b`)
+			case '`':
+				sb.WriteString(`\A`)
+			case '\'':
+				sb.WriteString(`\z`)
+			default:
+				sb.WriteByte('\\')
+				sb.WriteByte(re[i])
+			}
+		default:
+			sb.WriteByte(re[i])
+		}
+	}
+	return sb.String()
+}
+
+// Returns the index following the bracket expression which begins at
+// start, or the length of re if it is not terminated
+func bracketEnd(re string, start int) int {
+	i := start + 1
+	if i < len(re) && re[i] == '^' {
+		i++
+	}
+	if i < len(re) && re[i] == ']' {
+		i++
+	}
+	for i < len(re) {
+		switch {
+		case re[i] == '\\':
+			i += 2
+		case re[i] == '[' && i+1 < len(re) && strings.IndexByte(":.=", re[i+1]) >= 0:
+			// Character class, collating symbol or equivalence class
+			end := strings.Index(re[i+2:], string(re[i+1])+"]")
+			if end < 0 {
+				return len(re)
+			}
+			i += end + 4
+		case re[i] == ']':
+			return i + 1
+		default:
+			i++
+		}
+	}
+	return len(re)
+}
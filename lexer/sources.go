@@ -0,0 +1,31 @@
+/*
+ * Copyright (C) 2021 Andrea Fiori <andrea.fiori.1998@gmail.com>
+ *
+ * Licensed under GPLv2, see file LICENSE in this source tree.
+ */
+
+package lexer
+
+import "fmt"
+
+// A file of a program made of several files, which are concatenated before
+// being lexed
+type SourceFile struct {
+	Name  string
+	Start int // Line of the concatenated program where the file begins
+}
+
+// Where the lines of a program made of files come from. Tokens carry the
+// line of the concatenated program, which is translated when reported. The
+// map of a program given as a string is empty.
+type SourceMap []SourceFile
+
+// Describes a line of the program as "line n" or "line n of file"
+func (sm SourceMap) Position(line int) string {
+	for i := len(sm) - 1; i >= 0; i-- {
+		if line >= sm[i].Start {
+			return fmt.Sprintf("line %d of %s", line-sm[i].Start+1, sm[i].Name)
+		}
+	}
+	return fmt.Sprintf("line %d", line)
+}
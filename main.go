@@ -17,6 +17,8 @@ import (
 	"time"
 
 	"github.com/fioriandrea/aawk/interpreter"
+	"github.com/fioriandrea/aawk/lexer"
+	"github.com/fioriandrea/aawk/parser"
 )
 
 func printHelp(w io.Writer) {
@@ -25,113 +27,349 @@ func printHelp(w io.Writer) {
 SYNOPSIS
 	aawk [-F sepstring] [-v assignment]... program [argument...]
  
-	aawk [-F sepstring] -f progfile [-f progfile]... [-v assignment]...  [argument...]`
+	aawk [-F sepstring] -f progfile [-f progfile]... [-v assignment]...  [argument...]
+
+	aawk [-F sepstring] -e program-text [-e program-text | -f progfile]... [-v assignment]... [argument...]
+
+	aawk [-F sepstring] --compile progfile [-o file] [-v assignment]...
+
+	aawk [-F sepstring] --load file [-v assignment]... [argument...]
+
+	aawk selftest
+
+	Short options can be grouped, and their parameter can be attached to
+	them (-F: -vx=1). Long options take their parameter either as the next
+	argument or after an equal sign (--max-open-files=8). The argument --
+	ends the options.
+
+OPTIONS
+	-F sepstring
+		Set FS to sepstring. Escape sequences are processed as in string
+		literals, so -F '\t' separates fields with tabs
+
+	-f progfile
+		Read the program from progfile. The files given by several -f
+		options are joined, each starting on a new line, and errors name
+		the file and the line within it
+
+	-e program-text, --source program-text
+		Use program-text as a part of the program. The parts given by -e
+		and -f are joined in the order they are given, and errors in a
+		part given by -e name it as -e
+
+	-E progfile, --exec progfile
+		Like -f, but end the options: the arguments which follow are
+		operands even if they begin with -, and operands of the form
+		var=value are file names, not assignments. Scripts beginning with
+		#!/usr/bin/aawk -E can so take any argument
+
+	-v assignment
+		Assign a variable before running the program. The value is
+		processed like a string literal as well
+
+	-h, --help
+		Print this help and exit
+
+	-V, --version
+		Print the version and exit
+
+	-n, --check
+		Parse and resolve the program, print the errors found and exit
+		without reading input or running BEGIN. The exit status is 2 if
+		there are errors, 0 otherwise. With --lint, the warnings are
+		printed too
+
+	--compile progfile
+		Parse and resolve the program, which progfile begins like -f, and
+		write it in compiled form instead of running it. The compiled
+		program can only be loaded by the same version of aawk
+
+	-o file, --output file
+		Write the program compiled by --compile to file rather than to
+		the standard output
+
+	--load file
+		Run the program compiled by --compile into file, without parsing
+		it again. No program is given, so all the operands are arguments.
+		-F and -v are checked as usual
+
+	--catch-signals
+		On SIGINT or SIGTERM, stop reading input and running the program,
+		flush and close the files and commands it opened and exit with
+		the status of a process killed by the signal. On SIGHUP, close
+		the files written by output redirections: they are reopened in
+		append mode when written to again, so that they can be rotated
+
+	--end-on-signal
+		Like --catch-signals, but run the END actions before exiting. A
+		second signal stops them
+
+	--deterministic-rand
+		Seed the random number generator with 0 instead of the time of day,
+		so that rand() gives the same sequence on every run
+
+	--dump-tokens
+		Print the tokens of the program, one per line with its line number,
+		type and lexeme, and exit without running it
+
+	--dump-ast
+		Print the syntax tree of the program as S-expressions and exit
+		without running it. The tree is the one which would be run, with
+		constant expressions folded
+
+	--dump-streams
+		When the program terminates, print on standard error the files
+		and commands opened by redirections and getline, with the number
+		of times each was opened, the bytes read from and written to it
+		and whether it was still open. The same counts are available to
+		the program as PROCINFO[name, "opened"], PROCINFO[name,
+		"bytes_read"] and PROCINFO[name, "bytes_written"], and the number
+		of open streams as PROCINFO["open_streams"]
+
+	--stats
+		When the program terminates, print on standard error the bytes and
+		records read from every file of the main input, the records
+		matched by every main rule, and the time the program ran for with
+		the resulting throughput
+
+	--printf-ors
+		Terminate the output of printf with ORS, as print does
+
+	--lazy-elements
+		Do not create the missing array elements which are only referred
+		to as values, as in if (a[k] == ""), so that reading an array does
+		not grow it. By default, as POSIX requires, such a reference creates
+		the element, which is then counted by length and seen by for (k in
+		a). Assigning an element always creates it
+
+	--crlf
+		End the lines written to standard output and to files with "\r\n"
+		instead of "\n", whether they are terminated by ORS or by a
+		newline in a printf format. Lines which already end with "\r\n"
+		are left alone, and the output of commands is not changed
+
+	--strip-bom
+		Remove the UTF-8 byte order mark which begins the first record of
+		an input file, as found in the files exported by Windows programs
+
+	--encoding name
+		Read and write files in the encoding name instead of UTF-8, so
+		that length, substr, toupper and the like work on its characters.
+		The input files, standard input and the files read by getline are
+		decoded, standard output and the files written to are encoded.
+		Characters which the encoding lacks are written as '?'. The
+		encodings are latin1 (iso-8859-1), latin9 (iso-8859-15) and cp1252
+		(windows-1252). Commands read and write UTF-8
+
+	--collate locale
+		Compare strings, and sort them for PROCINFO["sorted_in"], in the
+		order of locale instead of byte by byte, so that accented letters
+		sort next to their base letters. The locale is a language tag
+		(de, sv-SE) or a locale name (de_DE.UTF-8); C and POSIX mean byte
+		order. Only identical strings compare equal
+
+	--case-locale locale
+		Convert case in toupper and tolower with the full Unicode rules of
+		the language of locale: "ß" becomes "SS" and, in Turkish (tr) and
+		Azerbaijani (az), "i" becomes "İ" and "I" becomes "ı". The locale
+		is a language tag or a locale name, as for --collate. By default,
+		it is given by the LC_ALL, LC_CTYPE or LANG environment variable.
+		In the C and POSIX locales every character is converted on its
+		own, and with --posix only the ASCII letters are
+
+	-b, --characters-as-bytes
+		Treat the characters of strings as bytes in toupper and tolower,
+		which only convert the ASCII letters and leave the other bytes
+		alone, even if they are not valid UTF-8, and in printf %c, which
+		prints the byte whose value a number is, or the first byte of a
+		string
+
+	--urls
+		Fetch the file operands and the files read by getline which are
+		http:// or https:// URLs. Writing to a URL is an error
+
+	--url-timeout seconds
+		Stop fetching a URL which takes longer than seconds, 30 by
+		default. 0 means no timeout
+
+	--url-max-size bytes
+		Fail when a URL holds more than bytes. By default there is no limit
+
+	--max-open-files n
+		Keep at most n files open for output redirections. Once the limit
+		is reached, the least recently used file is closed, and reopened in
+		append mode when written to again. By default, files are closed this
+		way only when the process runs out of file descriptors
+
+	--max-call-depth n
+		Stop the program with an error when calls of user defined functions
+		are nested more than n deep. By default calls can nest as deep as
+		memory allows. The current depth is PROCINFO["call_depth"], the
+		highest one reached so far PROCINFO["max_call_depth"], and the
+		highest number of parameters of the nested calls
+		PROCINFO["max_locals"]
+
+	--parallel n
+		Run the main rules on n records at once. The output is written in
+		the order of the input. Only programs whose rules process every
+		record on its own can run this way: they may add to global
+		variables (n++, sum += $1, count[$1]++) which are read only in END,
+		but not assign them otherwise, and may not use range patterns,
+		getline, redirections, system, close, fflush, rand, srand, exit or
+		nextfile. Other programs run sequentially, with a warning
+
+	--lint
+		Warn about suspicious constructs, such as variables which are never
+		assigned, assignments used as conditions, unused functions and
+		parameters and non-portable extensions. The warnings do not
+		prevent the program from running
+
+	--posix
+		Disable the extensions to POSIX awk: hexadecimal integers (0x1f) in
+		the program, in the input data and in strings converted to
+		numbers, arrays of arrays, the third argument of match, the fourth
+		argument of split and a space between the name of a function and
+		'(' in its definition. copyarr, warn, PROCINFO, ERRNO, IGNORECASE
+		and RT are ordinary names
+
+	--shell path
+		Run the commands of system, pipes and getline with path -c
+		command (/S /C "command" for cmd.exe). By default, the shell is
+		given by the AWKSHELL environment variable, or is sh (cmd.exe on
+		Windows)
+
+	--no-shell
+		Run commands without a shell: the command is split into words at
+		blanks, and the first word is the program run with the others as
+		arguments. Quotes and backslashes work as in the shell, but
+		variables, globs and other expansions are not processed
+
+	--compat
+		Accept calls to user defined functions with more arguments than
+		parameters, evaluating and discarding the extra arguments. --lint
+		reports them
+
+EXIT STATUS
+	0 if the program ran to completion, the status given to exit if it
+	called exit, 1 if an error stopped it while running and 2 if it could
+	not be run: the options were wrong, or the program could not be read
+	or had syntax errors`
 	fmt.Fprintf(w, "%s\n", helpstr)
 }
 
+// Formats the errors found before the command line is built
 func programError(msg string) error {
 	return fmt.Errorf("%s: %s", os.Args[0], msg)
 }
 
-func parseCliError(msg string) {
-	fmt.Fprintln(os.Stderr, programError(msg))
-	os.Exit(1)
+// Prints an error or warning as coming from the program of the command line
+func report(cl interpreter.CommandLine, err error) {
+	fmt.Fprintf(cl.Stderr, "%s: %s\n", cl.Programname, err)
 }
 
-func expectedArgument(opt string) {
-	parseCliError(fmt.Sprintf("expected parameter for option %s", opt))
+// Returns the locale of toupper and tolower: the one given by --case-locale,
+// or else the one of the character classes in the environment
+func caseLocale(opts options) string {
+	if opts.caselocale != "" {
+		return opts.caselocale
+	}
+	for _, name := range []string{"LC_ALL", "LC_CTYPE", "LANG"} {
+		if locale := os.Getenv(name); locale != "" {
+			return locale
+		}
+	}
+	return ""
 }
 
-func parseCliArguments() interpreter.CommandLine {
+// Returns the opener of the files of the program, which fetches URLs if
+// asked by --urls
+func files(opts options) interpreter.FileOpener {
+	if !opts.urls {
+		return nil
+	}
+	return interpreter.URLFiles{
+		Timeout: time.Duration(opts.urltimeout) * time.Second,
+		MaxSize: opts.urlmaxsize,
+	}
+}
+
+func parseCliArguments() (interpreter.CommandLine, options) {
 	if len(os.Args[1:]) == 0 {
 		printHelp(os.Stderr)
-		os.Exit(1)
+		os.Exit(2)
 	}
 
-	fs := " "
-	var variables []string
-	var remaining []string
+	opts := parseOptions(os.Args[1:])
 	var program io.Reader
-
-	var i int
-	var programfiles []io.Reader
-
-	args := os.Args[1:]
-outer:
-	for ; i < len(args); i++ {
-		switch {
-		case args[i] == "-h":
-			fallthrough
-		case args[i] == "--help":
-			printHelp(os.Stdout)
-			os.Exit(0)
-		case strings.HasPrefix(args[i], "-F"):
-			if args[i] != "-F" {
-				args[i] = args[i][2:]
-				i--
-			}
-			if i >= len(args) {
-				expectedArgument(args[i])
-			}
-			i++
-			fs = args[i]
-		case strings.HasPrefix(args[i], "-f"):
-			if args[i] != "-f" {
-				args[i] = args[i][2:]
-				i--
-			}
-			if i >= len(args) {
-				expectedArgument(args[i])
+	var programfiles []parser.ProgramFile
+	remaining := opts.operands
+	if opts.load != "" {
+		if len(opts.program) > 0 {
+			parseCliError("cannot give a program together with --load")
+		}
+		if opts.compile || opts.check || opts.dumptokens || opts.dumpast {
+			parseCliError("--load only runs a compiled program")
+		}
+	} else if opts.compile && len(remaining) > 0 {
+		parseCliError(fmt.Sprintf("unexpected argument %s with --compile", remaining[0]))
+	} else if len(opts.program) == 0 && len(remaining) == 0 {
+		parseCliError("expected program string")
+	} else if len(opts.program) == 0 {
+		program = strings.NewReader(remaining[0])
+		remaining = remaining[1:]
+	} else {
+		for _, part := range opts.program {
+			if part.file == "" {
+				programfiles = append(programfiles, parser.ProgramFile{Name: "-e", Source: strings.NewReader(part.text)})
+				continue
 			}
-			i++
-			fname := args[i]
-			file, err := os.Open(fname)
+			file, err := os.Open(part.file)
 			if err != nil {
 				fmt.Fprintln(os.Stderr, programError(err.Error()))
-				os.Exit(1)
-			}
-			programfiles = append(programfiles, file)
-		case strings.HasPrefix(args[i], "-v"):
-			if args[i] != "-v" {
-				args[i] = args[i][2:]
-				i--
+				os.Exit(2)
 			}
-			if i >= len(args) {
-				expectedArgument(args[i])
-			}
-			i++
-			variables = append(variables, args[i])
-		default:
-			if len(args[i]) > 0 && args[i][0] == '-' && args[i] != "--" {
-				parseCliError(fmt.Sprintf("unexpected option %s", args[i]))
-			}
-			break outer
+			programfiles = append(programfiles, parser.ProgramFile{Name: part.file, Source: bufio.NewReader(file)})
 		}
 	}
-	if len(programfiles) == 0 && i >= len(args) {
-		parseCliError("expected program string")
-	} else if len(programfiles) == 0 {
-		program = strings.NewReader(args[i])
-		i++
-	} else {
-		program = bufio.NewReader(io.MultiReader(programfiles...))
-	}
-	remaining = args[i:]
 
 	return interpreter.CommandLine{
-		Fs:             fs,
-		Preassignments: variables,
-		Program:        program,
-		Programname:    os.Args[0],
-		Arguments:      remaining,
-		Stdin:          os.Stdin,
-		Stdout:         os.Stdout,
-		Stderr:         os.Stderr,
+		Fs:                opts.fs,
+		Preassignments:    opts.variables,
+		Program:           program,
+		ProgramFiles:      programfiles,
+		NoAssignOperands:  opts.exec,
+		Programname:       os.Args[0],
+		Arguments:         remaining,
+		Stdin:             os.Stdin,
+		Stdout:            os.Stdout,
+		Stderr:            os.Stderr,
+		Compat:            opts.compat,
+		Posix:             opts.posix,
+		DeterministicRand: opts.deterministicrand,
+		PrintfOrs:         opts.printfors,
+		LazyElements:      opts.lazyelements,
+		Crlf:              opts.crlf,
+		StripBom:          opts.stripbom,
+		Encoding:          opts.encoding,
+		Collate:           opts.collate,
+		CaseLocale:        caseLocale(opts),
+		CharactersAsBytes: opts.bytes,
+		MaxOpenFiles:      opts.maxopenfiles,
+		MaxCallDepth:      opts.maxcalldepth,
+		Parallel:          opts.parallel,
+		DumpStreams:       opts.dumpstreams,
+		Stats:             opts.stats,
+		CatchSignals:      opts.catchsignals,
+		EndOnSignal:       opts.endonsignal,
+		Shell:             opts.shell,
+		DirectExec:        opts.noshell,
+		Lint:              opts.lint,
+		Files:             files(opts),
 		Natives: map[string]interpreter.NativeFunction{
 			"curl": func(args ...interpreter.NativeVal) (interpreter.NativeVal, error) {
 				url := args[0].String()
-				http.DefaultClient.Timeout = time.Second * 10
-				resp, err := http.Get(url)
+				client := http.Client{Timeout: time.Second * 10}
+				resp, err := client.Get(url)
 				if err != nil {
 					return nil, nil
 				}
@@ -143,20 +381,145 @@ outer:
 				return interpreter.NativeStr(body), nil
 			},
 		},
+	}, opts
+}
+
+// Prints the errors and warnings of the program and exits
+func check(cl interpreter.CommandLine) {
+	compiled, errs := interpreter.CompileCL(cl)
+	for _, warning := range compiled.Warnings {
+		report(cl, warning)
 	}
+	for _, err := range errs {
+		report(cl, err)
+	}
+	if len(errs) > 0 {
+		os.Exit(2)
+	}
+	os.Exit(0)
 }
 
-func main() {
-	cl := parseCliArguments()
-	errs := interpreter.ExecuteCL(cl)
+// Prints the tokens or the syntax tree of the program and exits
+func dump(cl interpreter.CommandLine, opts options) {
+	var errs []error
+	if opts.dumptokens {
+		var tokens []lexer.Token
+		tokens, errs = parser.Tokens(parser.CommandLine{
+			Program:      cl.Program,
+			ProgramFiles: cl.ProgramFiles,
+			Posix:        cl.Posix,
+		})
+		parser.DumpTokens(cl.Stdout, tokens)
+	} else {
+		var compiled parser.CompiledProgram
+		compiled, errs = interpreter.CompileCL(cl)
+		if len(errs) == 0 {
+			parser.DumpAst(cl.Stdout, compiled.All)
+		}
+	}
+	for _, err := range errs {
+		report(cl, err)
+	}
+	if len(errs) > 0 {
+		os.Exit(2)
+	}
+	os.Exit(0)
+}
+
+// Writes the compiled program to output and exits
+func compile(cl interpreter.CommandLine, output string) {
+	compiled, errs := interpreter.CompileCL(cl)
+	for _, warning := range compiled.Warnings {
+		report(cl, warning)
+	}
+	for _, err := range errs {
+		report(cl, err)
+	}
+	if len(errs) > 0 {
+		os.Exit(2)
+	}
+	var err error
+	if output == "-" {
+		err = parser.WriteProgram(cl.Stdout, compiled)
+	} else {
+		var file *os.File
+		if file, err = os.Create(output); err == nil {
+			err = parser.WriteProgram(file, compiled)
+			if cerr := file.Close(); err == nil {
+				err = cerr
+			}
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, programError(err.Error()))
+		os.Exit(2)
+	}
+	os.Exit(0)
+}
+
+// Runs the compiled program written by --compile to file
+func load(cl interpreter.CommandLine, file string) []error {
+	f, err := os.Open(file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, programError(err.Error()))
+		os.Exit(2)
+	}
+	compiled, errs := interpreter.LoadCL(cl, f)
+	f.Close()
+	if len(errs) > 0 {
+		return errs
+	}
+	return interpreter.Exec(interpreter.RunParams{
+		CompiledProgram: compiled,
+		CommandLine:     cl,
+	})
+}
+
+// Reports the errors of a run and returns the exit status they call for
+func exitStatus(cl interpreter.CommandLine, errs []error) int {
+	status := 0
+	failure := 0
 	for _, err := range errs {
 		if ee, ok := err.(interpreter.ErrorExit); ok {
-			os.Exit(ee.Status)
+			status = ee.Status
+		} else if _, ok := err.(interpreter.CompileError); ok {
+			report(cl, err)
+			failure = 2
 		} else if err != nil {
-			fmt.Fprintln(os.Stderr, programError(err.Error()))
+			report(cl, err)
+			if failure == 0 {
+				failure = 1
+			}
 		}
 	}
-	if len(errs) > 0 {
-		os.Exit(1)
+	if failure != 0 {
+		return failure
+	}
+	return status
+}
+
+func main() {
+	if len(os.Args) == 2 && os.Args[1] == "selftest" {
+		if !runSelftest(os.Stdout) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	cl, opts := parseCliArguments()
+	if opts.dumptokens || opts.dumpast {
+		dump(cl, opts)
+	}
+	if opts.check {
+		check(cl)
+	}
+	if opts.compile {
+		compile(cl, opts.output)
+	}
+	var errs []error
+	if opts.load != "" {
+		errs = load(cl, opts.load)
+	} else {
+		errs = interpreter.ExecuteCL(cl)
 	}
+	os.Exit(exitStatus(cl, errs))
 }
@@ -0,0 +1,273 @@
+/*
+ * Copyright (C) 2021 Andrea Fiori <andrea.fiori.1998@gmail.com>
+ *
+ * Licensed under GPLv2, see file LICENSE in this source tree.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Set at build time with -ldflags "-X main.version=..."
+var version = "devel"
+
+// A part of the program, read from a file given by -f or -E or given as
+// text by -e
+type programPart struct {
+	file string
+	text string
+}
+
+type options struct {
+	fs                string
+	variables         []string
+	program           []programPart
+	exec              bool // The last program file was given by -E, which ends the options
+	compat            bool
+	posix             bool
+	deterministicrand bool
+	printfors         bool
+	lazyelements      bool
+	crlf              bool
+	stripbom          bool
+	encoding          string
+	collate           string
+	caselocale        string
+	bytes             bool
+	maxopenfiles      int
+	maxcalldepth      int
+	parallel          int
+	check             bool
+	dumptokens        bool
+	dumpast           bool
+	dumpstreams       bool
+	stats             bool
+	catchsignals      bool
+	endonsignal       bool
+	shell             string
+	noshell           bool
+	lint              bool
+	urls              bool
+	urltimeout        int // Seconds
+	urlmaxsize        int64
+	compile           bool   // Write the compiled program to output instead of running it
+	output            string // "-" for standard output
+	load              string // Compiled program run in place of a program
+	operands          []string
+}
+
+func parseCliError(msg string) {
+	fmt.Fprintln(os.Stderr, programError(msg))
+	os.Exit(2)
+}
+
+func expectedArgument(opt string) {
+	parseCliError(fmt.Sprintf("expected parameter for option %s", opt))
+}
+
+// Parses the command line options, returning them together with the
+// operands (program text and arguments) following them. Short options can
+// be grouped (-hV) and their parameter can be attached (-F: or -vx=1).
+// Long options take their parameter either attached with = or as the
+// next argument. Option parsing ends at the first operand or at --.
+func parseOptions(args []string) options {
+	opts := options{fs: " ", output: "-", urltimeout: 30}
+
+	var i int
+	// Returns the parameter of option opt, either attached or the next
+	// argument
+	param := func(opt, attached string, hasattached bool) string {
+		if hasattached {
+			return attached
+		}
+		if i+1 >= len(args) {
+			expectedArgument(opt)
+		}
+		i++
+		return args[i]
+	}
+
+	for ; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			i++
+			break
+		}
+		if len(arg) < 2 || arg[0] != '-' {
+			break
+		}
+
+		if strings.HasPrefix(arg, "--") {
+			name, value, hasvalue := arg, "", false
+			if eq := strings.IndexByte(arg, '='); eq >= 0 {
+				name, value, hasvalue = arg[:eq], arg[eq+1:], true
+			}
+			flag := func(b *bool) {
+				if hasvalue {
+					parseCliError(fmt.Sprintf("option %s does not take a parameter", name))
+				}
+				*b = true
+			}
+			switch name {
+			case "--help":
+				printHelp(os.Stdout)
+				os.Exit(0)
+			case "--version":
+				printVersion()
+				os.Exit(0)
+			case "--source":
+				opts.program = append(opts.program, programPart{text: param(name, value, hasvalue)})
+			case "--exec":
+				opts.program = append(opts.program, programPart{file: param(name, value, hasvalue)})
+				opts.exec = true
+			case "--compile":
+				opts.program = append(opts.program, programPart{file: param(name, value, hasvalue)})
+				opts.compile = true
+			case "--output":
+				opts.output = param(name, value, hasvalue)
+			case "--load":
+				opts.load = param(name, value, hasvalue)
+			case "--compat":
+				flag(&opts.compat)
+			case "--posix":
+				flag(&opts.posix)
+			case "--deterministic-rand":
+				flag(&opts.deterministicrand)
+			case "--printf-ors":
+				flag(&opts.printfors)
+			case "--lazy-elements":
+				flag(&opts.lazyelements)
+			case "--crlf":
+				flag(&opts.crlf)
+			case "--strip-bom":
+				flag(&opts.stripbom)
+			case "--encoding":
+				opts.encoding = param(name, value, hasvalue)
+			case "--collate":
+				opts.collate = param(name, value, hasvalue)
+			case "--case-locale":
+				opts.caselocale = param(name, value, hasvalue)
+			case "--characters-as-bytes":
+				flag(&opts.bytes)
+			case "--check":
+				flag(&opts.check)
+			case "--dump-tokens":
+				flag(&opts.dumptokens)
+			case "--dump-ast":
+				flag(&opts.dumpast)
+			case "--dump-streams":
+				flag(&opts.dumpstreams)
+			case "--stats":
+				flag(&opts.stats)
+			case "--catch-signals":
+				flag(&opts.catchsignals)
+			case "--end-on-signal":
+				flag(&opts.endonsignal)
+			case "--no-shell":
+				flag(&opts.noshell)
+			case "--shell":
+				opts.shell = param(name, value, hasvalue)
+			case "--lint":
+				flag(&opts.lint)
+			case "--urls":
+				flag(&opts.urls)
+			case "--url-timeout":
+				p := param(name, value, hasvalue)
+				n, err := strconv.Atoi(p)
+				if err != nil || n < 0 {
+					parseCliError(fmt.Sprintf("invalid timeout %s", p))
+				}
+				opts.urltimeout = n
+			case "--url-max-size":
+				p := param(name, value, hasvalue)
+				n, err := strconv.ParseInt(p, 10, 64)
+				if err != nil || n < 0 {
+					parseCliError(fmt.Sprintf("invalid size %s", p))
+				}
+				opts.urlmaxsize = n
+			case "--max-open-files":
+				p := param(name, value, hasvalue)
+				n, err := strconv.Atoi(p)
+				if err != nil || n < 1 {
+					parseCliError(fmt.Sprintf("invalid number of files %s", p))
+				}
+				opts.maxopenfiles = n
+			case "--max-call-depth":
+				p := param(name, value, hasvalue)
+				n, err := strconv.Atoi(p)
+				if err != nil || n < 1 {
+					parseCliError(fmt.Sprintf("invalid call depth %s", p))
+				}
+				opts.maxcalldepth = n
+			case "--parallel":
+				p := param(name, value, hasvalue)
+				n, err := strconv.Atoi(p)
+				if err != nil || n < 1 {
+					parseCliError(fmt.Sprintf("invalid number of workers %s", p))
+				}
+				opts.parallel = n
+			default:
+				parseCliError(fmt.Sprintf("unknown option %s", name))
+			}
+			if opts.exec {
+				i++
+				break
+			}
+			continue
+		}
+
+	group:
+		for j := 1; j < len(arg); j++ {
+			opt := "-" + arg[j:j+1]
+			attached := arg[j+1:]
+			switch arg[j] {
+			case 'h':
+				printHelp(os.Stdout)
+				os.Exit(0)
+			case 'V':
+				printVersion()
+				os.Exit(0)
+			case 'n':
+				opts.check = true
+			case 'b':
+				opts.bytes = true
+			case 'F':
+				opts.fs = param(opt, attached, attached != "")
+				break group
+			case 'f':
+				opts.program = append(opts.program, programPart{file: param(opt, attached, attached != "")})
+				break group
+			case 'e':
+				opts.program = append(opts.program, programPart{text: param(opt, attached, attached != "")})
+				break group
+			case 'E':
+				opts.program = append(opts.program, programPart{file: param(opt, attached, attached != "")})
+				opts.exec = true
+				break group
+			case 'v':
+				opts.variables = append(opts.variables, param(opt, attached, attached != ""))
+				break group
+			case 'o':
+				opts.output = param(opt, attached, attached != "")
+				break group
+			default:
+				parseCliError(fmt.Sprintf("unknown option %s", opt))
+			}
+		}
+		if opts.exec {
+			i++
+			break
+		}
+	}
+	opts.operands = args[i:]
+	return opts
+}
+
+func printVersion() {
+	fmt.Printf("aawk %s\n", version)
+}
@@ -79,8 +79,10 @@ func (e *StringExpr) Token() lexer.Token {
 }
 
 type RegexExpr struct {
-	Regex    lexer.Token
-	Compiled *regexp.Regexp
+	Regex     lexer.Token
+	Compiled  *regexp.Regexp
+	Literal   string // Contained in every match, "" if none is known
+	IsLiteral bool   // The regex matches exactly the strings containing Literal
 	Expr
 }
 
@@ -90,7 +92,7 @@ func (e *RegexExpr) Token() lexer.Token {
 
 type MatchExpr struct {
 	Left  Expr
-	Op    lexer.Token
+	Op    lexer.Token // Tilde or NotTilde (lexer.Match is the match function)
 	Right Expr
 	Expr
 }
@@ -117,10 +119,11 @@ type LhsExpr interface {
 
 type IdExpr struct {
 	Id            lexer.Token
-	Index         int // Index in the global namespace stack
-	LocalIndex    int // Index in a function-local namespace stack
-	FunctionIndex int // Index in the function table (if Id is a function)
-	BuiltinIndex  int // Index in the builtin variable table (if Id is a builtin variable)
+	Index         int  // Index in the global namespace stack
+	LocalIndex    int  // Index in a function-local namespace stack
+	FunctionIndex int  // Index in the function table (if Id is a function)
+	BuiltinIndex  int  // Index in the builtin variable table (if Id is a builtin variable)
+	BeforeParen   bool // Followed by a space and '(', so it is concatenated with what is in parentheses
 	LhsExpr
 }
 
@@ -128,9 +131,12 @@ func (e *IdExpr) Token() lexer.Token {
 	return e.Id
 }
 
+// In a[i][j], Subarrays holds the subscripts selecting the nested array
+// (i) and Index the subscript of the element (j)
 type IndexingExpr struct {
-	Id    *IdExpr
-	Index []Expr
+	Id        *IdExpr
+	Subarrays [][]Expr
+	Index     []Expr
 	LhsExpr
 }
 
@@ -203,7 +209,7 @@ func (e *CallExpr) Token() lexer.Token {
 type InExpr struct {
 	Left  Expr
 	Op    lexer.Token
-	Right *IdExpr
+	Right LhsExpr // *IdExpr or *IndexingExpr referring to a subarray
 	Expr
 }
 
@@ -286,7 +292,7 @@ type ForEachStat struct {
 	For   lexer.Token
 	Id    *IdExpr
 	In    lexer.Token
-	Array *IdExpr
+	Array LhsExpr // *IdExpr or *IndexingExpr referring to a subarray
 	Body  Stat
 	Stat
 }
@@ -304,6 +310,15 @@ func (s *NextStat) Token() lexer.Token {
 	return s.Next
 }
 
+type NextfileStat struct {
+	Nextfile lexer.Token
+	Stat
+}
+
+func (s *NextfileStat) Token() lexer.Token {
+	return s.Nextfile
+}
+
 type BreakStat struct {
 	Break lexer.Token
 	Stat
@@ -418,19 +433,31 @@ type Items struct {
 	Normals   []*PatternAction
 	Ends      []*PatternAction
 	All       []Item
+	Sources   lexer.SourceMap
 }
 
 type ResolvedItems struct {
 	Items
 	Globalindices   map[string]int
 	Functionindices map[string]int
+	Warnings        []error
+}
+
+// A file of the program, as given by -f
+type ProgramFile struct {
+	Name   string
+	Source io.Reader
 }
 
 type CommandLine struct {
 	Program        io.Reader
+	ProgramFiles   []ProgramFile // Read in place of Program if not empty
 	Fs             string
 	Preassignments []string
 	Natives        map[string]bool
+	Compat         bool // Calls with more arguments than parameters are accepted
+	Posix          bool // Extensions are disabled
+	Lint           bool // Warn about suspicious constructs
 }
 
 type CompiledProgram struct {
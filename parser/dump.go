@@ -0,0 +1,208 @@
+/*
+ * Copyright (C) 2021 Andrea Fiori <andrea.fiori.1998@gmail.com>
+ *
+ * Licensed under GPLv2, see file LICENSE in this source tree.
+ */
+
+package parser
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/fioriandrea/aawk/lexer"
+)
+
+// Returns the tokens of the program as seen by the parser, which is what
+// decides whether a slash starts a regex. The tokens are returned even if
+// the program contains errors.
+func Tokens(cl CommandLine) ([]lexer.Token, []error) {
+	b, sources, err := readProgram(cl)
+	if err != nil {
+		return nil, []error{err}
+	}
+	ps := parser{
+		lexer:   lexer.NewLexer(b, cl.Posix),
+		sources: sources,
+		record:  true,
+	}
+	ps.advance()
+	_, errs := ps.itemList()
+	return ps.tokens, errs
+}
+
+// Writes one token per line as: line, type and quoted lexeme, separated
+// by tabs
+func DumpTokens(w io.Writer, tokens []lexer.Token) {
+	for _, tok := range tokens {
+		fmt.Fprintf(w, "%d\t%s\t%s\n", tok.Line, tok.Type, strconv.Quote(tok.Lexeme))
+	}
+}
+
+// Writes the syntax tree of the items as S-expressions, one item per
+// top level list and one statement per line
+func DumpAst(w io.Writer, items []Item) {
+	for _, item := range items {
+		fmt.Fprintf(w, "%s\n", dumpItem(item))
+	}
+}
+
+func dumpItem(item Item) string {
+	switch it := item.(type) {
+	case *FunctionDef:
+		args := make([]string, 0, len(it.Args))
+		for _, arg := range it.Args {
+			args = append(args, arg.Lexeme)
+		}
+		return fmt.Sprintf("(function %s (%s)\n%s)", it.Name.Lexeme, strings.Join(args, " "), dumpStat(it.Body, 1))
+	case *PatternAction:
+		return fmt.Sprintf("(rule %s\n%s)", dumpPattern(it.Pattern), dumpStat(it.Action, 1))
+	}
+	return "?"
+}
+
+func dumpPattern(pat Pattern) string {
+	switch p := pat.(type) {
+	case nil:
+		return "()"
+	case *SpecialPattern:
+		return p.Type.Lexeme
+	case *ExprPattern:
+		return dumpExpr(p.Expr)
+	case *RangePattern:
+		return sexpr("range", dumpExpr(p.Expr0), dumpExpr(p.Expr1))
+	}
+	return "?"
+}
+
+func dumpStat(stat Stat, depth int) string {
+	indent := strings.Repeat("  ", depth)
+	nested := func(stats ...Stat) string {
+		var b strings.Builder
+		for _, s := range stats {
+			fmt.Fprintf(&b, "\n%s", dumpStat(s, depth+1))
+		}
+		return b.String()
+	}
+	switch s := stat.(type) {
+	case nil:
+		return indent + "()"
+	case BlockStat:
+		// Empty statements are stored as nil
+		var stats []Stat
+		for _, st := range s {
+			if st != nil {
+				stats = append(stats, st)
+			}
+		}
+		return indent + "(block" + nested(stats...) + ")"
+	case *ExprStat:
+		return indent + dumpExpr(s.Expr)
+	case *PrintStat:
+		args := []string{s.Print.Lexeme, sexpr("", dumpExprs(s.Exprs)...)}
+		if s.File != nil {
+			args = append(args, s.RedirOp.Lexeme, dumpExpr(s.File))
+		}
+		return indent + sexpr(args[0], args[1:]...)
+	case *DeleteStat:
+		return indent + sexpr("delete", dumpExpr(s.Lhs))
+	case *IfStat:
+		if s.ElseBody != nil {
+			return indent + "(if " + dumpExpr(s.Cond) + nested(s.Body, s.ElseBody) + ")"
+		}
+		return indent + "(if " + dumpExpr(s.Cond) + nested(s.Body) + ")"
+	case *ForStat:
+		return indent + "(for" + nested(s.Init) + "\n" + indent + "  " + dumpExpr(s.Cond) + nested(s.Inc, s.Body) + ")"
+	case *ForEachStat:
+		return indent + "(for-in " + dumpExpr(s.Id) + " " + dumpExpr(s.Array) + nested(s.Body) + ")"
+	case *NextStat:
+		return indent + "(next)"
+	case *NextfileStat:
+		return indent + "(nextfile)"
+	case *BreakStat:
+		return indent + "(break)"
+	case *ContinueStat:
+		return indent + "(continue)"
+	case *ReturnStat:
+		return indent + sexpr("return", dumpExpr(s.ReturnVal))
+	case *ExitStat:
+		return indent + sexpr("exit", dumpExpr(s.Status))
+	}
+	return indent + "?"
+}
+
+func dumpExprs(exprs []Expr) []string {
+	res := make([]string, 0, len(exprs))
+	for _, e := range exprs {
+		res = append(res, dumpExpr(e))
+	}
+	return res
+}
+
+func dumpExpr(expr Expr) string {
+	switch e := expr.(type) {
+	case nil:
+		return "()"
+	case *BinaryExpr:
+		if e.Op.Type == lexer.Concat {
+			return sexpr("concat", dumpExpr(e.Left), dumpExpr(e.Right))
+		}
+		return sexpr(e.Op.Lexeme, dumpExpr(e.Left), dumpExpr(e.Right))
+	case *BinaryBoolExpr:
+		return sexpr(e.Op.Lexeme, dumpExpr(e.Left), dumpExpr(e.Right))
+	case *MatchExpr:
+		return sexpr(e.Op.Lexeme, dumpExpr(e.Left), dumpExpr(e.Right))
+	case *UnaryExpr:
+		return sexpr(e.Op.Lexeme, dumpExpr(e.Right))
+	case *NumberExpr:
+		return e.Num.Lexeme
+	case *StringExpr:
+		return strconv.Quote(e.Str.Lexeme)
+	case *RegexExpr:
+		return "/" + e.Regex.Lexeme + "/"
+	case *AssignExpr:
+		return sexpr(e.Equal.Lexeme, dumpExpr(e.Left), dumpExpr(e.Right))
+	case *IdExpr:
+		return e.Id.Lexeme
+	case *IndexingExpr:
+		args := []string{dumpExpr(e.Id)}
+		for _, sub := range e.Subarrays {
+			args = append(args, sexpr("", dumpExprs(sub)...))
+		}
+		args = append(args, sexpr("", dumpExprs(e.Index)...))
+		return sexpr("index", args...)
+	case *DollarExpr:
+		return sexpr("$", dumpExpr(e.Field))
+	case *PreIncrementExpr:
+		return sexpr("pre"+e.Op.Lexeme, dumpExpr(e.Lhs))
+	case *PostIncrementExpr:
+		return sexpr("post"+e.Op.Lexeme, dumpExpr(e.Lhs))
+	case *TernaryExpr:
+		return sexpr("?:", dumpExpr(e.Cond), dumpExpr(e.Expr0), dumpExpr(e.Expr1))
+	case *GetlineExpr:
+		args := []string{}
+		if e.File != nil {
+			args = append(args, e.Op.Lexeme, dumpExpr(e.File))
+		}
+		if e.Variable != nil {
+			args = append(args, dumpExpr(e.Variable))
+		}
+		return sexpr("getline", args...)
+	case *CallExpr:
+		return sexpr("call", append([]string{e.Called.Id.Lexeme}, dumpExprs(e.Args)...)...)
+	case *InExpr:
+		return sexpr("in", dumpExpr(e.Left), dumpExpr(e.Right))
+	case ExprList:
+		return sexpr("list", dumpExprs(e)...)
+	}
+	return "?"
+}
+
+func sexpr(head string, args ...string) string {
+	if head == "" {
+		return "(" + strings.Join(args, " ") + ")"
+	}
+	return "(" + strings.Join(append([]string{head}, args...), " ") + ")"
+}
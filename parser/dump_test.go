@@ -0,0 +1,78 @@
+/*
+ * Copyright (C) 2021 Andrea Fiori <andrea.fiori.1998@gmail.com>
+ *
+ * Licensed under GPLv2, see file LICENSE in this source tree.
+ */
+
+package parser
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDumpTokens(t *testing.T) {
+	tokens, errs := Tokens(CommandLine{Program: strings.NewReader("/a/ { x = 1 / 2 / 3\n\tprint > \"f\" }")})
+	if len(errs) > 0 {
+		t.Fatal(errs[0])
+	}
+	var b bytes.Buffer
+	DumpTokens(&b, tokens)
+	expected := `1	Regex	"a"
+1	LeftCurly	"{"
+1	Identifier	"x"
+1	Assign	"="
+1	Number	"1"
+1	Slash	"/"
+1	Number	"2"
+1	Slash	"/"
+1	Number	"3"
+2	Newline	"\n"
+2	Print	"print"
+2	Greater	">"
+2	String	"f"
+2	RightCurly	"}"
+2	Eof	"EOF"
+`
+	if b.String() != expected {
+		t.Errorf("dumped\n%s\nexpected\n%s", b.String(), expected)
+	}
+}
+
+func TestTokensOfInvalidProgram(t *testing.T) {
+	tokens, errs := Tokens(CommandLine{Program: strings.NewReader("BEGIN { print (1 }")})
+	if len(errs) == 0 {
+		t.Errorf("no errors for an invalid program")
+	}
+	if len(tokens) < 5 || tokens[3].Lexeme != "(" {
+		t.Errorf("tokens of an invalid program: %v", tokens)
+	}
+}
+
+func TestDumpAst(t *testing.T) {
+	program := `function f(a,  b) { for (b in a) delete a[b]; return }
+/x/, NR == 3 { $1 = f(arr); getline y < "file"; next }
+END { while (i++ < 3) printf "%d\n", -i }`
+	expected := `(function f (a b)
+  (block
+    (for-in b a
+      (delete (index a (b))))
+    (return ())))
+(rule (range /x/ (== NR 3))
+  (block
+    (= ($ 1) (call f arr))
+    (getline < "file" y)
+    (next)))
+(rule END
+  (block
+    (for
+      ()
+      (< (post++ i) 3)
+      ()
+      (printf ("%d\n" (- i))))))
+`
+	if got := optimizedAst(t, program); got != expected {
+		t.Errorf("dumped\n%s\nexpected\n%s", got, expected)
+	}
+}
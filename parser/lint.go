@@ -0,0 +1,308 @@
+/*
+ * Copyright (C) 2021 Andrea Fiori <andrea.fiori.1998@gmail.com>
+ *
+ * Licensed under GPLv2, see file LICENSE in this source tree.
+ */
+
+package parser
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/fioriandrea/aawk/lexer"
+)
+
+// Functions and built-in variables which are not defined by POSIX
+var nonPosixFuncs = map[lexer.TokenType]bool{
+	lexer.Copyarr: true,
+	lexer.Warn:    true,
+}
+
+var nonPosixVars = map[int]bool{
+	Errno:      true,
+	Ignorecase: true,
+	Procinfo:   true,
+	Rt:         true,
+}
+
+type lintWarning struct {
+	tok lexer.Token
+	msg string
+}
+
+// Looks for suspicious constructs in a resolved program. It never fails, the
+// problems found are returned as warnings sorted by line
+type linter struct {
+	warnings []lintWarning
+
+	assigned map[string]bool        // Global variables which are assigned somewhere
+	read     map[string]lexer.Token // First read of global scalars
+	called   map[string]bool        // Called user defined functions
+	arities  map[string]int         // Parameters of the user defined functions
+	strings  map[string]bool        // String constants, which may name functions (sorted_in)
+	params   map[string]bool        // Parameters of the current function which are used
+}
+
+func lint(ritems Items, cl CommandLine) []error {
+	items := ritems.All
+	l := &linter{
+		assigned: map[string]bool{},
+		read:     map[string]lexer.Token{},
+		called:   map[string]bool{},
+		arities:  map[string]int{},
+		strings:  map[string]bool{},
+	}
+	for _, item := range items {
+		if fd, ok := item.(*FunctionDef); ok {
+			l.arities[fd.Name.Lexeme] = len(fd.Args)
+		}
+	}
+	for _, preassign := range cl.Preassignments {
+		l.assigned[strings.SplitN(preassign, "=", 2)[0]] = true
+	}
+
+	var functions []*FunctionDef
+	for _, item := range items {
+		switch it := item.(type) {
+		case *FunctionDef:
+			functions = append(functions, it)
+			if it.Name.Type != lexer.IdentifierParen {
+				l.warn(it.Name, fmt.Sprintf("space between %s and '(' is not accepted in POSIX mode", it.Name.Lexeme))
+			}
+			l.params = map[string]bool{}
+			l.stat(it.Body)
+			for _, arg := range it.Args {
+				if !l.params[arg.Lexeme] {
+					l.warn(arg, fmt.Sprintf("parameter %s of function %s is never used", arg.Lexeme, it.Name.Lexeme))
+				}
+			}
+			l.params = nil
+		case *PatternAction:
+			switch p := it.Pattern.(type) {
+			case *ExprPattern:
+				l.cond(p.Expr)
+			case *RangePattern:
+				l.cond(p.Expr0)
+				l.cond(p.Expr1)
+			}
+			l.stat(it.Action)
+		}
+	}
+
+	for _, fd := range functions {
+		if !l.called[fd.Name.Lexeme] && !l.strings[fd.Name.Lexeme] {
+			l.warn(fd.Name, fmt.Sprintf("function %s is never called", fd.Name.Lexeme))
+		}
+	}
+	var names []string
+	for name := range l.read {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !l.assigned[name] {
+			l.warn(l.read[name], fmt.Sprintf("variable %s is used but never assigned", name))
+		}
+	}
+
+	sort.SliceStable(l.warnings, func(i, j int) bool {
+		return l.warnings[i].tok.Line < l.warnings[j].tok.Line
+	})
+	var errs []error
+	for _, w := range l.warnings {
+		errs = append(errs, fmt.Errorf("at %s (%s): lint: %s", ritems.Sources.Position(w.tok.Line), w.tok.Lexeme, w.msg))
+	}
+	return errs
+}
+
+func (l *linter) warn(tok lexer.Token, msg string) {
+	l.warnings = append(l.warnings, lintWarning{tok, msg})
+}
+
+func (l *linter) stat(s Stat) {
+	switch ss := s.(type) {
+	case BlockStat:
+		for _, st := range ss {
+			l.stat(st)
+		}
+	case *ExprStat:
+		l.expr(ss.Expr)
+	case *PrintStat:
+		l.exprs(ss.Exprs)
+		l.expr(ss.File)
+	case *DeleteStat:
+		l.lhs(ss.Lhs)
+	case *IfStat:
+		l.cond(ss.Cond)
+		l.stat(ss.Body)
+		l.stat(ss.ElseBody)
+	case *ForStat:
+		l.stat(ss.Init)
+		l.cond(ss.Cond)
+		l.stat(ss.Inc)
+		l.stat(ss.Body)
+	case *ForEachStat:
+		l.lhs(ss.Id)
+		l.expr(ss.Array)
+		l.stat(ss.Body)
+	case *ReturnStat:
+		l.expr(ss.ReturnVal)
+	case *ExitStat:
+		l.expr(ss.Status)
+	}
+}
+
+// Lints an expression used as a condition
+func (l *linter) cond(e Expr) {
+	if a, ok := e.(*AssignExpr); ok && a.Equal.Type == lexer.Assign {
+		l.warn(a.Equal, "assignment used as a condition, did you mean ==?")
+	}
+	l.expr(e)
+}
+
+// Lints an expression which is assigned to
+func (l *linter) lhs(e LhsExpr) {
+	switch v := e.(type) {
+	case *IdExpr:
+		l.id(v)
+		l.assigned[v.Id.Lexeme] = true
+	case *IndexingExpr:
+		l.expr(v)
+		l.assigned[v.Id.Id.Lexeme] = true
+	case *DollarExpr:
+		l.expr(v)
+	}
+}
+
+// Records the use of an identifier, without considering it a read
+func (l *linter) id(e *IdExpr) {
+	if e.BeforeParen {
+		l.warn(e.Id, fmt.Sprintf("%s is concatenated with the expression in parentheses which follows, it is not called", e.Id.Lexeme))
+	}
+	switch {
+	case e.LocalIndex >= 0 && l.params != nil:
+		l.params[e.Id.Lexeme] = true
+	case e.BuiltinIndex >= 0 && nonPosixVars[e.BuiltinIndex]:
+		l.warn(e.Id, fmt.Sprintf("%s is a non-portable extension", e.Id.Lexeme))
+	}
+}
+
+func (l *linter) regexOperand(e Expr, msg string) {
+	if _, ok := e.(*RegexExpr); ok {
+		l.warn(e.Token(), msg)
+	}
+}
+
+func (l *linter) exprs(es []Expr) {
+	for _, e := range es {
+		l.expr(e)
+	}
+}
+
+func (l *linter) expr(ex Expr) {
+	switch e := ex.(type) {
+	case *BinaryExpr:
+		l.regexOperand(e.Left, "regex constant used as an operand is matched against $0")
+		l.regexOperand(e.Right, "regex constant used as an operand is matched against $0")
+		l.expr(e.Left)
+		l.expr(e.Right)
+	case *BinaryBoolExpr:
+		l.cond(e.Left)
+		l.cond(e.Right)
+	case *UnaryExpr:
+		l.expr(e.Right)
+	case *MatchExpr:
+		l.regexOperand(e.Left, "regex constant on the left of a match operator is matched against $0")
+		l.expr(e.Left)
+		l.expr(e.Right)
+	case *AssignExpr:
+		l.regexOperand(e.Right, "assigning a regex constant assigns the result of matching it against $0")
+		l.lhs(e.Left)
+		l.expr(e.Right)
+	case *IdExpr:
+		l.id(e)
+		if e.Index >= 0 {
+			if _, ok := l.read[e.Id.Lexeme]; !ok {
+				l.read[e.Id.Lexeme] = e.Id
+			}
+		}
+	case *IndexingExpr:
+		l.id(e.Id)
+		if len(e.Subarrays) > 0 {
+			l.warn(e.Id.Id, "arrays of arrays are a non-portable extension")
+		}
+		for _, sub := range e.Subarrays {
+			l.exprs(sub)
+		}
+		l.exprs(e.Index)
+	case *DollarExpr:
+		l.expr(e.Field)
+	case *PreIncrementExpr:
+		l.lhs(e.Lhs)
+	case *PostIncrementExpr:
+		l.lhs(e.Lhs)
+	case *TernaryExpr:
+		l.cond(e.Cond)
+		l.expr(e.Expr0)
+		l.expr(e.Expr1)
+	case *GetlineExpr:
+		l.lhs(e.Variable)
+		l.expr(e.File)
+	case *CallExpr:
+		l.callExpr(e)
+	case *InExpr:
+		l.expr(e.Left)
+		l.expr(e.Right)
+	case ExprList:
+		l.exprs(e)
+	case *NumberExpr:
+		if strings.HasPrefix(e.Num.Lexeme, "0x") || strings.HasPrefix(e.Num.Lexeme, "0X") {
+			l.warn(e.Num, "hexadecimal constants are a non-portable extension")
+		}
+	case *StringExpr:
+		l.strings[e.Str.Lexeme] = true
+	}
+}
+
+func (l *linter) callExpr(e *CallExpr) {
+	name := e.Called.Id.Lexeme
+	typ := e.Called.Id.Type
+	user := typ == lexer.Identifier || typ == lexer.IdentifierParen
+	switch {
+	case user:
+		l.called[name] = true
+		if arity, ok := l.arities[name]; ok && len(e.Args) > arity {
+			l.warn(e.Called.Id, arityMessage(e, arity))
+		}
+	case nonPosixFuncs[typ]:
+		l.warn(e.Called.Id, fmt.Sprintf("%s is a non-portable extension", name))
+	case typ == lexer.Match && len(e.Args) == 3:
+		l.warn(e.Called.Id, "match with an array argument is a non-portable extension")
+	case typ == lexer.Split && len(e.Args) == 4:
+		l.warn(e.Called.Id, "split with a separators array is a non-portable extension")
+	}
+	for i, arg := range e.Args {
+		id, isid := arg.(*IdExpr)
+		switch {
+		case user:
+			l.regexOperand(arg, fmt.Sprintf("regex constant passed to %s is matched against $0", name))
+			if isid {
+				// It may be an array filled by the function
+				l.lhs(id)
+				continue
+			}
+		case typ == lexer.Split && (i == 1 || i == 3), typ == lexer.Match && i == 2, typ == lexer.Copyarr && i == 0:
+			l.lhs(arg.(LhsExpr))
+			continue
+		case (typ == lexer.Sub || typ == lexer.Gsub) && i == 2:
+			l.lhs(arg.(LhsExpr))
+			continue
+		case typ == lexer.Length && isid:
+			l.id(id)
+			continue
+		}
+		l.expr(arg)
+	}
+}
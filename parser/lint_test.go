@@ -0,0 +1,78 @@
+/*
+ * Copyright (C) 2021 Andrea Fiori <andrea.fiori.1998@gmail.com>
+ *
+ * Licensed under GPLv2, see file LICENSE in this source tree.
+ */
+
+package parser
+
+import (
+	"strings"
+	"testing"
+)
+
+// Calls with more arguments than parameters are accepted, so that they can
+// be warned about
+func lintProgram(t *testing.T, program string, preassignments ...string) []string {
+	compiled, errs := ParseCl(CommandLine{
+		Program:        strings.NewReader(program),
+		Fs:             " ",
+		Preassignments: preassignments,
+		Compat:         true,
+		Lint:           true,
+	})
+	if len(errs) > 0 {
+		t.Fatalf("%s: %s", program, errs[0])
+	}
+	var warnings []string
+	for _, w := range compiled.Warnings {
+		warnings = append(warnings, w.Error())
+	}
+	return warnings
+}
+
+func TestLint(t *testing.T) {
+	tests := []struct {
+		program, warning string
+	}{
+		{`$1 = "x" { print }`, "(=): lint: assignment used as a condition, did you mean ==?"},
+		{`{ if (x = 1) print; y = x }`, "(=): lint: assignment used as a condition, did you mean ==?"},
+		{`{ while ((n = $1) && (m = 2)) print m }`, "(=): lint: assignment used as a condition, did you mean ==?"},
+		{`function f(a) { return a } BEGIN { print 1 }`, "(f): lint: function f is never called"},
+		{`function f(a, b) { return a } BEGIN { f(1) }`, "(b): lint: parameter b of function f is never used"},
+		{`BEGIN { print x }`, "(x): lint: variable x is used but never assigned"},
+		{`function f(a) { return a } BEGIN { f(1, 2) }`, "(f): lint: function f called with 2 arguments, but accepts at most 1"},
+		{`function f(a) { return a }
+BEGIN { f(1, 2, 3) }`, "at line 2 (f): lint: function f called with 3 arguments"},
+	}
+	for _, test := range tests {
+		warnings := lintProgram(t, test.program)
+		found := false
+		for _, w := range warnings {
+			found = found || strings.Contains(w, test.warning)
+		}
+		if !found {
+			t.Errorf("%s: warnings %q, expected one containing %q", test.program, warnings, test.warning)
+		}
+	}
+}
+
+func TestLintClean(t *testing.T) {
+	tests := []struct {
+		program        string
+		preassignments []string
+	}{
+		{`{ if (x == 1) print; x = $1 }`, nil},
+		{`$1 == "x" { print } ($2 = "y") == "y" { print }`, nil},
+		{`function f(a) { return a } BEGIN { print f(1) }`, nil},
+		{`function f(a) { a[1] = 1 } BEGIN { f(arr); for (k in arr) print k }`, nil},
+		{`function f(a) { return a } BEGIN { name = "f"; print name }`, nil},
+		{`BEGIN { print x }`, []string{"x=1"}},
+		{`{ getline line; split($0, parts); print line, parts[1] }`, nil},
+	}
+	for _, test := range tests {
+		if warnings := lintProgram(t, test.program, test.preassignments...); len(warnings) > 0 {
+			t.Errorf("%s: unexpected warnings %q", test.program, warnings)
+		}
+	}
+}
@@ -0,0 +1,348 @@
+/*
+ * Copyright (C) 2021 Andrea Fiori <andrea.fiori.1998@gmail.com>
+ *
+ * Licensed under GPLv2, see file LICENSE in this source tree.
+ */
+
+package parser
+
+import (
+	"math"
+	"regexp/syntax"
+	"strconv"
+
+	"github.com/fioriandrea/aawk/lexer"
+)
+
+// Rewrites a resolved program so that it does less work at run time:
+// arithmetic and concatenations of constants are folded, constant dynamic
+// regexes are compiled once and rules whose pattern is a false constant
+// are dropped. It runs after the resolver and the linter, which see the
+// program as written.
+func optimize(items Items) Items {
+	for _, item := range items.All {
+		switch it := item.(type) {
+		case *FunctionDef:
+			optimizeStat(it.Body)
+		case *PatternAction:
+			switch p := it.Pattern.(type) {
+			case *ExprPattern:
+				p.Expr = fold(p.Expr)
+			case *RangePattern:
+				p.Expr0 = fold(p.Expr0)
+				p.Expr1 = fold(p.Expr1)
+			}
+			optimizeStat(it.Action)
+		}
+	}
+
+	normals := make([]*PatternAction, 0, len(items.Normals))
+	dead := map[Item]bool{}
+	for _, pa := range items.Normals {
+		if p, ok := pa.Pattern.(*ExprPattern); ok && isFalseConstant(p.Expr) {
+			dead[pa] = true
+			continue
+		}
+		normals = append(normals, pa)
+	}
+	// Main rules make the input be read, so one is kept if it is the only
+	// reason to read it
+	if len(normals) == 0 && len(items.Ends) == 0 && len(items.Normals) > 0 {
+		normals = items.Normals[:1]
+		delete(dead, items.Normals[0])
+	}
+	if len(dead) > 0 {
+		all := make([]Item, 0, len(items.All))
+		for _, item := range items.All {
+			if !dead[item] {
+				all = append(all, item)
+			}
+		}
+		items.All = all
+		items.Normals = normals
+	}
+	return items
+}
+
+func optimizeStat(s Stat) {
+	switch ss := s.(type) {
+	case BlockStat:
+		for _, st := range ss {
+			optimizeStat(st)
+		}
+	case *ExprStat:
+		ss.Expr = fold(ss.Expr)
+	case *PrintStat:
+		foldAll(ss.Exprs)
+		if ss.File != nil {
+			ss.File = fold(ss.File)
+		}
+	case *DeleteStat:
+		foldLhs(ss.Lhs)
+	case *IfStat:
+		ss.Cond = fold(ss.Cond)
+		optimizeStat(ss.Body)
+		optimizeStat(ss.ElseBody)
+	case *ForStat:
+		optimizeStat(ss.Init)
+		if ss.Cond != nil {
+			ss.Cond = fold(ss.Cond)
+		}
+		optimizeStat(ss.Inc)
+		optimizeStat(ss.Body)
+	case *ForEachStat:
+		foldLhs(ss.Array)
+		optimizeStat(ss.Body)
+	case *ReturnStat:
+		if ss.ReturnVal != nil {
+			ss.ReturnVal = fold(ss.ReturnVal)
+		}
+	case *ExitStat:
+		if ss.Status != nil {
+			ss.Status = fold(ss.Status)
+		}
+	}
+}
+
+func foldAll(es []Expr) {
+	for i, e := range es {
+		es[i] = fold(e)
+	}
+}
+
+// Returns the expression with its constant subexpressions folded. Lvalues
+// are left alone, except for their subscripts.
+func fold(ex Expr) Expr {
+	switch e := ex.(type) {
+	case *BinaryExpr:
+		e.Left = fold(e.Left)
+		e.Right = fold(e.Right)
+		if folded := foldBinary(e); folded != nil {
+			return folded
+		}
+	case *BinaryBoolExpr:
+		e.Left = fold(e.Left)
+		e.Right = fold(e.Right)
+	case *UnaryExpr:
+		e.Right = fold(e.Right)
+		if n, ok := e.Right.(*NumberExpr); ok {
+			switch e.Op.Type {
+			case lexer.Minus:
+				return numberConstant(e.Op, -n.NumVal)
+			case lexer.Plus:
+				return numberConstant(e.Op, n.NumVal)
+			case lexer.Not:
+				return numberConstant(e.Op, boolToFloat(n.NumVal == 0))
+			}
+		}
+	case *MatchExpr:
+		e.Left = fold(e.Left)
+		e.Right = foldRegex(fold(e.Right))
+	case *AssignExpr:
+		foldLhs(e.Left)
+		e.Right = fold(e.Right)
+	case *IndexingExpr:
+		foldLhs(e)
+	case *DollarExpr:
+		foldLhs(e)
+	case *PreIncrementExpr:
+		foldLhs(e.Lhs)
+	case *PostIncrementExpr:
+		foldLhs(e.Lhs)
+	case *TernaryExpr:
+		e.Cond = fold(e.Cond)
+		e.Expr0 = fold(e.Expr0)
+		e.Expr1 = fold(e.Expr1)
+	case *GetlineExpr:
+		if e.Variable != nil {
+			foldLhs(e.Variable)
+		}
+		if e.File != nil {
+			e.File = fold(e.File)
+		}
+	case *CallExpr:
+		foldAll(e.Args)
+		switch e.Called.Id.Type {
+		case lexer.Sub, lexer.Gsub:
+			e.Args[0] = foldRegex(e.Args[0])
+		case lexer.Match:
+			e.Args[1] = foldRegex(e.Args[1])
+		}
+	case *InExpr:
+		e.Left = fold(e.Left)
+		foldLhs(e.Right)
+	case ExprList:
+		foldAll(e)
+	}
+	return ex
+}
+
+func foldLhs(lhs LhsExpr) {
+	switch e := lhs.(type) {
+	case *IndexingExpr:
+		for _, sub := range e.Subarrays {
+			foldAll(sub)
+		}
+		foldAll(e.Index)
+	case *DollarExpr:
+		e.Field = fold(e.Field)
+	}
+}
+
+// Folds arithmetic on numeric constants and concatenations of constants
+// whose string value does not depend on CONVFMT. Returns nil if the
+// expression cannot be folded. Divisions by zero are left to fail at run
+// time.
+func foldBinary(e *BinaryExpr) Expr {
+	if e.Op.Type == lexer.Concat {
+		left, lok := constantString(e.Left)
+		right, rok := constantString(e.Right)
+		if !lok || !rok {
+			return nil
+		}
+		return &StringExpr{
+			Str: lexer.Token{
+				Lexeme: left + right,
+				Type:   lexer.String,
+				Line:   e.Op.Line,
+			},
+		}
+	}
+	left, lok := e.Left.(*NumberExpr)
+	right, rok := e.Right.(*NumberExpr)
+	if !lok || !rok {
+		return nil
+	}
+	l, r := left.NumVal, right.NumVal
+	var res float64
+	switch e.Op.Type {
+	case lexer.Plus:
+		res = l + r
+	case lexer.Minus:
+		res = l - r
+	case lexer.Star:
+		res = l * r
+	case lexer.Slash:
+		if r == 0 {
+			return nil
+		}
+		res = l / r
+	case lexer.Percent:
+		if r == 0 {
+			return nil
+		}
+		res = math.Mod(l, r)
+	case lexer.Caret:
+		res = math.Pow(l, r)
+	default:
+		return nil
+	}
+	return numberConstant(e.Op, res)
+}
+
+// Returns the string value of a string constant or of an integral numeric
+// constant
+func constantString(e Expr) (string, bool) {
+	switch c := e.(type) {
+	case *StringExpr:
+		return c.Str.Lexeme, true
+	case *NumberExpr:
+		if c.NumVal == math.Trunc(c.NumVal) && math.Abs(c.NumVal) < 1e15 && !(c.NumVal == 0 && math.Signbit(c.NumVal)) {
+			return strconv.FormatInt(int64(c.NumVal), 10), true
+		}
+	}
+	return "", false
+}
+
+// A string constant used as a dynamic regex is compiled once. Invalid
+// regexes are left to fail at run time.
+func foldRegex(e Expr) Expr {
+	s, ok := e.(*StringExpr)
+	if !ok {
+		return e
+	}
+	re, err := lexer.CompileRegex(s.Str.Lexeme)
+	if err != nil {
+		return e
+	}
+	lit, islit := requiredLiteral(lexer.TranslateRegex(s.Str.Lexeme))
+	return &RegexExpr{
+		Regex:     s.Str,
+		Compiled:  re,
+		Literal:   lit,
+		IsLiteral: islit,
+	}
+}
+
+// Returns a string which every match of the regex contains, so that
+// strings not containing it can be rejected without running the regex, and
+// whether containing it is also enough for a match.
+func requiredLiteral(expr string) (string, bool) {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return "", false
+	}
+	re = re.Simplify()
+	if re.Op == syntax.OpLiteral && re.Flags&syntax.FoldCase == 0 {
+		return string(re.Rune), true
+	}
+	lit := longestLiteral(re)
+	if len(lit) < 2 {
+		// Too common to be worth looking for
+		return "", false
+	}
+	return lit, false
+}
+
+func longestLiteral(re *syntax.Regexp) string {
+	switch re.Op {
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase == 0 {
+			return string(re.Rune)
+		}
+	case syntax.OpCapture, syntax.OpPlus:
+		return longestLiteral(re.Sub[0])
+	case syntax.OpRepeat:
+		if re.Min > 0 {
+			return longestLiteral(re.Sub[0])
+		}
+	case syntax.OpConcat:
+		// Every part of a concatenation is required
+		var longest string
+		for _, sub := range re.Sub {
+			if lit := longestLiteral(sub); len(lit) > len(longest) {
+				longest = lit
+			}
+		}
+		return longest
+	}
+	return ""
+}
+
+func numberConstant(tok lexer.Token, n float64) *NumberExpr {
+	return &NumberExpr{
+		Num: lexer.Token{
+			Lexeme: strconv.FormatFloat(n, 'g', -1, 64),
+			Type:   lexer.Number,
+			Line:   tok.Line,
+		},
+		NumVal: n,
+	}
+}
+
+func isFalseConstant(e Expr) bool {
+	switch c := e.(type) {
+	case *NumberExpr:
+		return c.NumVal == 0
+	case *StringExpr:
+		return c.Str.Lexeme == ""
+	}
+	return false
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,71 @@
+/*
+ * Copyright (C) 2021 Andrea Fiori <andrea.fiori.1998@gmail.com>
+ *
+ * Licensed under GPLv2, see file LICENSE in this source tree.
+ */
+
+package parser
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// Returns the dump of the optimized program
+func optimizedAst(t *testing.T, program string) string {
+	compiled, errs := ParseCl(CommandLine{
+		Program: strings.NewReader(program),
+		Fs:      " ",
+	})
+	if len(errs) > 0 {
+		t.Fatalf("%s: %s", program, errs[0])
+	}
+	var b bytes.Buffer
+	DumpAst(&b, compiled.All)
+	return b.String()
+}
+
+func TestOptimize(t *testing.T) {
+	tests := []struct {
+		program, expected string
+	}{
+		// Arithmetic
+		{`BEGIN { print 1 + 2 * 3, 2 ^ 10, 7 % 4, -(2), !0, !"a" }`, "(print (7 1024 3 -2 1 (! \"a\")))"},
+		{`BEGIN { print 1 / 0, 1 % 0, 1 / 4 }`, "(print ((/ 1 0) (% 1 0) 0.25))"},
+		{`BEGIN { print x + 1 * 2 }`, "(print ((+ x 2)))"},
+		// Concatenations keep strings strings and leave non integral
+		// numbers to CONVFMT
+		{`BEGIN { print "a" 1, 1 2, "x" "y" "z", 0.5 "x", -0 "x" }`, "(print (\"a1\" \"12\" \"xyz\" (concat 0.5 \"x\") (concat -0 \"x\")))"},
+		{`BEGIN { x = 1 2; print x + 0 }`, "(= x \"12\")"},
+		// Dynamic regexes
+		{`BEGIN { print ("x" ~ "^x+$"), sub("a", "b"), match(s, "c+") }`, "(print ((~ \"x\" /^x+$/) (call sub /a/ \"b\") (call match s /c+/)))"},
+		{`BEGIN { print ("x" ~ "(") }`, "(print ((~ \"x\" \"(\")))"},
+	}
+	for _, test := range tests {
+		if got := optimizedAst(t, test.program); !strings.Contains(got, test.expected) {
+			t.Errorf("%s: optimized to\n%s\nexpected to contain\n%s", test.program, got, test.expected)
+		}
+	}
+}
+
+func TestOptimizeDeadRules(t *testing.T) {
+	tests := []struct {
+		program string
+		rules   int
+	}{
+		{`0 { print } "" { print } 1 - 1 { print } { print }`, 1},
+		{`1 { print } "0" { print } 0.0 + 1 { print }`, 3},
+		// A range can still start and end on different records
+		{`0, 1 { print } 1, 0 { print }`, 2},
+		// The only main rule is kept, so that the input is read
+		{`0 { print }`, 1},
+		{`0 { print } END { print NR }`, 1},
+	}
+	for _, test := range tests {
+		got := optimizedAst(t, test.program)
+		if rules := strings.Count(got, "(rule "); rules != test.rules {
+			t.Errorf("%s: optimized to %d rules, expected %d\n%s", test.program, rules, test.rules, got)
+		}
+	}
+}
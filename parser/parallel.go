@@ -0,0 +1,310 @@
+/*
+ * Copyright (C) 2021 Andrea Fiori <andrea.fiori.1998@gmail.com>
+ *
+ * Licensed under GPLv2, see file LICENSE in this source tree.
+ */
+
+package parser
+
+import (
+	"fmt"
+
+	"github.com/fioriandrea/aawk/lexer"
+)
+
+// How the main rules of a program can be run on several records at once
+type ParallelPlan struct {
+	// Global variables (by index) which the main rules only add to, with
+	// statements such as n++, sum += $1 or count[$1]++, and never read.
+	// Every worker adds to its own copy, and the copies are summed up.
+	Accumulators map[int]bool
+}
+
+// Checks that the main rules process every record independently: they
+// must not assign or read back global state, read input, run commands,
+// redirect output or depend on the order of the records. Returns an error
+// explaining the first obstacle found.
+func PlanParallel(items ResolvedItems) (ParallelPlan, error) {
+	c := &parallelChecker{
+		sources:     items.Sources,
+		functions:   map[string]*FunctionDef{},
+		written:     map[string]map[int]bool{},
+		accumulated: map[int]lexer.Token{},
+		read:        map[int]bool{},
+	}
+	for _, fd := range items.Functions {
+		c.functions[fd.Name.Lexeme] = fd
+	}
+	for _, normal := range items.Normals {
+		switch p := normal.Pattern.(type) {
+		case *ExprPattern:
+			c.expr(p.Expr)
+		case *RangePattern:
+			c.fail(p.Comma, "range patterns depend on the previous records")
+		}
+		c.stat(normal.Action)
+	}
+	if c.err != nil {
+		return ParallelPlan{}, c.err
+	}
+	plan := ParallelPlan{Accumulators: map[int]bool{}}
+	for index, tok := range c.accumulated {
+		if c.read[index] {
+			return ParallelPlan{}, parallelError(c.sources, tok, fmt.Sprintf("%s is both added to and read", tok.Lexeme))
+		}
+		plan.Accumulators[index] = true
+	}
+	return plan, nil
+}
+
+func parallelError(sources lexer.SourceMap, tok lexer.Token, msg string) error {
+	return fmt.Errorf("at %s (%s): %s", sources.Position(tok.Line), tok.Lexeme, msg)
+}
+
+type parallelChecker struct {
+	sources     lexer.SourceMap
+	functions   map[string]*FunctionDef
+	written     map[string]map[int]bool // Parameters of a function used as arrays and modified
+	params      map[int]bool            // Same, for the function being checked
+	accumulated map[int]lexer.Token
+	read        map[int]bool
+	err         error
+}
+
+func (c *parallelChecker) fail(tok lexer.Token, msg string) {
+	if c.err == nil {
+		c.err = parallelError(c.sources, tok, msg)
+	}
+}
+
+func (c *parallelChecker) stat(s Stat) {
+	switch ss := s.(type) {
+	case BlockStat:
+		for _, st := range ss {
+			c.stat(st)
+		}
+	case *ExprStat:
+		// The value of the expression is discarded, so it can accumulate
+		if !c.accumulate(ss.Expr) {
+			c.expr(ss.Expr)
+		}
+	case *PrintStat:
+		if ss.File != nil {
+			c.fail(ss.RedirOp, "output redirections")
+		}
+		c.exprs(ss.Exprs)
+	case *DeleteStat:
+		c.write(ss.Lhs)
+	case *IfStat:
+		c.expr(ss.Cond)
+		c.stat(ss.Body)
+		c.stat(ss.ElseBody)
+	case *ForStat:
+		c.stat(ss.Init)
+		c.expr(ss.Cond)
+		c.stat(ss.Inc)
+		c.stat(ss.Body)
+	case *ForEachStat:
+		c.write(ss.Id)
+		c.expr(ss.Array)
+		c.stat(ss.Body)
+	case *ReturnStat:
+		c.expr(ss.ReturnVal)
+	case *NextfileStat:
+		c.fail(ss.Nextfile, "nextfile")
+	case *ExitStat:
+		c.fail(ss.Exit, "exit")
+	}
+}
+
+// Records n++, n += e and the like on a global variable or on an element of
+// a global array. Returns false if e is not such an expression.
+func (c *parallelChecker) accumulate(e Expr) bool {
+	var lhs LhsExpr
+	var tok lexer.Token
+	switch a := e.(type) {
+	case *AssignExpr:
+		if a.Equal.Type != lexer.PlusAssign && a.Equal.Type != lexer.MinusAssign {
+			return false
+		}
+		lhs, tok = a.Left, a.Equal
+		defer c.expr(a.Right)
+	case *PreIncrementExpr:
+		lhs, tok = a.Lhs, a.Op
+	case *PostIncrementExpr:
+		lhs, tok = a.Lhs, a.Op
+	default:
+		return false
+	}
+	var id *IdExpr
+	switch v := lhs.(type) {
+	case *IdExpr:
+		id = v
+	case *IndexingExpr:
+		if len(v.Subarrays) > 0 {
+			return false
+		}
+		id = v.Id
+		c.exprs(v.Index)
+	default:
+		return false
+	}
+	if id.Index < 0 {
+		return false
+	}
+	if _, ok := c.accumulated[id.Index]; !ok {
+		c.accumulated[id.Index] = lexer.Token{Lexeme: id.Id.Lexeme, Line: tok.Line}
+	}
+	return true
+}
+
+// Checks an assignment to lhs
+func (c *parallelChecker) write(lhs LhsExpr) {
+	switch v := lhs.(type) {
+	case *IdExpr:
+		c.writeId(v, false)
+	case *IndexingExpr:
+		for _, sub := range v.Subarrays {
+			c.exprs(sub)
+		}
+		c.exprs(v.Index)
+		c.writeId(v.Id, true)
+	case *DollarExpr:
+		c.expr(v.Field)
+	}
+}
+
+func (c *parallelChecker) writeId(id *IdExpr, element bool) {
+	switch {
+	case id.Index >= 0:
+		c.fail(id.Id, fmt.Sprintf("assigns global variable %s", id.Id.Lexeme))
+	case id.LocalIndex >= 0:
+		// Arrays are passed by reference, so modifying the elements of a
+		// parameter may modify a global array
+		if c.params != nil && element {
+			c.params[id.LocalIndex] = true
+		}
+	case id.BuiltinIndex != Nf:
+		c.fail(id.Id, fmt.Sprintf("assigns %s", id.Id.Lexeme))
+	}
+}
+
+func (c *parallelChecker) exprs(es []Expr) {
+	for _, e := range es {
+		c.expr(e)
+	}
+}
+
+func (c *parallelChecker) expr(ex Expr) {
+	switch e := ex.(type) {
+	case *BinaryExpr:
+		c.expr(e.Left)
+		c.expr(e.Right)
+	case *BinaryBoolExpr:
+		c.expr(e.Left)
+		c.expr(e.Right)
+	case *UnaryExpr:
+		c.expr(e.Right)
+	case *MatchExpr:
+		c.expr(e.Left)
+		c.expr(e.Right)
+	case *AssignExpr:
+		c.write(e.Left)
+		c.expr(e.Right)
+	case *IdExpr:
+		if e.Index >= 0 {
+			c.read[e.Index] = true
+		}
+	case *IndexingExpr:
+		c.expr(e.Id)
+		for _, sub := range e.Subarrays {
+			c.exprs(sub)
+		}
+		c.exprs(e.Index)
+	case *DollarExpr:
+		c.expr(e.Field)
+	case *PreIncrementExpr:
+		c.write(e.Lhs)
+	case *PostIncrementExpr:
+		c.write(e.Lhs)
+	case *TernaryExpr:
+		c.expr(e.Cond)
+		c.expr(e.Expr0)
+		c.expr(e.Expr1)
+	case *GetlineExpr:
+		c.fail(e.Getline, "getline")
+	case *CallExpr:
+		c.callExpr(e)
+	case *InExpr:
+		c.expr(e.Left)
+		c.expr(e.Right)
+	case ExprList:
+		c.exprs(e)
+	}
+}
+
+func (c *parallelChecker) callExpr(e *CallExpr) {
+	name := e.Called.Id
+	switch name.Type {
+	case lexer.Close, lexer.Fflush, lexer.System, lexer.Rand, lexer.Srand, lexer.Warn:
+		c.fail(name, fmt.Sprintf("calls %s", name.Lexeme))
+		return
+	case lexer.Identifier, lexer.IdentifierParen:
+		c.userCall(e)
+		return
+	}
+	for i, arg := range e.Args {
+		switch {
+		case (name.Type == lexer.Sub || name.Type == lexer.Gsub) && i == 2,
+			name.Type == lexer.Split && (i == 1 || i == 3),
+			name.Type == lexer.Match && i == 2,
+			name.Type == lexer.Copyarr && i == 0:
+			lhs := arg.(LhsExpr)
+			if id, ok := lhs.(*IdExpr); ok && name.Type != lexer.Sub && name.Type != lexer.Gsub {
+				// The array itself is filled
+				c.writeId(id, true)
+			} else {
+				c.write(lhs)
+			}
+		default:
+			c.expr(arg)
+		}
+	}
+}
+
+func (c *parallelChecker) userCall(e *CallExpr) {
+	fd, ok := c.functions[e.Called.Id.Lexeme]
+	if !ok {
+		c.fail(e.Called.Id, fmt.Sprintf("calls native function %s", e.Called.Id.Lexeme))
+		return
+	}
+	written := c.checkFunction(fd)
+	for i, arg := range e.Args {
+		if id, ok := arg.(*IdExpr); ok && written[i] {
+			c.writeId(id, true)
+		} else {
+			c.expr(arg)
+		}
+	}
+}
+
+// Checks the body of a function once, returning the parameters whose
+// elements it modifies
+func (c *parallelChecker) checkFunction(fd *FunctionDef) map[int]bool {
+	name := fd.Name.Lexeme
+	if written, ok := c.written[name]; ok {
+		return written
+	}
+	// A recursive call is assumed to modify every parameter
+	all := map[int]bool{}
+	for i := range fd.Args {
+		all[i] = true
+	}
+	c.written[name] = all
+	outer := c.params
+	c.params = map[int]bool{}
+	c.stat(fd.Body)
+	c.written[name] = c.params
+	c.params = outer
+	return c.written[name]
+}
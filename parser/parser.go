@@ -7,11 +7,12 @@
 package parser
 
 import (
+	"bytes"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"regexp"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/fioriandrea/aawk/lexer"
 )
@@ -28,24 +29,85 @@ type parser struct {
 	nextable   bool
 	loopdepth  int
 	infunction bool
+	sources    lexer.SourceMap
+
+	// Tokens consumed so far, if record is set
+	record bool
+	tokens []lexer.Token
 }
 
+// How a field separator splits records
+type FsKind int
+
+const (
+	FsBlanks  FsKind = iota // Runs of blanks
+	FsLiteral               // Occurrences of the separator
+	FsRegex                 // Matches of the separator
+)
+
+// A single space splits fields on runs of blanks, while any other single
+// character (including regex metacharacters such as "." or "\\") and the
+// empty string are used literally. Anything longer is an extended regular
+// expression, which is matched like a plain string if it contains no
+// metacharacters.
+func ClassifyFs(fs string) FsKind {
+	switch {
+	case fs == " ":
+		return FsBlanks
+	case utf8.RuneCountInString(fs) <= 1, regexp.QuoteMeta(fs) == fs:
+		return FsLiteral
+	default:
+		return FsRegex
+	}
+}
+
+// Returns the compiled field separator, nil if it is not a regex
 func CompileFs(fs string) (*regexp.Regexp, error) {
-	if len(fs) <= 1 {
+	if ClassifyFs(fs) != FsRegex {
 		return nil, nil
 	}
-	re, err := regexp.Compile(fs)
+	re, err := lexer.CompileRegex(fs)
 	if err != nil {
 		return nil, fmt.Errorf("invalid FS: %s", err.Error())
 	}
 	return re, nil
 }
 
+// Returns the compiled record separator, nil if it is a single character
+// or empty. A longer separator is a regex, except in POSIX mode where only
+// its first character counts. A multibyte character is a regex too, since
+// single character separators are bytes.
+func CompileRs(rs string, posix bool) (*regexp.Regexp, error) {
+	if len(rs) <= 1 || posix {
+		return nil, nil
+	}
+	re, err := lexer.CompileRegex(rs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid RS: %s", err.Error())
+	}
+	re.Longest()
+	return re, nil
+}
+
 func ParseCl(cl CommandLine) (CompiledProgram, []error) {
+	fsre, errors := checkAssignments(cl)
+	ri, errs := parseProgram(cl)
+	if len(errs) > 0 {
+		errors = append(errors, errs...)
+	}
+	return CompiledProgram{
+		ResolvedItems: ri,
+		Fsre:          fsre,
+	}, errors
+}
+
+// Checks the syntax of the assignments of the command line, returning the
+// field separator they give
+func checkAssignments(cl CommandLine) (*regexp.Regexp, []error) {
 	errors := make([]error, 0)
 
-	// Parse FS from -F
-	fsre, err := CompileFs(cl.Fs)
+	// Parse FS from -F, which is processed like a string literal
+	fsre, err := CompileFs(lexer.Unescape(cl.Fs))
 	if err != nil {
 		errors = append(errors, err)
 	}
@@ -54,53 +116,85 @@ func ParseCl(cl CommandLine) (CompiledProgram, []error) {
 		if !lexer.CommandLineAssignRegex.MatchString(preassign) {
 			errors = append(errors, fmt.Errorf("invalid syntax used for preassignment '%s'", preassign))
 		}
-		splits := strings.Split(preassign, "=")
+		splits := strings.SplitN(preassign, "=", 2)
+		if len(splits) < 2 {
+			continue
+		}
 		if i, ok := lexer.Builtinvars[splits[0]]; ok {
 			// Check FS from -v
 			if i == Fs {
 				var err error
-				if fsre, err = CompileFs(splits[1]); err != nil {
+				if fsre, err = CompileFs(lexer.Unescape(splits[1])); err != nil {
+					errors = append(errors, err)
+				}
+			}
+			if i == Rs {
+				if _, err := CompileRs(lexer.Unescape(splits[1]), cl.Posix); err != nil {
 					errors = append(errors, err)
 				}
 			}
 		}
 	}
+	return fsre, errors
+}
 
-	ri, errs := parseProgram(cl.Program, cl.Natives)
-	if len(errs) > 0 {
-		errors = append(errors, errs...)
+// Reads the program. The files of a program made of files are concatenated,
+// each starting on a line of its own.
+func readProgram(cl CommandLine) ([]byte, lexer.SourceMap, error) {
+	if len(cl.ProgramFiles) == 0 {
+		b, err := ioutil.ReadAll(cl.Program)
+		return b, nil, err
 	}
-	return CompiledProgram{
-		ResolvedItems: ri,
-		Fsre:          fsre,
-	}, errors
+	var program []byte
+	var sources lexer.SourceMap
+	line := 1
+	for _, pf := range cl.ProgramFiles {
+		b, err := ioutil.ReadAll(pf.Source)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %s", pf.Name, err)
+		}
+		if len(b) > 0 && b[len(b)-1] != '\n' {
+			b = append(b, '\n')
+		}
+		sources = append(sources, lexer.SourceFile{Name: pf.Name, Start: line})
+		line += bytes.Count(b, []byte{'\n'})
+		program = append(program, b...)
+	}
+	return program, sources, nil
 }
 
-func parseProgram(prog io.Reader, nativeFunctions map[string]bool) (ResolvedItems, []error) {
-	b, err := ioutil.ReadAll(prog)
+func parseProgram(cl CommandLine) (ResolvedItems, []error) {
+	b, sources, err := readProgram(cl)
 	if err != nil {
 		return ResolvedItems{}, []error{err}
 	}
-	lex := lexer.NewLexer(b)
-	items, errs := getItems(lex)
+	lex := lexer.NewLexer(b, cl.Posix)
+	items, errs := getItems(lex, sources)
 	if len(errs) > 0 {
 		return ResolvedItems{}, errs
 	}
 
-	globalindices, functionindices, errs := resolve(items.All, nativeFunctions)
+	globalindices, functionindices, errs := resolve(items, cl)
 	if len(errs) > 0 {
 		return ResolvedItems{}, errs
 	}
+	var warnings []error
+	if cl.Lint {
+		warnings = lint(items, cl)
+	}
+	items = optimize(items)
 	return ResolvedItems{
 		Items:           items,
 		Globalindices:   globalindices,
 		Functionindices: functionindices,
+		Warnings:        warnings,
 	}, nil
 }
 
-func getItems(lex lexer.Lexer) (Items, []error) {
+func getItems(lex lexer.Lexer, sources lexer.SourceMap) (Items, []error) {
 	ps := parser{
-		lexer: lex,
+		lexer:   lex,
+		sources: sources,
 	}
 	ps.advance()
 	items, errs := ps.itemList()
@@ -127,6 +221,7 @@ func getItems(lex lexer.Lexer) (Items, []error) {
 		}
 	}
 	res.All = items
+	res.Sources = sources
 
 	return res, nil
 }
@@ -307,6 +402,8 @@ func (ps *parser) stat() (Stat, []error) {
 		stat, errs = ps.blockStat()
 	case lexer.Next:
 		stat, errs = ps.nextStat()
+	case lexer.Nextfile:
+		stat, errs = ps.nextfileStat()
 	case lexer.Break:
 		stat, errs = ps.breakStat()
 	case lexer.Continue:
@@ -348,6 +445,17 @@ func (ps *parser) nextStat() (*NextStat, []error) {
 	}, nil
 }
 
+func (ps *parser) nextfileStat() (*NextfileStat, []error) {
+	ps.eat(lexer.Nextfile)
+	op := ps.previous
+	if !ps.nextable {
+		return nil, []error{ps.parseErrorAt(op, "cannot use 'nextfile' inside BEGIN or END")}
+	}
+	return &NextfileStat{
+		Nextfile: op,
+	}, nil
+}
+
 func (ps *parser) breakStat() (*BreakStat, []error) {
 	ps.eat(lexer.Break)
 	op := ps.previous
@@ -464,6 +572,11 @@ func (ps *parser) printStat() (*PrintStat, []error) {
 		if file == nil {
 			return nil, []error{ps.parseErrorAt(redir, "expected expression after redirection operator")}
 		}
+		// An unparenthesized '>' always redirects, so print a > b ? c : d
+		// is not a comparison
+		if redir.Type == lexer.Greater && !ps.checkTerminator() && !ps.check(lexer.RightCurly, lexer.RightParen) {
+			return nil, []error{ps.parseErrorAtCurrent("unexpected token after output redirection (comparisons in print must be parenthesized, as in print (a > b))")}
+		}
 	}
 	if op.Type == lexer.Printf && len(exprs) == 0 {
 		return nil, []error{ps.parseErrorAt(op, "'printf' requires at least one argument")}
@@ -511,6 +624,10 @@ func (ps *parser) ifStat() (*IfStat, []error) {
 	if len(errs) > 0 {
 		return nil, errs
 	}
+	// A simple statement can be terminated by a ';' before 'else'
+	if ps.eat(lexer.Semicolon) {
+		ps.skipNewLines()
+	}
 	var elsebody Stat
 	if ps.eat(lexer.Else) {
 		ps.skipNewLines()
@@ -563,6 +680,10 @@ func (ps *parser) doWhileStat() (Stat, []error) {
 	if len(errs) > 0 {
 		return nil, errs
 	}
+	// As before 'else', a simple statement can be terminated by a ';'
+	if ps.eat(lexer.Semicolon) {
+		ps.skipNewLines()
+	}
 	if !ps.eat(lexer.While) {
 		return nil, []error{ps.parseErrorAtCurrent("expected 'while' for do-while statement")}
 	}
@@ -846,14 +967,19 @@ func (ps *parser) inExpr() (Expr, error) {
 		if err != nil {
 			return nil, err
 		}
-		id, isid := right.(*IdExpr)
-		if !isid {
-			return nil, ps.parseErrorAt(op, "cannot use 'in' for non identifier")
+		var arr LhsExpr
+		switch v := right.(type) {
+		case *IdExpr:
+			arr = v
+		case *IndexingExpr:
+			arr = v
+		default:
+			return nil, ps.parseErrorAt(op, "cannot use 'in' for non array")
 		}
 		left = &InExpr{
 			Left:  left,
 			Op:    op,
-			Right: id,
+			Right: arr,
 		}
 	}
 	if _, isexplist := left.(ExprList); isexplist && !ps.isInPrint() {
@@ -974,7 +1100,9 @@ func (ps *parser) expExpr() (Expr, error) {
 		ps.inexp = true
 		defer func() { ps.inexp = false }()
 		op := ps.previous
-		right, err := ps.expr()
+		// '^' is right associative and binds tighter than the other
+		// binary operators
+		right, err := ps.unaryExpr()
 		if err != nil {
 			return nil, err
 		}
@@ -1094,7 +1222,8 @@ func (ps *parser) termExpr() (Expr, error) {
 			sub, err = ps.insideIndexing(id)
 		} else {
 			sub, err = &IdExpr{
-				Id: id,
+				Id:          id,
+				BeforeParen: ps.check(lexer.LeftParen),
 			}, nil
 		}
 	case lexer.IdentifierParen:
@@ -1276,28 +1405,36 @@ func (ps *parser) insideIndexing(id lexer.Token) (Expr, error) {
 	idexpr := &IdExpr{
 		Id: id,
 	}
-	exprs, err := ps.exprList(func() bool { return ps.check(lexer.RightSquare) })
-	if err != nil {
-		return nil, err
-	}
-	if !ps.eat(lexer.RightSquare) {
-		return nil, ps.parseErrorAtCurrent("expected ']'")
+	var subarrays [][]Expr
+	for {
+		exprs, err := ps.exprList(func() bool { return ps.check(lexer.RightSquare) })
+		if err != nil {
+			return nil, err
+		}
+		if !ps.eat(lexer.RightSquare) {
+			return nil, ps.parseErrorAtCurrent("expected ']'")
+		}
+		// a[i][j] indexes the subarray a[i]
+		if !ps.eat(lexer.LeftSquare) {
+			return &IndexingExpr{
+				Id:        idexpr,
+				Subarrays: subarrays,
+				Index:     exprs,
+			}, nil
+		}
+		subarrays = append(subarrays, exprs)
 	}
-	return &IndexingExpr{
-		Id:    idexpr,
-		Index: exprs,
-	}, nil
 }
 
 func (ps *parser) parseErrorAt(tok lexer.Token, msg string) error {
-	prelude := fmt.Sprintf("at line %d", tok.Line)
+	prelude := "at " + ps.sources.Position(tok.Line)
 	if ps.current.Type == lexer.Error {
 		if len(msg) > 0 {
 			return fmt.Errorf("%s: lexer error: %s", prelude, msg)
 		}
 		return fmt.Errorf("%s: lexer error: %s", prelude, tok.Lexeme)
 	}
-	return fmt.Errorf("%s (%s): parse error: %s", prelude, tok.Lexeme, msg)
+	return fmt.Errorf("%s (%s): parse error: %s", prelude, tok, msg)
 }
 
 func (ps *parser) parseErrorAtCurrent(msg string) error {
@@ -1308,12 +1445,20 @@ func (ps *parser) advance() {
 	t := ps.lexer.Next()
 	ps.previous = ps.current
 	ps.current = t
+	// The parser may keep advancing at the end of the program
+	if ps.record && (len(ps.tokens) == 0 || ps.tokens[len(ps.tokens)-1].Type != lexer.Eof) {
+		ps.tokens = append(ps.tokens, t)
+	}
 }
 
 func (ps *parser) advanceRegex() {
 	t := ps.lexer.NextRegex()
 	ps.previous = ps.current
 	ps.current = t
+	if ps.record {
+		// The regex replaces the slash token it starts with
+		ps.tokens[len(ps.tokens)-1] = t
+	}
 }
 
 func (ps *parser) check(types ...lexer.TokenType) bool {
@@ -8,8 +8,8 @@ package parser
 
 import (
 	"fmt"
-	"regexp"
 	"strconv"
+	"strings"
 
 	"github.com/fioriandrea/aawk/lexer"
 )
@@ -19,40 +19,93 @@ const (
 	Argv
 	Convfmt
 	Environ
+	Errno
 	Filename
 	Fnr
 	Fs
+	Ignorecase
 	Nf
 	Nr
 	Ofmt
 	Ofs
 	Ors
+	Procinfo
 	Rlength
 	Rs
 	Rstart
+	Rt
 	Subsep
 )
 
+// Minimum and maximum number of arguments of built-in functions (-1 means
+// any number)
+var builtinArities = map[lexer.TokenType][2]int{
+	lexer.Atan2:   {2, 2},
+	lexer.Close:   {1, 1},
+	lexer.Copyarr: {2, 2},
+	lexer.Cos:     {1, 1},
+	lexer.Exp:     {1, 1},
+	lexer.Fflush:  {0, 1},
+	lexer.Gsub:    {2, 3},
+	lexer.Index:   {2, 2},
+	lexer.Int:     {1, 1},
+	lexer.Length:  {0, 1},
+	lexer.Log:     {1, 1},
+	lexer.Match:   {2, 3},
+	lexer.Rand:    {0, 0},
+	lexer.Sin:     {1, 1},
+	lexer.Split:   {2, 4},
+	lexer.Sprintf: {1, -1},
+	lexer.Sqrt:    {1, 1},
+	lexer.Srand:   {0, 1},
+	lexer.Sub:     {2, 3},
+	lexer.Substr:  {2, 3},
+	lexer.System:  {1, 1},
+	lexer.Tolower: {1, 1},
+	lexer.Toupper: {1, 1},
+	lexer.Warn:    {1, 1},
+}
+
 type resolver struct {
 	indices         map[string]int
 	localindices    map[string]int
 	functionindices map[string]int
+	functionarities map[string]int
+	globaluses      map[string]*varuse
+	localuses       map[string]*varuse
+	compat          bool
+	posix           bool
+	sources         lexer.SourceMap
+	extensioncalls  []*CallExpr
+}
+
+// First scalar and array uses of a variable, used to detect conflicting uses
+// statically
+type varuse struct {
+	scalar *lexer.Token
+	array  *lexer.Token
 }
 
 func newResolver() *resolver {
 	return &resolver{
 		indices:         map[string]int{},
 		functionindices: map[string]int{},
+		functionarities: map[string]int{},
+		globaluses:      map[string]*varuse{},
 	}
 }
 
-func resolve(items []Item, nativeFunctions map[string]bool) (map[string]int, map[string]int, []error) {
+func resolve(ritems Items, cl CommandLine) (map[string]int, map[string]int, []error) {
 	var errors []error
+	items := ritems.All
 
 	resolver := newResolver()
+	resolver.compat = cl.Compat
+	resolver.posix = cl.Posix
+	resolver.sources = ritems.Sources
 
-	for native := range nativeFunctions {
-		if _, ok := lexer.Builtinvars[native]; ok {
+	for native := range cl.Natives {
+		if _, ok := BuiltinVar(native, cl.Posix); ok {
 			errors = append(errors, fmt.Errorf("cannot call native (%s) the same as a builtin variable", native))
 			continue
 		} else if _, ok := lexer.Builtinfuncs[native]; ok {
@@ -71,7 +124,7 @@ func resolve(items []Item, nativeFunctions map[string]bool) (map[string]int, map
 			if _, ok := resolver.functionindices[it.Name.Lexeme]; ok {
 				errors = append(errors, resolver.resolveError(it.Name, "function already defined"))
 				continue
-			} else if _, ok := lexer.Builtinvars[it.Name.Lexeme]; ok {
+			} else if _, ok := BuiltinVar(it.Name.Lexeme, resolver.posix); ok {
 				errors = append(errors, resolver.resolveError(it.Name, "cannot call a function the same as a built-in variable"))
 				continue
 			} else if _, ok := lexer.Builtinfuncs[it.Name.Lexeme]; ok {
@@ -82,10 +135,18 @@ func resolve(items []Item, nativeFunctions map[string]bool) (map[string]int, map
 				continue
 			}
 			resolver.functionindices[it.Name.Lexeme] = len(resolver.functionindices)
+			resolver.functionarities[it.Name.Lexeme] = len(it.Args)
 		}
 	}
 
 	errors = append(errors, resolver.items(items)...)
+	// Calls of extension built-ins are fine only if no global variable has
+	// the same name
+	for _, e := range resolver.extensioncalls {
+		if _, ok := resolver.indices[e.Called.Id.Lexeme]; ok {
+			errors = append(errors, resolver.resolveError(e.Token(), "cannot call non-callable"))
+		}
+	}
 	return resolver.indices, resolver.functionindices, errors
 }
 
@@ -104,10 +165,19 @@ func (res *resolver) items(items []Item) []error {
 
 func (res *resolver) functionDef(fd *FunctionDef) []error {
 	var errors []error
+	// The name is followed by '(' only when there is no space in between,
+	// as in calls
+	if res.posix && fd.Name.Type != lexer.IdentifierParen {
+		errors = append(errors, res.posixError(fd.Name, "space between the function name and '('"))
+	}
 	res.localindices = map[string]int{}
-	defer func() { res.localindices = nil }()
+	res.localuses = map[string]*varuse{}
+	defer func() {
+		res.localindices = nil
+		res.localuses = nil
+	}()
 	for i, arg := range fd.Args {
-		if _, ok := lexer.Builtinvars[arg.Lexeme]; ok {
+		if _, ok := BuiltinVar(arg.Lexeme, res.posix); ok {
 			errors = append(errors, res.resolveError(arg, "cannot call a function argument the same as a built-in variable"))
 			continue
 		} else if _, ok := res.localindices[arg.Lexeme]; ok {
@@ -213,11 +283,11 @@ func (res *resolver) forStat(fs *ForStat) []error {
 
 func (res *resolver) forEachStat(fe *ForEachStat) []error {
 	var errors []error
-	err := res.idExpr(fe.Id)
+	err := res.scalarIdExpr(fe.Id)
 	if err != nil {
 		errors = append(errors, err)
 	}
-	err = res.idExpr(fe.Array)
+	err = res.arrayExpr(fe.Array)
 	if err != nil {
 		errors = append(errors, err)
 	}
@@ -260,7 +330,13 @@ func (res *resolver) exitStat(ex *ExitStat) []error {
 }
 
 func (res *resolver) deleteStat(ds *DeleteStat) []error {
-	if err := res.lhsExpr(ds.Lhs); err != nil {
+	var err error
+	if id, ok := ds.Lhs.(*IdExpr); ok {
+		err = res.arrayIdExpr(id)
+	} else {
+		err = res.lhsExpr(ds.Lhs)
+	}
+	if err != nil {
 		return []error{err}
 	}
 	return nil
@@ -279,7 +355,7 @@ func (res *resolver) expr(ex Expr) error {
 	case *AssignExpr:
 		return res.assignExpr(e)
 	case *IdExpr:
-		return res.idExpr(e)
+		return res.scalarIdExpr(e)
 	case *IndexingExpr:
 		return res.indexingExpr(e)
 	case *DollarExpr:
@@ -370,7 +446,7 @@ func (res *resolver) lhsExpr(e LhsExpr) error {
 	case *DollarExpr:
 		return res.dollarExpr(v)
 	case *IdExpr:
-		return res.idExpr(v)
+		return res.scalarIdExpr(v)
 	case *IndexingExpr:
 		return res.indexingExpr(v)
 	}
@@ -388,10 +464,15 @@ func (res *resolver) idExpr(e *IdExpr) error {
 	}
 
 	if _, ok := res.functionindices[e.Id.Lexeme]; ok {
+		if e.BeforeParen {
+			// Unlike built-in functions, user-defined ones cannot be
+			// called with a space before '('
+			return res.resolveError(e.Token(), fmt.Sprintf("no space is allowed between %s and '(' in a call of a user-defined function", e.Id.Lexeme))
+		}
 		return res.resolveError(e.Token(), "cannot use function in variable context")
 	}
 
-	if i, ok := lexer.Builtinvars[e.Id.Lexeme]; ok {
+	if i, ok := BuiltinVar(e.Id.Lexeme, res.posix); ok {
 		e.LocalIndex = -1
 		e.Index = -1
 		e.FunctionIndex = -1
@@ -414,12 +495,78 @@ func (res *resolver) idExpr(e *IdExpr) error {
 	return nil
 }
 
+// Resolves an identifier used as a scalar
+func (res *resolver) scalarIdExpr(e *IdExpr) error {
+	if err := res.idExpr(e); err != nil {
+		return err
+	}
+	return res.use(e, false)
+}
+
+// Resolves an identifier used as an array
+func (res *resolver) arrayIdExpr(e *IdExpr) error {
+	if err := res.idExpr(e); err != nil {
+		return err
+	}
+	return res.use(e, true)
+}
+
+// Records the use of a resolved identifier, failing if it conflicts with a
+// previous use
+func (res *resolver) use(e *IdExpr, asarray bool) error {
+	name := e.Id.Lexeme
+	if e.BuiltinIndex >= 0 {
+		isarray := e.BuiltinIndex == Argv || e.BuiltinIndex == Environ || e.BuiltinIndex == Procinfo
+		if isarray && !asarray {
+			return res.resolveError(e.Token(), fmt.Sprintf("cannot use built-in array %s in scalar context", name))
+		} else if !isarray && asarray {
+			return res.resolveError(e.Token(), fmt.Sprintf("cannot use built-in scalar %s in array context", name))
+		}
+		return nil
+	}
+	uses := res.globaluses
+	if e.LocalIndex >= 0 {
+		uses = res.localuses
+	}
+	u, ok := uses[name]
+	if !ok {
+		u = &varuse{}
+		uses[name] = u
+	}
+	tok := e.Token()
+	if asarray {
+		if u.scalar != nil {
+			return res.resolveError(tok, fmt.Sprintf("cannot use %s as an array, it is used as a scalar at %s", name, res.sources.Position(u.scalar.Line)))
+		}
+		if u.array == nil {
+			u.array = &tok
+		}
+	} else {
+		if u.array != nil {
+			return res.resolveError(tok, fmt.Sprintf("cannot use %s as a scalar, it is used as an array at %s", name, res.sources.Position(u.array.Line)))
+		}
+		if u.scalar == nil {
+			u.scalar = &tok
+		}
+	}
+	return nil
+}
+
 func (res *resolver) indexingExpr(e *IndexingExpr) error {
 	var err error
-	err = res.idExpr(e.Id)
+	err = res.arrayIdExpr(e.Id)
 	if err != nil {
 		return err
 	}
+	if res.posix && len(e.Subarrays) > 0 {
+		return res.posixError(e.Token(), "arrays of arrays")
+	}
+	for _, sub := range e.Subarrays {
+		err = res.exprs(sub)
+		if err != nil {
+			return err
+		}
+	}
 	err = res.exprs(e.Index)
 	if err != nil {
 		return err
@@ -427,6 +574,15 @@ func (res *resolver) indexingExpr(e *IndexingExpr) error {
 	return nil
 }
 
+// Resolves an expression used as an array: an array name or an element
+// holding a subarray
+func (res *resolver) arrayExpr(e LhsExpr) error {
+	if id, ok := e.(*IdExpr); ok {
+		return res.arrayIdExpr(id)
+	}
+	return res.lhsExpr(e)
+}
+
 func (res *resolver) dollarExpr(e *DollarExpr) error {
 	err := res.expr(e.Field)
 	return err
@@ -480,16 +636,62 @@ func (res *resolver) callExpr(e *CallExpr) error {
 	if e.Called.Id.Type == lexer.Identifier || e.Called.Id.Type == lexer.IdentifierParen {
 		if i, ok := res.functionindices[e.Called.Id.Lexeme]; ok {
 			e.Called.FunctionIndex = i
+			if err := res.checkArity(e); err != nil {
+				return err
+			}
+		} else if t, ok := res.extensionFunc(e.Called.Id.Lexeme); ok {
+			e.Called.Id.Type = t
+			res.extensioncalls = append(res.extensioncalls, e)
 		} else {
 			return res.resolveError(e.Token(), "cannot call non-callable")
 		}
-	} else {
+	}
+	if e.Called.Id.Type != lexer.Identifier && e.Called.Id.Type != lexer.IdentifierParen {
 		e.Called.FunctionIndex = -1
+		if err := res.checkBuiltinCall(e); err != nil {
+			return err
+		}
 	}
 
 	e.Called.Index = -1
 	e.Called.LocalIndex = -1
-	return res.exprs(e.Args)
+	return res.callArgs(e)
+}
+
+// Returns the built-in function called by the name of an undefined
+// function, unless the name is a parameter of the current function. There
+// are none in POSIX mode.
+func (res *resolver) extensionFunc(name string) (lexer.TokenType, bool) {
+	if _, ok := res.localindices[name]; ok || res.posix {
+		return 0, false
+	}
+	t, ok := lexer.Extensionfuncs[name]
+	return t, ok
+}
+
+// Resolves call arguments. Bare identifiers passed to user defined functions,
+// natives and length could either be scalars or arrays, so their use is not
+// recorded
+func (res *resolver) callArgs(e *CallExpr) error {
+	for i, arg := range e.Args {
+		var err error
+		if id, ok := arg.(*IdExpr); ok {
+			switch {
+			case e.Called.Id.Type == lexer.Split && (i == 1 || i == 3), e.Called.Id.Type == lexer.Match && i == 2, e.Called.Id.Type == lexer.Copyarr:
+				err = res.arrayIdExpr(id)
+			case e.Called.Id.Type == lexer.Identifier, e.Called.Id.Type == lexer.IdentifierParen, e.Called.Id.Type == lexer.Length:
+				err = res.idExpr(id)
+			default:
+				err = res.scalarIdExpr(id)
+			}
+		} else {
+			err = res.expr(arg)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (res *resolver) inExpr(e *InExpr) error {
@@ -498,7 +700,7 @@ func (res *resolver) inExpr(e *InExpr) error {
 	if err != nil {
 		return err
 	}
-	err = res.idExpr(e.Right)
+	err = res.arrayExpr(e.Right)
 	if err != nil {
 		return err
 	}
@@ -510,14 +712,23 @@ func (res *resolver) exprList(e ExprList) error {
 }
 
 func (res *resolver) numberExpr(e *NumberExpr) error {
-	v, _ := strconv.ParseFloat(e.Num.Lexeme, 64)
+	lexeme := e.Num.Lexeme
+	if strings.HasPrefix(lexeme, "0x") || strings.HasPrefix(lexeme, "0X") {
+		// Hexadecimal floats need an exponent
+		lexeme += "p0"
+	}
+	v, _ := strconv.ParseFloat(lexeme, 64)
 	e.NumVal = v
 	return nil
 }
 
 func (res *resolver) regexExpr(e *RegexExpr) error {
-	c := regexp.MustCompile(e.Regex.Lexeme)
+	c, err := lexer.CompileRegex(e.Regex.Lexeme)
+	if err != nil {
+		return res.resolveError(e.Token(), err.Error())
+	}
 	e.Compiled = c
+	e.Literal, e.IsLiteral = requiredLiteral(lexer.TranslateRegex(e.Regex.Lexeme))
 	return nil
 }
 
@@ -532,6 +743,94 @@ func (res *resolver) exprs(es []Expr) error {
 	return nil
 }
 
+// Checks the number of arguments of a built-in function call and the
+// arguments which must be of a specific kind
+func (res *resolver) checkBuiltinCall(e *CallExpr) error {
+	name := e.Called.Id.Lexeme
+	arity := builtinArities[e.Called.Id.Type]
+	if len(e.Args) < arity[0] || (arity[1] >= 0 && len(e.Args) > arity[1]) {
+		var expected string
+		switch {
+		case arity[0] == arity[1]:
+			expected = fmt.Sprintf("%d", arity[0])
+		case arity[1] < 0:
+			expected = fmt.Sprintf("at least %d", arity[0])
+		default:
+			expected = fmt.Sprintf("%d to %d", arity[0], arity[1])
+		}
+		return res.resolveError(e.Token(), fmt.Sprintf("%s expects %s arguments, got %d", name, expected, len(e.Args)))
+	}
+	if res.posix {
+		switch {
+		case e.Called.Id.Type == lexer.Match && len(e.Args) == 3:
+			return res.posixError(e.Token(), "match with an array argument")
+		case e.Called.Id.Type == lexer.Split && len(e.Args) == 4:
+			return res.posixError(e.Token(), "split with a separators array")
+		}
+	}
+	switch e.Called.Id.Type {
+	case lexer.Copyarr:
+		for _, arg := range e.Args {
+			if _, ok := arg.(*IdExpr); !ok {
+				return res.resolveError(arg.Token(), "arguments of copyarr must be array names")
+			}
+		}
+	case lexer.Split:
+		if _, ok := e.Args[1].(*IdExpr); !ok {
+			return res.resolveError(e.Args[1].Token(), "second argument of split must be an array name")
+		}
+		if len(e.Args) == 4 {
+			if _, ok := e.Args[3].(*IdExpr); !ok {
+				return res.resolveError(e.Args[3].Token(), "fourth argument of split must be an array name")
+			}
+		}
+	case lexer.Match:
+		if len(e.Args) == 3 {
+			if _, ok := e.Args[2].(*IdExpr); !ok {
+				return res.resolveError(e.Args[2].Token(), "third argument of match must be an array name")
+			}
+		}
+	case lexer.Sub, lexer.Gsub:
+		if len(e.Args) == 3 {
+			if _, ok := e.Args[2].(LhsExpr); !ok {
+				return res.resolveError(e.Args[2].Token(), fmt.Sprintf("third argument of %s must be a variable, field or array element", name))
+			}
+		}
+	}
+	return nil
+}
+
+// Checks that a user defined function is not called with more arguments than
+// its parameters. This is undefined behaviour in POSIX, and an error for most
+// implementations. In compat mode the extra arguments are evaluated and
+// discarded, and only the linter reports them.
+func (res *resolver) checkArity(e *CallExpr) error {
+	arity, ok := res.functionarities[e.Called.Id.Lexeme]
+	if res.compat || !ok || len(e.Args) <= arity {
+		return nil
+	}
+	return res.resolveError(e.Token(), arityMessage(e, arity))
+}
+
+func arityMessage(e *CallExpr, arity int) string {
+	return fmt.Sprintf("function %s called with %d arguments, but accepts at most %d", e.Called.Id.Lexeme, len(e.Args), arity)
+}
+
+// Returns the index of the built-in variable with the given name. In POSIX
+// mode the extensions are ordinary variables.
+func BuiltinVar(name string, posix bool) (int, bool) {
+	i, ok := lexer.Builtinvars[name]
+	if !ok || (posix && nonPosixVars[i]) {
+		return 0, false
+	}
+	return i, true
+}
+
+// Reports the use of an extension in POSIX mode
+func (res *resolver) posixError(tok lexer.Token, what string) error {
+	return res.resolveError(tok, fmt.Sprintf("extension not available in POSIX mode: %s", what))
+}
+
 func (res *resolver) resolveError(tok lexer.Token, msg string) error {
-	return fmt.Errorf("at line %d (%s): resolve error: %s", tok.Line, tok.Lexeme, msg)
+	return fmt.Errorf("at %s (%s): resolve error: %s", res.sources.Position(tok.Line), tok.Lexeme, msg)
 }
@@ -0,0 +1,384 @@
+/*
+ * Copyright (C) 2021 Andrea Fiori <andrea.fiori.1998@gmail.com>
+ *
+ * Licensed under GPLv2, see file LICENSE in this source tree.
+ */
+
+package parser
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/fioriandrea/aawk/lexer"
+)
+
+// A compiled program is written as its resolved syntax tree, walked by
+// reflection: structs by their exported fields, slices and maps with their
+// length (nil slices apart from empty ones), interfaces with the name of
+// their concrete type and regexes as their source, compiled again when
+// read. The header holds a fingerprint of the node types, tokens and
+// built-in variables, so that a program written by a version of aawk whose
+// tree differs is rejected.
+
+const compiledMagic = "aawk compiled program\n"
+
+var nodeTypes = map[string]reflect.Type{}
+
+var compiledFingerprint uint32
+
+var regexpType = reflect.TypeOf((*regexp.Regexp)(nil))
+
+func init() {
+	for _, n := range []Node{
+		&BinaryExpr{}, &BinaryBoolExpr{}, &UnaryExpr{}, &NumberExpr{}, &StringExpr{},
+		&RegexExpr{}, &MatchExpr{}, &AssignExpr{}, &IdExpr{}, &IndexingExpr{},
+		&DollarExpr{}, &IncrementExpr{}, &PreIncrementExpr{}, &PostIncrementExpr{},
+		&TernaryExpr{}, &GetlineExpr{}, &CallExpr{}, &InExpr{}, ExprList{},
+		&ExprStat{}, &PrintStat{}, &DeleteStat{}, &IfStat{}, &ForStat{},
+		&ForEachStat{}, &NextStat{}, &NextfileStat{}, &BreakStat{}, &ContinueStat{},
+		&ReturnStat{}, &ExitStat{}, BlockStat{}, &ItemList{}, &FunctionDef{},
+		&PatternAction{},
+	} {
+		t := reflect.TypeOf(n)
+		nodeTypes[t.String()] = t
+	}
+	for _, p := range []Pattern{&SpecialPattern{}, &ExprPattern{}, &RangePattern{}} {
+		t := reflect.TypeOf(p)
+		nodeTypes[t.String()] = t
+	}
+
+	var names []string
+	for name := range nodeTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var schema strings.Builder
+	seen := map[reflect.Type]bool{}
+	for _, name := range names {
+		describeType(&schema, nodeTypes[name], seen)
+	}
+	describeType(&schema, reflect.TypeOf(ResolvedItems{}), seen)
+	// Tokens and built-in variables are stored as numbers
+	for tt := lexer.TokenType(0); tt < lexer.TokenCount; tt++ {
+		fmt.Fprintf(&schema, "%s;", tt)
+	}
+	names = names[:0]
+	for name := range lexer.Builtinvars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&schema, "%s=%d;", name, lexer.Builtinvars[name])
+	}
+	compiledFingerprint = crc32.ChecksumIEEE([]byte(schema.String()))
+}
+
+func describeType(w *strings.Builder, t reflect.Type, seen map[reflect.Type]bool) {
+	if seen[t] {
+		return
+	}
+	seen[t] = true
+	fmt.Fprintf(w, "%s %s;", t, t.Kind())
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice:
+		describeType(w, t.Elem(), seen)
+	case reflect.Map:
+		describeType(w, t.Key(), seen)
+		describeType(w, t.Elem(), seen)
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			fmt.Fprintf(w, "%s %s;", f.Name, f.Type)
+			describeType(w, f.Type, seen)
+		}
+	}
+}
+
+// Writes a compiled program, so that it can be loaded by LoadProgram
+// without being parsed and resolved again. Warnings are not written.
+func WriteProgram(w io.Writer, compiled CompiledProgram) (err error) {
+	bw := bufio.NewWriter(w)
+	enc := &encoder{w: bw}
+	defer func() {
+		if r := recover(); r != nil {
+			if e, ok := r.(encodingError); ok {
+				err = e
+				return
+			}
+			panic(r)
+		}
+	}()
+	bw.WriteString(compiledMagic)
+	enc.uint(uint64(compiledFingerprint))
+	ri := compiled.ResolvedItems
+	ri.Warnings = nil
+	enc.value(reflect.ValueOf(ri))
+	return bw.Flush()
+}
+
+// Reads a program written by WriteProgram and checks the command line it
+// is going to run with, as ParseCl does
+func LoadProgram(cl CommandLine, r io.Reader) (CompiledProgram, []error) {
+	fsre, errs := checkAssignments(cl)
+
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(compiledMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != compiledMagic {
+		return CompiledProgram{}, append(errs, errors.New("not a compiled program"))
+	}
+	var ri ResolvedItems
+	err := func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				if e, ok := r.(encodingError); ok {
+					err = e
+					return
+				}
+				panic(r)
+			}
+		}()
+		dec := &decoder{r: br}
+		if dec.uint() != uint64(compiledFingerprint) {
+			return errors.New("program compiled by a different version of aawk")
+		}
+		dec.value(reflect.ValueOf(&ri).Elem())
+		return nil
+	}()
+	if err != nil {
+		return CompiledProgram{}, append(errs, err)
+	}
+
+	defined := map[string]bool{}
+	for _, fdef := range ri.Functions {
+		defined[fdef.Name.Lexeme] = true
+	}
+	for name := range ri.Functionindices {
+		if !defined[name] && !cl.Natives[name] {
+			errs = append(errs, fmt.Errorf("native function %s is not defined", name))
+		}
+	}
+	return CompiledProgram{
+		ResolvedItems: ri,
+		Fsre:          fsre,
+	}, errs
+}
+
+type encodingError struct {
+	error
+}
+
+type encoder struct {
+	w   *bufio.Writer
+	buf [binary.MaxVarintLen64]byte
+}
+
+func (enc *encoder) uint(u uint64) {
+	n := binary.PutUvarint(enc.buf[:], u)
+	enc.w.Write(enc.buf[:n])
+}
+
+func (enc *encoder) int(i int64) {
+	n := binary.PutVarint(enc.buf[:], i)
+	enc.w.Write(enc.buf[:n])
+}
+
+func (enc *encoder) string(s string) {
+	enc.uint(uint64(len(s)))
+	enc.w.WriteString(s)
+}
+
+func (enc *encoder) value(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			enc.uint(1)
+		} else {
+			enc.uint(0)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		enc.int(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		enc.uint(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		enc.uint(math.Float64bits(v.Float()))
+	case reflect.String:
+		enc.string(v.String())
+	case reflect.Interface:
+		if v.IsNil() {
+			enc.string("")
+			return
+		}
+		name := v.Elem().Type().String()
+		if _, ok := nodeTypes[name]; !ok {
+			panic(encodingError{fmt.Errorf("cannot write values of type %s", name)})
+		}
+		enc.string(name)
+		enc.value(v.Elem())
+	case reflect.Ptr:
+		if v.IsNil() {
+			enc.uint(0)
+			return
+		}
+		enc.uint(1)
+		if v.Type() == regexpType {
+			enc.string(v.Interface().(*regexp.Regexp).String())
+			return
+		}
+		enc.value(v.Elem())
+	case reflect.Slice:
+		if v.IsNil() {
+			enc.uint(0)
+			return
+		}
+		enc.uint(uint64(v.Len()) + 1)
+		for i := 0; i < v.Len(); i++ {
+			enc.value(v.Index(i))
+		}
+	case reflect.Map:
+		enc.uint(uint64(v.Len()))
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j])
+		})
+		for _, k := range keys {
+			enc.value(k)
+			enc.value(v.MapIndex(k))
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath == "" {
+				enc.value(v.Field(i))
+			}
+		}
+	default:
+		panic(encodingError{fmt.Errorf("cannot write values of type %s", v.Type())})
+	}
+}
+
+type decoder struct {
+	r *bufio.Reader
+}
+
+func (dec *decoder) fail(err error) {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	panic(encodingError{fmt.Errorf("invalid compiled program: %s", err)})
+}
+
+func (dec *decoder) uint() uint64 {
+	u, err := binary.ReadUvarint(dec.r)
+	if err != nil {
+		dec.fail(err)
+	}
+	return u
+}
+
+func (dec *decoder) int() int64 {
+	i, err := binary.ReadVarint(dec.r)
+	if err != nil {
+		dec.fail(err)
+	}
+	return i
+}
+
+// Returns a length, which cannot exceed what is left to read
+func (dec *decoder) length() int {
+	n := dec.uint()
+	if n > math.MaxInt32 {
+		dec.fail(errors.New("length too large"))
+	}
+	return int(n)
+}
+
+func (dec *decoder) string() string {
+	var sb strings.Builder
+	if _, err := io.CopyN(&sb, dec.r, int64(dec.length())); err != nil {
+		dec.fail(err)
+	}
+	return sb.String()
+}
+
+func (dec *decoder) value(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Bool:
+		v.SetBool(dec.uint() != 0)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(dec.int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v.SetUint(dec.uint())
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(math.Float64frombits(dec.uint()))
+	case reflect.String:
+		v.SetString(dec.string())
+	case reflect.Interface:
+		name := dec.string()
+		if name == "" {
+			return
+		}
+		t, ok := nodeTypes[name]
+		if !ok || !t.Implements(v.Type()) {
+			dec.fail(fmt.Errorf("unexpected type %s", name))
+		}
+		elem := reflect.New(t).Elem()
+		dec.value(elem)
+		v.Set(elem)
+	case reflect.Ptr:
+		if dec.uint() == 0 {
+			return
+		}
+		if v.Type() == regexpType {
+			re, err := lexer.CompileRegex(dec.string())
+			if err != nil {
+				dec.fail(err)
+			}
+			v.Set(reflect.ValueOf(re))
+			return
+		}
+		elem := reflect.New(v.Type().Elem())
+		dec.value(elem.Elem())
+		v.Set(elem)
+	case reflect.Slice:
+		n := dec.length()
+		if n == 0 {
+			return
+		}
+		v.Set(reflect.MakeSlice(v.Type(), 0, 0))
+		for i := 0; i < n-1; i++ {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			dec.value(elem)
+			v.Set(reflect.Append(v, elem))
+		}
+	case reflect.Map:
+		n := dec.length()
+		v.Set(reflect.MakeMap(v.Type()))
+		for i := 0; i < n; i++ {
+			key := reflect.New(v.Type().Key()).Elem()
+			dec.value(key)
+			val := reflect.New(v.Type().Elem()).Elem()
+			dec.value(val)
+			v.SetMapIndex(key, val)
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath == "" {
+				dec.value(v.Field(i))
+			}
+		}
+	default:
+		dec.fail(fmt.Errorf("unexpected type %s", v.Type()))
+	}
+}
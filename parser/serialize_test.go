@@ -0,0 +1,120 @@
+/*
+ * Copyright (C) 2021 Andrea Fiori <andrea.fiori.1998@gmail.com>
+ *
+ * Licensed under GPLv2, see file LICENSE in this source tree.
+ */
+
+package parser_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fioriandrea/aawk/interpreter"
+	"github.com/fioriandrea/aawk/parser"
+)
+
+const serializedProgram = `
+function fib(n) { return n < 2 ? n : fib(n - 1) + fib(n - 2) }
+function total(arr,    k, s) { for (k in arr) s += arr[k]; return s }
+BEGIN { FS = ":"; re = "^[0-9]+$" }
+/start/, /stop/ { inside++ }
+$2 ~ re { nums[$1] = fib($2 + 0) }
+$2 !~ /^[0-9]+$/ { printf "%s is not a number\n", $2 }
+END {
+	while ((getline line < ARGV[1]) > 0)
+		lines++
+	n = split("c b a", parts, / /)
+	print inside, lines, n, parts[1], total(nums), nums["x"] + 0, toupper("end") 1 2
+}
+`
+
+const serializedInput = "x:10\nstart:3\ny:abc\nstop:1\nz:2\n"
+
+func compileSerialized(t *testing.T, program string) parser.CompiledProgram {
+	compiled, errs := parser.ParseCl(parser.CommandLine{
+		Program: strings.NewReader(program),
+		Fs:      " ",
+	})
+	if len(errs) > 0 {
+		t.Fatal(errs[0])
+	}
+	return compiled
+}
+
+func runCompiled(t *testing.T, compiled parser.CompiledProgram, input string) string {
+	file := filepath.Join(t.TempDir(), "input")
+	if err := ioutil.WriteFile(file, []byte(input), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	errs := interpreter.Exec(interpreter.RunParams{
+		CompiledProgram: compiled,
+		CommandLine: interpreter.CommandLine{
+			Fs:        " ",
+			Arguments: []string{file},
+			Stdin:     strings.NewReader(""),
+			Stdout:    &out,
+			Stderr:    &out,
+		},
+	})
+	for _, err := range errs {
+		if _, ok := err.(interpreter.ErrorExit); !ok {
+			t.Fatal(err)
+		}
+	}
+	return out.String()
+}
+
+func TestProgramRoundTrip(t *testing.T) {
+	var b bytes.Buffer
+	if err := parser.WriteProgram(&b, compileSerialized(t, serializedProgram)); err != nil {
+		t.Fatal(err)
+	}
+	loaded, errs := parser.LoadProgram(parser.CommandLine{Fs: " "}, &b)
+	if len(errs) > 0 {
+		t.Fatal(errs[0])
+	}
+	if got, expected := runCompiled(t, loaded, serializedInput), "abc is not a number\n3 5 3 c 59 55 END12\n"; got != expected {
+		t.Errorf("loaded program printed %q, expected %q", got, expected)
+	}
+	for _, input := range []string{serializedInput, "", "a:1\na:5\n"} {
+		expected := runCompiled(t, compileSerialized(t, serializedProgram), input)
+		if got := runCompiled(t, loaded, input); got != expected {
+			t.Errorf("input %q: loaded program printed\n%s\nparsed program printed\n%s", input, got, expected)
+		}
+	}
+}
+
+func TestLoadDamagedProgram(t *testing.T) {
+	// Every byte is damaged in turn, so the program is kept small
+	program := `function f(a) { return a ~ /x/ } /a/, /b/ { getline v < "f"; print f($0), v }`
+	var b bytes.Buffer
+	if err := parser.WriteProgram(&b, compileSerialized(t, program)); err != nil {
+		t.Fatal(err)
+	}
+	written := b.Bytes()
+	load := func(data []byte) (errs []error) {
+		defer func() {
+			if r := recover(); r != nil {
+				t.Fatalf("loading a damaged program panicked: %v", r)
+			}
+		}()
+		_, errs = parser.LoadProgram(parser.CommandLine{Fs: " "}, bytes.NewReader(data))
+		return errs
+	}
+	for i := 0; i < len(written); i++ {
+		if errs := load(written[:i]); len(errs) == 0 {
+			t.Errorf("loading the first %d of %d bytes did not fail", i, len(written))
+		}
+	}
+	damaged := make([]byte, len(written))
+	for i := 0; i < len(written); i++ {
+		copy(damaged, written)
+		damaged[i] ^= 0xff
+		load(damaged)
+	}
+}
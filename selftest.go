@@ -0,0 +1,350 @@
+/*
+ * Copyright (C) 2021 Andrea Fiori <andrea.fiori.1998@gmail.com>
+ *
+ * Licensed under GPLv2, see file LICENSE in this source tree.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/fioriandrea/aawk/interpreter"
+)
+
+type selfcheck struct {
+	area    string
+	program string
+	input   string
+	output  string
+}
+
+var selfchecks = []selfcheck{
+	// Number formatting
+	{"number formatting", `BEGIN { print 1e6, 0.1 + 0.2, -3, 1/3 }`, "", "1000000 0.3 -3 0.333333\n"},
+	{"number formatting", `BEGIN { OFMT = "%.2f"; print 3.14159; x = 3.14159 ""; print x }`, "", "3.14\n3.14159\n"},
+	{"number formatting", `BEGIN { CONVFMT = "%.2g"; x = 3.14159 ""; print x }`, "", "3.1\n"},
+	{"number formatting", `BEGIN { print 2^53, 17 "" }`, "", "9007199254740992 17\n"},
+	{"number formatting", `BEGIN { print 1e20, 2^63, -2^63, int(-3.9), 2^53 + 1 }`, "", "100000000000000000000 9223372036854775808 -9223372036854775808 -3 9007199254740992\n"},
+	{"number formatting", `{ print $1 + 0, $1 == 10 }`, " 1e1 \n", "10 1\n"},
+	{"number formatting", `{ OFMT = "%.2f"; CONVFMT = "%.3f"; $2 = 3.14159; print $2; print; a[3.14159]; for (k in a) print k }`, "a b\n", "3.14\na 3.142\n3.142\n"},
+	{"number formatting", `BEGIN { OFMT = "%.2f"; CONVFMT = "%.3f"; x = 3.14159; print x, x "", 17.0 "" }`, "", "3.14 3.142 17\n"},
+
+	// Field splitting
+	{"field splitting", `{ print NF, $2 }`, "  a   b  c \n", "3 b\n"},
+	{"field splitting", `BEGIN { FS = ":" } { print NF, $2 }`, "a::b\n", "3 \n"},
+	{"field splitting", `BEGIN { FS = "[0-9]+" } { print $1 $2 $3 }`, "a12b3c\n", "abc\n"},
+	{"field splitting", `BEGIN { OFS = "-" } { $1 = $1; print }`, "a b c\n", "a-b-c\n"},
+	{"field splitting", `{ $5 = "e"; print }`, "a b\n", "a b   e\n"},
+	{"field splitting", `{ NF = 2; print }`, "a b c\n", "a b\n"},
+	{"field splitting", `BEGIN { n = split("a:b:c", arr, ":"); print n, arr[1], arr[3] }`, "", "3 a c\n"},
+	{"field splitting", `BEGIN { n = split("a1b22c", arr, /[0-9]+/, seps); print n, arr[3], seps[1], seps[2], length(seps) }`, "", "3 c 1 22 2\n"},
+	{"field splitting", `BEGIN { n = split(" a b\tc ", arr, " ", seps); print n, "[" seps[0] "][" seps[2] "][" seps[3] "]" }`, "", "3 [ ][\t][ ]\n"},
+	{"field splitting", `function f(arr) { split("x y", arr) } BEGIN { f(a); print a[2]; print split("", a), length(a) }`, "", "y\n0 0\n"},
+	{"field splitting", `BEGIN { RS = "" } { print NR ": " $1 "," $NF }`, "\n\na b\nc\n\n\nd\n", "1: a,c\n2: d,d\n"},
+	{"field splitting", `BEGIN { RS = ""; FS = ":" } { print NF, $2, $3 }`, "\na:b\nc:d\n\n", "4 b c\n"},
+	{"field splitting", `BEGIN { FS = "." } { print NF, $2 }`, "a.b.c\n", "3 b\n"},
+	{"field splitting", `BEGIN { FS = "\\" } { print NF, $2; print split($0, arr, "|") }`, "a\\b|c\n", "2 b|c\n2\n"},
+	{"field splitting", `BEGIN { FS = "é" } { print NF, $2; print split("a.b", arr, /./) }`, "aébéc\n", "3 b\n4\n"},
+	{"field splitting", `BEGIN { FS = "::" } { print NF, $2; print split($0, arr, "b:"), arr[2] }`, "a::b:::c\n", "3 b\n2 ::c\n"},
+	{"field splitting", `{ print NF }`, "a\vb\fc\td e\n", "3\n"},
+
+	// Field assignment
+	{"field assignment", `{ OFS = "-"; print; print $1; $1 = $1; print }`, "a b c\n", "a b c\na\na-b-c\n"},
+	{"field assignment", `{ $2 = "x y"; NF = 3; print; print $2 }`, "a b c d\n", "a x y c\nx y\n"},
+	{"field assignment", `{ NF = 5; print; $7 = "z"; print NF; NF = 0; print "[" $0 "]", NF, "[" $1 "]" }`, "a b\n", "a b   \n7\n[] 0 []\n"},
+	{"field assignment", `{ $2 = 3.14159; CONVFMT = "%.3f"; OFMT = "%.2f"; NF = 2; print; print $2 }`, "a b c\n", "a 3.142\n3.14\n"},
+	{"field assignment", `BEGIN { NF = 2; $1 = "x"; print; print NF }`, "", "x \n2\n"},
+	{"field assignment", `{ FS = ","; $0 = "a,b"; print NF, $2; $0 = $0; print NF }`, "x\n", "2 b\n2\n"},
+	{"field assignment", `BEGIN { RS = ""; FS = ":" } { $1 = $1; print NF "|" $0; RS = "\n"; $0 = $0; print NF }`, "a:b\nc\n", "3|a b c\n1\n"},
+
+	// NUL bytes
+	{"NUL bytes", `{ print NF, length($0), length($2); $1 = "x"; print }`, "a\x00b c\x00d\n", "2 7 3\nx c\x00d\n"},
+	{"NUL bytes", `BEGIN { RS = "\0" } { print NR ": " $2 }`, "a b\x00c d\x00", "1: b\n2: d\n"},
+	{"NUL bytes", `BEGIN { FS = "\0" } { n = split($0, p, "\0"); s = $0; gsub(/\0/, "-", s); printf "%d %s %s|%s|%c\n", NF, $2, s, p[3], "" }`, "x\x00y\x00z\n", "3 y x-y-z|z|\x00\n"},
+	{"NUL bytes", "BEGIN { s = \"a\x00b\"; print length(s), (s ~ /a.b/), (s == \"a\\0b\"), s } # \x00", "", "3 1 1 a\x00b\n"},
+
+	// Record separators
+	{"record separators", `BEGIN { RS = "[0-9]+" } { printf "%s|%s ", $0, RT } END { print NR }`, "a1b22c333d", "a|1 b|22 c|333 d| 4\n"},
+	{"record separators", `{ printf "%s|%s", $0, RT } END { print "" }`, "a\nb", "a|\nb|\n"},
+	{"record separators", `BEGIN { RS = "" } { printf "%s|%s|", $0, RT } END { print NR }`, "\n\na\nb\n\n\nc\n", "a\nb|\n\n\n|c|\n|2\n"},
+	{"record separators", `BEGIN { RS = "ab"; IGNORECASE = 1 } { printf "%s|%s ", $0, RT } END { print "" }`, "xAbyaBz", "x|Ab y|aB z| \n"},
+	{"record separators", `BEGIN { RS = ":+" } { printf "%s%s", $0, RT } END { print "" }`, "one::two:::three\n", "one::two:::three\n\n"},
+	{"record separators", `BEGIN { RS = "x*" } { print NR ": " $0 }`, "aaxxb", "1: aa\n2: b\n"},
+	{"record separators", `BEGIN { RS = "--" } NR == 1 { "printf 1--2" | getline v; print $0, v, RT }`, "a--b", "a 1 --\n"},
+
+	// End of input
+	{"end of input", `{ n++ } END { print NR, n, length($0) }`, "", "0  0\n"},
+	{"end of input", `{ print NR ": " $0 "|" RT "|" }`, "a\nb", "1: a|\n|\n2: b||\n"},
+	{"end of input", `{ print NR ": " $0 }`, "a\n\n", "1: a\n2: \n"},
+	{"end of input", `{ print NR ": " $0 }`, "\n", "1: \n"},
+	{"end of input", `BEGIN { while ((r = getline) > 0) s = s "[" $0 "]"; print s, r, NR; print getline, $0 }`, "a\n\nb", "[a][][b] 0 3\n0 b\n"},
+	{"end of input", `BEGIN { RS = "x" } { printf "[%s]", $0 } END { print NR }`, "axbx", "[a][b]2\n"},
+	{"end of input", `BEGIN { RS = "x" } { printf "[%s]", $0 } END { print NR }`, "axbxx", "[a][b][]3\n"},
+	{"end of input", `BEGIN { RS = "x+" } { printf "[%s]", $0 } END { print NR }`, "axbxx", "[a][b]2\n"},
+	{"end of input", `BEGIN { RS = "x+" } { printf "[%s]", $0 } END { print NR }`, "axb", "[a][b]2\n"},
+	{"end of input", `BEGIN { RS = "" } { printf "[%s]", $0 } END { print NR }`, "\n\na\n\n\n", "[a]1\n"},
+	{"end of input", `BEGIN { RS = "" } END { print NR }`, "\n\n\n", "0\n"},
+	{"end of input", `BEGIN { "printf a" | getline x; "printf a" | getline y; print x, y, RT "|" }`, "", "a  |\n"},
+
+	// Operands
+	{"operands", `BEGIN { ARGV[1] = "x=1"; ARGC = 2 } { print $0, x }`, "a\n", "a 1\n"},
+	{"operands", `BEGIN { ARGV[1] = ""; ARGV[3] = "-"; ARGC = 4 } { print FILENAME, $0 }`, "a\n", "- a\n"},
+	{"operands", `BEGIN { ARGV[0] = "/nonexistent/file"; ARGV[1] = "x=1"; ARGV[2] = "/nonexistent/file"; ARGC = 2 } { print $0, x }`, "a\n", "a 1\n"},
+	{"operands", `BEGIN { ARGV[1] = "x=1"; ARGV[2] = "-"; ARGV[3] = "x=2"; ARGC = 4 } { print $0, x } END { print x }`, "a\n", "a 1\n2\n"},
+	{"operands", `BEGIN { ARGV[1] = "-"; ARGV[2] = "x=1"; ARGV[3] = "-"; ARGC = 4 } { print FILENAME, FNR, $0 } END { print NR, x }`, "a\nb\n", "- 1 a\n- 2 b\n2 1\n"},
+	{"operands", `BEGIN { ARGV[1] = "/dev/stdin"; ARGC = 2; delete ARGV[1] } { print FILENAME "|" $0 }`, "a\n", "|a\n"},
+	{"operands", `NR == 1 { ARGV[ARGC++] = "x=3" } END { print x }`, "a\nb\n", "3\n"},
+
+	// NR and FNR across the files "one" and "two" (see selffiles)
+	{"records of files", `BEGIN { ARGV[1] = "one"; ARGV[2] = "two"; ARGC = 3 } { print FILENAME, NR, FNR, $0 } END { print NR, FNR }`, "", "one 1 1 a\none 2 2 b\ntwo 3 1 c\ntwo 4 2 d\ntwo 5 3 e\n5 3\n"},
+	{"records of files", `BEGIN { ARGV[1] = "one"; ARGV[2] = "two"; ARGC = 3 } { getline; print NR, FNR, $0 }`, "", "2 2 b\n4 2 d\n5 3 e\n"},
+	{"records of files", `BEGIN { ARGV[1] = "one"; ARGV[2] = "two"; ARGC = 3 } FNR == 2 { getline; print FILENAME, NR, FNR, $0; next } { print NR, FNR, $0 }`, "", "1 1 a\ntwo 3 1 c\ntwo 5 3 e\n"},
+	{"records of files", `BEGIN { ARGV[1] = "one"; ARGV[2] = "two"; ARGC = 3 } NR == 1 { getline x; print NR, FNR, $0, x; getline y < "two"; print NR, FNR, y }`, "", "2 2 a b\n2 2 c\n"},
+	{"records of files", `BEGIN { ARGV[1] = "one"; ARGV[2] = "two"; ARGC = 3; while ((getline) > 0) print FILENAME, NR, FNR, $0 }`, "", "one 1 1 a\none 2 2 b\ntwo 3 1 c\ntwo 4 2 d\ntwo 5 3 e\n"},
+	{"records of files", `BEGIN { ARGV[1] = "one"; ARGV[2] = "two"; ARGC = 3 } { print FILENAME, NR, FNR; nextfile } END { print NR, FNR }`, "", "one 1 1\ntwo 2 1\n2 1\n"},
+	{"records of files", `BEGIN { ARGV[1] = "one"; ARGV[2] = "two"; ARGC = 3 } NR == 1 { ARGV[2] = "one"; ARGV[ARGC++] = "two" } END { print FILENAME, NR, FNR }`, "", "two 7 3\n"},
+	{"records of files", `BEGIN { ARGV[1] = "one"; ARGV[2] = "two"; ARGV[3] = "one"; ARGC = 4; delete ARGV[2] } { print FILENAME, NR, FNR }`, "", "one 1 1\none 2 2\none 3 1\none 4 2\n"},
+
+	// Getline
+	{"getline", `BEGIN { while ((getline line) > 0) n++; print n, NR }`, "a\nb\n", "2 2\n"},
+	{"getline", `NR == 1 { getline; print $0, NR }`, "a\nb\n", "b 2\n"},
+	{"getline", `NR == 1 { getline x; print $0, x, NR }`, "a\nb\n", "a b 2\n"},
+	{"getline", `BEGIN { "echo a b" | getline; print $2, NF }`, "", "b 2\n"},
+	{"getline", `BEGIN { "echo a b" | getline x; print x, length($0) }`, "", "a b 0\n"},
+	{"getline", `BEGIN { print (getline x < "/nonexistent/file") }`, "", "-1\n"},
+	{"getline", `NR == 1 { getline x < "/dev/stdin"; print $0, x } END { print NR }`, "a\nb\nc\n", "a b\n2\n"},
+	{"getline", `BEGIN { while ((getline line < "-") > 0) n++; print n }`, "a\nb\n", "2\n"},
+	{"getline", `BEGIN { ARGV[1] = "/dev/stdin"; ARGC = 2 } { print FILENAME ":" $0 }`, "a\n", "/dev/stdin:a\n"},
+	{"getline", `BEGIN { print (getline x < "/nonexistent/file"), (ERRNO != "") }`, "", "-1 1\n"},
+	{"getline", `BEGIN { ARGV[1] = "/dev/stdin"; ARGC = 2; getline; print FILENAME, NR, FNR, $0 } { print "main", $0 }`, "a\nb\n", "/dev/stdin 1 1 a\nmain b\n"},
+	{"getline", `BEGIN { ARGV[1] = "/nonexistent/file"; ARGC = 2; print getline, (ERRNO != ""), NR }`, "", "-1 1 0\n"},
+	{"getline", `BEGIN { c = "sleep 1"; PROCINFO[c, "READ_TIMEOUT"] = 50; print (c | getline x), (ERRNO != "") }`, "", "-1 1\n"},
+	{"getline", `BEGIN { PROCINFO["READ_TIMEOUT"] = 5000; "echo a" | getline x; print x }`, "", "a\n"},
+	{"getline", `BEGIN { x = "y"; r = (getline x < "/nonexistent/file"); print r, x; print "still running" }`, "", "-1 y\nstill running\n"},
+	{"getline", `BEGIN { c = "echo a; kill -9 $$"; while ((r = (c | getline l)) > 0) print l; print r, (ERRNO != ""), close(c) }`, "", "a\n-1 1 -1\n"},
+	{"getline", `BEGIN { c = "echo a; exit 3"; while ((r = (c | getline l)) > 0) print l; print r, close(c) }`, "", "a\n0 3\n"},
+	{"getline", `BEGIN { c = "echo a"; print (c | getline), (c | getline), (c | getline), close(c); print (c | getline), $0 }`, "", "1 0 0 0\n1 a\n"},
+	{"getline", `BEGIN { "echo a; exit 3" | getline; print "x" | "cat >/dev/null; exit 7"; print "ok" }`, "", "ok\n"},
+	{"getline", `BEGIN { "echo a; echo b" | getline; "echo c" | getline x; print NR, FNR, $0, x }`, "", "2 0 a c\n"},
+	{"getline", `NR == 1 { "echo c" | getline; print NR, FNR, $0 } END { print NR, FNR }`, "a\nb\n", "2 1 c\n3 2\n"},
+	{"getline", `BEGIN { "echo c" | getline; "echo c" | getline; print NR, (getline) }`, "", "1 0\n"},
+	{"getline", `NR == 1 { getline < "/dev/stdin"; getline x < "/dev/stdin"; print NR, FNR, $0, x }`, "a\nb\nc\n", "1 1 b c\n"},
+	{"getline", `NR == 1 { getline; print NR, FNR, $0; getline x; print NR, FNR, x }`, "a\nb\nc\n", "2 2 b\n3 3 c\n"},
+
+	// Printf
+	{"printf", `BEGIN { printf "%d %o %x %X\n", 42.9, 8, 255, 255 }`, "", "42 10 ff FF\n"},
+	{"printf", `BEGIN { printf "%5s|%-5s|%.2s\n", "ab", "ab", "abc" }`, "", "   ab|ab   |ab\n"},
+	{"printf", `BEGIN { printf "%5.2f|%e|%g\n", 3.14159, 1234.5, 0.0001 }`, "", " 3.14|1.234500e+03|0.0001\n"},
+	{"printf", `BEGIN { printf "%*d|%%\n", 4, 7 }`, "", "   7|%\n"},
+	{"printf", `BEGIN { x = sprintf("%s-%s", "a", "b"); print x }`, "", "a-b\n"},
+	{"printf", `BEGIN { printf "%s=%d\n", "a", 1, "b", 2, "c"; printf "x\n", 1, 2 }`, "", "a=1\nb=2\nc=0\nx\n"},
+	{"printf", `BEGIN { s = sprintf("%*d|", 3, 1, 4, 2); print s }`, "", "  1|   2|\n"},
+	{"printf", `BEGIN { printf "%g|%g|%G|%#g|%.3g|%.0e|%#.0f\n", 123456789, 0.00001, 1e-10, 1.5, 3.14159, 2.5, 2 }`, "", "1.23457e+08|1e-05|1E-10|1.50000|3.14|2e+00|2.\n"},
+	{"printf", `BEGIN { printf "%05d|%+d|% d|%.3d|%.0d|%#x|%#o|%x|%u\n", -7, 5, 5, 7, 0, 255, 8, -1, 2^53 }`, "", "-0007|+5| 5|007||0xff|010|ffffffffffffffff|9007199254740992\n"},
+	{"printf", `BEGIN { printf "%-*d|%.*f|%*.*s|%05s|%ld\n", 4, 2, 2, 3.14159, 6, 2, "abcdef", "x", 3 }`, "", "2   |3.14|    ab|    x|3\n"},
+	{"printf", `BEGIN { x = 2 ^ 1024; printf "%d %f %E %x\n", x, -x, x - x, "inf" + 0 }`, "", "inf -inf NAN 0\n"},
+	{"printf", `BEGIN { printf "%c|%c|%c|%c|%3c|%-2c|%c\n", 65, 233, 0x1F600, "éa", "ü", 66, -1 }`, "", "A|é|😀|é|  ü|B |\uFFFD\n"},
+	{"printf", `{ printf "%c%c", $1, $2; printf "%c", ""; printf "%c\n", x }`, "65 6x\n", "A6\000\000\n"},
+
+	// Substr
+	{"substr", `BEGIN { print substr("hello", 2), substr("hello", 2, 3), substr("hello", 0), substr("hello", 10) "|" }`, "", "ello ell hello |\n"},
+	{"substr", `BEGIN { print substr("hello", 0, 2), substr("hello", -1, 3), substr("hello", 2, -1) "|" }`, "", "h h |\n"},
+	{"substr", `BEGIN { print substr("hello", 1.5), substr("hello", 1.4, 1.5), substr("hello", 1, 1e300) }`, "", "ello he hello\n"},
+	{"substr", `BEGIN { print substr("hello", -1e300, 1e300) "|" substr("hello", 2, 2^1024 - 2^1024) "|" substr("hello", "x", "2") }`, "", "||h\n"},
+	{"substr", `BEGIN { print substr("àèìòù", 2, 2), substr(12345, 2, 3) }`, "", "èì 234\n"},
+	{"case conversion", `BEGIN { print toupper("àèìòù ǆ straße"), tolower("ÀÈÌ ΟΔΟΣ"), length(toupper("ß")) }`, "", "ÀÈÌÒÙ Ǆ STRAßE àèì οδοσ 1\n"},
+
+	// Random numbers
+	{"random numbers", `BEGIN { print srand(1.5), srand(2), srand() }`, "", "0 1.5 2\n"},
+	{"random numbers", `BEGIN { srand(3); x = rand(); srand(3); print (x == rand()), (x >= 0 && x < 1) }`, "", "1 1\n"},
+
+	// Exit
+	{"exit", `BEGIN { print "b"; exit; print "x" } { print "x" } END { print "e", NR }`, "a\n", "b\ne 0\n"},
+	{"exit", `{ print; exit } END { print "e", NR, $0 }`, "a\nb\n", "a\ne 1 a\n"},
+	{"exit", `function f() { exit } END { print "e"; f(); print "x" } END { print "x" }`, "", "e\n"},
+	{"exit", `END { print NR, $0 }`, "a\nb\n", "2 b\n"},
+
+	// Output
+	{"output", `BEGIN { ORS = "|"; print "a"; ORS = "\n"; print "b" }`, "", "a|b\n"},
+	{"output", `BEGIN { OFS = "-"; print "a", "b"; OFS = ":"; print "a" "b", "c"; print ("d", "e") }`, "", "a-b\nab:c\nd:e\n"},
+	{"output", `{ ORS = NR % 2 ? " " : "\n"; print }`, "1\n2\n3\n4\n", "1 2\n3 4\n"},
+	{"output", `BEGIN { ORS = "|"; printf "%s", "a"; printf "b\n" }`, "", "ab\n"},
+	{"output", `BEGIN { ORS = ";"; print "a" | "cat"; ORS = "\n"; print "b" | "cat"; close("cat"); print "c" }`, "", "a;b\nc\n"},
+	{"output", `BEGIN { OFS = "-"; $0 = "a b"; $1 = $1; print; print $1, $2 > "/dev/null"; OFS = "+"; print }`, "", "a-b\na-b\n"},
+	{"output", `BEGIN { print "a" > "/dev/stdout"; print "b"; close("/dev/stdout"); printf "c\n" >> "/dev/fd/1" }`, "", "a\nb\nc\n"},
+	{"output", `BEGIN { print "e" > "/dev/stderr" }`, "", "e\n"},
+	{"output", `BEGIN { print "x" > "/dev/full"; print close("/dev/full"); printf "x" > "/dev/full"; print fflush("/dev/full"), close("/dev/full") }`, "", "-1\n-1 -1\n"},
+	{"output", `BEGIN {
+		warn("bad " 1) }`, "", "aawk: at line 2: bad 1\n"},
+	{"output", `function warn(m) { print "mine " m } BEGIN { warn("x") }`, "", "mine x\n"},
+	{"output", `BEGIN { warn = 1; print warn }`, "", "1\n"},
+	{"output", `BEGIN { print (2 > 1), (1 > 2); print (2 > 1) (3 > 4); printf "%d\n", (2 > 1) }`, "", "1 0\n10\n1\n"},
+	{"output", `BEGIN { f = "/dev/"; print "x" > f "null"; printf "x" > "/dev/null"; print (1 > 2) > "/dev/null"; print "y" }`, "", "y\n"},
+	{"output", `BEGIN { OFMT = "%.2f"; x = 3.14159; print x, x ""; printf "%s %d\n", x, x }`, "", "3.14 3.14159\n3.14159 3\n"},
+	{"output", `BEGIN { print "ab" > "/dev/stdout"; printf "c" > "/dev/stdout"; print ""; print PROCINFO["/dev/stdout", "bytes_written"], PROCINFO["open_streams"] }`, "", "ab\nc\n4 1\n"},
+	{"output", `BEGIN { "echo hi" | getline x; close("echo hi"); "echo hi" | getline x; print PROCINFO["echo hi", "bytes_read"], PROCINFO["echo hi", "opened"], PROCINFO["open_streams"] }`, "", "6 2 1\n"},
+	{"output", `BEGIN { print "a" > "/dev/stdout"; for (k in PROCINFO) if (k == "open_streams") n++; print n, (("/dev/stdout", "opened") in PROCINFO), PROCINFO["open_streams"] }`, "", "a\n1 1 1\n"},
+	{"output", `BEGIN { print "a"; print "b" | "cat"; close("cat"); print "c"; system("echo d"); print "e" }`, "", "a\nb\nc\nd\ne\n"},
+
+	// Regular expressions
+	{"regular expressions", `/b+/ { print }`, "abc\nxyz\nbb\n", "abc\nbb\n"},
+	{"regular expressions", `BEGIN { print match("foobar", /ob/), RSTART, RLENGTH }`, "", "3 3 2\n"},
+	{"regular expressions", `BEGIN { print match("xxàbc", /b/), RSTART, RLENGTH; print match("abc", /z/), RSTART, RLENGTH }`, "", "4 4 1\n0 0 -1\n"},
+	{"regular expressions", `BEGIN { match("foo=bar", /(\w+)=(\w+)(x)?/, m); print m[0], m[1], m[2], m[2, "start"], m[2, "length"], ((3, "start") in m) }`, "", "foo=bar foo bar 5 3 0\n"},
+	{"regular expressions", `BEGIN { m["old"]; print match("abc", /z/, m), length(m) }`, "", "0 0\n"},
+	{"regular expressions", `BEGIN { s = "aaa"; n = gsub(/a/, "<&>", s); print n, s }`, "", "3 <a><a><a>\n"},
+	{"regular expressions", `BEGIN { s = "aaa"; sub(/a/, "\\&", s); print s }`, "", "&aa\n"},
+	{"regular expressions", `/foo(bar)+baz/ { print "a" NR } /ba[rz]/ { print "b" NR } $0 ~ "ob" { print "c" NR } !/xy/ { print "d" NR }`, "foobarbarbaz\nfoobaz\nxyz\n", "a1\nb1\nc1\nd1\nb2\nc2\nd2\n"},
+	{"regular expressions", `BEGIN { print ("a cat" ~ /\ycat\y/), ("concat" ~ /\ycat/), match("the word", /\<w/), ("x<y" ~ /[<]/), ("abc" ~ /ab\'/), ("xab" ~ /ab\'/) }`, "", "1 0 5 1 0 1\n"},
+	{"regular expressions", `BEGIN { IGNORECASE = 1; s = "AaA"; print ("ABC" ~ /b/), ("ABC" ~ "b"), index("xABc", "bC"), gsub(/a/, "x", s), s; IGNORECASE = 0; print ("ABC" ~ /b/), index("xABc", "bC") }`, "", "1 1 3 3 xxx\n0 0\n"},
+	{"regular expressions", `BEGIN { FS = "x+" } { print NF; IGNORECASE = 1; $0 = $0; print NF, $2 }`, "oneXtwoxthree\n", "2\n3 two\n"},
+	{"regular expressions", `BEGIN { IGNORECASE = 1; FS = "ab" } { print NF, $2; IGNORECASE = 0; $0 = $0; print NF }`, "xABy\n", "2 y\n1\n"},
+	{"regular expressions", `BEGIN { IGNORECASE = 1; print split("xABy", a, "ab"), a[1], a[2]; IGNORECASE = 0; print split("xABy", a, "ab") }`, "", "2 x y\n1\n"},
+
+	// Arrays
+	{"arrays", `BEGIN { a[1, 2] = 3; for (k in a) { split(k, p, SUBSEP); print p[1], p[2] } }`, "", "1 2\n"},
+	{"arrays", `BEGIN { a["x"]; print length(a), ("x" in a), ("y" in a) }`, "", "1 1 0\n"},
+	{"arrays", `BEGIN { a[1]; delete a[1]; print length(a); a[2]; delete a; print length(a) }`, "", "0\n0\n"},
+	{"arrays", `function f(arr) { arr["k"] = 1 } BEGIN { f(a); print a["k"] }`, "", "1\n"},
+	{"arrays", `BEGIN { a[1, 2]; if ((1, 2) in a) print "y"; else print "n"; i = 1; delete a[i, i + 1]; print length(a) }`, "", "y\n0\n"},
+	{"arrays", `BEGIN { a[2] = "b"; a[10] = "a"; a[1] = "c"; PROCINFO["sorted_in"] = "@ind_num_asc"; for (k in a) printf "%s", a[k]; print "" }`, "", "cba\n"},
+	{"arrays", `function rev(i1, v1, i2, v2) { return i2 < i1 ? -1 : i2 > i1 } BEGIN { a["x"]; a["z"]; a["y"]; PROCINFO["sorted_in"] = "rev"; for (k in a) printf "%s", k; print "" }`, "", "zyx\n"},
+	{"arrays", `BEGIN { for (i = 0; i < 10; i++) a[i]; for (k in a) { n++; delete a; a["new" k] } print n, length(a) }`, "", "1 1\n"},
+	{"arrays", `function clear(arr) { delete arr } BEGIN { a[1]; clear(a); print length(a) }`, "", "0\n"},
+	{"arrays", `BEGIN { a[1] = "x"; a[2, 3] = "y"; b["old"]; print copyarr(b, a), b[1], b[2, 3], ("old" in b); a[1] = "z"; print b[1] }`, "", "2 x y 0\nx\n"},
+	{"arrays", `function copyarr(a, b) { return a + b } BEGIN { print copyarr(1, 2) }`, "", "3\n"},
+	{"arrays", `function f(arr) { return copyarr(arr, arr) } BEGIN { a[1] = "x"; print f(a), a[1]; copyarr(c, d); print length(c) }`, "", "1 x\n0\n"},
+	{"arrays", `function sum(arr, k, t) { for (k in arr) t += arr[k]; return t } BEGIN { a[1][1] = 10; a[1][2] = 20; a["x"]["y"]["z"] = 1; print sum(a[1]), length(a), (2 in a[1]), a["x"]["y"]["z"] }`, "", "30 2 1 1\n"},
+	{"arrays", `BEGIN { i = 1; a[i++][i++] = 7; a[1][2] += 1; delete a[1][3]; print i, a[1][2], length(a[1]); copyarr(b, a); b[1][2] = 0; print a[1][2] }`, "", "3 8 1\n8\n"},
+	{"arrays", `BEGIN { a[3, 1]; for (i = 0; !((i, 1) in a); i++) ; print i }`, "", "3\n"},
+	{"arrays", `BEGIN { a[3, 1]; while (!((i, 1) in a)) i++; print i; do j++; while (!((j, 1) in a)); print j }`, "", "3\n3\n"},
+	{"arrays", `BEGIN { a[1, 2]; a[1, 3]; a[2, 1]; k = 2; while ((1, k) in a) delete a[1, k++]; for (; (k - 2, 1) in a; ) delete a[2, 1]; print length(a), k }`, "", "0 4\n"},
+	{"arrays", `BEGIN { i = 1; a[1, 2]; a[3, 4]; delete a[i++, i++]; print length(a), i, ((3, 4) in a); delete a[substr("32", 1, 1), length("abcd")]; print length(a) }`, "", "1 3 1\n0\n"},
+	{"arrays", `{ a[$1, $2 + 1] } END { delete a[$1, $2 + 1]; print length(a), (($1, $2) in a) }`, "x 1\n", "0 0\n"},
+
+	// Comparisons
+	{"comparisons", `BEGIN { print 2 < 10, "2" < "10", "a" < "b" }`, "", "1 0 1\n"},
+	{"comparisons", `{ print ($1 < $2) }`, "2 10\n", "1\n"},
+	{"comparisons", `BEGIN { $0 = "2 10"; print ($1 < $2) }`, "", "1\n"},
+	{"comparisons", `{ print ($1 == 1) }`, "1.0\n", "1\n"},
+	{"comparisons", `{ print ($1 < $2), ($3 < $4), ($5 == 1) }`, "0x1A 9 inf io +1e0\n", "0 1 1\n"},
+	{"comparisons", `BEGIN { IGNORECASE = 1; print ("abc" == "ABC"), ("B" < "a"), ("b" > "A") }`, "", "1 0 1\n"},
+
+	// Numeric strings
+	{"numeric strings", `BEGIN { print 0x1F, 0x10 + 1 }`, "", "31 17\n"},
+	{"numeric strings", `{ print $1 + 0, $2 + 0, $3 + 0, $4 + 0 }`, " +1.5 1e3x .5e 0x1a\n", "1.5 1000 0.5 26\n"},
+	{"numeric strings", `BEGIN { print " 12abc" + 0, "info" + 0, "0x1a" + 0, "0x1g" + 0, "0x" + 0 }`, "", "12 0 26 1 0\n"},
+	{"numeric strings", `BEGIN { x = "0x1a"; print x + 0, -x, x * 2, int(x "z"), substr("abcdef", "0x2", "0x3"); printf "%d\n", x }`, "", "26 -26 52 26 bcd\n26\n"},
+
+	// Program items
+	{"program items", `BEGIN { x = "a"; print x (1), length ("ab"), substr ("abc", 2) }`, "", "a1 2 bc\n"},
+	{"program items", `function f (a,
+		b) { return a b } function g(x) { return f(x, x) } BEGIN { print f(1, 2), g(3) }`, "", "12 33\n"},
+	{"program items", `END { print "e1" } BEGIN { print "b1" } END { print "e2" } BEGIN { print "b2" }`, "", "b1\nb2\ne1\ne2\n"},
+	{"program items", `BEGIN { n = 1 }; $1 > n; { n++ }; END { print n }`, "1\n3\n2\n", "3\n4\n"},
+	{"program items", "/a/\n{ print \"x\" }", "a\nb\n", "a\nx\nx\n"},
+
+	// Uninitialized values
+	{"function calls", `function f(n) { return n ? f(n - 1) : PROCINFO["call_depth"] } BEGIN { print f(10), PROCINFO["call_depth"] }`, "", "11 0\n"},
+	{"function calls", `function f(n) { return n ? f(n - 1) + 1 : 0 } BEGIN { print f(20000) }`, "", "20000\n"},
+	{"function calls", `function f(n, acc) { if (n == 0) return acc PROCINFO["call_depth"]; return f(n - 1, acc + 1) } BEGIN { print f(100000, 0) }`, "", "1000001\n"},
+	{"function calls", `function f(a, n, l) { if (!n) return length(a) l; a[n]; return f(a, n - 1, l) } BEGIN { print f(x, 3, "-"), length(x) }`, "", "3- 3\n"},
+	{"function calls", `function f(n, a, b) { return n ? 1 + f(n - 1) : 0 } function g(x) { return x } BEGIN { f(20); g(1); print PROCINFO["max_call_depth"], PROCINFO["max_locals"] }`, "", "21 63\n"},
+	{"function calls", `function f(n) { return n == 0 ? 0 : 1 + f(n - 1) } BEGIN { print f(100000), PROCINFO["max_call_depth"] }`, "", "100000 100001\n"},
+	{"array parameters", `function f(a) { x = 3 } BEGIN { f(x); print x }`, "", "3\n"},
+	{"array parameters", `function f(a, b) { b[1] = 1 } BEGIN { f(x, x); print length(x), x[1] }`, "", "1 1\n"},
+	{"array parameters", `function f(a) { a[1] = 1; print length(x) } BEGIN { f(x) }`, "", "1\n"},
+	{"array parameters", `function f(a) { a[1] = 1; g(a) } function g(b) { b[2] = 2 } BEGIN { f(x); print length(x) }`, "", "2\n"},
+	{"array parameters", `function f(a) { a = 5; return a } BEGIN { print f(x), length(x); x[1]; print length(x) }`, "", "5 0\n1\n"},
+	{"array parameters", `function f(a) { x[1] = 1; return length(a) } BEGIN { print f(x) }`, "", "1\n"},
+	{"array parameters", `function f(a) { split("a b c", a) } function g(v) { f(v) } BEGIN { g(x); print length(x), x[3] }`, "", "3 c\n"},
+	{"array parameters", `function f(a, b) { a[1] = 1; return length(b) } BEGIN { print f(x, x) }`, "", "1\n"},
+	{"array parameters", `function f(a) { y = a; g(a) } function g(b) { b[1] } BEGIN { f(x); print "[" y "]", length(x) }`, "", "[] 1\n"},
+	{"uninitialized values", `BEGIN { print x; print x + 0, -x + 1, x * 2; print "[" x "]", length(x), x == 0, x == "" }`, "", "\n0 1 0\n[] 0 1 1\n"},
+	{"uninitialized values", `BEGIN { printf "%s|%d|%5.1f|%x|%5s|\n", x, x, x, x, x }`, "", "|0|  0.0|0|     |\n"},
+	{"uninitialized values", `BEGIN { OFMT = CONVFMT = "%.2f"; print x, a[1], x "" a[2]; y = x; print y, length(a) }`, "", "  \n 2\n"},
+	{"uninitialized values", `{ print "[" $3 "]", $3 + 0, NF }`, "a b\n", "[] 0 2\n"},
+
+	// Range patterns
+	{"range patterns", `/b/,/d/`, "a\nb\nc\nd\ne\n", "b\nc\nd\n"},
+	{"range patterns", `/b/,/b/ { print NR }`, "a\nb\nc\nb\n", "2\n4\n"},
+	{"range patterns", `/a/,/c/ { print NR }`, "a\nb\nc\na\nb\n", "1\n2\n3\n4\n5\n"},
+	{"range patterns", `$1 == "s",$1 == "e" { n++ } END { print n }`, "x\ns\ne\ns\nx\ne\nx\n", "5\n"},
+	{"range patterns", `NR == 1, 0 { n++ } NR == 2, NR == 3 { m++ } END { print n, m }`, "a\nb\nc\nd\n", "4 2\n"},
+	{"range patterns", `x++ == 0, y++ == 1 { print NR } END { print x, y }`, "a\nb\nc\n", "1\n2\n2 2\n"},
+}
+
+// Files which the checks can read besides those of the file system
+var selffiles = map[string]string{
+	"one": "a\nb\n",
+	"two": "c\nd\ne\n",
+}
+
+type selfopener struct {
+	interpreter.OSFiles
+}
+
+func (o selfopener) Open(name string) (io.ReadCloser, error) {
+	if s, ok := selffiles[name]; ok {
+		return ioutil.NopCloser(strings.NewReader(s)), nil
+	}
+	return o.OSFiles.Open(name)
+}
+
+func runSelfcheck(check selfcheck) (string, error) {
+	var out strings.Builder
+	errs := interpreter.ExecuteCL(interpreter.CommandLine{
+		Fs:                " ",
+		Program:           strings.NewReader(check.program),
+		Programname:       "aawk",
+		Stdin:             strings.NewReader(check.input),
+		Stdout:            &out,
+		Stderr:            &out,
+		Files:             selfopener{},
+		DeterministicRand: true,
+	})
+	for _, err := range errs {
+		if _, ok := err.(interpreter.ErrorExit); !ok {
+			return out.String(), err
+		}
+	}
+	return out.String(), nil
+}
+
+// Runs the embedded conformance checks, printing pass/fail information for
+// each area. Returns true if every check passed.
+func runSelftest(w io.Writer) bool {
+	var areas []string
+	passed := map[string]int{}
+	total := map[string]int{}
+	var failures []string
+	for _, check := range selfchecks {
+		if total[check.area] == 0 {
+			areas = append(areas, check.area)
+		}
+		total[check.area]++
+		out, err := runSelfcheck(check)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s\n\terror: %s", check.area, check.program, err))
+		} else if out != check.output {
+			failures = append(failures, fmt.Sprintf("%s: %s\n\texpected: %q\n\tgot:      %q", check.area, check.program, check.output, out))
+		} else {
+			passed[check.area]++
+		}
+	}
+	for _, area := range areas {
+		result := "pass"
+		if passed[area] != total[area] {
+			result = "FAIL"
+		}
+		fmt.Fprintf(w, "%-20s %s (%d/%d)\n", area, result, passed[area], total[area])
+	}
+	for _, failure := range failures {
+		fmt.Fprintf(w, "\n%s\n", failure)
+	}
+	return len(failures) == 0
+}